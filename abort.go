@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Runs aren't aborted until the window holds at least this many requests, so
+// a couple of early failures can't end a run.
+const abortMinRequests = 10
+
+// watchErrorRate calls abort, recording why in the stats, once the error
+// rate over the window exceeds conf.AbortOnErrorRate.
+func (r *reporter) watchErrorRate(ctx context.Context, conf *testConfig, abort context.CancelFunc) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			rate, n := r.Window.Rate(now)
+			if n < abortMinRequests || rate*100 <= conf.AbortOnErrorRate {
+				continue
+			}
+			reason := fmt.Sprintf("error rate %.2f%% over the last %v exceeded %.2f%%",
+				rate*100, conf.AbortWindow, conf.AbortOnErrorRate)
+			zlog.Error(ctx).Int64("requests", n).Msg("aborting run: " + reason)
+			r.Stats.Abort(reason)
+			abort()
+			return
+		}
+	}
+}
+
+// parsePercent parses a percentage such as "25%" or "25". An empty string
+// is zero.
+func parsePercent(s string) (float64, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if s == "" {
+		return 0, nil
+	}
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 100 {
+		return 0, fmt.Errorf("%v%% is not between 0 and 100", p)
+	}
+	return p, nil
+}
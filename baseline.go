@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+	"github.com/crozzy/clair-load-test/pkg/results"
+)
+
+var baselineFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "baseline",
+		Usage:   "--baseline baseline.json (a file, or an http(s) URL taking PUT and GET such as a presigned object storage URL)",
+		Value:   "baseline.json",
+		EnvVars: []string{"BASELINE"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "baseline-header",
+		Usage:   "--baseline-header \"Authorization: Bearer ...\" (sent with requests for an http(s) --baseline, can be repeated)",
+		EnvVars: []string{"BASELINE_HEADERS"},
+	},
+	&cli.StringFlag{
+		Name:    "stats",
+		Usage:   "--stats stats.json (a run's output, its config and stats)",
+		Value:   "",
+		EnvVars: []string{"STATS"},
+	},
+	&cli.StringFlag{
+		Name:    "results",
+		Usage:   "--results results.jsonl (the run's results file, for latencies to test, instead of the samples in --stats)",
+		Value:   "",
+		EnvVars: []string{"RESULTS"},
+	},
+}
+
+// BaselineCmd keeps a reference run's latencies and compares later runs with
+// them, so CI can fail a change that made Clair slower.
+var BaselineCmd = &cli.Command{
+	Name:        "baseline",
+	Description: "save a run's latencies as a baseline, and check later runs against it for regressions",
+	Usage:       "clair-load-test baseline save|check --stats stats.json --baseline baseline.json",
+	Subcommands: []*cli.Command{
+		{
+			Name:        "save",
+			Description: "save the latencies of the run in --stats as the baseline, replacing an earlier one",
+			Usage:       "clair-load-test baseline save --stats stats.json --baseline baseline.json",
+			Action:      baselineSaveAction,
+			Flags:       baselineFlags,
+		},
+		{
+			Name:        "check",
+			Description: "compare the latencies of the run in --stats with the baseline, exiting with 2 if any endpoint regressed",
+			Usage:       "clair-load-test baseline check --stats stats.json --baseline baseline.json",
+			Action:      baselineCheckAction,
+			Flags: append([]cli.Flag{
+				&cli.Float64Flag{
+					Name:    "alpha",
+					Usage:   "--alpha 0.01 (the significance level a shift in latencies must reach to count)",
+					Value:   0.05,
+					EnvVars: []string{"ALPHA"},
+				},
+				&cli.StringFlag{
+					Name:    "max-regression",
+					Usage:   "--max-regression 20% (how much the p50 or p95 can grow before it counts as a regression)",
+					Value:   "10%",
+					EnvVars: []string{"MAX_REGRESSION"},
+				},
+				outputFileFlag,
+			}, baselineFlags...),
+		},
+	},
+}
+
+func baselineSaveAction(c *cli.Context) error {
+	ctx := c.Context
+	runID, stats, samples, err := readRun(c)
+	if err != nil {
+		return err
+	}
+	b := loadtest.NewBaseline(runID, stats, samples)
+	if len(b.Endpoints) == 0 {
+		return fmt.Errorf("no requests in %s to make a baseline of", c.String("stats"))
+	}
+	header, err := parseHeaders(c.StringSlice("baseline-header"))
+	if err != nil {
+		return fmt.Errorf("invalid --baseline-header: %w", err)
+	}
+	if err := writeBaseline(ctx, c.String("baseline"), header, b); err != nil {
+		return err
+	}
+	for name, e := range b.Endpoints {
+		zlog.Info(ctx).
+			Str("endpoint", name).
+			Int64("p50", e.P50LatencyMilliseconds).
+			Int64("p95", e.P95LatencyMilliseconds).
+			Int("latencies", len(e.Latencies)).
+			Msg("saved baseline")
+	}
+	return nil
+}
+
+func baselineCheckAction(c *cli.Context) error {
+	ctx := c.Context
+	alpha := c.Float64("alpha")
+	if alpha <= 0 || alpha >= 1 {
+		return fmt.Errorf("--alpha must be between 0 and 1")
+	}
+	threshold, err := parsePercent(c.String("max-regression"))
+	if err != nil {
+		return fmt.Errorf("invalid --max-regression: %w", err)
+	}
+	header, err := parseHeaders(c.StringSlice("baseline-header"))
+	if err != nil {
+		return fmt.Errorf("invalid --baseline-header: %w", err)
+	}
+	b, err := readBaseline(ctx, c.String("baseline"), header)
+	if err != nil {
+		return err
+	}
+	runID, stats, samples, err := readRun(c)
+	if err != nil {
+		return err
+	}
+	cmp := b.Compare(runID, stats, samples, alpha, threshold)
+	for name, ec := range cmp.Endpoints {
+		ev := zlog.Info(ctx)
+		switch ec.Verdict {
+		case loadtest.VerdictRegressed:
+			ev = zlog.Error(ctx)
+		case loadtest.VerdictMissing:
+			ev = zlog.Warn(ctx)
+		}
+		ev = ev.Str("endpoint", name).
+			Str("verdict", ec.Verdict).
+			Float64("p50_change_percent", ec.P50ChangePercent).
+			Float64("p95_change_percent", ec.P95ChangePercent)
+		if ec.Tested {
+			ev = ev.Float64("p_value", ec.PValue)
+		}
+		ev.Msg("compared with baseline")
+	}
+	if len(cmp.DatabaseChanges) != 0 {
+		zlog.Warn(ctx).
+			Strs("updaters", cmp.DatabaseChanges).
+			Msg("the vulnerability database was updated between the baseline and the run, they may not be comparable")
+	}
+	if err := writeOutput(c, cmp); err != nil {
+		return fmt.Errorf("could not write verdict: %w", err)
+	}
+	if v := cmp.Regressions(); len(v) > 0 {
+		return cli.Exit("regressed against the baseline: "+strings.Join(v, "; "), ExitSLOViolation)
+	}
+	zlog.Info(ctx).Str("baseline_run_id", cmp.BaselineRunID).Msg("no regressions against the baseline")
+	return nil
+}
+
+// readRun reads the run's output given by --stats and the samples to test,
+// from --results if given, otherwise those kept in the stats.
+func readRun(c *cli.Context) (string, *results.Stats, []*results.Sample, error) {
+	path := c.String("stats")
+	if path == "" {
+		return "", nil, nil, fmt.Errorf("--stats is needed")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("could not open stats: %w", err)
+	}
+	defer f.Close()
+	out, err := results.ReadOutput(f)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("could not read stats %s: %w", path, err)
+	}
+	runID, _ := out.Config["run_id"].(string)
+	samples := out.Stats.Samples
+	if path := c.String("results"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("could not open results: %w", err)
+		}
+		defer f.Close()
+		samples, err = results.ReadSamples(f)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("could not read results %s: %w", path, err)
+		}
+	}
+	return runID, out.Stats, samples, nil
+}
+
+var baselineClient = &http.Client{Timeout: time.Minute}
+
+func isURL(loc string) bool {
+	return strings.HasPrefix(loc, "http://") || strings.HasPrefix(loc, "https://")
+}
+
+// writeBaseline stores b at loc, a path or a URL it's PUT to.
+func writeBaseline(ctx context.Context, loc string, header http.Header, b *loadtest.Baseline) error {
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("could not encode baseline: %w", err)
+	}
+	if !isURL(loc) {
+		if err := os.WriteFile(loc, buf, 0o644); err != nil {
+			return fmt.Errorf("could not write baseline: %w", err)
+		}
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, loc, bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("invalid --baseline: %w", err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := baselineClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not upload baseline: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("could not upload baseline: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// readBaseline reads the baseline at loc, a path or a URL it's fetched from.
+func readBaseline(ctx context.Context, loc string, header http.Header) (*loadtest.Baseline, error) {
+	var body io.Reader
+	if !isURL(loc) {
+		f, err := os.Open(loc)
+		if err != nil {
+			return nil, fmt.Errorf("could not open baseline: %w", err)
+		}
+		defer f.Close()
+		body = f
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, loc, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --baseline: %w", err)
+		}
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		resp, err := baselineClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("could not download baseline: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("could not download baseline: unexpected status %s", resp.Status)
+		}
+		body = resp.Body
+	}
+	var b loadtest.Baseline
+	if err := json.NewDecoder(body).Decode(&b); err != nil {
+		return nil, fmt.Errorf("could not decode baseline: %w", err)
+	}
+	if b.SchemaVersion != results.SchemaVersion {
+		return nil, fmt.Errorf("baseline was saved from stats of schema version %d, expected %d, save a new one", b.SchemaVersion, results.SchemaVersion)
+	}
+	return &b, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/quay/zlog"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+// duplicateBurst indexes container's manifest n times at once, to exercise
+// Clair's handling of concurrent requests for the same manifest, then fetches
+// its vulnerability report. All of the requests are released together, once
+// the manifest and token are ready. Each should get the manifest's hash back,
+// and a request that gets another is recorded as failed.
+func (r *reporter) duplicateBurst(ctx context.Context, container string, n int, delete bool) error {
+	manifest, err := r.Manifest(ctx, container)
+	if err != nil {
+		r.Quarantine.ManifestFailed(ctx, container, err)
+		return fmt.Errorf("could not generate manifest: %w", err)
+	}
+	var m manifestHash
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return fmt.Errorf("could not decode manifest: %w", err)
+	}
+	hash := m.Hash
+	token, err := loadtest.CreateToken(r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+
+	start := make(chan struct{})
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs[i] = r.CreateIndexReportFor(ctx, manifest, hash, token)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+			zlog.Debug(ctx).Str("container", container).Err(err).Msg("duplicate index report failed")
+		}
+	}
+	if failed == n {
+		r.Quarantine.IndexFailed(ctx, container, errs[0])
+		return fmt.Errorf("could not create index report: all %d duplicates failed: %w", n, errs[0])
+	}
+	r.Quarantine.Indexed(container)
+	if failed != 0 {
+		zlog.Warn(ctx).
+			Str("container", container).
+			Int("failed", failed).
+			Int("burst", n).
+			Msg("some duplicate index reports failed")
+	}
+
+	if err := r.MatchContainer(ctx, container, hash, token); err != nil {
+		return err
+	}
+	if delete {
+		if r.Deletes != nil {
+			return r.QueueDelete(ctx, hash)
+		}
+		if err := r.DeleteIndexReports(ctx, hash, token); err != nil {
+			return fmt.Errorf("could not delete index report: %w", err)
+		}
+	}
+	return nil
+}
+
+// burstWorkload is the report workload, but indexing each container in
+// bursts of n duplicate requests.
+type burstWorkload struct {
+	*loadtest.ReportWorkload
+	r *reporter
+	n int
+}
+
+func (w *burstWorkload) Step(ctx context.Context, n int) error {
+	cc, err := w.r.Quarantine.Pick(w.Containers, n)
+	if err != nil {
+		return err
+	}
+	w.r.Schedule.Step(ctx, n, "burst", cc)
+	if err := w.r.duplicateBurst(ctx, cc, w.n, w.Delete); err != nil {
+		zlog.Error(ctx).Str("container", cc).Msg(err.Error())
+		return w.r.StepFailed("burst", err)
+	}
+	zlog.Debug(ctx).Str("container", cc).Msg("completed")
+	return nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var CapacityCmd = &cli.Command{
+	Name:        "capacity",
+	Description: "find the highest rate Clair sustains while meeting its latency and error thresholds",
+	Usage:       "clair-load-test capacity --containers ubuntu:latest --max-p95 30s --max-rate 20",
+	Action:      capacityAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "containers",
+			Usage:   "--containers ubuntu:latest,mysql:latest",
+			Value:   "",
+			EnvVars: []string{"CONTAINERS"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		presetFlag,
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		platformFlag,
+		allPlatformsFlag,
+		noPinDigestsFlag,
+		registryUserFlag,
+		registryPasswordFlag,
+		registryRateFlag,
+		registryRetriesFlag,
+		manifestSourceFlag,
+		&cli.StringFlag{
+			Name:    "search",
+			Usage:   "--search linear|binary",
+			Value:   SearchLinear,
+			EnvVars: []string{"CAPACITY_SEARCH"},
+		},
+		&cli.Float64Flag{
+			Name:    "start-rate",
+			Usage:   "--start-rate 1",
+			Value:   1,
+			EnvVars: []string{"CAPACITY_START_RATE"},
+		},
+		&cli.Float64Flag{
+			Name:    "step",
+			Usage:   "--step 1 (rate added each linear step)",
+			Value:   1,
+			EnvVars: []string{"CAPACITY_STEP"},
+		},
+		&cli.Float64Flag{
+			Name:    "max-rate",
+			Usage:   "--max-rate 50",
+			Value:   50,
+			EnvVars: []string{"CAPACITY_MAX_RATE"},
+		},
+		&cli.Float64Flag{
+			Name:    "precision",
+			Usage:   "--precision 0.5 (binary search stops once the range is narrower)",
+			Value:   0.5,
+			EnvVars: []string{"CAPACITY_PRECISION"},
+		},
+		&cli.DurationFlag{
+			Name:    "step-duration",
+			Usage:   "--step-duration 1m (how long each rate is held)",
+			Value:   time.Minute,
+			EnvVars: []string{"CAPACITY_STEP_DURATION"},
+		},
+		&cli.DurationFlag{
+			Name:    "cooldown",
+			Usage:   "--cooldown 30s (pause between steps, to let Clair settle)",
+			Value:   0,
+			EnvVars: []string{"CAPACITY_COOLDOWN"},
+		},
+		&cli.BoolFlag{
+			Name:    "delete",
+			Usage:   "--delete",
+			Value:   false,
+			EnvVars: []string{"DELETE"},
+		},
+		&cli.DurationFlag{
+			Name:    "max-p95",
+			Usage:   "--max-p95 30s",
+			Value:   0,
+			EnvVars: []string{"MAX_P95"},
+		},
+		&cli.Float64Flag{
+			Name:    "max-error-rate",
+			Usage:   "--max-error-rate 5 (percent)",
+			Value:   0,
+			EnvVars: []string{"MAX_ERROR_RATE"},
+		},
+		&cli.StringFlag{
+			Name:    "scenario",
+			Usage:   "--scenario scenario.yaml (SLOs each step must meet)",
+			Value:   "",
+			EnvVars: []string{"SCENARIO"},
+		},
+		&cli.StringFlag{
+			Name:    "layer-url-rewrite",
+			Usage:   "--layer-url-rewrite http://localhost:8080",
+			Value:   "",
+			EnvVars: []string{"LAYER_URL_REWRITE"},
+		},
+		outputFileFlag,
+	},
+}
+
+// Capacity search strategies.
+const (
+	SearchLinear = "linear"
+	SearchBinary = "binary"
+)
+
+type capacityConfig struct {
+	RunID         string             `json:"run_id"`
+	Build         *BuildInfo         `json:"build"`
+	Host          string             `json:"host"`
+	PSK           string             `json:"-"`
+	Containers    []string           `json:"containers"`
+	Preset        string             `json:"preset,omitempty"`
+	PinnedDigests map[string]string  `json:"pinned_digests,omitempty"`
+	Search        string             `json:"search"`
+	StartRate     float64            `json:"start_rate"`
+	Step          float64            `json:"step,omitempty"`
+	MaxRate       float64            `json:"max_rate"`
+	Precision     float64            `json:"precision,omitempty"`
+	StepDuration  time.Duration      `json:"step_duration"`
+	Cooldown      time.Duration      `json:"cooldown,omitempty"`
+	Delete        bool               `json:"delete"`
+	MaxP95        time.Duration      `json:"max_p95,omitempty"`
+	MaxErrorRate  float64            `json:"max_error_rate,omitempty"`
+	Scenario      *loadtest.Scenario `json:"scenario,omitempty"`
+}
+
+// CapacityStep is the outcome of holding a rate for a step.
+type CapacityStep struct {
+	Rate         float64 `json:"rate"`
+	AchievedRate float64 `json:"achieved_rate"`
+	Passed       bool    `json:"passed"`
+	// Violations are the thresholds and SLOs the step didn't meet.
+	Violations []string        `json:"violations,omitempty"`
+	Stats      *loadtest.Stats `json:"stats"`
+}
+
+type capacityResult struct {
+	// MaxSustainableRate is the highest rate that met every threshold, or
+	// zero if none did.
+	MaxSustainableRate float64         `json:"max_sustainable_rate"`
+	Steps              []*CapacityStep `json:"steps"`
+}
+
+func capacityAction(c *cli.Context) error {
+	ctx := c.Context
+	conf := &capacityConfig{
+		Host:         c.String("host"),
+		PSK:          c.String("psk"),
+		Search:       c.String("search"),
+		StartRate:    c.Float64("start-rate"),
+		MaxRate:      c.Float64("max-rate"),
+		StepDuration: c.Duration("step-duration"),
+		Cooldown:     c.Duration("cooldown"),
+		Delete:       c.Bool("delete"),
+		MaxP95:       c.Duration("max-p95"),
+		MaxErrorRate: c.Float64("max-error-rate"),
+		Preset:       c.String("preset"),
+	}
+	for _, cc := range strings.Split(c.String("containers"), ",") {
+		if cc = strings.TrimSpace(cc); cc != "" {
+			conf.Containers = append(conf.Containers, cc)
+		}
+	}
+	var err error
+	conf.Containers, err = applyPreset(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	if len(conf.Containers) == 0 {
+		return fmt.Errorf("--containers is needed")
+	}
+	switch conf.Search {
+	case SearchLinear:
+		conf.Step = c.Float64("step")
+		if conf.Step <= 0 {
+			return fmt.Errorf("step must be more than 0")
+		}
+	case SearchBinary:
+		conf.Precision = c.Float64("precision")
+		if conf.Precision <= 0 {
+			return fmt.Errorf("precision must be more than 0")
+		}
+	default:
+		return fmt.Errorf("unknown search %q", conf.Search)
+	}
+	if conf.StartRate <= 0 || conf.MaxRate < conf.StartRate {
+		return fmt.Errorf("start rate must be more than 0 and no more than the max rate")
+	}
+	if conf.StepDuration <= 0 {
+		return fmt.Errorf("step duration must be more than 0")
+	}
+	if path := c.String("scenario"); path != "" {
+		var err error
+		conf.Scenario, err = loadtest.LoadScenario(path)
+		if err != nil {
+			return err
+		}
+		if conf.Scenario.UsesSizeClasses() {
+			return fmt.Errorf("capacity doesn't classify manifests, so can't use size class SLOs")
+		}
+	}
+	if conf.MaxP95 <= 0 && conf.MaxErrorRate <= 0 && (conf.Scenario == nil || len(conf.Scenario.SLOs) == 0) {
+		return fmt.Errorf("one of --max-p95, --max-error-rate or a --scenario with SLOs is needed")
+	}
+
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	conf.RunID = reporter.RunID
+	conf.Build = buildInfo()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Msg("starting run")
+	if err := reporter.setRegistryAuth(c, conf.Containers); err != nil {
+		return err
+	}
+	if err := reporter.setRegistryLimits(c); err != nil {
+		return err
+	}
+	if err := reporter.setManifestSource(ctx, c); err != nil {
+		return err
+	}
+	defer reporter.Auth.Close()
+	conf.Containers, err = reporter.resolvePlatforms(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	conf.Containers, conf.PinnedDigests, err = reporter.pinDigests(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	reporter.Rewrite, err = loadtest.ParseLayerRewrite(c.String("layer-url-rewrite"))
+	if err != nil {
+		return fmt.Errorf("invalid --layer-url-rewrite: %w", err)
+	}
+
+	res := &capacityResult{}
+	step := func(rate float64) (bool, error) {
+		if len(res.Steps) != 0 && conf.Cooldown > 0 {
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-time.After(conf.Cooldown):
+			}
+		}
+		s, err := reporter.capacityStep(ctx, conf, rate)
+		if err != nil {
+			return false, err
+		}
+		res.Steps = append(res.Steps, s)
+		if s.Passed && rate > res.MaxSustainableRate {
+			res.MaxSustainableRate = rate
+		}
+		return s.Passed, nil
+	}
+	switch conf.Search {
+	case SearchLinear:
+		for rate := conf.StartRate; rate <= conf.MaxRate; rate += conf.Step {
+			ok, err := step(rate)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+		}
+	case SearchBinary:
+		// The start rate has to pass, and if the max rate does there's
+		// nothing to search.
+		lo, hi := conf.StartRate, conf.MaxRate
+		ok, err := step(lo)
+		if err == nil && ok {
+			ok, err = step(hi)
+			for err == nil && !ok && hi-lo > conf.Precision {
+				mid := (lo + hi) / 2
+				var pass bool
+				pass, err = step(mid)
+				if pass {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeOutput(c, conf, res); err != nil {
+		return err
+	}
+	zlog.Info(ctx).Float64("max_sustainable_rate", res.MaxSustainableRate).Msg("capacity search done")
+	if res.MaxSustainableRate == 0 {
+		if reporter.Stats.Unreachable() {
+			return cli.Exit("could not reach clair", ExitUnreachable)
+		}
+		return cli.Exit("no rate met the thresholds", ExitSLOViolation)
+	}
+	return nil
+}
+
+// capacityStep holds rate for a step, with fresh stats, and checks the
+// thresholds against them.
+func (r *reporter) capacityStep(ctx context.Context, conf *capacityConfig, rate float64) (*CapacityStep, error) {
+	zlog.Info(ctx).Float64("rate", rate).Dur("duration", conf.StepDuration).Msg("starting step")
+	r.Stats = loadtest.NewStats()
+	r.Limits.Stats = r.Stats
+	r.Control = loadtest.NewControl(rate)
+	w := &loadtest.ReportWorkload{Reporter: r.Reporter, Containers: conf.Containers, Delete: conf.Delete}
+	if err := loadtest.NewRunner(r.Control, conf.StepDuration).RunWorkload(ctx, w); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stats := r.Stats.GetStats()
+	s := &CapacityStep{
+		Rate:  rate,
+		Stats: stats,
+	}
+	if stats.ElapsedSeconds > 0 {
+		s.AchievedRate = float64(stats.Endpoint(loadtest.EndpointIndexReport).TotalRequests) / stats.ElapsedSeconds
+	}
+	s.Violations = CheckThresholds(&testConfig{MaxP95: conf.MaxP95, MaxErrorRate: conf.MaxErrorRate}, stats)
+	s.Violations = append(s.Violations, loadtest.NewSLOTracker(conf.Scenario).Evaluate(stats)...)
+	if stats.Unreachable() {
+		s.Violations = append(s.Violations, "could not reach clair")
+	}
+	s.Passed = len(s.Violations) == 0
+	zlog.Info(ctx).
+		Float64("rate", rate).
+		Float64("achieved_rate", s.AchievedRate).
+		Bool("passed", s.Passed).
+		Strs("violations", s.Violations).
+		Msg("step done")
+	return s, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var CheckCmd = &cli.Command{
+	Name:        "check",
+	Description: "check Clair, its databases, clairctl and the containers are ready before a long run",
+	Usage:       "clair-load-test check --host http://localhost:6060 --psk secretkey --containers ubuntu:latest",
+	Action:      checkAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		&cli.StringFlag{
+			Name:    "containers",
+			Usage:   "--containers ubuntu:latest,mysql:latest (checked by generating their manifests)",
+			Value:   "",
+			EnvVars: []string{"CONTAINERS"},
+		},
+		presetFlag,
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		registryUserFlag,
+		registryPasswordFlag,
+		manifestSourceFlag,
+		&cli.StringFlag{
+			Name:    "indexer-dsn",
+			Usage:   "--indexer-dsn postgres://clair@localhost/indexer",
+			Value:   "",
+			EnvVars: []string{"INDEXER_DSN"},
+		},
+		&cli.StringFlag{
+			Name:    "matcher-dsn",
+			Usage:   "--matcher-dsn postgres://clair@localhost/matcher",
+			Value:   "",
+			EnvVars: []string{"MATCHER_DSN"},
+		},
+		&cli.DurationFlag{
+			Name:    "check-timeout",
+			Usage:   "--check-timeout 10s (for each check)",
+			Value:   10 * time.Second,
+			EnvVars: []string{"CHECK_TIMEOUT"},
+		},
+		outputFileFlag,
+	},
+}
+
+// CheckResult is the outcome of a check. Hint suggests how to fix a failed
+// check.
+type CheckResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Hint  string `json:"hint,omitempty"`
+}
+
+type checkConfig struct {
+	Build      *BuildInfo `json:"build"`
+	Host       string     `json:"host"`
+	PSK        string     `json:"-"`
+	Containers []string   `json:"containers,omitempty"`
+	Preset     string     `json:"preset,omitempty"`
+	IndexerDSN string     `json:"-"`
+	MatcherDSN string     `json:"-"`
+}
+
+type checkResults struct {
+	Failed int            `json:"failed"`
+	Checks []*CheckResult `json:"checks"`
+}
+
+func checkAction(c *cli.Context) error {
+	ctx := c.Context
+	conf := &checkConfig{
+		Build:      buildInfo(),
+		Host:       c.String("host"),
+		PSK:        c.String("psk"),
+		Preset:     c.String("preset"),
+		IndexerDSN: c.String("indexer-dsn"),
+		MatcherDSN: c.String("matcher-dsn"),
+	}
+	for _, cc := range strings.Split(c.String("containers"), ",") {
+		if cc = strings.TrimSpace(cc); cc != "" {
+			conf.Containers = append(conf.Containers, cc)
+		}
+	}
+	var err error
+	conf.Containers, err = applyPreset(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	timeout := c.Duration("check-timeout")
+	if timeout <= 0 {
+		return fmt.Errorf("check timeout must be more than 0")
+	}
+
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	if err := reporter.setRegistryAuth(c, conf.Containers); err != nil {
+		return err
+	}
+	if err := reporter.setManifestSource(ctx, c); err != nil {
+		return err
+	}
+	defer reporter.Auth.Close()
+
+	res := &checkResults{}
+	check := func(name string, fn func(ctx context.Context) (hint string, err error)) bool {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		cr := &CheckResult{Name: name, OK: true}
+		if hint, err := fn(ctx); err != nil {
+			cr.OK, cr.Error, cr.Hint = false, err.Error(), hint
+			res.Failed++
+			zlog.Error(ctx).Str("check", name).Str("hint", hint).Msg(cr.Error)
+		} else {
+			zlog.Info(ctx).Str("check", name).Msg("ok")
+		}
+		res.Checks = append(res.Checks, cr)
+		return cr.OK
+	}
+
+	// There's no point checking the rest of Clair if it can't be reached.
+	if check("clair", reporter.checkReachable) {
+		var token string
+		ok := true
+		if conf.PSK != "" {
+			ok = check("token", func(context.Context) (string, error) {
+				var err error
+				token, err = loadtest.CreateToken(conf.PSK)
+				return "--psk should be Clair's base64 encoded auth.psk.key", err
+			})
+		}
+		if ok {
+			check("indexer", func(ctx context.Context) (string, error) {
+				return reporter.checkReady(ctx, "/indexer/api/v1/index_state", token)
+			})
+			check("matcher", func(ctx context.Context) (string, error) {
+				return reporter.checkReady(ctx, "/matcher/api/v1/internal/update_operation", token)
+			})
+		}
+	}
+	// clairctl is only needed as the manifest source, auto does without it.
+	clairctl := true
+	if reporter.ManifestSource == loadtest.ManifestSourceClairctl {
+		clairctl = check("clairctl", checkClairctl)
+	}
+	for _, cc := range conf.Containers {
+		if !clairctl {
+			break
+		}
+		cc := cc
+		check("manifest "+cc, func(ctx context.Context) (string, error) {
+			if _, err := reporter.GetManifest(ctx, cc); err != nil {
+				return "check the image exists, and the registry credentials in the docker config or --registry-user and --registry-password", err
+			}
+			return "", nil
+		})
+	}
+	for _, db := range []struct{ name, dsn string }{
+		{"indexer", conf.IndexerDSN},
+		{"matcher", conf.MatcherDSN},
+	} {
+		if db.dsn == "" {
+			continue
+		}
+		dsn := db.dsn
+		check(db.name+" database", func(ctx context.Context) (string, error) {
+			conn, err := loadtest.ConnectDB(ctx, dsn)
+			if err != nil {
+				return "check the DSN, and that the database accepts connections from here", err
+			}
+			defer conn.Close(ctx)
+			if err := conn.Ping(ctx); err != nil {
+				return "check the database is up", err
+			}
+			return "", nil
+		})
+	}
+
+	if err := writeOutput(c, conf, res); err != nil {
+		return err
+	}
+	if res.Failed != 0 {
+		return failedExit(reporter.Stats, fmt.Sprintf("%d checks failed", res.Failed))
+	}
+	return nil
+}
+
+// checkReachable checks Clair answers at all.
+func (r *reporter) checkReachable(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Host, nil)
+	if err != nil {
+		return "--host should be Clair's URL, such as http://localhost:6060", err
+	}
+	resp, sample, err := r.Do("check", req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return "check --host, and that Clair is running and reachable from here", err
+	}
+	resp.Body.Close()
+	return "", nil
+}
+
+// checkReady checks path answers with a 200, authenticated with token.
+func (r *reporter) checkReady(ctx context.Context, path, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(r.Host, "/")+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	resp, sample, err := r.Do("check", req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return "check Clair is running and reachable from here", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return "", nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		if token == "" {
+			return "Clair needs authentication, set --psk", fmt.Errorf("token rejected, status %d", resp.StatusCode)
+		}
+		return "--psk should match Clair's auth.psk.key", fmt.Errorf("token rejected, status %d", resp.StatusCode)
+	case http.StatusNotFound:
+		return "check --host points at Clair, and that it runs this service", fmt.Errorf("not found, status %d", resp.StatusCode)
+	default:
+		return "check Clair's logs, it may still be starting up", fmt.Errorf("not ready, status %d", resp.StatusCode)
+	}
+}
+
+// checkClairctl checks clairctl, needed for --manifest-source clairctl, is
+// installed.
+func checkClairctl(ctx context.Context) (string, error) {
+	if _, err := exec.LookPath("clairctl"); err != nil {
+		return "install clairctl and put it on the PATH, or use another --manifest-source", err
+	}
+	return "", nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var CleanupCmd = &cli.Command{
+	Name:        "cleanup",
+	Description: "delete index reports left behind by earlier runs",
+	Usage:       "clair-load-test cleanup --results results.jsonl",
+	Action:      cleanupAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		&cli.StringSliceFlag{
+			Name:    "hashes",
+			Usage:   "--hashes sha256:...,sha256:...",
+			EnvVars: []string{"HASHES"},
+		},
+		&cli.StringFlag{
+			Name:    "hashes-file",
+			Usage:   "--hashes-file hashes.txt (one manifest hash per line)",
+			Value:   "",
+			EnvVars: []string{"HASHES_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "results",
+			Usage:   "--results results.jsonl",
+			Value:   "",
+			EnvVars: []string{"RESULTS"},
+		},
+		&cli.BoolFlag{
+			Name:  "list",
+			Usage: "--list (print the hashes that would be deleted and exit)",
+			Value: false,
+		},
+		&cli.IntFlag{
+			Name:    "batch-size",
+			Usage:   "--batch-size 100 (index reports per bulk delete)",
+			Value:   100,
+			EnvVars: []string{"BATCH_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Usage:   "--concurrency 10",
+			Value:   10,
+			EnvVars: []string{"CONCURRENCY"},
+		},
+		&cli.Float64Flag{
+			Name:    "rate",
+			Usage:   "--rate 0 (bulk deletes per second, 0 for unlimited)",
+			Value:   0,
+			EnvVars: []string{"RATE"},
+		},
+	},
+}
+
+func cleanupAction(c *cli.Context) error {
+	ctx := c.Context
+	hashes, err := collectHashes(splitList(c.StringSlice("hashes")), c.String("hashes-file"), c.String("results"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("list") {
+		for _, h := range hashes {
+			fmt.Println(h)
+		}
+		return nil
+	}
+	if len(hashes) == 0 {
+		zlog.Info(ctx).Msg("no hashes to delete")
+		return nil
+	}
+	batchSize := c.Int("batch-size")
+	if batchSize < 1 {
+		return fmt.Errorf("batch size must be at least 1")
+	}
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	total := len(hashes)
+	var batches [][]string
+	for len(hashes) > 0 {
+		n := batchSize
+		if n > len(hashes) {
+			n = len(hashes)
+		}
+		batches = append(batches, hashes[:n])
+		hashes = hashes[n:]
+	}
+
+	reporter := newReporter(c.String("host"), c.String("psk"))
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	var tick <-chan time.Time
+	if rate := c.Float64("rate"); rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	sem := make(chan struct{}, concurrency)
+	var deleted, failed int64
+	g, ctx := errgroup.WithContext(ctx)
+loop:
+	for _, batch := range batches {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-tick:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+		batch := batch
+		g.Go(func() error {
+			defer func() { <-sem }()
+			token, err := loadtest.CreateToken(reporter.PSK)
+			if err != nil {
+				return fmt.Errorf("could not create token: %w", err)
+			}
+			n, err := reporter.BulkDeleteIndexReports(ctx, batch, token)
+			if err != nil {
+				atomic.AddInt64(&failed, int64(len(batch)))
+				zlog.Error(ctx).Int("count", len(batch)).Msg(err.Error())
+				return nil
+			}
+			atomic.AddInt64(&deleted, int64(n))
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	zlog.Info(ctx).
+		Int("hashes", total).
+		Int("batches", len(batches)).
+		Int64("deleted", deleted).
+		Int64("failed", failed).
+		Msg("cleanup done")
+	if failed != 0 {
+		return failedExit(reporter.Stats, fmt.Sprintf("could not delete %d index reports", failed))
+	}
+	return nil
+}
+
+// collectHashes gathers the unique manifest hashes named on the command
+// line, in a hashes file and in a results file, in that order.
+func collectHashes(hashes []string, hashesFile, resultsFile string) ([]string, error) {
+	seen := map[string]bool{}
+	var out []string
+	add := func(h string) {
+		h = strings.TrimSpace(h)
+		if h == "" || seen[h] {
+			return
+		}
+		seen[h] = true
+		out = append(out, h)
+	}
+	for _, h := range hashes {
+		add(h)
+	}
+	if hashesFile != "" {
+		hs, err := ReadHashes(hashesFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hs {
+			add(h)
+		}
+	}
+	if resultsFile != "" {
+		f, err := os.Open(resultsFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not open results file: %w", err)
+		}
+		samples, err := loadtest.ReadSamples(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples {
+			if s.Endpoint == loadtest.EndpointIndexReport {
+				add(s.Hash)
+			}
+		}
+	}
+	return out, nil
+}
+
+// ReadHashes reads a file of manifest hashes, one per line. Blank lines and
+// lines starting with "#" are ignored.
+func ReadHashes(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open hashes file: %w", err)
+	}
+	defer f.Close()
+	var hashes []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		hashes = append(hashes, l)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read hashes file: %w", err)
+	}
+	return hashes, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var configFlag = &cli.StringFlag{
+	Name:    "config",
+	Usage:   "--config clair-load-test.yaml (flag values, overridden by env vars and then flags)",
+	Value:   "",
+	EnvVars: []string{"CLAIR_LOAD_TEST_CONFIG"},
+}
+
+// configFile holds flag values for any command. Top level values apply to
+// every command with the flag, and the values under commands to the command
+// named, such as "report" or "db snapshot", and its subcommands.
+type configFile struct {
+	Flags    map[string]interface{}            `yaml:",inline"`
+	Commands map[string]map[string]interface{} `yaml:"commands"`
+}
+
+// useConfigFile makes app's global flags, its commands and their
+// subcommands take flag values from the --config file.
+func useConfigFile(app *cli.App) {
+	useCommandConfig(app.Commands)
+	before := app.Before
+	app.Before = func(c *cli.Context) error {
+		if err := applyGlobalConfig(c); err != nil {
+			return err
+		}
+		if before != nil {
+			return before(c)
+		}
+		return nil
+	}
+}
+
+// useCommandConfig makes cmds, and their subcommands, take flag values from
+// the --config file.
+func useCommandConfig(cmds []*cli.Command) {
+	for _, cmd := range cmds {
+		useCommandConfig(cmd.Subcommands)
+		before := cmd.Before
+		cmd.Before = func(c *cli.Context) error {
+			if err := applyConfigFile(c); err != nil {
+				return err
+			}
+			if before != nil {
+				return before(c)
+			}
+			return nil
+		}
+	}
+}
+
+// applyConfigFile sets the command's flags from the --config file, unless
+// they were set by a flag or env var.
+func applyConfigFile(c *cli.Context) error {
+	path := c.String("config")
+	if path == "" || c.Command == nil {
+		return nil
+	}
+	// Subcommands run as apps of their own, so the root app is the
+	// outermost one.
+	var root *cli.App
+	for _, l := range c.Lineage() {
+		if l.App != nil {
+			root = l.App
+		}
+	}
+	conf, err := readConfig(path, root)
+	if err != nil {
+		return err
+	}
+	values := conf.values(commandPath(root.Commands, c.Command))
+	for _, f := range c.Command.Flags {
+		set, err := setFromConfig(c, f, values)
+		if err != nil {
+			return fmt.Errorf("invalid %s in config %s: %w", f.Names()[0], path, err)
+		}
+		if set {
+			zlog.Debug(c.Context).Str("flag", f.Names()[0]).Msg("set from config")
+		}
+	}
+	return nil
+}
+
+// applyGlobalConfig sets the app's global flags, such as --log-level, from
+// the --config file, unless they were set by a flag or env var. It runs
+// before the command is, so its section is found from the arguments.
+func applyGlobalConfig(c *cli.Context) error {
+	path := c.String("config")
+	if path == "" {
+		return nil
+	}
+	conf, err := readConfig(path, c.App)
+	if err != nil {
+		return err
+	}
+	values := conf.values(argsPath(c.App.Commands, c.Args().Slice()))
+	// Logging isn't set up yet, so these aren't logged.
+	for _, f := range globalFlags(c.App) {
+		if _, err := setFromConfig(c, f, values); err != nil {
+			return fmt.Errorf("invalid %s in config %s: %w", f.Names()[0], path, err)
+		}
+	}
+	return nil
+}
+
+// readConfig reads and checks the config at path against root's flags and
+// commands.
+func readConfig(path string, root *cli.App) (*configFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+	var conf configFile
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("could not decode config %s: %w", path, err)
+	}
+	if err := conf.check(root); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &conf, nil
+}
+
+// values returns the flag values for the command named by names, such as db
+// then snapshot. Sections for the command's parents come first, so the
+// command's own section wins.
+func (conf *configFile) values(names []string) map[string]interface{} {
+	values := map[string]interface{}{}
+	for k, v := range conf.Flags {
+		values[k] = v
+	}
+	for i := range names {
+		for k, v := range conf.Commands[strings.Join(names[:i+1], " ")] {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// setFromConfig sets f to its value in values, unless it has none or was
+// set by a flag or env var, and reports whether it did.
+func setFromConfig(c *cli.Context, f cli.Flag, values map[string]interface{}) (bool, error) {
+	v, ok := values[f.Names()[0]]
+	if !ok || flagSet(c, f) {
+		return false, nil
+	}
+	return true, setFlag(c, f, v)
+}
+
+// globalFlags returns the app's flags that can be set from a config, which
+// are all but --config itself, --help and --version.
+func globalFlags(app *cli.App) []cli.Flag {
+	var flags []cli.Flag
+	for _, f := range app.Flags {
+		if f == configFlag || f == cli.HelpFlag || f == cli.VersionFlag {
+			continue
+		}
+		flags = append(flags, f)
+	}
+	return flags
+}
+
+// check makes sure every value is a flag of some command, and every section
+// names a command with the flags in it, to catch typos.
+func (conf *configFile) check(app *cli.App) error {
+	// Global flags can be given at the top level or for a command.
+	global := map[string]bool{}
+	for _, f := range globalFlags(app) {
+		for _, n := range f.Names() {
+			global[n] = true
+		}
+	}
+	all := map[string]bool{}
+	for n := range global {
+		all[n] = true
+	}
+	sections := map[string]map[string]bool{}
+	var walk func(prefix string, cmds []*cli.Command) map[string]bool
+	walk = func(prefix string, cmds []*cli.Command) map[string]bool {
+		flags := map[string]bool{}
+		for _, cmd := range cmds {
+			name := strings.TrimSpace(prefix + " " + cmd.Name)
+			own := walk(name, cmd.Subcommands)
+			for n := range global {
+				own[n] = true
+			}
+			for _, f := range cmd.Flags {
+				for _, n := range f.Names() {
+					own[n] = true
+				}
+			}
+			for n := range own {
+				flags[n], all[n] = true, true
+			}
+			sections[name] = own
+		}
+		return flags
+	}
+	walk("", app.Commands)
+	for k := range conf.Flags {
+		if !all[k] {
+			return fmt.Errorf("unknown flag %q", k)
+		}
+	}
+	for name, values := range conf.Commands {
+		flags, ok := sections[name]
+		if !ok {
+			return fmt.Errorf("unknown command %q", name)
+		}
+		for k := range values {
+			if !flags[k] {
+				return fmt.Errorf("unknown flag %q for %s", k, name)
+			}
+		}
+	}
+	return nil
+}
+
+// commandPath returns the names leading to cmd, such as db then snapshot.
+func commandPath(cmds []*cli.Command, cmd *cli.Command) []string {
+	for _, cc := range cmds {
+		if cc == cmd {
+			return []string{cc.Name}
+		}
+		if p := commandPath(cc.Subcommands, cmd); p != nil {
+			return append([]string{cc.Name}, p...)
+		}
+	}
+	return nil
+}
+
+// argsPath returns the names of the command, and subcommands, that args
+// run, such as db then snapshot, before the command has been parsed.
+func argsPath(cmds []*cli.Command, args []string) []string {
+	var names []string
+	for _, arg := range args {
+		var cmd *cli.Command
+		for _, cc := range cmds {
+			if cc.HasName(arg) {
+				cmd = cc
+				break
+			}
+		}
+		if cmd == nil {
+			break
+		}
+		names = append(names, cmd.Name)
+		cmds = cmd.Subcommands
+	}
+	return names
+}
+
+// flagSet reports whether f was given as a flag or env var.
+func flagSet(c *cli.Context, f cli.Flag) bool {
+	for _, n := range f.Names() {
+		if c.IsSet(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// setFlag sets f to v, a value from the config.
+func setFlag(c *cli.Context, f cli.Flag, v interface{}) error {
+	vals, err := configValues(f, v)
+	if err != nil {
+		return err
+	}
+	for _, val := range vals {
+		if err := c.Set(f.Names()[0], val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configValues returns the values v, from a config, sets f to. Lists are
+// each element for slice flags, and are joined with commas for others, such
+// as --containers.
+func configValues(f cli.Flag, v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		var vals []string
+		for _, e := range v {
+			vals = append(vals, fmt.Sprint(e))
+		}
+		switch f.(type) {
+		case *cli.StringSliceFlag, *cli.IntSliceFlag, *cli.Int64SliceFlag, *cli.Float64SliceFlag:
+			return vals, nil
+		}
+		return []string{strings.Join(vals, ",")}, nil
+	case map[string]interface{}:
+		return nil, fmt.Errorf("expected a value or list")
+	case nil:
+		return nil, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
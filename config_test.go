@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestConfigGlobalFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	conf := "log-level: debug\ncommands:\n  run:\n    log-format: json\n    host: http://clair/\n"
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var level, format, host string
+	app := &cli.App{
+		Before: func(c *cli.Context) error {
+			level, format = c.String("log-level"), c.String("log-format")
+			return nil
+		},
+		Flags: append([]cli.Flag{configFlag}, logFlags...),
+		Commands: []*cli.Command{{
+			Name:  "run",
+			Flags: []cli.Flag{&cli.StringFlag{Name: "host"}},
+			Action: func(c *cli.Context) error {
+				host = c.String("host")
+				return nil
+			},
+		}},
+	}
+	useConfigFile(app)
+	if err := app.RunContext(context.Background(), []string{"clair-load-test", "--config", path, "--log-level", "warn", "run"}); err != nil {
+		t.Fatal(err)
+	}
+	if level != "warn" || format != "json" || host != "http://clair/" {
+		t.Errorf("got log level %q, log format %q and host %q, want warn, json and http://clair/", level, format, host)
+	}
+}
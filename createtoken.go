@@ -1,13 +1,10 @@
 package main
 
 import (
-	"encoding/base64"
-	"time"
-
 	"github.com/quay/zlog"
 	"github.com/urfave/cli/v2"
-	"gopkg.in/square/go-jose.v2"
-	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
 )
 
 var CreateTokenCmd = &cli.Command{
@@ -22,42 +19,33 @@ var CreateTokenCmd = &cli.Command{
 			Value:   "",
 			EnvVars: []string{"PSK_KEY"},
 		},
+		signingKeyFlag,
+		keyIDFlag,
+		issuerFlag,
+		audienceFlag,
 	},
 }
 
 func createTokenAction(c *cli.Context) error {
 	ctx := c.Context
+	if path := c.String("signing-key"); path != "" {
+		s, err := loadtest.LoadKeySigner(path, c.String("key-id"), c.String("issuer"), c.String("audience"))
+		if err != nil {
+			return err
+		}
+		tok, err := s.Token()
+		if err != nil {
+			return err
+		}
+		zlog.Info(ctx).Msg(tok)
+		return nil
+	}
 	key := c.String("key")
 	zlog.Debug(ctx).Str("key", key).Msg("got md5 key")
-	tok, err := createToken(key)
+	tok, err := loadtest.CreateToken(key)
 	if err != nil {
 		return err
 	}
 	zlog.Info(ctx).Msg(tok)
 	return nil
 }
-
-func createToken(key string) (string, error) {
-	decKey, err := base64.StdEncoding.DecodeString(key)
-	if err != nil {
-		return "", err
-	}
-	sk := jose.SigningKey{
-		Algorithm: jose.HS256,
-		Key:       decKey,
-	}
-	s, err := jose.NewSigner(sk, nil)
-	if err != nil {
-		return "", err
-	}
-	now := time.Now()
-
-	// Mint the jwt.
-	return jwt.Signed(s).Claims(&jwt.Claims{
-		Issuer:    "clairctl",
-		Expiry:    jwt.NewNumericDate(now.Add(time.Minute * 10)),
-		IssuedAt:  jwt.NewNumericDate(now),
-		NotBefore: jwt.NewNumericDate(now),
-	}).CompactSerialize()
-
-}
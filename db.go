@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+)
+
+var dbFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "indexer-dsn",
+		Usage:   "--indexer-dsn postgres://clair@localhost/indexer",
+		Value:   "",
+		EnvVars: []string{"INDEXER_DSN"},
+	},
+	&cli.StringFlag{
+		Name:    "matcher-dsn",
+		Usage:   "--matcher-dsn postgres://clair@localhost/matcher",
+		Value:   "",
+		EnvVars: []string{"MATCHER_DSN"},
+	},
+	&cli.StringFlag{
+		Name:    "notifier-dsn",
+		Usage:   "--notifier-dsn postgres://clair@localhost/notifier",
+		Value:   "",
+		EnvVars: []string{"NOTIFIER_DSN"},
+	},
+	&cli.StringFlag{
+		Name:    "name",
+		Usage:   "--name baseline (snapshots are stored as <database>_<name>)",
+		Value:   "snapshot",
+		EnvVars: []string{"SNAPSHOT_NAME"},
+	},
+	&cli.BoolFlag{
+		Name:  "terminate",
+		Usage: "--terminate (end other sessions on the databases, instead of failing while Clair is connected)",
+		Value: false,
+	},
+}
+
+// DBCmd snapshots databases by cloning them with CREATE DATABASE ...
+// TEMPLATE, which is much quicker than a dump and restore but needs the
+// cloned database to have no other sessions. Clair should be stopped, or
+// --terminate used.
+var DBCmd = &cli.Command{
+	Name:        "db",
+	Description: "snapshot and restore Clair's databases, so every run starts from the same state",
+	Usage:       "clair-load-test db snapshot|restore --indexer-dsn ... --name baseline",
+	Subcommands: []*cli.Command{
+		{
+			Name:        "snapshot",
+			Description: "copy each database to <database>_<name>, replacing an earlier snapshot",
+			Usage:       "clair-load-test db snapshot --indexer-dsn ... --name baseline",
+			Action:      dbSnapshotAction,
+			Flags:       dbFlags,
+		},
+		{
+			Name:        "restore",
+			Description: "replace each database with its <database>_<name> snapshot",
+			Usage:       "clair-load-test db restore --indexer-dsn ... --name baseline",
+			Action:      dbRestoreAction,
+			Flags:       dbFlags,
+		},
+	},
+}
+
+func dbSnapshotAction(c *cli.Context) error {
+	return forEachDB(c, func(ctx context.Context, conn *pgx.Conn, db, snapshot string) error {
+		if err := dropDatabase(ctx, conn, snapshot, c.Bool("terminate")); err != nil {
+			return err
+		}
+		if err := cloneDatabase(ctx, conn, db, snapshot, c.Bool("terminate")); err != nil {
+			return err
+		}
+		zlog.Info(ctx).Str("database", db).Str("snapshot", snapshot).Msg("took snapshot")
+		return nil
+	})
+}
+
+func dbRestoreAction(c *cli.Context) error {
+	return forEachDB(c, func(ctx context.Context, conn *pgx.Conn, db, snapshot string) error {
+		var exists bool
+		err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", snapshot).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("could not look up snapshot: %w", err)
+		}
+		if !exists {
+			return fmt.Errorf("no snapshot %q", snapshot)
+		}
+		if err := dropDatabase(ctx, conn, db, c.Bool("terminate")); err != nil {
+			return err
+		}
+		if err := cloneDatabase(ctx, conn, snapshot, db, false); err != nil {
+			return err
+		}
+		zlog.Info(ctx).Str("database", db).Str("snapshot", snapshot).Msg("restored snapshot")
+		return nil
+	})
+}
+
+// forEachDB calls fn for every database with a DSN, connected to the
+// server's postgres database, as a database can't be dropped or cloned
+// while connected to it.
+func forEachDB(c *cli.Context, fn func(ctx context.Context, conn *pgx.Conn, db, snapshot string) error) error {
+	ctx := c.Context
+	n := 0
+	for _, scope := range []string{ScopeIndexer, ScopeMatcher, ScopeNotifier} {
+		dsn := c.String(scope + "-dsn")
+		if dsn == "" {
+			continue
+		}
+		n++
+		cfg, err := pgx.ParseConfig(dsn)
+		if err != nil {
+			return fmt.Errorf("%s: could not parse dsn: %w", scope, err)
+		}
+		db := cfg.Database
+		if db == "" || db == "postgres" {
+			return fmt.Errorf("%s: dsn needs to name Clair's database", scope)
+		}
+		cfg.Database = "postgres"
+		conn, err := pgx.ConnectConfig(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("%s: could not connect to database: %w", scope, err)
+		}
+		err = fn(ctx, conn, db, db+"_"+c.String("name"))
+		conn.Close(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", scope, err)
+		}
+	}
+	if n == 0 {
+		return fmt.Errorf("at least one of --indexer-dsn, --matcher-dsn or --notifier-dsn is needed")
+	}
+	return nil
+}
+
+func terminateSessions(ctx context.Context, conn *pgx.Conn, db string) error {
+	_, err := conn.Exec(ctx, `
+SELECT pg_terminate_backend(pid)
+FROM pg_stat_activity
+WHERE datname = $1 AND pid <> pg_backend_pid();`, db)
+	if err != nil {
+		return fmt.Errorf("could not terminate sessions on %s: %w", db, err)
+	}
+	return nil
+}
+
+func dropDatabase(ctx context.Context, conn *pgx.Conn, db string, terminate bool) error {
+	if terminate {
+		if err := terminateSessions(ctx, conn, db); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Exec(ctx, "DROP DATABASE IF EXISTS "+pgx.Identifier{db}.Sanitize())
+	if err != nil {
+		return fmt.Errorf("could not drop %s: %w", db, err)
+	}
+	return nil
+}
+
+func cloneDatabase(ctx context.Context, conn *pgx.Conn, from, to string, terminate bool) error {
+	if terminate {
+		if err := terminateSessions(ctx, conn, from); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{to}.Sanitize()+" TEMPLATE "+pgx.Identifier{from}.Sanitize())
+	if err != nil {
+		return fmt.Errorf("could not copy %s to %s: %w", from, to, err)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import "strconv"
+
+// dumpFailed is set by -vvv, to dump the requests and responses of failed
+// requests.
+var dumpFailed bool
+
+// verbosity counts how many times -v is given.
+type verbosity int
+
+// Set counts another -v, or sets the count, such as v: 3 in a config file.
+func (v *verbosity) Set(s string) error {
+	if n, err := strconv.Atoi(s); err == nil {
+		*v = verbosity(n)
+		return nil
+	}
+	*v++
+	return nil
+}
+
+func (v *verbosity) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*v))
+}
+
+// IsBoolFlag lets -v be given without a value.
+func (v *verbosity) IsBoolFlag() bool { return true }
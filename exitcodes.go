@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+// Exit codes, so wrapper scripts can tell why a run failed without parsing
+// its output.
+const (
+	ExitOK = 0
+	// ExitUsage is for invalid flags or arguments, and any other error
+	// stopping the tool before or during a run.
+	ExitUsage = 1
+	// ExitSLOViolation is for runs breaching a latency threshold, an SLO
+	// in the scenario or the drift threshold, or regressing against a
+	// baseline.
+	ExitSLOViolation = 2
+	// ExitUnreachable is for runs where no request got a response.
+	ExitUnreachable = 3
+	// ExitErrors is for runs whose error rate was above --max-error-rate
+	// or --abort-on-error-rate, or where some operations failed.
+	ExitErrors = 4
+)
+
+// failedExit is the error for a command where some operations failed:
+// ExitUnreachable if Clair couldn't be reached at all, otherwise ExitErrors.
+func failedExit(stats *loadtest.Stats, msg string) error {
+	if stats.Unreachable() {
+		return cli.Exit("could not reach clair: "+msg, ExitUnreachable)
+	}
+	return cli.Exit(msg, ExitErrors)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var FlushDBCmd = &cli.Command{
+	Name:        "flushdb",
+	Description: "truncate Clair's tables to reset state between runs",
+	Usage:       "clair-load-test flushdb --scope indexer --dry-run",
+	Action:      flushDBAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "indexer-dsn",
+			Usage:   "--indexer-dsn postgres://clair@localhost/indexer",
+			Value:   "",
+			EnvVars: []string{"INDEXER_DSN"},
+		},
+		&cli.StringFlag{
+			Name:    "matcher-dsn",
+			Usage:   "--matcher-dsn postgres://clair@localhost/matcher",
+			Value:   "",
+			EnvVars: []string{"MATCHER_DSN"},
+		},
+		&cli.StringFlag{
+			Name:    "notifier-dsn",
+			Usage:   "--notifier-dsn postgres://clair@localhost/notifier",
+			Value:   "",
+			EnvVars: []string{"NOTIFIER_DSN"},
+		},
+		&cli.StringFlag{
+			Name:    "scope",
+			Usage:   "--scope indexer|matcher|notifier",
+			Value:   ScopeIndexer,
+			EnvVars: []string{"FLUSH_SCOPE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "tables",
+			Usage:   "--tables manifest,layer (defaults to every table in the scope)",
+			EnvVars: []string{"FLUSH_TABLES"},
+		},
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/ (used without an indexer DSN)",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		&cli.StringFlag{
+			Name:    "hashes-file",
+			Usage:   "--hashes-file hashes.txt (index reports to delete without an indexer DSN)",
+			Value:   "",
+			EnvVars: []string{"HASHES_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "results",
+			Usage:   "--results results.jsonl (index reports to delete without an indexer DSN)",
+			Value:   "",
+			EnvVars: []string{"RESULTS"},
+		},
+		&cli.IntFlag{
+			Name:    "page-size",
+			Usage:   "--page-size 100 (index reports per bulk delete)",
+			Value:   100,
+			EnvVars: []string{"PAGE_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Usage:   "--concurrency 4 (bulk deletes in flight)",
+			Value:   4,
+			EnvVars: []string{"CONCURRENCY"},
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "--dry-run (print the tables and row counts that would be truncated)",
+			Value: false,
+		},
+	},
+}
+
+// Scopes flushdb can operate on, one per Clair database.
+const (
+	ScopeIndexer  = "indexer"
+	ScopeMatcher  = "matcher"
+	ScopeNotifier = "notifier"
+)
+
+// scopeTables are the tables holding the state each scope's Clair service
+// builds up. Tables that don't exist in the database, as the schema differs
+// between Clair versions, are skipped.
+var scopeTables = map[string][]string{
+	// The indexer tables for manifests and what was found in them. The
+	// package, distribution and repository tables are shared content and
+	// are kept.
+	ScopeIndexer: {
+		"indexreport",
+		"manifest_index",
+		"manifest_layer",
+		"scanned_manifest",
+		"scanned_layer",
+		"package_scanartifact",
+		"dist_scanartifact",
+		"repo_scanartifact",
+		"file_scanartifact",
+		"manifest",
+		"layer",
+	},
+	// The vulnerability database. Rebuilding it can take hours.
+	ScopeMatcher: {
+		"uo_vuln",
+		"vuln",
+		"uo_enrich",
+		"enrichment",
+		"update_operation",
+	},
+	ScopeNotifier: {
+		"receipt",
+		"notification_body",
+		"notification",
+		"subscription",
+	},
+}
+
+func flushDBAction(c *cli.Context) error {
+	ctx := c.Context
+	scope := c.String("scope")
+	defaults, ok := scopeTables[scope]
+	if !ok {
+		return fmt.Errorf("unknown scope %q", scope)
+	}
+	dsn := c.String(scope + "-dsn")
+	switch {
+	case dsn == "" && scope == ScopeIndexer:
+		return flushAPI(c)
+	case dsn == "":
+		return fmt.Errorf("--%s-dsn is needed to flush the %s database", scope, scope)
+	}
+	tables := splitList(c.StringSlice("tables"))
+	if len(tables) == 0 {
+		tables = defaults
+	}
+
+	conn, err := loadtest.ConnectDB(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	tables, err = existingTables(ctx, conn, tables)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("none of the tables exist in the %s database", scope)
+	}
+	if c.Bool("dry-run") {
+		for _, t := range tables {
+			var n int64
+			err := conn.QueryRow(ctx, "SELECT count(*) FROM "+pgx.Identifier{t}.Sanitize()).Scan(&n)
+			if err != nil {
+				return fmt.Errorf("could not count rows in %s: %w", t, err)
+			}
+			fmt.Printf("%s\t%d\n", t, n)
+		}
+		return nil
+	}
+
+	ids := make([]string, len(tables))
+	for i, t := range tables {
+		ids[i] = pgx.Identifier{t}.Sanitize()
+	}
+	// Truncating everything in one statement lets tables referencing each
+	// other go together. There's deliberately no CASCADE, so tables outside
+	// the selection are never touched.
+	_, err = conn.Exec(ctx, "TRUNCATE "+strings.Join(ids, ", "))
+	if err != nil {
+		return fmt.Errorf("could not truncate tables: %w", err)
+	}
+	zlog.Info(ctx).
+		Str("scope", scope).
+		Strs("tables", tables).
+		Msg("truncated tables")
+	return nil
+}
+
+// existingTables returns the tables that exist, logging the others.
+func existingTables(ctx context.Context, conn *pgx.Conn, tables []string) ([]string, error) {
+	var out []string
+	for _, t := range tables {
+		var exists bool
+		err := conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", t).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up table %s: %w", t, err)
+		}
+		if !exists {
+			zlog.Warn(ctx).Str("table", t).Msg("table doesn't exist, skipping")
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// flushAPI deletes index reports through Clair's API, for users without
+// direct database access. Clair has no way to list index reports, so the
+// hashes come from a hashes file or the results of earlier runs. They're
+// deleted in pages with concurrent bulk deletes.
+func flushAPI(c *cli.Context) error {
+	ctx := c.Context
+	hashes, err := collectHashes(nil, c.String("hashes-file"), c.String("results"))
+	if err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return fmt.Errorf("without --indexer-dsn, index reports to delete must be given with --hashes-file or --results")
+	}
+	pageSize := c.Int("page-size")
+	if pageSize < 1 {
+		return fmt.Errorf("page size must be at least 1")
+	}
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	if c.Bool("dry-run") {
+		fmt.Printf("index reports\t%d\n", len(hashes))
+		return nil
+	}
+	var pages [][]string
+	for len(hashes) > 0 {
+		n := pageSize
+		if n > len(hashes) {
+			n = len(hashes)
+		}
+		pages = append(pages, hashes[:n])
+		hashes = hashes[n:]
+	}
+
+	reporter := newReporter(c.String("host"), c.String("psk"))
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	sem := make(chan struct{}, concurrency)
+	var deleted, failed int64
+	g, gctx := errgroup.WithContext(ctx)
+loop:
+	for _, page := range pages {
+		select {
+		case <-gctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+		page := page
+		g.Go(func() error {
+			defer func() { <-sem }()
+			token, err := loadtest.CreateToken(reporter.PSK)
+			if err != nil {
+				return fmt.Errorf("could not create token: %w", err)
+			}
+			n, err := reporter.BulkDeleteIndexReports(gctx, page, token)
+			if err != nil {
+				atomic.AddInt64(&failed, int64(len(page)))
+				zlog.Error(gctx).Int("count", len(page)).Msg(err.Error())
+				return nil
+			}
+			atomic.AddInt64(&deleted, int64(n))
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	zlog.Info(ctx).
+		Int("pages", len(pages)).
+		Int64("deleted", deleted).
+		Int64("failed", failed).
+		Msg("flushed index reports through the API")
+	if failed != 0 {
+		return failedExit(reporter.Stats, fmt.Sprintf("could not delete %d index reports", failed))
+	}
+	return nil
+}
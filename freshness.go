@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/quay/zlog"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+// databaseFreshness gets how up to date the matcher's vulnerability database
+// is before a run. It's nil if that can't be got, which only gets a warning:
+// the update operation endpoints are internal, and may not be exposed.
+func (r *reporter) databaseFreshness(ctx context.Context) *loadtest.DatabaseFreshness {
+	updates, err := r.DatabaseUpdates(ctx)
+	if err != nil {
+		zlog.Warn(ctx).Err(err).Msg("could not get the vulnerability database's last updates")
+		return nil
+	}
+	f := loadtest.NewDatabaseFreshness(updates, time.Now())
+	if f == nil {
+		zlog.Warn(ctx).Msg("the vulnerability database has never been updated")
+		return nil
+	}
+	zlog.Info(ctx).
+		Int("updaters", len(f.Updaters)).
+		Time("newest", f.Newest).
+		Time("oldest", f.Oldest).
+		Msg("vulnerability database last updated")
+	return f
+}
+
+// finishDatabaseFreshness records the updaters that updated the vulnerability
+// database during the run into f.
+func (r *reporter) finishDatabaseFreshness(ctx context.Context, f *loadtest.DatabaseFreshness) {
+	if f == nil {
+		return
+	}
+	updates, err := r.DatabaseUpdates(ctx)
+	if err != nil {
+		zlog.Warn(ctx).Err(err).Msg("could not get the vulnerability database's last updates")
+		return
+	}
+	f.Finish(updates)
+	if len(f.UpdatedDuringRun) != 0 {
+		zlog.Warn(ctx).
+			Strs("updaters", f.UpdatedDuringRun).
+			Msg("the vulnerability database was updated during the run")
+	}
+}
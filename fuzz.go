@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var FuzzCmd = &cli.Command{
+	Name:        "fuzz",
+	Description: "send malformed manifests, checking Clair rejects them with a 4xx rather than failing with a 5xx",
+	Usage:       "clair-load-test fuzz --host http://localhost:6060",
+	Action:      fuzzAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "containers",
+			Usage:   "--containers ubuntu:latest (the manifest to corrupt, a built in one if unset)",
+			Value:   "",
+			EnvVars: []string{"CONTAINERS"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		&cli.StringSliceFlag{
+			Name:    "cases",
+			Usage:   "--cases invalid-json,bad-hash (defaults to all of them)",
+			EnvVars: []string{"FUZZ_CASES"},
+		},
+		&cli.IntFlag{
+			Name:    "oversized-layers",
+			Usage:   "--oversized-layers 10000 (layers in the oversized-layers case)",
+			Value:   10000,
+			EnvVars: []string{"FUZZ_OVERSIZED_LAYERS"},
+		},
+		&cli.StringFlag{
+			Name:    "layer-url-rewrite",
+			Usage:   "--layer-url-rewrite http://localhost:8080",
+			Value:   "",
+			EnvVars: []string{"LAYER_URL_REWRITE"},
+		},
+		outputFileFlag,
+	},
+}
+
+// Fuzz case outcomes.
+const (
+	// FuzzRejected is a 4xx response, what every case expects.
+	FuzzRejected = "rejected"
+	// FuzzAccepted is a 2xx or 3xx response. Clair took the manifest, which
+	// is worth knowing but isn't a failure.
+	FuzzAccepted = "accepted"
+	// FuzzServerError is a 5xx response, a failure.
+	FuzzServerError = "server_error"
+	// FuzzRequestError is a request that got no response at all, such as
+	// a dropped connection, a failure.
+	FuzzRequestError = "request_error"
+)
+
+type fuzzConfig struct {
+	RunID           string     `json:"run_id"`
+	Build           *BuildInfo `json:"build"`
+	Host            string     `json:"host"`
+	PSK             string     `json:"-"`
+	Container       string     `json:"container,omitempty"`
+	Cases           []string   `json:"cases"`
+	OversizedLayers int        `json:"oversized_layers"`
+}
+
+// FuzzResult is the outcome of sending a case's manifest.
+type FuzzResult struct {
+	Case       string `json:"case"`
+	Outcome    string `json:"outcome"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Response is the start of the response body, for 5xx responses.
+	Response            string `json:"response,omitempty"`
+	RequestBytes        int    `json:"request_bytes"`
+	LatencyMilliseconds int64  `json:"latency_milliseconds"`
+}
+
+type fuzzResult struct {
+	Results  []*FuzzResult `json:"results"`
+	Rejected int           `json:"rejected"`
+	Accepted int           `json:"accepted"`
+	Failed   int           `json:"failed"`
+}
+
+// fuzzCase makes a malformed manifest out of a valid one.
+type fuzzCase struct {
+	name string
+	body func(base []byte, conf *fuzzConfig) ([]byte, error)
+}
+
+var fuzzCases = []fuzzCase{
+	{"empty-body", func([]byte, *fuzzConfig) ([]byte, error) { return []byte{}, nil }},
+	{"invalid-json", func(base []byte, _ *fuzzConfig) ([]byte, error) { return base[:len(base)/2], nil }},
+	{"not-an-object", func([]byte, *fuzzConfig) ([]byte, error) { return []byte(`["not", "a", "manifest"]`), nil }},
+	{"missing-hash", mutateManifest(func(m map[string]interface{}) { delete(m, "hash") })},
+	{"missing-layers", mutateManifest(func(m map[string]interface{}) { delete(m, "layers") })},
+	{"bad-hash", mutateManifest(func(m map[string]interface{}) { m["hash"] = "not-a-digest" })},
+	{"unknown-hash-algorithm", mutateManifest(func(m map[string]interface{}) {
+		m["hash"] = "md5:d41d8cd98f00b204e9800998ecf8427e"
+	})},
+	{"short-hash", mutateManifest(func(m map[string]interface{}) { m["hash"] = "sha256:abc" })},
+	{"wrong-types", mutateManifest(func(m map[string]interface{}) {
+		m["hash"] = 42
+		m["layers"] = "layers"
+	})},
+	{"bad-layer-hash", mutateLayers(func(l map[string]interface{}) { l["hash"] = "not-a-digest" })},
+	{"missing-layer-uri", mutateLayers(func(l map[string]interface{}) { delete(l, "uri") })},
+	{"invalid-layer-uri", mutateLayers(func(l map[string]interface{}) { l["uri"] = "::not a url" })},
+	{"oversized-layers", func(base []byte, conf *fuzzConfig) ([]byte, error) {
+		return mutateManifest(func(m map[string]interface{}) {
+			layers := make([]interface{}, conf.OversizedLayers)
+			for i := range layers {
+				layers[i] = map[string]interface{}{
+					"hash":    loadtest.SyntheticHash(0, "fuzz-layer", i),
+					"uri":     fmt.Sprintf("https://localhost/blobs/%d", i),
+					"headers": map[string]interface{}{},
+				}
+			}
+			m["layers"] = layers
+		})(base, conf)
+	}},
+	{"deeply-nested", func([]byte, *fuzzConfig) ([]byte, error) {
+		const depth = 10000
+		return []byte(`{"hash":"` + loadtest.SyntheticHash(0, "fuzz", 1) + `","layers":` +
+			strings.Repeat("[", depth) + strings.Repeat("]", depth) + `}`), nil
+	}},
+}
+
+// mutateManifest returns a case changing the decoded manifest with fn.
+func mutateManifest(fn func(m map[string]interface{})) func([]byte, *fuzzConfig) ([]byte, error) {
+	return func(base []byte, _ *fuzzConfig) ([]byte, error) {
+		var m map[string]interface{}
+		if err := json.Unmarshal(base, &m); err != nil {
+			return nil, fmt.Errorf("could not decode manifest: %w", err)
+		}
+		fn(m)
+		return json.Marshal(m)
+	}
+}
+
+// mutateLayers returns a case changing every layer of the manifest with fn.
+func mutateLayers(fn func(l map[string]interface{})) func([]byte, *fuzzConfig) ([]byte, error) {
+	return mutateManifest(func(m map[string]interface{}) {
+		layers, _ := m["layers"].([]interface{})
+		for _, l := range layers {
+			if l, ok := l.(map[string]interface{}); ok {
+				fn(l)
+			}
+		}
+	})
+}
+
+// fuzzManifest is the manifest corrupted when no container is given. It's
+// never sent as is, so its layer doesn't need to exist.
+func fuzzManifest() []byte {
+	m, _ := json.Marshal(map[string]interface{}{
+		"hash": loadtest.SyntheticHash(0, "fuzz", 0),
+		"layers": []interface{}{
+			map[string]interface{}{
+				"hash":    loadtest.SyntheticHash(0, "fuzz-layer", 0),
+				"uri":     "https://localhost/blobs/0",
+				"headers": map[string]interface{}{},
+			},
+		},
+	})
+	return m
+}
+
+func fuzzAction(c *cli.Context) error {
+	ctx := c.Context
+	conf := &fuzzConfig{
+		Host:            c.String("host"),
+		PSK:             c.String("psk"),
+		Container:       strings.TrimSpace(c.String("containers")),
+		OversizedLayers: c.Int("oversized-layers"),
+	}
+	if strings.Contains(conf.Container, ",") {
+		return fmt.Errorf("fuzz takes a single container")
+	}
+	if conf.OversizedLayers < 1 {
+		return fmt.Errorf("oversized layers must be at least 1")
+	}
+	cases := fuzzCases
+	if names := splitList(c.StringSlice("cases")); len(names) != 0 {
+		cases = nil
+	names:
+		for _, name := range names {
+			for _, fc := range fuzzCases {
+				if fc.name == name {
+					cases = append(cases, fc)
+					continue names
+				}
+			}
+			return fmt.Errorf("unknown fuzz case %q", name)
+		}
+	}
+	for _, fc := range cases {
+		conf.Cases = append(conf.Cases, fc.name)
+	}
+
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	conf.RunID = reporter.RunID
+	conf.Build = buildInfo()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Msg("starting run")
+	var err error
+	reporter.Rewrite, err = loadtest.ParseLayerRewrite(c.String("layer-url-rewrite"))
+	if err != nil {
+		return fmt.Errorf("invalid --layer-url-rewrite: %w", err)
+	}
+	base := fuzzManifest()
+	if conf.Container != "" {
+		base, err = reporter.Manifest(ctx, conf.Container)
+		if err != nil {
+			return fmt.Errorf("could not generate manifest for %s: %w", conf.Container, err)
+		}
+	}
+
+	res := &fuzzResult{}
+	for _, fc := range cases {
+		body, err := fc.body(base, conf)
+		if err != nil {
+			return fmt.Errorf("could not make case %s: %w", fc.name, err)
+		}
+		fr, err := reporter.fuzzOne(ctx, fc.name, body)
+		if err != nil {
+			return err
+		}
+		res.Results = append(res.Results, fr)
+		ev := zlog.Info(ctx)
+		switch fr.Outcome {
+		case FuzzRejected:
+			res.Rejected++
+		case FuzzAccepted:
+			res.Accepted++
+			ev = zlog.Warn(ctx)
+		default:
+			res.Failed++
+			ev = zlog.Error(ctx)
+		}
+		ev.Str("case", fc.name).
+			Str("outcome", fr.Outcome).
+			Int("status", fr.StatusCode).
+			Msg("sent case")
+	}
+
+	if err := writeOutput(c, conf, res); err != nil {
+		return err
+	}
+	if res.Failed != 0 {
+		return failedExit(reporter.Stats, fmt.Sprintf("%d cases failed with a 5xx or no response", res.Failed))
+	}
+	return nil
+}
+
+// fuzzOne sends body as a manifest and classifies the response. Only a
+// failure to build the request is returned as an error.
+func (r *reporter) fuzzOne(ctx context.Context, name string, body []byte) (*FuzzResult, error) {
+	token, err := loadtest.CreateToken(r.PSK)
+	if err != nil {
+		return nil, fmt.Errorf("could not create token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost,
+		r.Host+"/indexer/api/v1/index_report",
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	fr := &FuzzResult{Case: name, RequestBytes: len(body)}
+	resp, sample, err := r.Do(loadtest.EndpointIndexReport, req)
+	defer r.Record(ctx, sample)
+	fr.LatencyMilliseconds = sample.LatencyMilliseconds
+	if err != nil {
+		fr.Outcome = FuzzRequestError
+		fr.Error = err.Error()
+		return fr, nil
+	}
+	defer resp.Body.Close()
+	fr.StatusCode = resp.StatusCode
+	switch {
+	case resp.StatusCode >= 500:
+		fr.Outcome = FuzzServerError
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(resp.Body, buf)
+		fr.Response = string(buf[:n])
+	case resp.StatusCode >= 400:
+		fr.Outcome = FuzzRejected
+	default:
+		fr.Outcome = FuzzAccepted
+	}
+	if resp.StatusCode >= 300 {
+		r.Stats.Endpoint(loadtest.EndpointIndexReport).IncrNon2XXResponses(int64(1))
+	}
+	return fr, nil
+}
@@ -4,11 +4,12 @@ go 1.16
 
 require (
 	github.com/bsipos/thist v1.0.0
-	github.com/jackc/pgx/v4 v4.11.0 // indirect
+	github.com/jackc/pgx/v4 v4.11.0
 	github.com/prometheus/client_golang v1.12.1
 	github.com/quay/clair/v4 v4.1.1
 	github.com/quay/zlog v0.0.0-20210113185248-ce16eed1dcec
 	github.com/rs/zerolog v1.23.0
+	github.com/streadway/amqp v1.0.0
 	github.com/urfave/cli/v2 v2.3.0
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
 	gopkg.in/square/go-jose.v2 v2.6.0
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/quay/zlog"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+// indexGetWorkload indexes every container once and then, for the rest of
+// the run, fetches the resulting index reports. This loads Clair's read path
+// without the cost of indexing. If hashes are set the containers aren't
+// indexed.
+type indexGetWorkload struct {
+	r          *reporter
+	containers []string
+	hashes     []string
+	delete     bool
+	indexed    []string
+}
+
+func (w *indexGetWorkload) Setup(ctx context.Context) error {
+	if w.hashes != nil {
+		return nil
+	}
+	var err error
+	w.indexed, err = w.r.indexContainers(ctx, w.containers)
+	if err != nil {
+		return err
+	}
+	zlog.Info(ctx).Int("count", len(w.indexed)).Msg("indexed containers")
+	w.hashes = w.indexed
+	return nil
+}
+
+func (w *indexGetWorkload) Step(ctx context.Context, n int) error {
+	hash := w.hashes[n%len(w.hashes)]
+	w.r.Schedule.Step(ctx, n, OpGet, hash)
+	token, err := loadtest.CreateToken(w.r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	if err := w.r.GetIndexReport(ctx, hash, token); err != nil {
+		zlog.Error(ctx).Str("hash", hash).Msg(err.Error())
+		return w.r.StepFailed(OpGet, err)
+	}
+	return nil
+}
+
+// Teardown deletes the index reports Setup created, if asked to.
+func (w *indexGetWorkload) Teardown(ctx context.Context) error {
+	w.r.finishDeletes(ctx, w.indexed, w.delete)
+	return nil
+}
+
+// vulnWorkload fetches vulnerability reports for the already indexed hashes
+// for the whole run, isolating the matcher.
+type vulnWorkload struct {
+	r      *reporter
+	hashes []string
+}
+
+func (w *vulnWorkload) Setup(context.Context) error { return nil }
+
+func (w *vulnWorkload) Step(ctx context.Context, n int) error {
+	hash := w.hashes[n%len(w.hashes)]
+	w.r.Schedule.Step(ctx, n, OpVuln, hash)
+	token, err := loadtest.CreateToken(w.r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	report, err := w.r.GetVulnerabilityReport(ctx, hash, token)
+	if err != nil {
+		zlog.Error(ctx).Str("hash", hash).Msg(err.Error())
+		return w.r.StepFailed(OpVuln, err)
+	}
+	w.r.Stats.Image(hash).ObserveVulnerabilityReport(report)
+	return nil
+}
+
+func (w *vulnWorkload) Teardown(context.Context) error { return nil }
+
+// vulnPollWorkload indexes every container once and then, for the rest of
+// the run, polls each vulnerability report every poll interval, as a
+// dashboard refreshing them would. If hashes are set the containers aren't
+// indexed.
+type vulnPollWorkload struct {
+	r          *reporter
+	conf       *testConfig
+	containers []string
+	hashes     []string
+	delete     bool
+	indexed    []string
+}
+
+// Setup indexes the containers, and sets the rate so each hash is polled
+// once per poll interval.
+func (w *vulnPollWorkload) Setup(ctx context.Context) error {
+	if w.hashes == nil {
+		var err error
+		w.indexed, err = w.r.indexContainers(ctx, w.containers)
+		if err != nil {
+			return err
+		}
+		zlog.Info(ctx).Int("count", len(w.indexed)).Msg("indexed containers")
+		w.hashes = w.indexed
+	}
+	w.conf.PerSecond = float64(len(w.hashes)) / w.conf.PollInterval.Seconds()
+	w.r.Control.SetRate(w.conf.PerSecond)
+	zlog.Info(ctx).
+		Int("hashes", len(w.hashes)).
+		Float64("rate", w.conf.PerSecond).
+		Msg("polling vulnerability reports")
+	return nil
+}
+
+func (w *vulnPollWorkload) Step(ctx context.Context, n int) error {
+	hash := w.hashes[n%len(w.hashes)]
+	w.r.Schedule.Step(ctx, n, OpVuln, hash)
+	token, err := loadtest.CreateToken(w.r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	if _, err := w.r.GetVulnerabilityReport(ctx, hash, token); err != nil {
+		zlog.Error(ctx).Str("hash", hash).Msg(err.Error())
+		return w.r.StepFailed(OpVuln, err)
+	}
+	return nil
+}
+
+// Teardown deletes the index reports Setup created, if asked to.
+func (w *vulnPollWorkload) Teardown(ctx context.Context) error {
+	w.r.finishDeletes(ctx, w.indexed, w.delete)
+	return nil
+}
+
+// indexContainers creates an index report for each container, returning the
+// manifest hashes. It fails if none of the containers could be indexed.
+func (r *reporter) indexContainers(ctx context.Context, containers []string) ([]string, error) {
+	hashes := make([]string, len(containers))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, cc := range containers {
+		i, cc := i, cc
+		g.Go(func() error {
+			manifest, err := r.Manifest(gctx, cc)
+			if err != nil {
+				zlog.Error(gctx).Str("container", cc).Msgf("could not generate manifest: %v", err)
+				return nil
+			}
+			token, err := loadtest.CreateToken(r.PSK)
+			if err != nil {
+				return fmt.Errorf("could not create token: %w", err)
+			}
+			hash, err := r.CreateIndexReport(gctx, manifest, token)
+			if err != nil {
+				zlog.Error(gctx).Str("container", cc).Msgf("could not create index report: %v", err)
+				return nil
+			}
+			hashes[i] = hash
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, h := range hashes {
+		if h != "" {
+			out = append(out, h)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("could not index any containers")
+	}
+	return out, nil
+}
+
+// deleteHashes deletes the index reports for hashes, honouring the delete
+// mode. Failures are logged, and the first returned.
+func (r *reporter) deleteHashes(ctx context.Context, hashes []string) error {
+	var first error
+	for _, hash := range hashes {
+		if r.Deletes != nil {
+			if err := r.QueueDelete(ctx, hash); err != nil {
+				zlog.Error(ctx).Msg(err.Error())
+				if first == nil {
+					first = err
+				}
+			}
+			continue
+		}
+		token, err := loadtest.CreateToken(r.PSK)
+		if err != nil {
+			zlog.Error(ctx).Msgf("could not create token: %v", err)
+			return fmt.Errorf("could not create token: %w", err)
+		}
+		if err := r.DeleteIndexReports(ctx, hash, token); err != nil {
+			zlog.Error(ctx).Str("hash", hash).Msgf("could not delete index report: %v", err)
+			if first == nil {
+				first = fmt.Errorf("could not delete index report: %w", err)
+			}
+		}
+	}
+	return first
+}
+
+// finishDeletes deletes the index reports for hashes if delete is set, and
+// sends any deletes still batched. Failures are logged.
+func (r *reporter) finishDeletes(ctx context.Context, hashes []string, delete bool) {
+	if delete {
+		r.deleteHashes(ctx, hashes)
+	}
+	if err := r.FlushDeletes(ctx); err != nil {
+		zlog.Error(ctx).Msg(err.Error())
+	}
+}
+
+// deleteWorkload deletes the index reports for hashes at the run's rate, one
+// per step, stopping once every one has been deleted.
+type deleteWorkload struct {
+	r      *reporter
+	hashes []string
+}
+
+func (w *deleteWorkload) Setup(context.Context) error { return nil }
+
+func (w *deleteWorkload) Step(ctx context.Context, n int) error {
+	if n >= len(w.hashes) {
+		return nil
+	}
+	if n == len(w.hashes)-1 {
+		w.r.Control.Stop()
+	}
+	w.r.Schedule.Step(ctx, n, OpDelete, w.hashes[n])
+	if err := w.r.deleteHashes(ctx, w.hashes[n:n+1]); err != nil {
+		return w.r.StepFailed(OpDelete, err)
+	}
+	return nil
+}
+
+func (w *deleteWorkload) Teardown(ctx context.Context) error {
+	w.r.finishDeletes(ctx, nil, false)
+	return nil
+}
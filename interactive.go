@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+// rateStep is how much + and - change the rate by in interactive mode.
+const rateStep = 1.25
+
+const interactiveHelp = `commands, followed by enter:
+  +        raise the rate by 25%
+  -        lower the rate by 20%
+  rate N   make N requests a second
+  phase N  begin a new phase named N, reported separately
+  p        pause or resume
+  s        print the stats so far
+  q        stop the load and report
+  ?        print this help
+`
+
+// runInteractive reads commands from in, one per line, adjusting ctl while
+// the load runs. Responses are written to out. The q command calls quit,
+// ending the run as if it had reached its timeout. It returns when ctx is
+// done or in is closed.
+func runInteractive(ctx context.Context, in io.Reader, out io.Writer, ctl *loadtest.Control, stats *loadtest.Stats, phases *loadtest.PhaseTracker, quit func()) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(in)
+		for s.Scan() {
+			select {
+			case lines <- strings.TrimSpace(s.Text()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	fmt.Fprint(out, interactiveHelp)
+	for {
+		var line string
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok = <-lines:
+			if !ok {
+				return
+			}
+		}
+		rate, paused, _ := ctl.State()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "+":
+			ctl.SetRate(rate * rateStep)
+			fmt.Fprintf(out, "rate %.2f/s\n", rate*rateStep)
+		case "-":
+			ctl.SetRate(rate / rateStep)
+			fmt.Fprintf(out, "rate %.2f/s\n", rate/rateStep)
+		case "rate":
+			var r float64
+			var err error
+			if len(fields) == 2 {
+				r, err = strconv.ParseFloat(fields[1], 64)
+			}
+			if len(fields) != 2 || err != nil || r <= 0 {
+				fmt.Fprintln(out, "usage: rate N, with N more than 0")
+				continue
+			}
+			ctl.SetRate(r)
+			fmt.Fprintf(out, "rate %.2f/s\n", r)
+		case "phase":
+			if len(fields) != 2 {
+				fmt.Fprintln(out, "usage: phase NAME")
+				continue
+			}
+			phases.Begin(fields[1])
+			fmt.Fprintf(out, "phase %s\n", fields[1])
+		case "p":
+			if paused {
+				ctl.Resume()
+				fmt.Fprintln(out, "resumed")
+			} else {
+				ctl.Pause()
+				fmt.Fprintln(out, "paused")
+			}
+		case "s":
+			printControlStatus(out, loadtest.NewControlStatus(ctl, stats, phases))
+		case "q":
+			fmt.Fprintln(out, "stopping")
+			quit()
+			return
+		case "?", "h", "help":
+			fmt.Fprint(out, interactiveHelp)
+		default:
+			fmt.Fprintf(out, "unknown command %q, ? for help\n", line)
+		}
+	}
+}
+
+func printControlStatus(out io.Writer, st *loadtest.ControlStatus) {
+	state := "running"
+	if st.Paused {
+		state = "paused"
+	}
+	if st.Phase != "" {
+		state += " phase " + st.Phase
+	}
+	fmt.Fprintf(out, "%s at %.2f/s, %.0fs elapsed, error rate %.2f%%\n",
+		state, st.Rate, st.ElapsedSeconds, st.ErrorRate*100)
+	names := make([]string, 0, len(st.Endpoints))
+	for name := range st.Endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := st.Endpoints[name]
+		fmt.Fprintf(out, "  %-26s %6d requests %5d failed  p50 %5dms  p95 %5dms  p99 %5dms\n",
+			name, e.TotalRequests, e.Non2XXResponses+e.RequestErrors+e.FailedResponses,
+			e.P50LatencyMilliseconds, e.P95LatencyMilliseconds, e.P99LatencyMilliseconds)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+// Log formats.
+const (
+	LogConsole = "console"
+	LogJSON    = "json"
+)
+
+var logFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "log-level",
+		Usage:   "--log-level debug|info|warn|error (overrides -D, -q and -v)",
+		Value:   "",
+		EnvVars: []string{"LOG_LEVEL"},
+	},
+	&cli.StringFlag{
+		Name:    "log-format",
+		Usage:   "--log-format console|json",
+		Value:   LogConsole,
+		EnvVars: []string{"LOG_FORMAT"},
+	},
+	&cli.StringFlag{
+		Name:    "log-file",
+		Usage:   "--log-file clair-load-test.log (appended to, instead of logging to stderr)",
+		Value:   "",
+		EnvVars: []string{"LOG_FILE"},
+	},
+}
+
+// setLogging replaces the logger with one configured by the logging flags.
+// Logs never go to stdout, which is kept for results.
+func setLogging(c *cli.Context) error {
+	level := zerolog.InfoLevel
+	if c.Bool("q") {
+		level = zerolog.ErrorLevel
+	}
+	v := *c.Generic("v").(*verbosity)
+	if c.Bool("D") || v > 0 {
+		level = zerolog.DebugLevel
+	}
+	dumpFailed = v >= 3
+	if s := c.String("log-level"); s != "" {
+		var err error
+		level, err = zerolog.ParseLevel(s)
+		if err != nil {
+			return fmt.Errorf("invalid --log-level %q", s)
+		}
+	}
+
+	var w io.Writer = os.Stderr
+	file := c.String("log-file")
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open log file: %w", err)
+		}
+		w = f
+	}
+	switch format := c.String("log-format"); format {
+	case LogConsole:
+		w = &zerolog.ConsoleWriter{
+			Out:        w,
+			TimeFormat: time.RFC3339,
+			NoColor:    file != "",
+		}
+	case LogJSON:
+	default:
+		return fmt.Errorf("unknown --log-format %q, expected %s or %s", format, LogConsole, LogJSON)
+	}
+	logout = zerolog.New(w).Level(level).With().Timestamp().Logger()
+	return nil
+}
@@ -21,25 +21,32 @@ var (
 		Logger()
 
 	commonClaim = jwt.Claims{}
+
+	// version is set at build time with -ldflags "-X main.version=...".
+	version = "0.0.1"
 )
 
 func main() {
+	// -v is verbosity.
+	cli.VersionFlag = &cli.BoolFlag{
+		Name:  "version",
+		Usage: "print the version",
+	}
 	var exit int
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	app := &cli.App{
 		Name:                 "clair-load-test",
-		Version:              "0.0.1",
+		Version:              version,
 		Usage:                "A command-line tool for stress testing clair v4.",
 		Description:          "A command-line tool for stress testing clair v4.",
 		EnableBashCompletion: true,
+		// So -vvv is -v three times.
+		UseShortOptionHandling: true,
 		Before: func(c *cli.Context) error {
-			if c.IsSet("q") {
-				logout = logout.Level(zerolog.WarnLevel)
-			}
-			if c.IsSet("D") {
-				logout = logout.Level(zerolog.DebugLevel)
+			if err := setLogging(c); err != nil {
+				return err
 			}
 			zlog.Set(&logout)
 			commonClaim.Issuer = c.String("issuer")
@@ -48,20 +55,50 @@ func main() {
 		Commands: []*cli.Command{
 			ReportsCmd,
 			CreateTokenCmd,
+			RenderCmd,
+			CleanupCmd,
+			UpdateOpsCmd,
+			UpdatersCmd,
+			QuaySimCmd,
+			ServeLayersCmd,
+			ServeWebhookCmd,
+			ConsumeCmd,
+			ProxyCmd,
+			FlushDBCmd,
+			SeedCmd,
+			DBCmd,
+			ReplayCmd,
+			CapacityCmd,
+			MatrixCmd,
+			FuzzCmd,
+			CheckCmd,
+			ValidateResultsCmd,
+			BaselineCmd,
+			VersionCmd,
 		},
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.BoolFlag{
 				Name:  "D",
 				Usage: "print debugging logs",
 			},
 			&cli.BoolFlag{
 				Name:  "q",
-				Usage: "quieter log output",
+				Usage: "only log errors, leaving the results",
 			},
+			&cli.GenericFlag{
+				Name:  "v",
+				Usage: "-v for debug logs, -vvv to also dump the requests and responses of failed requests",
+				Value: new(verbosity),
+			},
+			configFlag,
+		}, logFlags...),
+		CommandNotFound: func(c *cli.Context, command string) {
+			exit = ExitUsage
+			logout.Error().Msgf("no command %q", command)
 		},
 		ExitErrHandler: func(c *cli.Context, err error) {
 			if err != nil {
-				exit = 1
+				exit = ExitUsage
 				if err, ok := err.(cli.ExitCoder); ok {
 					exit = err.ExitCode()
 				}
@@ -69,6 +106,11 @@ func main() {
 			}
 		},
 	}
-	app.RunContext(ctx, os.Args)
-
+	useConfigFile(app)
+	// Errors parsing flags are returned without going through
+	// ExitErrHandler.
+	if err := app.RunContext(ctx, os.Args); err != nil && exit == ExitOK {
+		exit = ExitUsage
+	}
+	os.Exit(exit)
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var manifestSourceFlag = &cli.StringFlag{
+	Name:    "manifest-source",
+	Usage:   "--manifest-source native (where manifests come from: auto, clairctl, native from image registries, file of manifests named as containers, or registry of manifests given as URLs)",
+	Value:   loadtest.ManifestSourceAuto,
+	EnvVars: []string{"MANIFEST_SOURCE"},
+}
+
+// setManifestSource applies --manifest-source, logging what auto detects.
+func (r *reporter) setManifestSource(ctx context.Context, c *cli.Context) error {
+	source, err := loadtest.ParseManifestSource(c.String("manifest-source"))
+	if err != nil {
+		return err
+	}
+	r.ManifestSource = source
+	if source == loadtest.ManifestSourceAuto {
+		zlog.Debug(ctx).
+			Bool("clairctl", loadtest.ClairctlAvailable()).
+			Msg("generating manifests natively, falling back to clairctl if it's installed")
+	}
+	return nil
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/crozzy/clair-load-test/pkg/results"
+)
+
+var MatrixCmd = &cli.Command{
+	Name:        "matrix",
+	Description: "run report for every combination of the parameters in a matrix file, and combine the results",
+	Usage:       "clair-load-test matrix --matrix matrix.yaml --dir matrix-runs",
+	Action:      matrixAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "matrix",
+			Usage:   "--matrix matrix.yaml (the flags every run is given, and the parameters varied between them)",
+			Value:   "",
+			EnvVars: []string{"MATRIX"},
+		},
+		&cli.StringFlag{
+			Name:    "dir",
+			Usage:   "--dir matrix-runs (where each run's output is kept)",
+			Value:   "matrix-runs",
+			EnvVars: []string{"MATRIX_DIR"},
+		},
+		&cli.BoolFlag{
+			Name:    "resume",
+			Usage:   "--resume (carry on with a matrix that was interrupted, skipping the runs already finished in --dir)",
+			Value:   false,
+			EnvVars: []string{"MATRIX_RESUME"},
+		},
+		&cli.DurationFlag{
+			Name:    "cooldown",
+			Usage:   "--cooldown 30s (pause between runs, to let Clair settle)",
+			Value:   0,
+			EnvVars: []string{"MATRIX_COOLDOWN"},
+		},
+		&cli.StringFlag{
+			Name:    "table",
+			Usage:   "--table matrix.md (where the table of results is written as Markdown, stderr by default)",
+			Value:   "",
+			EnvVars: []string{"MATRIX_TABLE"},
+		},
+		outputFileFlag,
+	},
+}
+
+// matrixFile is a matrix of report runs. Every run is given Flags, and one
+// value of each of the Parameters, with a run for every combination. Values
+// are as in a config file.
+type matrixFile struct {
+	Flags map[string]interface{} `yaml:"flags"`
+	// Parameters is a mapping of flags to lists of values, kept as a node
+	// so the runs are in the order the parameters were written in.
+	Parameters yaml.Node `yaml:"parameters"`
+}
+
+type matrixParameter struct {
+	Name   string
+	Values []interface{}
+}
+
+// MatrixCell is one run of a matrix.
+type MatrixCell struct {
+	Name string `json:"name"`
+	// Values are the parameters' values for the run, as given to report.
+	Values map[string]string `json:"values"`
+	Output string            `json:"output"`
+	// Verdict is "pass", or why the run didn't pass going by its exit
+	// code: "slo_violation", "unreachable", "errors" or "failed".
+	Verdict  string `json:"verdict"`
+	ExitCode int    `json:"exit_code"`
+	// Resumed is set for runs finished by an earlier, interrupted matrix.
+	Resumed bool   `json:"resumed,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// The rest are from the run's stats.
+	IndexRequests                             int64   `json:"index_requests"`
+	AchievedRate                              float64 `json:"achieved_rate"`
+	ErrorRate                                 float64 `json:"error_rate"`
+	IndexP50LatencyMilliseconds               int64   `json:"index_p50_latency_milliseconds"`
+	IndexP95LatencyMilliseconds               int64   `json:"index_p95_latency_milliseconds"`
+	VulnerabilityReportP95LatencyMilliseconds int64   `json:"vulnerability_report_p95_latency_milliseconds"`
+
+	values map[string]interface{}
+}
+
+// MatrixReport is the combined results of a matrix's runs.
+type MatrixReport struct {
+	Parameters []string      `json:"parameters"`
+	Cells      []*MatrixCell `json:"cells"`
+}
+
+// matrixStatus is written once a run has finished, so a resumed matrix knows
+// to skip it.
+type matrixStatus struct {
+	ExitCode int       `json:"exit_code"`
+	Finished time.Time `json:"finished"`
+}
+
+func matrixAction(c *cli.Context) error {
+	ctx := c.Context
+	path := c.String("matrix")
+	if path == "" {
+		return fmt.Errorf("--matrix is needed")
+	}
+	flags, params, err := readMatrix(path)
+	if err != nil {
+		return err
+	}
+	cells := matrixCells(params)
+	dir := c.String("dir")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("could not create --dir: %w", err)
+	}
+	if !c.Bool("resume") {
+		for _, cell := range cells {
+			if _, err := os.Stat(matrixStatusPath(dir, cell)); err == nil {
+				return fmt.Errorf("%s has runs from an earlier matrix, use --resume to carry on with them or remove them", dir)
+			}
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not find the executable to run: %w", err)
+	}
+
+	report := &MatrixReport{Cells: cells}
+	for _, p := range params {
+		report.Parameters = append(report.Parameters, p.Name)
+	}
+	ran := 0
+	for i, cell := range cells {
+		cell.Output = filepath.Join(dir, cell.Name+".json")
+		if st, err := readMatrixStatus(matrixStatusPath(dir, cell)); err == nil {
+			zlog.Info(ctx).Str("run", cell.Name).Msg("already finished, skipping")
+			cell.Resumed = true
+			cell.finish(st.ExitCode)
+			continue
+		}
+		if ran != 0 && c.Duration("cooldown") > 0 {
+			time.Sleep(c.Duration("cooldown"))
+		}
+		ran++
+		zlog.Info(ctx).
+			Str("run", cell.Name).
+			Int("of", len(cells)).
+			Int("number", i+1).
+			Msg("starting run")
+		code, err := runMatrixCell(ctx, exe, matrixEnv(c), flags, cell)
+		if err != nil {
+			return err
+		}
+		st := &matrixStatus{ExitCode: code, Finished: time.Now().UTC()}
+		if err := writeMatrixStatus(matrixStatusPath(dir, cell), st); err != nil {
+			return err
+		}
+		cell.finish(code)
+		zlog.Info(ctx).
+			Str("run", cell.Name).
+			Str("verdict", cell.Verdict).
+			Msg("run done")
+	}
+
+	if err := writeMatrixTable(c.String("table"), report); err != nil {
+		return err
+	}
+	if err := writeOutput(c, report); err != nil {
+		return err
+	}
+	failed, errored := 0, false
+	for _, cell := range report.Cells {
+		if cell.Verdict != "pass" {
+			failed++
+			errored = errored || cell.Verdict != "slo_violation"
+		}
+	}
+	switch {
+	case errored:
+		return cli.Exit(fmt.Sprintf("%d of %d runs didn't pass", failed, len(cells)), ExitErrors)
+	case failed != 0:
+		return cli.Exit(fmt.Sprintf("%d of %d runs didn't pass", failed, len(cells)), ExitSLOViolation)
+	}
+	return nil
+}
+
+// readMatrix reads the matrix file at path, checking every flag it sets is
+// one of report's.
+func readMatrix(path string) (map[string]interface{}, []matrixParameter, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read matrix: %w", err)
+	}
+	var m matrixFile
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, nil, fmt.Errorf("could not decode matrix %s: %w", path, err)
+	}
+	if m.Parameters.Kind != yaml.MappingNode || len(m.Parameters.Content) == 0 {
+		return nil, nil, fmt.Errorf("invalid matrix %s: parameters must map flags to lists of values", path)
+	}
+	var params []matrixParameter
+	for i := 0; i < len(m.Parameters.Content); i += 2 {
+		name, values := m.Parameters.Content[i].Value, m.Parameters.Content[i+1]
+		p := matrixParameter{Name: name}
+		if values.Kind != yaml.SequenceNode || len(values.Content) == 0 {
+			return nil, nil, fmt.Errorf("invalid matrix %s: parameter %q must be a list of values", path, name)
+		}
+		for _, n := range values.Content {
+			var v interface{}
+			if err := n.Decode(&v); err != nil {
+				return nil, nil, fmt.Errorf("invalid matrix %s: %w", path, err)
+			}
+			p.Values = append(p.Values, v)
+		}
+		params = append(params, p)
+	}
+	check := func(name string, v interface{}) error {
+		f := reportFlag(name)
+		if f == nil {
+			return fmt.Errorf("invalid matrix %s: unknown flag %q", path, name)
+		}
+		if name == outputFileFlag.Name {
+			return fmt.Errorf("invalid matrix %s: %s is set for each run", path, name)
+		}
+		if _, err := configValues(f, v); err != nil {
+			return fmt.Errorf("invalid %s in matrix %s: %w", name, path, err)
+		}
+		return nil
+	}
+	for name, v := range m.Flags {
+		if err := check(name, v); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, p := range params {
+		for _, v := range p.Values {
+			if err := check(p.Name, v); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return m.Flags, params, nil
+}
+
+// reportFlag returns report's flag called name, or nil if it has none.
+func reportFlag(name string) cli.Flag {
+	for _, f := range ReportsCmd.Flags {
+		for _, n := range f.Names() {
+			if n == name {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// matrixCells returns a cell for every combination of the parameters' values,
+// the first parameter varying slowest.
+func matrixCells(params []matrixParameter) []*MatrixCell {
+	combos := []map[string]interface{}{{}}
+	for _, p := range params {
+		var next []map[string]interface{}
+		for _, combo := range combos {
+			for _, v := range p.Values {
+				m := map[string]interface{}{p.Name: v}
+				for k, v := range combo {
+					m[k] = v
+				}
+				next = append(next, m)
+			}
+		}
+		combos = next
+	}
+	cells := make([]*MatrixCell, len(combos))
+	for i, combo := range combos {
+		cell := &MatrixCell{Values: map[string]string{}, values: combo}
+		var name, key []string
+		for _, p := range params {
+			vals, _ := configValues(reportFlag(p.Name), combo[p.Name])
+			v := strings.Join(vals, ",")
+			cell.Values[p.Name] = v
+			name = append(name, p.Name+"-"+v)
+			key = append(key, p.Name+"="+v)
+		}
+		cell.Name = matrixCellName(strings.Join(name, "_"), strings.Join(key, "\n"))
+		cells[i] = cell
+	}
+	return cells
+}
+
+// matrixCellName makes a file name of name, made unique by the hash of key,
+// the cell's values, so a resumed matrix finds its runs even if the matrix
+// file was reordered.
+func matrixCellName(name, key string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, name)
+	if len(safe) > 64 {
+		safe = safe[:64]
+	}
+	sum := sha256.Sum256([]byte(key))
+	return safe + "-" + hex.EncodeToString(sum[:4])
+}
+
+// runMatrixCell runs report for cell, returning its exit code. Its logs go to
+// stderr, as do any samples sent to stdout, keeping stdout for the matrix's
+// report.
+func runMatrixCell(ctx context.Context, exe string, env []string, flags map[string]interface{}, cell *MatrixCell) (int, error) {
+	values := map[string]interface{}{}
+	for k, v := range flags {
+		values[k] = v
+	}
+	for k, v := range cell.values {
+		values[k] = v
+	}
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	args := []string{ReportsCmd.Name}
+	for _, name := range names {
+		vals, err := configValues(reportFlag(name), values[name])
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range vals {
+			args = append(args, "--"+name+"="+v)
+		}
+	}
+	args = append(args, "--"+outputFileFlag.Name+"="+cell.Output)
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Env = env
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return ExitOK, nil
+	case ctx.Err() != nil:
+		return 0, ctx.Err()
+	case errors.As(err, &exitErr) && exitErr.ExitCode() > 0:
+		return exitErr.ExitCode(), nil
+	}
+	return 0, fmt.Errorf("could not run %s: %w", cell.Name, err)
+}
+
+// matrixEnv returns the environment for the matrix's runs, passing on the
+// global flags given to it with values, such as --config and --log-file, by
+// way of their env vars.
+func matrixEnv(c *cli.Context) []string {
+	env := os.Environ()
+	for _, f := range c.App.Flags {
+		sf, ok := f.(*cli.StringFlag)
+		if !ok || len(sf.EnvVars) == 0 || !c.IsSet(sf.Name) {
+			continue
+		}
+		env = append(env, sf.EnvVars[0]+"="+c.String(sf.Name))
+	}
+	return env
+}
+
+// finish sets the cell's verdict from the exit code of its run, and its
+// results from its output.
+func (cell *MatrixCell) finish(code int) {
+	cell.ExitCode = code
+	switch code {
+	case ExitOK:
+		cell.Verdict = "pass"
+	case ExitSLOViolation:
+		cell.Verdict = "slo_violation"
+	case ExitUnreachable:
+		cell.Verdict = "unreachable"
+	case ExitErrors:
+		cell.Verdict = "errors"
+	default:
+		cell.Verdict = "failed"
+	}
+	f, err := os.Open(cell.Output)
+	if err != nil {
+		cell.Error = fmt.Sprintf("could not open output: %v", err)
+		return
+	}
+	defer f.Close()
+	out, err := results.ReadOutput(f)
+	if err != nil {
+		cell.Error = fmt.Sprintf("could not read output: %v", err)
+		return
+	}
+	stats := out.Stats
+	cell.ErrorRate = stats.ErrorRate
+	if e, ok := stats.Endpoints[results.EndpointIndexReport]; ok {
+		cell.IndexRequests = e.TotalRequests
+		cell.IndexP50LatencyMilliseconds = e.P50LatencyMilliseconds
+		cell.IndexP95LatencyMilliseconds = e.P95LatencyMilliseconds
+		if stats.ElapsedSeconds > 0 {
+			cell.AchievedRate = float64(e.TotalRequests) / stats.ElapsedSeconds
+		}
+	}
+	if e, ok := stats.Endpoints[results.EndpointVulnerabilityReport]; ok {
+		cell.VulnerabilityReportP95LatencyMilliseconds = e.P95LatencyMilliseconds
+	}
+}
+
+func matrixStatusPath(dir string, cell *MatrixCell) string {
+	return filepath.Join(dir, cell.Name+".status.json")
+}
+
+func readMatrixStatus(path string) (*matrixStatus, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st matrixStatus
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", path, err)
+	}
+	return &st, nil
+}
+
+// writeMatrixStatus writes st to path by way of a temporary file, so an
+// interrupted matrix never leaves half a status behind.
+func writeMatrixStatus(path string, st *matrixStatus) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("could not write run status: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not write run status: %w", err)
+	}
+	return nil
+}
+
+// writeMatrixTable writes the report's table to path, or stderr if it's
+// empty.
+func writeMatrixTable(path string, report *MatrixReport) (err error) {
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("could not create table: %w", err)
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+	header := append(append([]string{}, report.Parameters...),
+		"verdict", "index requests", "rate", "error rate", "index p50", "index p95", "vuln p95")
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(header)))
+	for _, cell := range report.Cells {
+		row := make([]string, 0, len(header))
+		for _, p := range report.Parameters {
+			row = append(row, strings.ReplaceAll(cell.Values[p], "|", `\|`))
+		}
+		row = append(row,
+			cell.Verdict,
+			fmt.Sprint(cell.IndexRequests),
+			fmt.Sprintf("%.2f/s", cell.AchievedRate),
+			fmt.Sprintf("%.2f%%", cell.ErrorRate*100),
+			fmt.Sprintf("%dms", cell.IndexP50LatencyMilliseconds),
+			fmt.Sprintf("%dms", cell.IndexP95LatencyMilliseconds),
+			fmt.Sprintf("%dms", cell.VulnerabilityReportP95LatencyMilliseconds),
+		)
+		if _, err := fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
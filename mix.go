@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/quay/zlog"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+// Operations that can make up a mixed workload.
+const (
+	OpIndex  = "index"
+	OpVuln   = "vuln"
+	OpGet    = "get"
+	OpDelete = "delete"
+)
+
+// Mix is a set of operation weights.
+type Mix map[string]int
+
+// ParseMix parses a mix of the form "index=50,vuln=40,delete=10".
+func ParseMix(s string) (Mix, error) {
+	m, err := parseWeights(s, OpIndex, OpVuln, OpGet, OpDelete)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	if m[OpIndex] == 0 {
+		return nil, fmt.Errorf("mix needs a non-zero index weight to fill the hash pool")
+	}
+	return m, nil
+}
+
+// parseWeights parses comma separated op=weight pairs, where op must be one
+// of ops.
+func parseWeights(s string, ops ...string) (Mix, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := Mix{}
+	total := 0
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid entry %q, expected op=weight", kv)
+		}
+		k, v := strings.TrimSpace(parts[0]), parts[1]
+		known := false
+		for _, op := range ops {
+			known = known || k == op
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown operation %q, expected one of %s", k, strings.Join(ops, ", "))
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight for %q: %q", k, v)
+		}
+		m[k] += w
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("at least one weight must be non-zero")
+	}
+	return m, nil
+}
+
+// pick returns an operation chosen at random according to the weights.
+func (m Mix) pick(rng func() float64) string {
+	ops := make([]string, 0, len(m))
+	total := 0
+	for op, w := range m {
+		ops = append(ops, op)
+		total += w
+	}
+	sort.Strings(ops)
+	n := rng() * float64(total)
+	for _, op := range ops {
+		n -= float64(m[op])
+		if n < 0 {
+			return op
+		}
+	}
+	return ops[len(ops)-1]
+}
+
+// hashPool is the set of manifest hashes known to Clair that operations in
+// a mixed workload draw from.
+type hashPool struct {
+	mu     sync.Mutex
+	hashes []string
+	// owned are the hashes indexed by this run, only these are deleted.
+	owned []string
+	// members are the hashes in the pool, so that one indexed again isn't
+	// added twice and can't be picked after it's taken.
+	members map[string]struct{}
+}
+
+// add adds hash to the pool, unless it's already there.
+func (p *hashPool) add(hash string, owned bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.members[hash]; ok {
+		return
+	}
+	if p.members == nil {
+		p.members = map[string]struct{}{}
+	}
+	p.members[hash] = struct{}{}
+	p.hashes = append(p.hashes, hash)
+	if owned {
+		p.owned = append(p.owned, hash)
+	}
+}
+
+func (p *hashPool) random(rng *rand.Rand) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.hashes) == 0 {
+		return "", false
+	}
+	return p.hashes[rng.Intn(len(p.hashes))], true
+}
+
+// take removes a random owned hash from the pool.
+func (p *hashPool) take(rng *rand.Rand) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.owned) == 0 {
+		return "", false
+	}
+	i := rng.Intn(len(p.owned))
+	hash := p.owned[i]
+	p.owned = append(p.owned[:i], p.owned[i+1:]...)
+	delete(p.members, hash)
+	for i, h := range p.hashes {
+		if h == hash {
+			p.hashes = append(p.hashes[:i], p.hashes[i+1:]...)
+			break
+		}
+	}
+	return hash, true
+}
+
+func (p *hashPool) takeAll() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	owned := p.owned
+	p.owned = nil
+	p.hashes = nil
+	p.members = nil
+	return owned
+}
+
+// mixWorkload is made up of operations chosen by mix, sharing a pool of
+// hashes between them. Operations that need a hash fall back to indexing
+// while the pool is empty.
+type mixWorkload struct {
+	r          *reporter
+	mix        Mix
+	containers []string
+	hashes     []string
+	delete     bool
+	pool       hashPool
+}
+
+// Setup adds the already indexed hashes to the pool.
+func (w *mixWorkload) Setup(context.Context) error {
+	for _, h := range w.hashes {
+		w.pool.add(h, false)
+	}
+	return nil
+}
+
+func (w *mixWorkload) Step(ctx context.Context, n int) error {
+	token, err := loadtest.CreateToken(w.r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	rng := loadtest.StepRand(w.r.Seed, n)
+	op := w.mix.pick(rng.Float64)
+	var hash string
+	var ok bool
+	switch op {
+	case OpVuln, OpGet:
+		hash, ok = w.pool.random(rng)
+	case OpDelete:
+		hash, ok = w.pool.take(rng)
+	}
+	if op != OpIndex && !ok {
+		zlog.Debug(ctx).Str("op", op).Msg("hash pool empty, indexing instead")
+		op = OpIndex
+	}
+
+	switch op {
+	case OpIndex:
+		cc, err := w.r.Quarantine.Pick(w.containers, n)
+		if err != nil {
+			return err
+		}
+		w.r.Schedule.Step(ctx, n, op, cc)
+		manifest, err := w.r.Manifest(ctx, cc)
+		if err != nil {
+			w.r.Quarantine.ManifestFailed(ctx, cc, err)
+			zlog.Error(ctx).Str("container", cc).Msgf("could not generate manifest: %v", err)
+			return w.r.StepFailed(op, fmt.Errorf("could not generate manifest: %w", err))
+		}
+		hash, err := w.r.CreateIndexReport(ctx, manifest, token)
+		if err != nil {
+			w.r.Quarantine.IndexFailed(ctx, cc, err)
+			zlog.Error(ctx).Str("container", cc).Msgf("could not create index report: %v", err)
+			return w.r.StepFailed(op, fmt.Errorf("could not create index report: %w", err))
+		}
+		w.r.Quarantine.Indexed(cc)
+		w.pool.add(hash, true)
+	case OpVuln:
+		w.r.Schedule.Step(ctx, n, op, hash)
+		var report *loadtest.VulnerabilityReportSummary
+		report, err = w.r.GetVulnerabilityReport(ctx, hash, token)
+		if err == nil {
+			w.r.Stats.Image(hash).ObserveVulnerabilityReport(report)
+		}
+	case OpGet:
+		w.r.Schedule.Step(ctx, n, op, hash)
+		err = w.r.GetIndexReport(ctx, hash, token)
+	case OpDelete:
+		w.r.Schedule.Step(ctx, n, op, hash)
+		err = w.r.DeleteIndexReports(ctx, hash, token)
+	}
+	if err != nil {
+		zlog.Error(ctx).Str("op", op).Str("hash", hash).Msg(err.Error())
+		return w.r.StepFailed(op, err)
+	}
+	return nil
+}
+
+// Teardown deletes the index reports indexed by the run that are still in
+// the pool, if asked to.
+func (w *mixWorkload) Teardown(ctx context.Context) error {
+	w.r.finishDeletes(ctx, w.pool.takeAll(), w.delete)
+	return nil
+}
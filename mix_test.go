@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestHashPoolDedupes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var p hashPool
+	p.add("sha256:a", false)
+	p.add("sha256:b", true)
+	p.add("sha256:b", true)
+	p.add("sha256:a", true)
+	if len(p.hashes) != 2 || len(p.owned) != 1 {
+		t.Fatalf("pool has %d hashes, %d owned, want 2 and 1", len(p.hashes), len(p.owned))
+	}
+
+	hash, ok := p.take(rng)
+	if !ok || hash != "sha256:b" {
+		t.Fatalf("took %q, want sha256:b", hash)
+	}
+	if _, ok := p.take(rng); ok {
+		t.Error("took a hash that was already taken")
+	}
+	for i := 0; i < 10; i++ {
+		if h, _ := p.random(rng); h != "sha256:a" {
+			t.Fatalf("picked %q, want sha256:a", h)
+		}
+	}
+	// A taken hash can be indexed and added again.
+	p.add("sha256:b", true)
+	if len(p.hashes) != 2 || len(p.owned) != 1 {
+		t.Errorf("pool has %d hashes, %d owned, want 2 and 1", len(p.hashes), len(p.owned))
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+// How often thresholds are checked while a run is in progress.
+const thresholdCheckInterval = time.Second * 10
+
+// Notification statuses.
+const (
+	NotifyPass   = "pass"
+	NotifyFail   = "fail"
+	NotifyBreach = "breach"
+)
+
+// Notification is the payload posted to the webhook. The text field makes it
+// acceptable to Slack-compatible incoming webhooks, the rest is there for
+// anything that wants to act on the numbers.
+type Notification struct {
+	Text                               string   `json:"text"`
+	Status                             string   `json:"status"`
+	RunID                              string   `json:"run_id"`
+	P95IndexReportMilliseconds         int64    `json:"p95_index_report_milliseconds"`
+	P95VulnerabilityReportMilliseconds int64    `json:"p95_vulnerability_report_milliseconds"`
+	ErrorRate                          float64  `json:"error_rate"`
+	RunLink                            string   `json:"run_link,omitempty"`
+	Violations                         []string `json:"violations,omitempty"`
+}
+
+func NewNotification(status string, conf *testConfig, stats *loadtest.Stats, violations []string) *Notification {
+	n := &Notification{
+		Status:                             status,
+		RunID:                              conf.RunID,
+		P95IndexReportMilliseconds:         endpointP95(stats, loadtest.EndpointIndexReport),
+		P95VulnerabilityReportMilliseconds: endpointP95(stats, loadtest.EndpointVulnerabilityReport),
+		ErrorRate:                          stats.CurrentErrorRate(),
+		RunLink:                            conf.RunLink,
+		Violations:                         violations,
+	}
+	var b strings.Builder
+	switch status {
+	case NotifyPass:
+		b.WriteString("clair-load-test run passed")
+	case NotifyFail:
+		b.WriteString("clair-load-test run failed")
+	case NotifyBreach:
+		b.WriteString("clair-load-test thresholds breached mid-run")
+	}
+	fmt.Fprintf(&b, ": index_report p95 %dms, vulnerability_report p95 %dms, error rate %.2f%%",
+		n.P95IndexReportMilliseconds, n.P95VulnerabilityReportMilliseconds, n.ErrorRate*100)
+	for _, v := range violations {
+		b.WriteString("\n• ")
+		b.WriteString(v)
+	}
+	if conf.RunLink != "" {
+		b.WriteString("\n")
+		b.WriteString(conf.RunLink)
+	}
+	n.Text = b.String()
+	return n
+}
+
+// Notifier posts notifications to a webhook. A nil Notifier does nothing.
+type Notifier struct {
+	url string
+	cl  *http.Client
+}
+
+func NewNotifier(url string) *Notifier {
+	if url == "" {
+		return nil
+	}
+	return &Notifier{
+		url: url,
+		cl:  &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+func (n *Notifier) Notify(ctx context.Context, msg *Notification) error {
+	if n == nil {
+		return nil
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non 2XX response from webhook %d", resp.StatusCode)
+	}
+	zlog.Debug(ctx).Str("status", msg.Status).Msg("sent notification")
+	return nil
+}
+
+// CheckThresholds returns a description of every threshold in conf that the
+// stats currently violate.
+func CheckThresholds(conf *testConfig, stats *loadtest.Stats) []string {
+	var v []string
+	if conf.MaxP95 > 0 {
+		max := conf.MaxP95.Milliseconds()
+		if p := endpointP95(stats, loadtest.EndpointIndexReport); p > max {
+			v = append(v, fmt.Sprintf("index_report p95 %dms > %dms", p, max))
+		}
+		if p := endpointP95(stats, loadtest.EndpointVulnerabilityReport); p > max {
+			v = append(v, fmt.Sprintf("vulnerability_report p95 %dms > %dms", p, max))
+		}
+	}
+	if conf.MaxErrorRate > 0 {
+		if r := stats.CurrentErrorRate() * 100; r > conf.MaxErrorRate {
+			v = append(v, fmt.Sprintf("error rate %.2f%% > %.2f%%", r, conf.MaxErrorRate))
+		}
+	}
+	return v
+}
+
+// endpointP95 returns the p95 latency of the named endpoint so far, or 0 if
+// there have been no requests to it yet.
+func endpointP95(stats *loadtest.Stats, name string) int64 {
+	e, ok := stats.LookupEndpoint(name)
+	if !ok {
+		return 0
+	}
+	return e.Percentile(95)
+}
+
+// watchThresholds sends a single breach notification the first time the
+// thresholds are violated, or returns when ctx is done.
+func watchThresholds(ctx context.Context, conf *testConfig, stats *loadtest.Stats, n *Notifier) {
+	t := time.NewTicker(thresholdCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			v := CheckThresholds(conf, stats)
+			if len(v) == 0 {
+				continue
+			}
+			if err := n.Notify(ctx, NewNotification(NotifyBreach, conf, stats, v)); err != nil {
+				zlog.Warn(ctx).Err(err).Msg("could not send notification")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+var outputFileFlag = &cli.StringFlag{
+	Name:    "output-file",
+	Usage:   "--output-file stats.json (where the config and stats are written, stdout by default)",
+	Value:   "",
+	EnvVars: []string{"OUTPUT_FILE"},
+}
+
+// writeOutput writes each of vs, the config and stats of a run, as indented
+// JSON to --output-file or stdout. Logs never go to stdout, so it can be
+// piped to jq.
+func writeOutput(c *cli.Context, vs ...interface{}) (err error) {
+	var w io.Writer = os.Stdout
+	if path := c.String("output-file"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("could not create output file: %w", err)
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	for _, v := range vs {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package loadtest
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Anomalous requests less than anomalyGap apart are clustered together, and
+// clusters of fewer than anomalyMinRequests aren't reported.
+const (
+	anomalyGap         = 5 * time.Second
+	anomalyMinRequests = 3
+)
+
+// Kinds of anomaly.
+const (
+	AnomalyTimeouts = "timeouts"
+	AnomalySlow     = "slow"
+)
+
+// Anomaly is a cluster of timeouts or unusually slow requests to an endpoint,
+// such as a GC pause or a lock held too long would cause. Its window can be
+// cross-referenced with Clair's logs.
+type Anomaly struct {
+	Kind     string    `json:"kind"`
+	Endpoint string    `json:"endpoint"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Requests int       `json:"requests"`
+	// MaxLatencyMilliseconds is the slowest of the requests, against the
+	// endpoint's median over the whole run.
+	MaxLatencyMilliseconds    int64 `json:"max_latency_milliseconds"`
+	MedianLatencyMilliseconds int64 `json:"median_latency_milliseconds"`
+}
+
+type anomalyPoint struct {
+	start   time.Time
+	latency time.Duration
+	timeout bool
+}
+
+// AnomalyDetector looks for clusters of timeouts, and of requests slower than
+// a factor of their endpoint's median latency. A nil AnomalyDetector does
+// nothing.
+type AnomalyDetector struct {
+	factor float64
+
+	mu     sync.Mutex
+	points map[string][]anomalyPoint
+	// latencies are every request's, for the median so far.
+	latencies map[string]*histogram
+}
+
+// NewAnomalyDetector returns an AnomalyDetector counting requests slower than
+// factor times the median as slow. A factor of 0 returns nil.
+func NewAnomalyDetector(factor float64) *AnomalyDetector {
+	if factor <= 0 {
+		return nil
+	}
+	return &AnomalyDetector{
+		factor:    factor,
+		points:    map[string][]anomalyPoint{},
+		latencies: map[string]*histogram{},
+	}
+}
+
+// observe keeps the sample if it timed out or took more than half the
+// factor of its endpoint's median so far, so that only the requests that
+// could turn out slow against the median over the whole run are kept.
+func (d *AnomalyDetector) observe(s *Sample) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.latencies[s.Endpoint]
+	if !ok {
+		h = &histogram{}
+		d.latencies[s.Endpoint] = h
+	}
+	median := h.percentile(50)
+	h.observe(s.LatencyMilliseconds)
+	timeout := s.ErrorClass == ErrorTimeout || s.StatusCode == http.StatusGatewayTimeout
+	if !timeout && float64(s.LatencyMilliseconds) <= float64(median)*d.factor/2 {
+		return
+	}
+	d.points[s.Endpoint] = append(d.points[s.Endpoint], anomalyPoint{
+		start:   s.Time,
+		latency: time.Duration(s.LatencyMilliseconds) * time.Millisecond,
+		timeout: timeout,
+	})
+}
+
+// Detect returns the anomalies of the run, ordered by when they started,
+// measuring slowness against the endpoints' medians in stats.
+func (d *AnomalyDetector) Detect(stats *Stats) []*Anomaly {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []*Anomaly
+	for name, points := range d.points {
+		var median int64
+		if e, ok := stats.Endpoints[name]; ok {
+			median = e.P50LatencyMilliseconds
+		}
+		if median < 1 {
+			median = 1
+		}
+		limit := time.Duration(float64(median)*d.factor) * time.Millisecond
+		sort.Slice(points, func(i, j int) bool { return points[i].start.Before(points[j].start) })
+		out = append(out, clusters(AnomalyTimeouts, name, median, points, func(p anomalyPoint) bool { return p.timeout })...)
+		out = append(out, clusters(AnomalySlow, name, median, points, func(p anomalyPoint) bool { return !p.timeout && p.latency > limit })...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+// clusters groups the sorted points matching anomalous into anomalies.
+func clusters(kind, endpoint string, median int64, points []anomalyPoint, anomalous func(anomalyPoint) bool) []*Anomaly {
+	var out []*Anomaly
+	var cur *Anomaly
+	flush := func() {
+		if cur != nil && cur.Requests >= anomalyMinRequests {
+			out = append(out, cur)
+		}
+		cur = nil
+	}
+	for _, p := range points {
+		if !anomalous(p) {
+			continue
+		}
+		if cur != nil && p.start.Sub(cur.End) > anomalyGap {
+			flush()
+		}
+		if cur == nil {
+			cur = &Anomaly{
+				Kind:                      kind,
+				Endpoint:                  endpoint,
+				Start:                     p.start,
+				MedianLatencyMilliseconds: median,
+			}
+		}
+		cur.Requests++
+		if end := p.start.Add(p.latency); end.After(cur.End) {
+			cur.End = end
+		}
+		if ms := p.latency.Milliseconds(); ms > cur.MaxLatencyMilliseconds {
+			cur.MaxLatencyMilliseconds = ms
+		}
+	}
+	flush()
+	return out
+}
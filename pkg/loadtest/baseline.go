@@ -0,0 +1,292 @@
+package loadtest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/crozzy/clair-load-test/pkg/results"
+)
+
+// baselineMaxLatencies is the most latencies kept per endpoint, in a
+// baseline and from a run compared with it. That's plenty for the test to
+// find small shifts while keeping baselines small.
+const baselineMaxLatencies = 5000
+
+// baselineMinLatencies is the fewest latencies on each side for an endpoint
+// to be tested for significance, the normal approximation is poor below it.
+const baselineMinLatencies = 20
+
+// Verdicts for an endpoint compared with a baseline.
+const (
+	VerdictUnchanged = "unchanged"
+	VerdictRegressed = "regressed"
+	VerdictImproved  = "improved"
+	// VerdictMissing is for endpoints in the baseline the run made no
+	// requests to.
+	VerdictMissing = "missing"
+)
+
+// Baseline is a reference run's latencies, for later runs to be compared
+// with.
+type Baseline struct {
+	// SchemaVersion is the version of the stats the baseline was made
+	// from.
+	SchemaVersion int                          `json:"schema_version"`
+	RunID         string                       `json:"run_id,omitempty"`
+	Created       time.Time                    `json:"created"`
+	Endpoints     map[string]*BaselineEndpoint `json:"endpoints"`
+	// Database is how up to date the vulnerability database was for the
+	// reference run.
+	Database *results.DatabaseFreshness `json:"database,omitempty"`
+}
+
+// BaselineEndpoint is an endpoint's latencies in a baseline.
+type BaselineEndpoint struct {
+	Requests               int64 `json:"requests"`
+	P50LatencyMilliseconds int64 `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64 `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds int64 `json:"p99_latency_milliseconds"`
+	// Latencies are those of successful requests, evenly spread over the
+	// run, if the run's samples were kept.
+	Latencies []int64 `json:"latencies,omitempty"`
+}
+
+// NewBaseline returns a baseline of the run with stats, read from its output,
+// taking latencies for the significance test from samples, which may be nil.
+func NewBaseline(runID string, stats *results.Stats, samples []*results.Sample) *Baseline {
+	b := &Baseline{
+		SchemaVersion: SchemaVersion,
+		RunID:         runID,
+		Created:       time.Now().UTC(),
+		Endpoints:     map[string]*BaselineEndpoint{},
+		Database:      stats.Database,
+	}
+	latencies := baselineLatencies(samples)
+	for name, e := range stats.Endpoints {
+		if e.TotalRequests == 0 {
+			continue
+		}
+		b.Endpoints[name] = &BaselineEndpoint{
+			Requests:               e.TotalRequests,
+			P50LatencyMilliseconds: e.P50LatencyMilliseconds,
+			P95LatencyMilliseconds: e.P95LatencyMilliseconds,
+			P99LatencyMilliseconds: e.P99LatencyMilliseconds,
+			Latencies:              latencies[name],
+		}
+	}
+	return b
+}
+
+// baselineLatencies returns the latencies of the successful samples by
+// endpoint, thinned to baselineMaxLatencies.
+func baselineLatencies(samples []*results.Sample) map[string][]int64 {
+	out := map[string][]int64{}
+	for _, s := range samples {
+		if s.Failed() {
+			continue
+		}
+		out[s.Endpoint] = append(out[s.Endpoint], s.LatencyMilliseconds)
+	}
+	for name, ls := range out {
+		if len(ls) <= baselineMaxLatencies {
+			continue
+		}
+		thin := make([]int64, baselineMaxLatencies)
+		for i := range thin {
+			thin[i] = ls[i*len(ls)/baselineMaxLatencies]
+		}
+		out[name] = thin
+	}
+	return out
+}
+
+// BaselineComparison is a run compared with a baseline, endpoint by
+// endpoint.
+type BaselineComparison struct {
+	BaselineRunID string `json:"baseline_run_id,omitempty"`
+	RunID         string `json:"run_id,omitempty"`
+	// Verdict is "fail" if any endpoint regressed, otherwise "pass".
+	Verdict   string                         `json:"verdict"`
+	Alpha     float64                        `json:"alpha"`
+	Threshold float64                        `json:"threshold_percent"`
+	Endpoints map[string]*EndpointComparison `json:"endpoints"`
+	// DatabaseChanges are the updaters that updated the vulnerability
+	// database between the baseline and the run, if both recorded it. The
+	// runs matched against different data, so may not be comparable.
+	DatabaseChanges []string `json:"database_changes,omitempty"`
+}
+
+// EndpointComparison is an endpoint's latencies in a run compared with a
+// baseline. With enough latencies on both sides they're compared with a
+// one-sided Mann-Whitney U test, and only a significant shift of the p50 or
+// p95 by more than the threshold counts. Otherwise a shift of the p50 or p95
+// by more than the threshold is enough.
+type EndpointComparison struct {
+	Verdict                        string  `json:"verdict"`
+	BaselineP50LatencyMilliseconds int64   `json:"baseline_p50_latency_milliseconds"`
+	BaselineP95LatencyMilliseconds int64   `json:"baseline_p95_latency_milliseconds"`
+	BaselineP99LatencyMilliseconds int64   `json:"baseline_p99_latency_milliseconds"`
+	P50LatencyMilliseconds         int64   `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds         int64   `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds         int64   `json:"p99_latency_milliseconds"`
+	P50ChangePercent               float64 `json:"p50_change_percent"`
+	P95ChangePercent               float64 `json:"p95_change_percent"`
+	P99ChangePercent               float64 `json:"p99_change_percent"`
+	// Tested is set if the latencies were tested for significance, then
+	// PValue is that of the test in the direction of the change and
+	// PSlower the chance a request in the run was slower than one in the
+	// baseline, ties counting as half.
+	Tested            bool    `json:"tested"`
+	BaselineLatencies int     `json:"baseline_latencies,omitempty"`
+	Latencies         int     `json:"latencies,omitempty"`
+	PValue            float64 `json:"p_value,omitempty"`
+	PSlower           float64 `json:"p_slower,omitempty"`
+}
+
+// Compare compares the run with stats and samples, which may be nil, with
+// the baseline. Endpoints are judged to have regressed or improved when
+// their latencies shifted with a one-sided p-value below alpha and their
+// p50 or p95 moved by more than threshold percent.
+func (b *Baseline) Compare(runID string, stats *results.Stats, samples []*results.Sample, alpha, threshold float64) *BaselineComparison {
+	cmp := &BaselineComparison{
+		BaselineRunID: b.RunID,
+		RunID:         runID,
+		Verdict:       "pass",
+		Alpha:         alpha,
+		Threshold:     threshold,
+		Endpoints:     map[string]*EndpointComparison{},
+	}
+	if b.Database != nil && stats.Database != nil {
+		cmp.DatabaseChanges = updatersChanged(b.Database.Updaters, stats.Database.Updaters)
+	}
+	latencies := baselineLatencies(samples)
+	for name, base := range b.Endpoints {
+		ec := &EndpointComparison{
+			Verdict:                        VerdictMissing,
+			BaselineP50LatencyMilliseconds: base.P50LatencyMilliseconds,
+			BaselineP95LatencyMilliseconds: base.P95LatencyMilliseconds,
+			BaselineP99LatencyMilliseconds: base.P99LatencyMilliseconds,
+		}
+		cmp.Endpoints[name] = ec
+		e, ok := stats.Endpoints[name]
+		if !ok || e.TotalRequests == 0 {
+			continue
+		}
+		ec.P50LatencyMilliseconds = e.P50LatencyMilliseconds
+		ec.P95LatencyMilliseconds = e.P95LatencyMilliseconds
+		ec.P99LatencyMilliseconds = e.P99LatencyMilliseconds
+		ec.P50ChangePercent = changePercent(base.P50LatencyMilliseconds, e.P50LatencyMilliseconds)
+		ec.P95ChangePercent = changePercent(base.P95LatencyMilliseconds, e.P95LatencyMilliseconds)
+		ec.P99ChangePercent = changePercent(base.P99LatencyMilliseconds, e.P99LatencyMilliseconds)
+		worse := ec.P50ChangePercent > threshold || ec.P95ChangePercent > threshold
+		better := ec.P50ChangePercent < -threshold || ec.P95ChangePercent < -threshold
+
+		ls := latencies[name]
+		ec.BaselineLatencies, ec.Latencies = len(base.Latencies), len(ls)
+		if len(base.Latencies) >= baselineMinLatencies && len(ls) >= baselineMinLatencies {
+			slower, faster, pSlower := mannWhitney(base.Latencies, ls)
+			ec.Tested = true
+			ec.PSlower = pSlower
+			ec.PValue = slower
+			if faster < slower {
+				ec.PValue = faster
+			}
+			worse = worse && slower < alpha
+			better = better && faster < alpha
+		}
+		switch {
+		case worse:
+			ec.Verdict = VerdictRegressed
+			cmp.Verdict = "fail"
+		case better:
+			ec.Verdict = VerdictImproved
+		default:
+			ec.Verdict = VerdictUnchanged
+		}
+	}
+	return cmp
+}
+
+// Regressions describes the endpoints that regressed.
+func (c *BaselineComparison) Regressions() []string {
+	var v []string
+	for name, ec := range c.Endpoints {
+		if ec.Verdict != VerdictRegressed {
+			continue
+		}
+		s := fmt.Sprintf("%s p50 %dms to %dms (%+.1f%%), p95 %dms to %dms (%+.1f%%)", name,
+			ec.BaselineP50LatencyMilliseconds, ec.P50LatencyMilliseconds, ec.P50ChangePercent,
+			ec.BaselineP95LatencyMilliseconds, ec.P95LatencyMilliseconds, ec.P95ChangePercent)
+		if ec.Tested {
+			s += fmt.Sprintf(", p=%.3g", ec.PValue)
+		}
+		v = append(v, s)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// changePercent is the change from was to is, in percent of was.
+func changePercent(was, is int64) float64 {
+	if was == 0 {
+		if is == 0 {
+			return 0
+		}
+		return 100
+	}
+	return float64(is-was) / float64(was) * 100
+}
+
+// mannWhitney is the Mann-Whitney U test of whether the values in b tend to
+// be larger or smaller than those in a. It returns the one-sided p-value of
+// each, using the normal approximation with corrections for ties and
+// continuity, and the chance a value from b is larger than one from a.
+func mannWhitney(a, b []int64) (larger, smaller, superiority float64) {
+	type value struct {
+		x     int64
+		fromB bool
+	}
+	all := make([]value, 0, len(a)+len(b))
+	for _, x := range a {
+		all = append(all, value{x: x})
+	}
+	for _, x := range b {
+		all = append(all, value{x: x, fromB: true})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].x < all[j].x })
+
+	// Tied values share the average of their ranks.
+	var rankB, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].x == all[i].x {
+			j++
+		}
+		rank := float64(i+1+j) / 2
+		t := float64(j - i)
+		ties += t*t*t - t
+		for k := i; k < j; k++ {
+			if all[k].fromB {
+				rankB += rank
+			}
+		}
+		i = j
+	}
+	n1, n2 := float64(len(a)), float64(len(b))
+	n := n1 + n2
+	u := rankB - n2*(n2+1)/2
+	superiority = u / (n1 * n2)
+	mean := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return 1, 1, superiority
+	}
+	return normalTail((u - mean - 0.5) / sigma), normalTail((mean - u - 0.5) / sigma), superiority
+}
+
+// normalTail is the chance a standard normal variable is above z.
+func normalTail(z float64) float64 {
+	return math.Erfc(z/math.Sqrt2) / 2
+}
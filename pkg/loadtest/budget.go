@@ -0,0 +1,160 @@
+package loadtest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Parts of a step's time that are measured while it runs.
+const (
+	stepClair = iota
+	stepRegistry
+	stepThrottled
+	stepParts
+)
+
+// stepTiming is the time a step has spent on each of its measured parts, in
+// nanoseconds.
+type stepTiming [stepParts]int64
+
+type stepTimingKey struct{}
+
+// addStepTime counts d towards part of the step running with ctx, if any.
+func addStepTime(ctx context.Context, part int, d time.Duration) {
+	if t, ok := ctx.Value(stepTimingKey{}).(*stepTiming); ok {
+		atomic.AddInt64(&t[part], int64(d))
+	}
+}
+
+// LatencyBudget is where the time of a run's steps went, from each being due
+// to it returning, so a slow run can be put down to the load generator
+// falling behind or to Clair.
+type LatencyBudget struct {
+	Steps int64 `json:"steps"`
+	// Total is from a step being due to it returning.
+	Total *BudgetPart `json:"total"`
+	// Queued is from a step being due to a worker starting it, time lost
+	// to every worker being busy.
+	Queued *BudgetPart `json:"queued"`
+	// Clair is waiting on responses from Clair, and Registry on those from
+	// registries, up to their headers as for endpoint latencies.
+	Clair    *BudgetPart `json:"clair"`
+	Registry *BudgetPart `json:"registry"`
+	// Throttled is waiting for a registry's rate limit.
+	Throttled *BudgetPart `json:"throttled"`
+	// Other is the rest, such as delays between requests, waits between
+	// polls, and building requests and reading responses.
+	Other *BudgetPart `json:"other"`
+}
+
+// BudgetPart is the time steps spent on one part of their work.
+type BudgetPart struct {
+	TotalMilliseconds int64 `json:"total_milliseconds"`
+	// Percent is the share of the steps' total time.
+	Percent                float64 `json:"percent"`
+	P50LatencyMilliseconds int64   `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64   `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds int64   `json:"p99_latency_milliseconds"`
+	MaxLatencyMilliseconds int64   `json:"max_latency_milliseconds"`
+}
+
+// Indexes of BudgetTracker's histograms.
+const (
+	budgetTotal = iota
+	budgetQueued
+	budgetClair
+	budgetRegistry
+	budgetThrottled
+	budgetOther
+	budgetParts
+)
+
+// BudgetTracker splits the time of a Runner's steps into its LatencyBudget.
+// Requests made concurrently within a step each count in full, so with
+// duplicate bursts the parts can add up to more than the step took, and
+// Other is then 0. A nil BudgetTracker does nothing.
+type BudgetTracker struct {
+	mu    sync.Mutex
+	steps int64
+	// sums are kept apart from the histograms, which are in whole
+	// milliseconds, so parts shorter than that still add up.
+	sums  [budgetParts]time.Duration
+	parts [budgetParts]histogram
+}
+
+func NewBudgetTracker() *BudgetTracker {
+	return &BudgetTracker{}
+}
+
+// start returns the context to run a step with, measuring its parts.
+func (b *BudgetTracker) start(ctx context.Context) (context.Context, *stepTiming) {
+	if b == nil {
+		return ctx, nil
+	}
+	t := &stepTiming{}
+	return context.WithValue(ctx, stepTimingKey{}, t), t
+}
+
+// observe counts a step that was due at due, started at start and has just
+// returned.
+func (b *BudgetTracker) observe(due, start time.Time, t *stepTiming) {
+	if b == nil {
+		return
+	}
+	end := time.Now()
+	var d [budgetParts]time.Duration
+	d[budgetTotal] = end.Sub(due)
+	d[budgetQueued] = start.Sub(due)
+	d[budgetClair] = time.Duration(atomic.LoadInt64(&t[stepClair]))
+	d[budgetRegistry] = time.Duration(atomic.LoadInt64(&t[stepRegistry]))
+	d[budgetThrottled] = time.Duration(atomic.LoadInt64(&t[stepThrottled]))
+	if other := end.Sub(start) - d[budgetClair] - d[budgetRegistry] - d[budgetThrottled]; other > 0 {
+		d[budgetOther] = other
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.steps++
+	for i, v := range d {
+		b.sums[i] += v
+		b.parts[i].observe(v.Milliseconds())
+	}
+}
+
+// Budget returns the budget of the steps so far, or nil if none have
+// returned.
+func (b *BudgetTracker) Budget() *LatencyBudget {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.steps == 0 {
+		return nil
+	}
+	total := b.sums[budgetTotal]
+	part := func(i int) *BudgetPart {
+		h := &b.parts[i]
+		p := &BudgetPart{
+			TotalMilliseconds:      b.sums[i].Milliseconds(),
+			P50LatencyMilliseconds: h.percentile(50),
+			P95LatencyMilliseconds: h.percentile(95),
+			P99LatencyMilliseconds: h.percentile(99),
+			MaxLatencyMilliseconds: h.max,
+		}
+		if total > 0 {
+			p.Percent = float64(b.sums[i]) / float64(total) * 100
+		}
+		return p
+	}
+	return &LatencyBudget{
+		Steps:     b.steps,
+		Total:     part(budgetTotal),
+		Queued:    part(budgetQueued),
+		Clair:     part(budgetClair),
+		Registry:  part(budgetRegistry),
+		Throttled: part(budgetThrottled),
+		Other:     part(budgetOther),
+	}
+}
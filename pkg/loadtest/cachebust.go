@@ -0,0 +1,43 @@
+package loadtest
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Ways of keeping caches from answering requests.
+const (
+	// CacheBustQuery adds a query parameter unique to the request, so
+	// every URL is one a cache hasn't seen.
+	CacheBustQuery = "query"
+	// CacheBustHeader asks caches to revalidate with Cache-Control:
+	// no-cache, which well behaved caches honour.
+	CacheBustHeader = "header"
+)
+
+// cacheBustParam is the query parameter added by CacheBustQuery. Clair
+// ignores query parameters it doesn't know.
+const cacheBustParam = "clair_load_test_nocache"
+
+// ValidCacheBust reports an error if mode isn't empty or one of the cache
+// busting modes.
+func ValidCacheBust(mode string) error {
+	switch mode {
+	case "", CacheBustQuery, CacheBustHeader:
+		return nil
+	}
+	return fmt.Errorf("unknown cache bust mode %q, expected %s or %s", mode, CacheBustQuery, CacheBustHeader)
+}
+
+// cacheBust applies mode to req, using id to make its URL unique.
+func cacheBust(req *http.Request, mode, id string) {
+	switch mode {
+	case CacheBustQuery:
+		q := req.URL.Query()
+		q.Set(cacheBustParam, id)
+		req.URL.RawQuery = q.Encode()
+	case CacheBustHeader:
+		req.Header.Set("Cache-Control", "no-cache")
+		req.Header.Set("Pragma", "no-cache")
+	}
+}
@@ -0,0 +1,68 @@
+package loadtest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// drainMax is the most of a body drainClose reads. Past that it's cheaper to
+// give up the connection than to read the rest.
+const drainMax = 256 << 10
+
+// drainClose reads what's left of body, up to drainMax, before closing it.
+// A body closed unread keeps its connection from being reused, so every
+// request after it pays for a new one.
+func drainClose(body io.ReadCloser) error {
+	io.CopyN(io.Discard, body, drainMax)
+	return body.Close()
+}
+
+// Connection states seen by connTrace.
+const (
+	connUnknown int32 = iota
+	connNew
+	connReused
+)
+
+// connTrace records whether a request was sent on a new connection or one
+// kept alive from an earlier request.
+type connTrace struct {
+	state int32
+}
+
+// traceConn returns req traced by a new connTrace.
+func traceConn(req *http.Request) (*http.Request, *connTrace) {
+	t := &connTrace{}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			state := connNew
+			if info.Reused {
+				state = connReused
+			}
+			atomic.StoreInt32(&t.state, state)
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// observe counts the connection the request got, if it got one.
+func (t *connTrace) observe(es *EndpointStats, s *Sample) {
+	switch atomic.LoadInt32(&t.state) {
+	case connNew:
+		atomic.AddInt64(&es.NewConnections, 1)
+		s.NewConnection = true
+	case connReused:
+		atomic.AddInt64(&es.ReusedConnections, 1)
+	}
+}
+
+// reuseRatio is the share of connections that were reused, or 0 if there
+// were none.
+func reuseRatio(created, reused int64) float64 {
+	if created+reused == 0 {
+		return 0
+	}
+	return float64(reused) / float64(created+reused)
+}
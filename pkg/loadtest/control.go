@@ -0,0 +1,219 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Control is the rate a Runner makes requests at, and whether it's paused.
+// Both can be changed while it's running. Once stopped, the Runner makes no
+// more requests, as if it had reached its timeout.
+type Control struct {
+	mu      sync.Mutex
+	rate    float64
+	paused  bool
+	stopped bool
+	// changed is closed, and replaced, on every change.
+	changed chan struct{}
+}
+
+// NewControl returns a Control making rate requests a second.
+func NewControl(rate float64) *Control {
+	return &Control{rate: rate, changed: make(chan struct{})}
+}
+
+// State returns the current rate, whether load is paused, and a channel
+// closed on the next change.
+func (l *Control) State() (rate float64, paused bool, changed <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, l.paused, l.changed
+}
+
+func (l *Control) update(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fn()
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *Control) Pause()  { l.update(func() { l.paused = true }) }
+func (l *Control) Resume() { l.update(func() { l.paused = false }) }
+
+func (l *Control) SetRate(rate float64) { l.update(func() { l.rate = rate }) }
+
+func (l *Control) Stop() { l.update(func() { l.stopped = true }) }
+
+func (l *Control) Stopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped
+}
+
+// ControlStatus is what the control API reports: the state of the load and
+// a summary of the stats so far.
+type ControlStatus struct {
+	Phase          string                            `json:"phase,omitempty"`
+	Paused         bool                              `json:"paused"`
+	Rate           float64                           `json:"rate"`
+	ElapsedSeconds float64                           `json:"elapsed_seconds"`
+	ErrorRate      float64                           `json:"error_rate"`
+	Endpoints      map[string]*ControlEndpointStatus `json:"endpoints"`
+}
+
+type ControlEndpointStatus struct {
+	TotalRequests          int64 `json:"total_requests"`
+	Non2XXResponses        int64 `json:"non_2XX_responses"`
+	RequestErrors          int64 `json:"request_errors"`
+	FailedResponses        int64 `json:"failed_responses"`
+	P50LatencyMilliseconds int64 `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64 `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds int64 `json:"p99_latency_milliseconds"`
+}
+
+// ControlServer serves the control API, for adjusting a run's load while
+// it's running:
+//
+//	POST /pause             stop making requests
+//	POST /resume            start making requests again
+//	POST /set-rate?rate=N   make N requests a second
+//	POST /phase?name=NAME   begin a new phase, reported separately
+//	GET  /stats             the current state and stats
+//
+// Every route responds with the status.
+type ControlServer struct {
+	ctl    *Control
+	stats  *Stats
+	phases *PhaseTracker
+	srv    *http.Server
+}
+
+// StartControlServer listens on addr and serves the control API until Close
+// is called. An empty addr returns a nil ControlServer, which does nothing.
+func StartControlServer(ctx context.Context, addr string, ctl *Control, stats *Stats, phases *PhaseTracker) (*ControlServer, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", addr, err)
+	}
+	s := &ControlServer{ctl: ctl, stats: stats, phases: phases}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pause", s.post(func(r *http.Request) error {
+		zlog.Info(ctx).Msg("pausing load")
+		s.ctl.Pause()
+		return nil
+	}))
+	mux.HandleFunc("/resume", s.post(func(r *http.Request) error {
+		zlog.Info(ctx).Msg("resuming load")
+		s.ctl.Resume()
+		return nil
+	}))
+	mux.HandleFunc("/set-rate", s.post(func(r *http.Request) error {
+		rate, err := strconv.ParseFloat(r.URL.Query().Get("rate"), 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("rate must be a number more than 0")
+		}
+		zlog.Info(ctx).Float64("rate", rate).Msg("setting rate")
+		s.ctl.SetRate(rate)
+		return nil
+	}))
+	mux.HandleFunc("/phase", s.post(func(r *http.Request) error {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			return fmt.Errorf("name is needed")
+		}
+		zlog.Info(ctx).Str("phase", name).Msg("beginning phase")
+		s.phases.Begin(name)
+		return nil
+	}))
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeStatus(w)
+	})
+	s.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := s.srv.Serve(l); err != http.ErrServerClosed {
+			zlog.Error(ctx).Err(err).Msg("control api stopped")
+		}
+	}()
+	zlog.Info(ctx).Str("addr", l.Addr().String()).Msg("serving control api")
+	return s, nil
+}
+
+// post wraps a handler for a route changing the load. Errors are the
+// client's fault.
+func (s *ControlServer) post(fn func(*http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := fn(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeStatus(w)
+	}
+}
+
+func (s *ControlServer) writeStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(NewControlStatus(s.ctl, s.stats, s.phases))
+}
+
+// NewControlStatus summarizes the load and the stats so far. The stats are
+// still being written to, so only what's safe to read concurrently is
+// reported.
+func NewControlStatus(ctl *Control, stats *Stats, phases *PhaseTracker) *ControlStatus {
+	rate, paused, _ := ctl.State()
+	st := &ControlStatus{
+		Phase:     phases.Current(),
+		Paused:    paused,
+		Rate:      rate,
+		ErrorRate: stats.CurrentErrorRate(),
+		Endpoints: map[string]*ControlEndpointStatus{},
+	}
+	stats.mu.RLock()
+	st.ElapsedSeconds = time.Since(stats.start).Seconds()
+	endpoints := make(map[string]*EndpointStats, len(stats.Endpoints))
+	for name, e := range stats.Endpoints {
+		endpoints[name] = e
+	}
+	stats.mu.RUnlock()
+	for name, e := range endpoints {
+		st.Endpoints[name] = &ControlEndpointStatus{
+			TotalRequests:          atomic.LoadInt64(&e.TotalRequests),
+			Non2XXResponses:        atomic.LoadInt64(&e.Non2XXResponses),
+			RequestErrors:          atomic.LoadInt64(&e.RequestErrors),
+			FailedResponses:        atomic.LoadInt64(&e.FailedResponses),
+			P50LatencyMilliseconds: e.Percentile(50),
+			P95LatencyMilliseconds: e.Percentile(95),
+			P99LatencyMilliseconds: e.Percentile(99),
+		}
+	}
+	return st
+}
+
+func (s *ControlServer) Close() {
+	if s == nil {
+		return
+	}
+	s.srv.Close()
+}
@@ -0,0 +1,107 @@
+package loadtest
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// statShards is how many ways latencies are split, so requests finishing at
+// once rarely wait on each other to record theirs.
+const statShards = 16
+
+// counters counts occurrences of keys, such as status codes, without a lock
+// once a key's been seen.
+type counters struct {
+	m sync.Map
+}
+
+func (c *counters) add(key interface{}, by int64) {
+	v, ok := c.m.Load(key)
+	if !ok {
+		v, _ = c.m.LoadOrStore(key, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), by)
+}
+
+func (c *counters) each(f func(key interface{}, n int64)) {
+	c.m.Range(func(k, v interface{}) bool {
+		f(k, atomic.LoadInt64(v.(*int64)))
+		return true
+	})
+}
+
+// latencyShard is one of an endpoint's latency shards.
+type latencyShard struct {
+	mu        sync.Mutex
+	latencies histogram
+	outcomes  map[string]*histogram
+	// Keep shards on their own cache lines.
+	_ [64]byte
+}
+
+// shardedLatencies records latencies into a shard picked round robin, and
+// merges them when they're read.
+type shardedLatencies struct {
+	next   uint32
+	shards [statShards]latencyShard
+}
+
+func (l *shardedLatencies) shard() *latencyShard {
+	return &l.shards[atomic.AddUint32(&l.next, 1)%statShards]
+}
+
+func (l *shardedLatencies) observe(v int64) {
+	sh := l.shard()
+	sh.mu.Lock()
+	sh.latencies.observe(v)
+	sh.mu.Unlock()
+}
+
+// observeOutcomes records v under each of outcomes.
+func (l *shardedLatencies) observeOutcomes(v int64, outcomes ...string) {
+	sh := l.shard()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.outcomes == nil {
+		sh.outcomes = map[string]*histogram{}
+	}
+	for _, o := range outcomes {
+		h, ok := sh.outcomes[o]
+		if !ok {
+			h = &histogram{}
+			sh.outcomes[o] = h
+		}
+		h.observe(v)
+	}
+}
+
+// merged returns every shard's latencies together.
+func (l *shardedLatencies) merged() *histogram {
+	out := &histogram{}
+	for i := range l.shards {
+		sh := &l.shards[i]
+		sh.mu.Lock()
+		out.merge(&sh.latencies)
+		sh.mu.Unlock()
+	}
+	return out
+}
+
+// mergedOutcomes returns every shard's latencies by outcome together.
+func (l *shardedLatencies) mergedOutcomes() map[string]*histogram {
+	out := map[string]*histogram{}
+	for i := range l.shards {
+		sh := &l.shards[i]
+		sh.mu.Lock()
+		for o, h := range sh.outcomes {
+			m, ok := out[o]
+			if !ok {
+				m = &histogram{}
+				out[o] = m
+			}
+			m.merge(h)
+		}
+		sh.mu.Unlock()
+	}
+	return out
+}
@@ -0,0 +1,19 @@
+// Package loadtest generates load against Clair, and measures how it copes.
+// It's the core of the clair-load-test command, for embedding load tests in
+// other programs.
+//
+// A Reporter makes the requests: it gets manifests from their registries
+// itself, or from the ManifestSource it's set to, indexes them, fetches their
+// vulnerability reports and deletes them, recording each request in its Stats
+// and passing a Sample of it to its Sink.
+// A Runner runs a Workload, such as a ReportWorkload indexing and matching
+// containers, calling its Step at the rate set by a Control, which can be
+// paused or have its rate changed while running. A Scenario describes phases
+// of a run and the SLOs it must meet.
+//
+//	r := loadtest.NewReporter("http://localhost:6060", psk)
+//	ctl := loadtest.NewControl(5)
+//	w := &loadtest.ReportWorkload{Reporter: r, Containers: containers, Delete: true}
+//	err := loadtest.NewRunner(ctl, time.Minute).RunWorkload(ctx, w)
+//	stats := r.Stats.GetStats()
+package loadtest
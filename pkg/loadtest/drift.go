@@ -0,0 +1,161 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Drift isn't analyzed with fewer points than this, a line through two
+// points says nothing about a trend.
+const driftMinPoints = 3
+
+// DriftPoint is the p95 latency of the requests made during one interval.
+type DriftPoint struct {
+	ElapsedSeconds         float64 `json:"elapsed_seconds"`
+	Requests               int     `json:"requests"`
+	P95LatencyMilliseconds int64   `json:"p95_latency_milliseconds"`
+}
+
+// EndpointDrift is the trend of an endpoint's p95 latency over a run, fitted
+// with a least squares line. Drifting is set when the fitted p95 grew by more
+// than the threshold over the run, the slow degradation typical of a leak.
+type EndpointDrift struct {
+	Points          []DriftPoint `json:"points"`
+	SlopeMsPerHour  float64      `json:"slope_ms_per_hour"`
+	FittedStartP95  float64      `json:"fitted_start_p95"`
+	FittedEndP95    float64      `json:"fitted_end_p95"`
+	IncreasePercent float64      `json:"increase_percent"`
+	Drifting        bool         `json:"drifting"`
+}
+
+// DriftTracker records per interval p95 latencies for every endpoint. A nil
+// DriftTracker does nothing.
+type DriftTracker struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	seen   map[string]*histogram
+	points map[string][]DriftPoint
+}
+
+func NewDriftTracker(interval time.Duration) *DriftTracker {
+	if interval <= 0 {
+		return nil
+	}
+	return &DriftTracker{
+		interval: interval,
+		start:    time.Now(),
+		seen:     map[string]*histogram{},
+		points:   map[string][]DriftPoint{},
+	}
+}
+
+// Watch records a point per endpoint every interval until ctx is done.
+func (d *DriftTracker) Watch(ctx context.Context, stats *Stats) {
+	if d == nil {
+		return
+	}
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			d.sample(stats)
+		}
+	}
+}
+
+func (d *DriftTracker) sample(stats *Stats) {
+	stats.mu.RLock()
+	endpoints := make(map[string]*EndpointStats, len(stats.Endpoints))
+	for name, e := range stats.Endpoints {
+		endpoints[name] = e
+	}
+	stats.mu.RUnlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elapsed := time.Since(d.start).Seconds()
+	for name, e := range endpoints {
+		all := e.snapshot()
+		latencies := all.since(d.seen[name])
+		d.seen[name] = all
+		if latencies.n == 0 {
+			continue
+		}
+		d.points[name] = append(d.points[name], DriftPoint{
+			ElapsedSeconds:         elapsed,
+			Requests:               int(latencies.n),
+			P95LatencyMilliseconds: latencies.percentile(95),
+		})
+	}
+}
+
+// Analyze fits a line to each endpoint's points, flagging those whose p95
+// grew by more than threshold percent. Endpoints with too few points are
+// left out.
+func (d *DriftTracker) Analyze(threshold float64) map[string]*EndpointDrift {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := map[string]*EndpointDrift{}
+	for name, points := range d.points {
+		if len(points) < driftMinPoints {
+			continue
+		}
+		slope, intercept := linearFit(points)
+		first, last := points[0].ElapsedSeconds, points[len(points)-1].ElapsedSeconds
+		ed := &EndpointDrift{
+			Points:         points,
+			SlopeMsPerHour: slope * 3600,
+			FittedStartP95: intercept + slope*first,
+			FittedEndP95:   intercept + slope*last,
+		}
+		if ed.FittedStartP95 > 0 {
+			ed.IncreasePercent = (ed.FittedEndP95 - ed.FittedStartP95) / ed.FittedStartP95 * 100
+		}
+		ed.Drifting = threshold > 0 && ed.IncreasePercent > threshold
+		out[name] = ed
+	}
+	return out
+}
+
+// linearFit returns the least squares line through the points' p95
+// latencies over time.
+func linearFit(points []DriftPoint) (slope, intercept float64) {
+	n := float64(len(points))
+	var sx, sy, sxx, sxy float64
+	for _, p := range points {
+		x, y := p.ElapsedSeconds, float64(p.P95LatencyMilliseconds)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return 0, sy / n
+	}
+	slope = (n*sxy - sx*sy) / den
+	return slope, (sy - slope*sx) / n
+}
+
+// DriftViolations describes the drifting endpoints.
+func DriftViolations(drift map[string]*EndpointDrift) []string {
+	var v []string
+	for name, ed := range drift {
+		if ed.Drifting {
+			v = append(v, fmt.Sprintf("%s p95 drifted %.0fms to %.0fms (+%.1f%%)", name, ed.FittedStartP95, ed.FittedEndP95, ed.IncreasePercent))
+		}
+	}
+	sort.Strings(v)
+	return v
+}
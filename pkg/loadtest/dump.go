@@ -0,0 +1,54 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/quay/zlog"
+)
+
+// dumpLimit is the most of each body dumped.
+const dumpLimit = 16 << 10
+
+// dumpRequest logs req and resp, if there was a response, with their bodies
+// cut at dumpLimit. The response body is replaced, so it can still be read.
+func dumpRequest(ctx context.Context, name string, req *http.Request, resp *http.Response) {
+	var b strings.Builder
+	if d, err := httputil.DumpRequest(req, false); err == nil {
+		b.Write(d)
+	}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			writeDumpBody(&b, body)
+			body.Close()
+		}
+	}
+	if resp != nil {
+		b.WriteString("\n\n")
+		if d, err := httputil.DumpResponse(resp, false); err == nil {
+			b.Write(d)
+		}
+		head, _ := io.ReadAll(io.LimitReader(resp.Body, dumpLimit+1))
+		writeDumpBody(&b, bytes.NewReader(head))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	}
+	zlog.Debug(ctx).Str("endpoint", name).Msg("failed request\n" + b.String())
+}
+
+// writeDumpBody writes up to dumpLimit of r to w, noting if there was more.
+func writeDumpBody(w io.Writer, r io.Reader) {
+	body, _ := io.ReadAll(io.LimitReader(r, dumpLimit+1))
+	if len(body) > dumpLimit {
+		w.Write(body[:dumpLimit])
+		io.WriteString(w, "\n... (truncated)")
+		return
+	}
+	w.Write(body)
+}
@@ -0,0 +1,107 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterSink(SinkElastic, func(ctx context.Context, target string) (Sink, error) {
+		if target == "" {
+			target = "http://localhost:9200/clair-load-test"
+		}
+		return NewElasticSink(ctx, target), nil
+	})
+}
+
+// elasticBatch is how many samples are sent in each bulk request.
+const elasticBatch = 500
+
+// ElasticSink indexes samples into an Elasticsearch index, in batches using
+// the bulk API.
+type ElasticSink struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+
+	mu  sync.Mutex
+	buf []*Sample
+}
+
+// NewElasticSink indexes into the index at url, such as
+// http://localhost:9200/clair-load-test.
+func NewElasticSink(ctx context.Context, url string) *ElasticSink {
+	return &ElasticSink{
+		ctx:    ctx,
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{},
+		buf:    make([]*Sample, 0, elasticBatch),
+	}
+}
+
+// ConsumeSample buffers the sample, sending the buffer once it's full.
+func (e *ElasticSink) ConsumeSample(s *Sample) error {
+	e.mu.Lock()
+	e.buf = append(e.buf, s)
+	if len(e.buf) < elasticBatch {
+		e.mu.Unlock()
+		return nil
+	}
+	batch := e.buf
+	e.buf = make([]*Sample, 0, elasticBatch)
+	e.mu.Unlock()
+	return e.send(batch)
+}
+
+// Summary sends whatever's still buffered.
+func (e *ElasticSink) Summary(*Stats) error {
+	e.mu.Lock()
+	batch := e.buf
+	e.buf = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	return e.send(batch)
+}
+
+func (e *ElasticSink) send(batch []*Sample) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, s := range batch {
+		body.WriteString(`{"index":{}}` + "\n")
+		if err := enc.Encode(s); err != nil {
+			return fmt.Errorf("could not encode sample: %w", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, e.url+"/_bulk", &body)
+	if err != nil {
+		return fmt.Errorf("could not create bulk request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send %d samples to elasticsearch: %w", len(batch), err)
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("elasticsearch returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var res struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("could not decode bulk response: %w", err)
+	}
+	if res.Errors {
+		return fmt.Errorf("elasticsearch failed to index some of %d samples", len(batch))
+	}
+	return nil
+}
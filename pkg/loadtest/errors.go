@@ -0,0 +1,159 @@
+package loadtest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Classes of transport error, for requests that got no response.
+const (
+	ErrorTimeout           = "timeout"
+	ErrorCanceled          = "canceled"
+	ErrorDNS               = "dns"
+	ErrorConnectionRefused = "connection_refused"
+	ErrorConnectionReset   = "connection_reset"
+	ErrorTLS               = "tls"
+	ErrorOther             = "other"
+)
+
+// classifyError sorts a transport error into one of the error classes.
+func classifyError(err error) string {
+	var (
+		netErr  net.Error
+		dnsErr  *net.DNSError
+		hostErr x509.HostnameError
+		authErr x509.UnknownAuthorityError
+		certErr x509.CertificateInvalidError
+		recErr  tls.RecordHeaderError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorConnectionReset
+	case errors.As(err, &hostErr),
+		errors.As(err, &authErr),
+		errors.As(err, &certErr),
+		errors.As(err, &recErr):
+		return ErrorTLS
+	}
+	return ErrorOther
+}
+
+// ResponseError is a request that got a response with an unexpected status
+// code.
+type ResponseError struct {
+	StatusCode int
+	msg        string
+}
+
+// ResponseErrorf returns a ResponseError for code, described by format.
+func ResponseErrorf(code int, format string, a ...interface{}) error {
+	return &ResponseError{StatusCode: code, msg: fmt.Sprintf(format, a...)}
+}
+
+func (e *ResponseError) Error() string { return e.msg }
+
+// ErrorType sorts the error a step failed with by what went wrong: the status
+// code of an unexpected response, such as "status_500", the class of a
+// transport error, "index_error" for an index report returned in state
+// IndexError, "not_found" for a missing index report, "delete_not_applied"
+// for one still there after being deleted, or "other".
+func ErrorType(err error) string {
+	var (
+		re  *ResponseError
+		ire *IndexReportError
+	)
+	switch {
+	case errors.As(err, &re):
+		return "status_" + strconv.Itoa(re.StatusCode)
+	case errors.As(err, &ire):
+		return "index_error"
+	case errors.Is(err, ErrIndexReportNotFound):
+		return "not_found"
+	case errors.Is(err, ErrDeleteNotApplied):
+		return "delete_not_applied"
+	}
+	return classifyError(err)
+}
+
+// ErrorCount is how many steps doing one operation failed with one type of
+// error.
+type ErrorCount struct {
+	Op    string `json:"op"`
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+	// Example is the first of the errors.
+	Example string `json:"example"`
+}
+
+// ErrorTracker counts the errors steps failed with, by operation and type,
+// so they're in the stats rather than only in the log. A nil ErrorTracker
+// does nothing.
+type ErrorTracker struct {
+	mu     sync.Mutex
+	counts map[[2]string]*ErrorCount
+}
+
+func NewErrorTracker() *ErrorTracker {
+	return &ErrorTracker{counts: map[[2]string]*ErrorCount{}}
+}
+
+// Record counts a step doing op that failed with err.
+func (t *ErrorTracker) Record(op string, err error) {
+	if t == nil {
+		return
+	}
+	typ := ErrorType(err)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.counts[[2]string{op, typ}]
+	if !ok {
+		c = &ErrorCount{Op: op, Type: typ, Example: err.Error()}
+		t.counts[[2]string{op, typ}] = c
+	}
+	c.Count++
+}
+
+// Counts returns the counts, most frequent first.
+func (t *ErrorTracker) Counts() []*ErrorCount {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]*ErrorCount, 0, len(t.counts))
+	for _, c := range t.counts {
+		cc := *c
+		out = append(out, &cc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		if out[i].Op != out[j].Op {
+			return out[i].Op < out[j].Op
+		}
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
@@ -0,0 +1,47 @@
+package loadtest
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ETagCache remembers the validators Clair returned for each resource, so
+// repeated requests for it can be made conditional. A nil ETagCache does
+// nothing.
+type ETagCache struct {
+	mu   sync.Mutex
+	tags map[string]string
+}
+
+func NewETagCache() *ETagCache {
+	return &ETagCache{tags: map[string]string{}}
+}
+
+// apply adds If-None-Match to req if there's a validator for key, reporting
+// whether it did.
+func (c *ETagCache) apply(req *http.Request, key string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	tag, ok := c.tags[key]
+	c.mu.Unlock()
+	if ok {
+		req.Header.Set("If-None-Match", tag)
+	}
+	return ok
+}
+
+// store remembers the ETag in resp, if there is one, for key.
+func (c *ETagCache) store(key string, resp *http.Response) {
+	if c == nil {
+		return
+	}
+	tag := resp.Header.Get("ETag")
+	if tag == "" {
+		return
+	}
+	c.mu.Lock()
+	c.tags[key] = tag
+	c.mu.Unlock()
+}
@@ -0,0 +1,125 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DatabaseFreshness is how up to date the matcher's vulnerability database
+// was for a run, from when each updater last updated it. Runs against
+// databases of different ages match different vulnerabilities, so their
+// results aren't comparable.
+type DatabaseFreshness struct {
+	// Updaters are when each updater last updated the database, as of the
+	// start of the run.
+	Updaters map[string]time.Time `json:"updaters"`
+	// Newest and Oldest are the latest and earliest of those, with how
+	// long before the run started they were.
+	Newest           time.Time `json:"newest"`
+	Oldest           time.Time `json:"oldest"`
+	NewestAgeSeconds float64   `json:"newest_age_seconds"`
+	OldestAgeSeconds float64   `json:"oldest_age_seconds"`
+	// UpdatedDuringRun are the updaters that updated the database while
+	// the run went on, so reports from before and after can differ.
+	UpdatedDuringRun []string `json:"updated_during_run,omitempty"`
+}
+
+// NewDatabaseFreshness returns the freshness of a database last updated by
+// each updater at the time in updaters, for a run starting at start. It
+// returns nil if there are no updaters.
+func NewDatabaseFreshness(updaters map[string]time.Time, start time.Time) *DatabaseFreshness {
+	if len(updaters) == 0 {
+		return nil
+	}
+	f := &DatabaseFreshness{Updaters: updaters}
+	for _, t := range updaters {
+		if f.Newest.IsZero() || t.After(f.Newest) {
+			f.Newest = t
+		}
+		if f.Oldest.IsZero() || t.Before(f.Oldest) {
+			f.Oldest = t
+		}
+	}
+	f.NewestAgeSeconds = start.Sub(f.Newest).Seconds()
+	f.OldestAgeSeconds = start.Sub(f.Oldest).Seconds()
+	return f
+}
+
+// Finish records the updaters that have updated the database since f, from
+// when each last updated it at the end of the run.
+func (f *DatabaseFreshness) Finish(updaters map[string]time.Time) {
+	if f == nil {
+		return
+	}
+	f.UpdatedDuringRun = f.Changes(updaters)
+}
+
+// Changes returns the updaters that last updated the database at a different
+// time in updaters than in f, sorted.
+func (f *DatabaseFreshness) Changes(updaters map[string]time.Time) []string {
+	return updatersChanged(f.Updaters, updaters)
+}
+
+// updatersChanged returns the updaters that last updated the database at a
+// different time in now than in was, sorted.
+func updatersChanged(was, now map[string]time.Time) []string {
+	var changed []string
+	for name, t := range now {
+		if w, ok := was[name]; !ok || !w.Equal(t) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range was {
+		if _, ok := now[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// DatabaseUpdates fetches the matcher's update operations, returning when
+// each updater last updated the vulnerability database. The request isn't
+// counted in the stats, so it can be made around a run without being part
+// of it.
+func (r *Reporter) DatabaseUpdates(ctx context.Context) (map[string]time.Time, error) {
+	req, err := r.newRequest(ctx, http.MethodGet, "/matcher/api/v1/internal/update_operation", nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := CreateToken(r.PSK)
+	if err != nil {
+		return nil, fmt.Errorf("could not create token: %w", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	if _, _, err := r.authorize(req); err != nil {
+		return nil, err
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, ResponseErrorf(resp.StatusCode, "non 200 response from matcher %d", resp.StatusCode)
+	}
+	var ops map[string][]struct {
+		Date time.Time `json:"date"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ops); err != nil {
+		return nil, fmt.Errorf("could not decode update operations: %w", err)
+	}
+	updates := map[string]time.Time{}
+	for name, list := range ops {
+		for _, op := range list {
+			if op.Date.After(updates[name]) {
+				updates[name] = op.Date
+			}
+		}
+	}
+	return updates, nil
+}
@@ -0,0 +1,202 @@
+package loadtest
+
+import (
+	"math"
+	"math/bits"
+)
+
+// histogramBits sets the precision of histograms: latencies under
+// 2<<histogramBits milliseconds are counted exactly, and longer ones in
+// buckets 1/(1<<histogramBits) of their size wide, about 3%.
+const histogramBits = 5
+
+const histogramSub = 1 << histogramBits
+
+// histogram counts latencies in milliseconds, so percentiles can be taken
+// of any number of requests in bounded memory. Only the buckets between the
+// smallest and largest latency seen are kept.
+type histogram struct {
+	counts   []uint32
+	offset   int
+	n        int64
+	sum      int64
+	min, max int64
+}
+
+// histogramIndex returns the bucket v is counted in.
+func histogramIndex(v int64) int {
+	if v < 0 {
+		v = 0
+	}
+	if v < histogramSub {
+		return int(v)
+	}
+	e := bits.Len64(uint64(v)) - 1
+	shift := e - histogramBits
+	return histogramSub + shift*histogramSub + int(v>>shift) - histogramSub
+}
+
+// histogramBounds returns the smallest and largest latency counted in
+// bucket i.
+func histogramBounds(i int) (int64, int64) {
+	if i < histogramSub {
+		return int64(i), int64(i)
+	}
+	shift := uint((i - histogramSub) / histogramSub)
+	sub := int64(i%histogramSub + histogramSub)
+	return sub << shift, (sub+1)<<shift - 1
+}
+
+func (h *histogram) observe(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	i := histogramIndex(v)
+	switch {
+	case len(h.counts) == 0:
+		h.counts = make([]uint32, 1)
+		h.offset = i
+		h.min, h.max = v, v
+	case i < h.offset:
+		grown := make([]uint32, len(h.counts)+h.offset-i)
+		copy(grown[h.offset-i:], h.counts)
+		h.counts, h.offset = grown, i
+	case i >= h.offset+len(h.counts):
+		h.counts = append(h.counts, make([]uint32, i-h.offset-len(h.counts)+1)...)
+	}
+	h.counts[i-h.offset]++
+	h.n++
+	h.sum += v
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// percentile returns the p-th percentile (0-100) by the nearest-rank
+// method, as the largest latency its bucket counts. It returns 0 if
+// nothing's been counted.
+func (h *histogram) percentile(p float64) int64 {
+	if h.n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(h.n)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += int64(c)
+		if seen >= rank {
+			_, hi := histogramBounds(i + h.offset)
+			return h.clamp(hi)
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) clamp(v int64) int64 {
+	if v < h.min {
+		return h.min
+	}
+	if v > h.max {
+		return h.max
+	}
+	return v
+}
+
+// within returns the fraction of latencies at most max, or 1 if nothing's
+// been counted. The bucket max falls in is assumed to be evenly filled.
+func (h *histogram) within(max int64) float64 {
+	if h.n == 0 {
+		return 1
+	}
+	var n float64
+	for i, c := range h.counts {
+		lo, hi := histogramBounds(i + h.offset)
+		switch {
+		case hi <= max:
+			n += float64(c)
+		case lo <= max:
+			n += float64(c) * float64(max-lo+1) / float64(hi-lo+1)
+		}
+	}
+	return n / float64(h.n)
+}
+
+func (h *histogram) clone() *histogram {
+	c := *h
+	c.counts = append([]uint32(nil), h.counts...)
+	return &c
+}
+
+// since returns the latencies counted since prev, an earlier clone of h.
+// Its smallest and largest latencies are those of its buckets.
+func (h *histogram) since(prev *histogram) *histogram {
+	out := h.clone()
+	if prev == nil || prev.n == 0 {
+		return out
+	}
+	for i, c := range prev.counts {
+		out.counts[i+prev.offset-out.offset] -= c
+	}
+	out.n -= prev.n
+	out.sum -= prev.sum
+	first, last := -1, -1
+	for i, c := range out.counts {
+		if c == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+	if first < 0 {
+		return &histogram{}
+	}
+	out.min, _ = histogramBounds(first + out.offset)
+	_, out.max = histogramBounds(last + out.offset)
+	if out.max > h.max {
+		out.max = h.max
+	}
+	out.counts = out.counts[first : last+1]
+	out.offset += first
+	return out
+}
+
+// merge adds the latencies counted by o.
+func (h *histogram) merge(o *histogram) {
+	if o.n == 0 {
+		return
+	}
+	if h.n == 0 {
+		*h = *o.clone()
+		return
+	}
+	lo, hi := h.offset, h.offset+len(h.counts)
+	if o.offset < lo {
+		lo = o.offset
+	}
+	if end := o.offset + len(o.counts); end > hi {
+		hi = end
+	}
+	if lo != h.offset || hi != h.offset+len(h.counts) {
+		grown := make([]uint32, hi-lo)
+		copy(grown[h.offset-lo:], h.counts)
+		h.counts, h.offset = grown, lo
+	}
+	for i, c := range o.counts {
+		h.counts[i+o.offset-h.offset] += c
+	}
+	h.n += o.n
+	h.sum += o.sum
+	if o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
@@ -0,0 +1,105 @@
+package loadtest
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxIndexReportErrors is how many different error messages IndexReportStats
+// count separately. The rest are counted together under "other", as messages
+// naming layers could otherwise grow without bound.
+const maxIndexReportErrors = 20
+
+// IndexReportError is an index report Clair returned in state IndexError, or
+// with an error, rather than a failed request.
+type IndexReportError struct {
+	Hash  string
+	State string
+	Err   string
+}
+
+func (e *IndexReportError) Error() string {
+	if e.Err == "" {
+		return fmt.Sprintf("index report %s returned in state %s", e.Hash, e.State)
+	}
+	return fmt.Sprintf("index report %s returned in state %s: %s", e.Hash, e.State, e.Err)
+}
+
+// failed reports whether Clair couldn't index the manifest irr is the report
+// of.
+func (irr *IndexReportReponse) failed() bool {
+	return irr.State == IndexError || irr.Err != ""
+}
+
+// IndexReportStats count the index reports Clair returned by state, so a
+// report returned in state IndexError isn't mistaken for a success.
+type IndexReportStats struct {
+	Reports int64            `json:"reports"`
+	States  map[string]int64 `json:"states"`
+	// Succeeded counts the reports returned in state IndexFinished without
+	// an error.
+	Succeeded    int64   `json:"succeeded"`
+	SuccessRatio float64 `json:"success_ratio"`
+	// Errors counts the errors reports were returned with, by message.
+	Errors map[string]int64 `json:"errors,omitempty"`
+}
+
+// indexReportTracker counts the index reports returned during a run, into
+// IndexReportStats when summarizing.
+type indexReportTracker struct {
+	mu        sync.Mutex
+	reports   int64
+	succeeded int64
+	states    map[string]int64
+	errors    map[string]int64
+}
+
+func (t *indexReportTracker) observe(irr *IndexReportReponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.states == nil {
+		t.states = map[string]int64{}
+		t.errors = map[string]int64{}
+	}
+	t.reports++
+	state := irr.State
+	if state == "" {
+		state = "unknown"
+	}
+	t.states[state]++
+	if irr.State == IndexFinished && !irr.failed() {
+		t.succeeded++
+	}
+	if irr.Err != "" {
+		msg := irr.Err
+		if _, ok := t.errors[msg]; !ok && len(t.errors) >= maxIndexReportErrors {
+			msg = "other"
+		}
+		t.errors[msg]++
+	}
+}
+
+// stats returns what's been counted, or nil if no reports were returned.
+func (t *indexReportTracker) stats() *IndexReportStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reports == 0 {
+		return nil
+	}
+	st := &IndexReportStats{
+		Reports:      t.reports,
+		States:       map[string]int64{},
+		Succeeded:    t.succeeded,
+		SuccessRatio: float64(t.succeeded) / float64(t.reports),
+	}
+	for k, n := range t.states {
+		st.States[k] = n
+	}
+	for k, n := range t.errors {
+		if st.Errors == nil {
+			st.Errors = map[string]int64{}
+		}
+		st.Errors[k] = n
+	}
+	return st
+}
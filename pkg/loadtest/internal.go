@@ -0,0 +1,194 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/quay/zlog"
+)
+
+// Vulnerabilities found in vulnerability reports are kept to ask Clair which
+// manifests they affect. At most vulnPoolSize are kept, and each request
+// asks about at most affectedBatch of them.
+const (
+	vulnPoolSize  = 100
+	affectedBatch = 10
+)
+
+// vulnPool keeps the most recently found vulnerabilities, as Clair encoded
+// them.
+type vulnPool struct {
+	mu    sync.Mutex
+	vulns []json.RawMessage
+	next  int
+}
+
+// collect adds the vulnerabilities in the vulnerability report body to the
+// pool, replacing the oldest once it's full.
+func (p *vulnPool) collect(body []byte) error {
+	var report struct {
+		Vulnerabilities map[string]json.RawMessage `json:"vulnerabilities"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range report.Vulnerabilities {
+		if len(p.vulns) < vulnPoolSize {
+			p.vulns = append(p.vulns, v)
+			continue
+		}
+		p.vulns[p.next] = v
+		p.next = (p.next + 1) % vulnPoolSize
+	}
+	return nil
+}
+
+// batch returns up to n of the pooled vulnerabilities.
+func (p *vulnPool) batch(n int) []json.RawMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n > len(p.vulns) {
+		n = len(p.vulns)
+	}
+	out := make([]json.RawMessage, n)
+	copy(out, p.vulns[:n])
+	return out
+}
+
+// internalRequests makes the requests to the indexer's internal endpoints
+// that Quay makes alongside indexing: checking the indexer's state, and
+// asking which manifests the vulnerabilities found so far affect.
+func (r *Reporter) internalRequests(ctx context.Context, token string) error {
+	if _, err := r.IndexState(ctx, token); err != nil {
+		return fmt.Errorf("could not get index state: %w", err)
+	}
+	vulns := r.Vulnerabilities(affectedBatch)
+	if len(vulns) == 0 {
+		return nil
+	}
+	if _, err := r.AffectedManifests(ctx, vulns, token); err != nil {
+		return fmt.Errorf("could not get affected manifests: %w", err)
+	}
+	return nil
+}
+
+// Vulnerabilities returns up to n of the vulnerabilities found in
+// vulnerability reports so far. They're only kept if Internal is set.
+func (r *Reporter) Vulnerabilities(n int) []json.RawMessage {
+	return r.vulns.batch(n)
+}
+
+// IndexState fetches the indexer's state, which changes when its
+// configuration does and manifests need to be indexed again. It's requested
+// conditionally if ETags are kept.
+func (r *Reporter) IndexState(ctx context.Context, token string) (string, error) {
+	req, err := r.newRequest(
+		ctx, http.MethodGet,
+		"/indexer/api/v1/index_state",
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	conditional := r.ETags.apply(req, EndpointIndexState)
+
+	resp, sample, err := r.Do(EndpointIndexState, req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		r.Stats.Endpoint(EndpointIndexState).IncrNotModifiedResponses(int64(1))
+		return "", nil
+	}
+	r.ETags.store(EndpointIndexState, resp)
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(EndpointIndexState).IncrNon2XXResponses(int64(1))
+		return "", ResponseErrorf(resp.StatusCode, "non 200 response from indexer %d", resp.StatusCode)
+	}
+	var state struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		sample.Error = err.Error()
+		return "", err
+	}
+	return state.State, nil
+}
+
+// AffectedManifests asks the indexer which manifests are affected by vulns,
+// as Quay does for vulnerability notifications, returning how many were.
+func (r *Reporter) AffectedManifests(ctx context.Context, vulns []json.RawMessage, token string) (int, error) {
+	body, err := json.Marshal(struct {
+		Vulnerabilities []json.RawMessage `json:"vulnerabilities"`
+	}{vulns})
+	if err != nil {
+		return 0, err
+	}
+	req, err := r.newRequest(
+		ctx, http.MethodPost,
+		"/indexer/api/v1/internal/affected_manifest",
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	zlog.Debug(ctx).Int("count", len(vulns)).Msg("requesting affected manifests")
+	resp, sample, err := r.Do(EndpointAffectedManifests, req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(EndpointAffectedManifests).IncrNon2XXResponses(int64(1))
+		return 0, ResponseErrorf(resp.StatusCode, "non 200 response from indexer %d", resp.StatusCode)
+	}
+	var affected struct {
+		VulnerableManifests map[string][]string `json:"vulnerable_manifests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&affected); err != nil {
+		sample.Error = err.Error()
+		return 0, err
+	}
+	n := 0
+	for _, hashes := range affected.VulnerableManifests {
+		n += len(hashes)
+	}
+	return n, nil
+}
+
+// readVulnerabilityReport reads the vulnerability report body, counting
+// what's in it unless it's filtered, and keeping its vulnerabilities if the
+// internal endpoints are used.
+func (r *Reporter) readVulnerabilityReport(ctx context.Context, body io.Reader, filtered bool) (*VulnerabilityReportSummary, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, body)
+	report := &VulnerabilityReportSummary{Bytes: n}
+	if err != nil {
+		return report, err
+	}
+	if !filtered {
+		if err := report.count(buf.Bytes()); err != nil {
+			zlog.Warn(ctx).Err(err).Msg("could not count vulnerability report")
+		}
+	}
+	if r.Internal {
+		if err := r.vulns.collect(buf.Bytes()); err != nil {
+			zlog.Warn(ctx).Err(err).Msg("could not read vulnerabilities")
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,164 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Where manifests come from, see the Reporter's ManifestSource.
+const (
+	// ManifestSourceAuto picks a source for each container: URLs are
+	// fetched, paths to files read, and images generated natively, falling
+	// back to clairctl for those that can't be if it's installed.
+	ManifestSourceAuto = "auto"
+	// ManifestSourceClairctl runs clairctl manifest.
+	ManifestSourceClairctl = "clairctl"
+	// ManifestSourceNative builds manifests from image registries itself,
+	// as clairctl does.
+	ManifestSourceNative = "native"
+	// ManifestSourceFile reads containers as paths to manifests generated
+	// beforehand.
+	ManifestSourceFile = "file"
+	// ManifestSourceRegistry fetches containers as the URLs of manifests
+	// kept by a manifest registry, such as those serve-layers serves.
+	ManifestSourceRegistry = "registry"
+)
+
+// ParseManifestSource checks s is one of the manifest sources. An empty
+// string is ManifestSourceAuto.
+func ParseManifestSource(s string) (string, error) {
+	switch s {
+	case "":
+		return ManifestSourceAuto, nil
+	case ManifestSourceAuto, ManifestSourceClairctl, ManifestSourceNative, ManifestSourceFile, ManifestSourceRegistry:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown manifest source %q, expected %s, %s, %s, %s or %s", s,
+		ManifestSourceAuto, ManifestSourceClairctl, ManifestSourceNative, ManifestSourceFile, ManifestSourceRegistry)
+}
+
+var (
+	clairctlOnce  sync.Once
+	clairctlFound bool
+)
+
+// ClairctlAvailable reports whether clairctl is on the PATH.
+func ClairctlAvailable() bool {
+	clairctlOnce.Do(func() {
+		_, err := exec.LookPath("clairctl")
+		clairctlFound = err == nil
+	})
+	return clairctlFound
+}
+
+// manifestSources remembers the source picked for each container in auto
+// mode, so an image that can't be generated natively goes straight to
+// clairctl after the first time.
+type manifestSources struct {
+	mu       sync.Mutex
+	fallback map[string]bool
+}
+
+func (m *manifestSources) fellBack(container string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fallback[container]
+}
+
+func (m *manifestSources) fallBack(container string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fallback == nil {
+		m.fallback = map[string]bool{}
+	}
+	m.fallback[container] = true
+}
+
+// manifestSource returns the source of container's manifest.
+func (r *Reporter) manifestSource(container string) string {
+	if r.ManifestSource != "" && r.ManifestSource != ManifestSourceAuto {
+		return r.ManifestSource
+	}
+	if isManifestURL(container) {
+		return ManifestSourceRegistry
+	}
+	if fi, err := os.Stat(container); err == nil && fi.Mode().IsRegular() {
+		return ManifestSourceFile
+	}
+	if r.sources.fellBack(container) {
+		return ManifestSourceClairctl
+	}
+	return ManifestSourceNative
+}
+
+// fromImage reports whether container's manifest is generated from an image,
+// rather than given.
+func (r *Reporter) fromImage(container string) bool {
+	switch r.manifestSource(container) {
+	case ManifestSourceNative, ManifestSourceClairctl:
+		return true
+	}
+	return false
+}
+
+func isManifestURL(container string) bool {
+	return strings.HasPrefix(container, "http://") || strings.HasPrefix(container, "https://")
+}
+
+// manifestFrom gets container's manifest from source.
+func (r *Reporter) manifestFrom(ctx context.Context, source, container string) ([]byte, error) {
+	switch source {
+	case ManifestSourceClairctl:
+		return r.clairctlManifest(ctx, container)
+	case ManifestSourceNative:
+		r.registryOnce.Do(func() { r.registry = r.registryClient() })
+		return r.registry.clairManifest(ctx, container)
+	case ManifestSourceFile:
+		return os.ReadFile(container)
+	case ManifestSourceRegistry:
+		if !isManifestURL(container) {
+			return nil, fmt.Errorf("%s isn't the URL of a manifest", container)
+		}
+		return fetchManifest(ctx, container)
+	}
+	return nil, fmt.Errorf("unknown manifest source %q", source)
+}
+
+// clairctlManifest generates the manifest for container with clairctl,
+// within the registry's rate limit.
+func (r *Reporter) clairctlManifest(ctx context.Context, container string) ([]byte, error) {
+	host := "unknown"
+	if ref, err := ParseImageRef(container); err == nil {
+		host = ref.Registry
+	}
+	var out []byte
+	err := r.Limits.do(ctx, host, func() (bool, time.Duration, error) {
+		cmd := exec.Command("clairctl", "manifest", container)
+		if env := r.Auth.env(); env != nil {
+			cmd.Env = append(os.Environ(), env...)
+		}
+		zlog.Debug(ctx).Str("container", cmd.String()).Msg("getting manifest")
+		var err error
+		out, err = cmd.Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if r.DumpFailed {
+				var b strings.Builder
+				writeDumpBody(&b, bytes.NewReader(exitErr.Stderr))
+				zlog.Debug(ctx).Str("container", container).Msg("clairctl failed\n" + b.String())
+			}
+			return clairctlRateLimited(exitErr.Stderr), 0, err
+		}
+		return false, 0, err
+	})
+	return out, err
+}
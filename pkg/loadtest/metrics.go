@@ -0,0 +1,171 @@
+package loadtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// DefaultClairMetrics are the prefixes of the Clair metrics kept by default:
+// database pool usage, indexer activity, GC and memory.
+var DefaultClairMetrics = []string{
+	"pgxpool_",
+	"clair_indexer_",
+	"go_gc_duration_seconds",
+	"go_goroutines",
+	"go_memstats_heap_inuse_bytes",
+	"process_resident_memory_bytes",
+}
+
+// MetricsSnapshot is a scrape of Clair's metrics. Series are keyed by name
+// and labels as they appear in the exposition format.
+type MetricsSnapshot struct {
+	Time           time.Time          `json:"time"`
+	ElapsedSeconds float64            `json:"elapsed_seconds"`
+	Series         map[string]float64 `json:"series"`
+}
+
+// MetricsScraper scrapes Clair's Prometheus endpoint, keeping the series
+// matching its prefixes. A nil MetricsScraper does nothing.
+type MetricsScraper struct {
+	url      string
+	prefixes []string
+	interval time.Duration
+	cl       *http.Client
+
+	mu        sync.Mutex
+	start     time.Time
+	snapshots []*MetricsSnapshot
+}
+
+// NewMetricsScraper returns a scraper using tr, so metrics are fetched through
+// the same proxy as other requests to Clair.
+func NewMetricsScraper(url string, prefixes []string, interval time.Duration, tr http.RoundTripper) *MetricsScraper {
+	if url == "" {
+		return nil
+	}
+	return &MetricsScraper{
+		url:      url,
+		prefixes: prefixes,
+		interval: interval,
+		cl:       &http.Client{Timeout: time.Second * 10, Transport: tr},
+		start:    time.Now(),
+	}
+}
+
+// Scrape takes a snapshot. Failures are logged, Clair's metrics are a nice
+// to have and shouldn't fail a run.
+func (m *MetricsScraper) Scrape(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	t := time.Now()
+	series, err := m.scrape(ctx)
+	if err != nil {
+		zlog.Warn(ctx).Err(err).Str("url", m.url).Msg("could not scrape clair metrics")
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshots = append(m.snapshots, &MetricsSnapshot{
+		Time:           t,
+		ElapsedSeconds: t.Sub(m.start).Seconds(),
+		Series:         series,
+	})
+}
+
+// Watch scrapes every interval until ctx is done.
+func (m *MetricsScraper) Watch(ctx context.Context) {
+	if m == nil || m.interval <= 0 {
+		return
+	}
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			m.Scrape(ctx)
+		}
+	}
+}
+
+func (m *MetricsScraper) Snapshots() []*MetricsSnapshot {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshots
+}
+
+func (m *MetricsScraper) scrape(ctx context.Context) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain")
+	resp, err := m.cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non 200 response from metrics endpoint %d", resp.StatusCode)
+	}
+	return parseMetrics(resp.Body, m.prefixes)
+}
+
+// parseMetrics reads samples in the Prometheus text exposition format,
+// keeping those whose names start with one of prefixes.
+func parseMetrics(r io.Reader, prefixes []string) (map[string]float64, error) {
+	series := map[string]float64{}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := line
+		if i := strings.IndexAny(line, "{ "); i >= 0 {
+			name = line[:i]
+		}
+		keep := false
+		for _, p := range prefixes {
+			keep = keep || strings.HasPrefix(name, p)
+		}
+		if !keep {
+			continue
+		}
+		// The key runs up to the end of the labels, if any, then the
+		// value follows, optionally followed by a timestamp.
+		end := len(name)
+		if strings.HasPrefix(line[end:], "{") {
+			i := strings.LastIndex(line, "}")
+			if i < 0 {
+				return nil, fmt.Errorf("malformed metric line %q", line)
+			}
+			end = i + 1
+		}
+		fields := strings.Fields(line[end:])
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("malformed metric line %q", line)
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed metric value in %q: %w", line, err)
+		}
+		series[line[:end]] = v
+	}
+	return series, s.Err()
+}
@@ -0,0 +1,239 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// NotificationStats are the stats for notifications delivered by Clair's
+// notifier. Latencies are in milliseconds.
+type NotificationStats struct {
+	// Deliveries counts every delivery, Notifications only distinct
+	// notifications, and Redeliveries the deliveries of notifications
+	// already delivered.
+	Deliveries    int64 `json:"deliveries"`
+	Notifications int64 `json:"notifications"`
+	Redeliveries  int64 `json:"redeliveries"`
+	// Rejected counts the deliveries failed on purpose, to make the
+	// notifier retry.
+	Rejected int64 `json:"rejected"`
+	// Read counts the notifications read from their pages, if they're
+	// fetched.
+	Read            int64 `json:"read,omitempty"`
+	PayloadBytes    int64 `json:"payload_bytes"`
+	MaxPayloadBytes int64 `json:"max_payload_bytes"`
+	// FirstDeliverySeconds and LastDeliverySeconds are how long after the
+	// receiver started the first and last deliveries arrived.
+	FirstDeliverySeconds float64 `json:"first_delivery_seconds"`
+	LastDeliverySeconds  float64 `json:"last_delivery_seconds"`
+	// Delivery latency is from a notification's first delivery to the one
+	// accepted, so it's only more than 0 for retried notifications.
+	P50DeliveryLatency int64 `json:"p50_delivery_latency_milliseconds"`
+	P95DeliveryLatency int64 `json:"p95_delivery_latency_milliseconds"`
+	MaxDeliveryLatency int64 `json:"max_delivery_latency_milliseconds"`
+	// Retry delays are between consecutive deliveries of a notification.
+	P50RetryDelay int64 `json:"p50_retry_delay_milliseconds,omitempty"`
+	P95RetryDelay int64 `json:"p95_retry_delay_milliseconds,omitempty"`
+	MaxRetryDelay int64 `json:"max_retry_delay_milliseconds,omitempty"`
+	// Lag is from when a message holding notifications was published to a
+	// broker to when it was consumed, where the broker stamps messages.
+	P50Lag int64 `json:"p50_lag_milliseconds,omitempty"`
+	P95Lag int64 `json:"p95_lag_milliseconds,omitempty"`
+	MaxLag int64 `json:"max_lag_milliseconds,omitempty"`
+}
+
+// notificationState is what's known about a notification's deliveries.
+type notificationState struct {
+	first, last time.Time
+	attempts    int
+	accepted    bool
+}
+
+// NotificationTracker records the deliveries of notifications. A nil
+// NotificationTracker does nothing.
+type NotificationTracker struct {
+	start time.Time
+
+	mu        sync.Mutex
+	stats     NotificationStats
+	seen      map[string]*notificationState
+	latencies []int64
+	delays    []int64
+	lags      []int64
+	first     time.Time
+	last      time.Time
+}
+
+func NewNotificationTracker() *NotificationTracker {
+	return &NotificationTracker{start: time.Now(), seen: map[string]*notificationState{}}
+}
+
+// Deliver records a delivery of the notification id, of size bytes, that was
+// accepted or rejected. It returns which attempt at delivering it this was,
+// and whether it's the first accepted.
+func (t *NotificationTracker) Deliver(id string, size int64, accepted bool) (attempt int, first bool) {
+	if t == nil {
+		return 0, false
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.first.IsZero() {
+		t.first = now
+	}
+	t.last = now
+	t.stats.Deliveries++
+	t.stats.PayloadBytes += size
+	if size > t.stats.MaxPayloadBytes {
+		t.stats.MaxPayloadBytes = size
+	}
+	if !accepted {
+		t.stats.Rejected++
+	}
+	n, ok := t.seen[id]
+	if !ok {
+		n = &notificationState{first: now}
+		t.seen[id] = n
+		t.stats.Notifications++
+	} else {
+		t.stats.Redeliveries++
+		t.delays = append(t.delays, now.Sub(n.last).Milliseconds())
+	}
+	n.last = now
+	n.attempts++
+	if accepted && !n.accepted {
+		n.accepted = true
+		first = true
+		t.latencies = append(t.latencies, now.Sub(n.first).Milliseconds())
+	}
+	return n.attempts, first
+}
+
+// Read records that n notifications were read from a notification's pages.
+func (t *NotificationTracker) Read(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.stats.Read += int64(n)
+	t.mu.Unlock()
+}
+
+// Lag records how long a message waited between being published and being
+// consumed.
+func (t *NotificationTracker) Lag(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.lags = append(t.lags, d.Milliseconds())
+	t.mu.Unlock()
+}
+
+// Stats returns the stats for the deliveries so far.
+func (t *NotificationTracker) Stats() *NotificationStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.stats
+	if !t.first.IsZero() {
+		s.FirstDeliverySeconds = t.first.Sub(t.start).Seconds()
+		s.LastDeliverySeconds = t.last.Sub(t.start).Seconds()
+	}
+	if len(t.latencies) > 0 {
+		s.P50DeliveryLatency = percentileOf(t.latencies, 50)
+		s.P95DeliveryLatency = percentileOf(t.latencies, 95)
+		s.MaxDeliveryLatency = percentileOf(t.latencies, 100)
+	}
+	if len(t.delays) > 0 {
+		s.P50RetryDelay = percentileOf(t.delays, 50)
+		s.P95RetryDelay = percentileOf(t.delays, 95)
+		s.MaxRetryDelay = percentileOf(t.delays, 100)
+	}
+	if len(t.lags) > 0 {
+		s.P50Lag = percentileOf(t.lags, 50)
+		s.P95Lag = percentileOf(t.lags, 95)
+		s.MaxLag = percentileOf(t.lags, 100)
+	}
+	return &s
+}
+
+// NotificationPage fetches a page of the notification at callback, as given
+// in a webhook delivery, starting from next if it's set. It returns how many
+// notifications the page held, and the next page, which is empty after the
+// last.
+func (r *Reporter) NotificationPage(ctx context.Context, callback, next, token string) (int, string, error) {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid callback %q: %w", callback, err)
+	}
+	if next != "" {
+		q := u.Query()
+		q.Set("next", next)
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	resp, sample, err := r.Do(EndpointNotificationPage, req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(EndpointNotificationPage).IncrNon2XXResponses(int64(1))
+		return 0, "", fmt.Errorf("non 200 response from notifier %d", resp.StatusCode)
+	}
+	var page struct {
+		Page struct {
+			Next string `json:"next"`
+		} `json:"page"`
+		Notifications []json.RawMessage `json:"notifications"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		sample.Error = err.Error()
+		return 0, "", err
+	}
+	// The last page has no next page, or "-1".
+	if page.Page.Next == "-1" {
+		page.Page.Next = ""
+	}
+	return len(page.Notifications), page.Page.Next, nil
+}
+
+// DeleteNotification deletes the notification at callback, marking it read.
+func (r *Reporter) DeleteNotification(ctx context.Context, callback, token string) error {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return fmt.Errorf("invalid callback %q: %w", callback, err)
+	}
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	resp, sample, err := r.Do(EndpointDeleteNotification, req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		r.Stats.Endpoint(EndpointDeleteNotification).IncrNon2XXResponses(int64(1))
+		return fmt.Errorf("non 200 response from notifier while deleting %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/quay/zlog"
+)
+
+// paddingField is the manifest field padding is put in. Clair ignores fields
+// it doesn't know.
+const paddingField = "clair_load_test_padding"
+
+// ManifestPad is a size manifests are padded to, named as it was given.
+type ManifestPad struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// ParseManifestPads parses sizes such as "512KB" or "5MB".
+func ParseManifestPads(specs []string) ([]*ManifestPad, error) {
+	var pads []*ManifestPad
+	seen := map[int64]bool{}
+	for _, spec := range specs {
+		n, err := ParseBytes(spec)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid manifest pad %q, expected a size such as 5MB", spec)
+		}
+		if seen[n] {
+			return nil, fmt.Errorf("manifest pad %q given twice", spec)
+		}
+		seen[n] = true
+		pads = append(pads, &ManifestPad{Name: strings.ToUpper(spec), Bytes: n})
+	}
+	return pads, nil
+}
+
+// ManifestPadder pads manifests to each of its sizes in turn, and attributes
+// index requests to the size they were padded to. A nil ManifestPadder does
+// nothing.
+type ManifestPadder struct {
+	pads []*ManifestPad
+
+	mu   sync.Mutex
+	next int
+}
+
+func NewManifestPadder(pads []*ManifestPad) *ManifestPadder {
+	if len(pads) == 0 {
+		return nil
+	}
+	return &ManifestPadder{pads: pads}
+}
+
+// pad returns the manifest padded to the next size. Manifests already too
+// big for it are returned as is.
+func (p *ManifestPadder) pad(ctx context.Context, manifest []byte) []byte {
+	if p == nil {
+		return manifest
+	}
+	p.mu.Lock()
+	size := p.pads[p.next]
+	p.next = (p.next + 1) % len(p.pads)
+	p.mu.Unlock()
+
+	m := bytes.TrimSpace(manifest)
+	if len(m) < 2 || m[len(m)-1] != '}' {
+		zlog.Warn(ctx).Msg("manifest isn't a JSON object, not padding it")
+		return manifest
+	}
+	head := m[:len(m)-1]
+	field := `,"` + paddingField + `":"`
+	fill := size.Bytes - int64(len(head)+len(field)+len(`"}`))
+	if fill < 0 {
+		zlog.Debug(ctx).
+			Str("pad", size.Name).
+			Int("bytes", len(manifest)).
+			Msg("manifest is bigger than the pad size, not padding it")
+		return manifest
+	}
+	out := make([]byte, 0, size.Bytes)
+	out = append(out, head...)
+	out = append(out, field...)
+	out = append(out, bytes.Repeat([]byte{'x'}, int(fill))...)
+	out = append(out, `"}`...)
+	return out
+}
+
+// observe attributes index requests to the pad size matching their body.
+func (p *ManifestPadder) observe(s *Sample, stats *Stats) {
+	if p == nil || s.Endpoint != EndpointIndexReport {
+		return
+	}
+	for _, size := range p.pads {
+		if s.RequestBytes != size.Bytes {
+			continue
+		}
+		es := stats.ManifestPad(size.Name)
+		es.IncrTotalLatencyMilliseconds(s.LatencyMilliseconds)
+		es.IncrTotalRequests(int64(1))
+		es.IncrRequestBytes(s.RequestBytes)
+		if s.Failed() {
+			es.IncrNon2XXResponses(int64(1))
+		}
+		es.ObserveOutcome(s)
+		return
+	}
+}
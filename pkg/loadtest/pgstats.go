@@ -0,0 +1,202 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/quay/zlog"
+)
+
+// PGSnapshot is a sample of a Clair database's activity. The pg_stat_database
+// counters are cumulative, so the difference between snapshots is what
+// happened in between.
+type PGSnapshot struct {
+	Time              time.Time `json:"time"`
+	ElapsedSeconds    float64   `json:"elapsed_seconds"`
+	Connections       int64     `json:"connections"`
+	ActiveConnections int64     `json:"active_connections"`
+	WaitingOnLocks    int64     `json:"waiting_on_locks"`
+	Locks             int64     `json:"locks"`
+	UngrantedLocks    int64     `json:"ungranted_locks"`
+	XactCommit        int64     `json:"xact_commit"`
+	XactRollback      int64     `json:"xact_rollback"`
+	BlocksRead        int64     `json:"blks_read"`
+	BlocksHit         int64     `json:"blks_hit"`
+	TuplesReturned    int64     `json:"tup_returned"`
+	TuplesFetched     int64     `json:"tup_fetched"`
+	TuplesInserted    int64     `json:"tup_inserted"`
+	TuplesUpdated     int64     `json:"tup_updated"`
+	TuplesDeleted     int64     `json:"tup_deleted"`
+	TempFiles         int64     `json:"temp_files"`
+	TempBytes         int64     `json:"temp_bytes"`
+	Deadlocks         int64     `json:"deadlocks"`
+}
+
+const pgActivityQuery = `
+SELECT
+	count(*),
+	count(*) FILTER (WHERE state = 'active'),
+	count(*) FILTER (WHERE wait_event_type = 'Lock')
+FROM pg_stat_activity
+WHERE datname = current_database();`
+
+const pgLocksQuery = `
+SELECT
+	count(*),
+	count(*) FILTER (WHERE NOT granted)
+FROM pg_locks l
+JOIN pg_database d ON d.oid = l.database
+WHERE d.datname = current_database();`
+
+const pgDatabaseQuery = `
+SELECT
+	xact_commit, xact_rollback, blks_read, blks_hit,
+	tup_returned, tup_fetched, tup_inserted, tup_updated, tup_deleted,
+	temp_files, temp_bytes, deadlocks
+FROM pg_stat_database
+WHERE datname = current_database();`
+
+// ConnectDB connects to one of Clair's databases.
+func ConnectDB(ctx context.Context, dsn string) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to database: %w", err)
+	}
+	return conn, nil
+}
+
+// PGSampler samples the activity of Clair's databases during a run. A nil
+// PGSampler does nothing.
+type PGSampler struct {
+	interval time.Duration
+	start    time.Time
+	// conns are keyed by database, "indexer" or "matcher".
+	conns map[string]*pgx.Conn
+	// sampling serializes use of conns.
+	sampling sync.Mutex
+
+	mu        sync.Mutex
+	snapshots map[string][]*PGSnapshot
+}
+
+// NewPGSampler connects to the databases with a DSN, returning nil if there
+// are none.
+func NewPGSampler(ctx context.Context, dsns map[string]string, interval time.Duration) (*PGSampler, error) {
+	s := &PGSampler{
+		interval:  interval,
+		start:     time.Now(),
+		conns:     map[string]*pgx.Conn{},
+		snapshots: map[string][]*PGSnapshot{},
+	}
+	for name, dsn := range dsns {
+		if dsn == "" {
+			continue
+		}
+		conn, err := ConnectDB(ctx, dsn)
+		if err != nil {
+			s.Close(ctx)
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		s.conns[name] = conn
+	}
+	if len(s.conns) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Sample takes a snapshot of every database. Failures are logged.
+func (s *PGSampler) Sample(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	s.sampling.Lock()
+	defer s.sampling.Unlock()
+	for name, conn := range s.conns {
+		snap, err := s.sample(ctx, conn)
+		if err != nil {
+			zlog.Warn(ctx).Err(err).Str("database", name).Msg("could not sample postgres stats")
+			continue
+		}
+		s.mu.Lock()
+		s.snapshots[name] = append(s.snapshots[name], snap)
+		s.mu.Unlock()
+	}
+}
+
+func (s *PGSampler) sample(ctx context.Context, conn *pgx.Conn) (*PGSnapshot, error) {
+	t := time.Now()
+	snap := &PGSnapshot{
+		Time:           t,
+		ElapsedSeconds: t.Sub(s.start).Seconds(),
+	}
+	err := conn.QueryRow(ctx, pgActivityQuery).Scan(
+		&snap.Connections, &snap.ActiveConnections, &snap.WaitingOnLocks,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not query pg_stat_activity: %w", err)
+	}
+	err = conn.QueryRow(ctx, pgLocksQuery).Scan(&snap.Locks, &snap.UngrantedLocks)
+	if err != nil {
+		return nil, fmt.Errorf("could not query pg_locks: %w", err)
+	}
+	err = conn.QueryRow(ctx, pgDatabaseQuery).Scan(
+		&snap.XactCommit, &snap.XactRollback, &snap.BlocksRead, &snap.BlocksHit,
+		&snap.TuplesReturned, &snap.TuplesFetched, &snap.TuplesInserted, &snap.TuplesUpdated, &snap.TuplesDeleted,
+		&snap.TempFiles, &snap.TempBytes, &snap.Deadlocks,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not query pg_stat_database: %w", err)
+	}
+	return snap, nil
+}
+
+// Watch samples every interval until ctx is done. Samples aren't made with
+// ctx, as pgx closes connections whose queries are cancelled, each is given
+// an interval to complete instead.
+func (s *PGSampler) Watch(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			sctx, cancel := context.WithTimeout(context.Background(), s.interval)
+			s.Sample(sctx)
+			cancel()
+		}
+	}
+}
+
+// Interval is how often the databases are sampled.
+func (s *PGSampler) Interval() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return s.interval
+}
+
+func (s *PGSampler) Snapshots() map[string][]*PGSnapshot {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshots
+}
+
+func (s *PGSampler) Close(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	for _, conn := range s.conns {
+		conn.Close(ctx)
+	}
+}
@@ -0,0 +1,153 @@
+package loadtest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Phase is a named stretch of a run, such as a ramp, steady state or spike,
+// that's reported separately. If Rate is set the load changes to it when the
+// phase begins.
+type Phase struct {
+	Name     string        `yaml:"name" json:"name"`
+	Duration time.Duration `yaml:"duration" json:"duration"`
+	Rate     float64       `yaml:"rate" json:"rate,omitempty"`
+}
+
+// PhaseStats are the stats for the requests recorded during a phase.
+type PhaseStats struct {
+	Name         string                    `json:"name"`
+	StartSeconds float64                   `json:"start_seconds"`
+	EndSeconds   float64                   `json:"end_seconds"`
+	Endpoints    map[string]*EndpointStats `json:"endpoints"`
+
+	mu sync.Mutex
+}
+
+// Endpoint returns the phase's stats for the named endpoint, creating them if
+// needed.
+func (p *PhaseStats) Endpoint(name string) *EndpointStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.Endpoints[name]
+	if !ok {
+		e = &EndpointStats{}
+		p.Endpoints[name] = e
+	}
+	return e
+}
+
+func (p *PhaseStats) summarize() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.Endpoints {
+		e.mu.Lock()
+		e.summarize()
+		e.mu.Unlock()
+	}
+}
+
+// PhaseTracker attributes requests to the current phase. Phases are begun
+// by the scenario, or from the control API. Requests made before the first
+// phase aren't attributed to any. A nil PhaseTracker does nothing.
+type PhaseTracker struct {
+	start time.Time
+
+	mu      sync.Mutex
+	current *PhaseStats
+	phases  []*PhaseStats
+}
+
+func NewPhaseTracker() *PhaseTracker {
+	return &PhaseTracker{start: time.Now()}
+}
+
+// Begin ends the current phase, if there is one, and begins the named phase.
+func (t *PhaseTracker) Begin(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Since(t.start).Seconds()
+	if t.current != nil {
+		t.current.EndSeconds = now
+	}
+	t.current = &PhaseStats{
+		Name:         name,
+		StartSeconds: now,
+		Endpoints:    map[string]*EndpointStats{},
+	}
+	t.phases = append(t.phases, t.current)
+}
+
+// Current returns the name of the current phase, if there is one.
+func (t *PhaseTracker) Current() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == nil {
+		return ""
+	}
+	return t.current.Name
+}
+
+func (t *PhaseTracker) observe(s *Sample) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	p := t.current
+	t.mu.Unlock()
+	if p == nil {
+		return
+	}
+	s.Phase = p.Name
+	es := p.Endpoint(s.Endpoint)
+	es.IncrTotalLatencyMilliseconds(s.LatencyMilliseconds)
+	es.IncrTotalRequests(int64(1))
+	switch {
+	case s.Error != "" && s.StatusCode == 0:
+		es.IncrRequestErrors(int64(1))
+		es.IncrTransportErrors(s.ErrorClass)
+	case s.Failed():
+		es.IncrNon2XXResponses(int64(1))
+	}
+	if s.StatusCode != 0 {
+		es.IncrStatusCodes(s.StatusCode)
+	}
+	es.ObserveOutcome(s)
+}
+
+// Run begins each of the phases in turn, changing ctl's rate for those that
+// set one, until they're done or ctx is.
+func (t *PhaseTracker) Run(ctx context.Context, phases []*Phase, ctl *Control) {
+	for _, ph := range phases {
+		zlog.Info(ctx).Str("phase", ph.Name).Dur("duration", ph.Duration).Msg("beginning phase")
+		t.Begin(ph.Name)
+		if ph.Rate > 0 {
+			ctl.SetRate(ph.Rate)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ph.Duration):
+		}
+	}
+}
+
+// Finish ends the current phase and returns the stats for every phase.
+func (t *PhaseTracker) Finish() []*PhaseStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		t.current.EndSeconds = time.Since(t.start).Seconds()
+		t.current = nil
+	}
+	for _, p := range t.phases {
+		p.summarize()
+	}
+	return t.phases
+}
@@ -0,0 +1,113 @@
+package loadtest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sync"
+)
+
+// PollStats are the stats for vulnerability reports polled repeatedly, as a
+// dashboard refreshing them would.
+type PollStats struct {
+	Hashes int   `json:"hashes"`
+	Polls  int64 `json:"polls"`
+	// NotModified counts the 304s to conditional polls, and Cached the
+	// responses a cache in front of Clair answered.
+	NotModified int64 `json:"not_modified"`
+	Cached      int64 `json:"cached"`
+	// CacheHitRate is the fraction of polls answered by either.
+	CacheHitRate float64 `json:"cache_hit_rate"`
+	// Changes counts the full responses that differed from the previous
+	// one for their hash, and Reverts those that went back to a version
+	// seen earlier, such as replicas disagreeing would cause.
+	Changes int64 `json:"changes"`
+	Reverts int64 `json:"reverts"`
+	// MaxVersions is the most distinct responses seen for a single hash.
+	MaxVersions int `json:"max_versions"`
+}
+
+// pollState is what's been seen of a hash's vulnerability report.
+type pollState struct {
+	last     string
+	versions map[string]bool
+}
+
+// PollTracker records the responses to repeated polls of vulnerability
+// reports. A nil PollTracker does nothing.
+type PollTracker struct {
+	mu     sync.Mutex
+	stats  PollStats
+	hits   int64
+	hashes map[string]*pollState
+}
+
+func NewPollTracker() *PollTracker {
+	return &PollTracker{hashes: map[string]*pollState{}}
+}
+
+// pollDigest sums a response body as it's read.
+type pollDigest struct{ hash.Hash }
+
+// digest returns a pollDigest, or nil if t is nil.
+func (t *PollTracker) digest() *pollDigest {
+	if t == nil {
+		return nil
+	}
+	return &pollDigest{sha256.New()}
+}
+
+// observe records a poll of the vulnerability report for manifest. A nil
+// digest means the report wasn't sent, because it hadn't changed.
+func (t *PollTracker) observe(manifest string, d *pollDigest, notModified, cached bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Polls++
+	if notModified {
+		t.stats.NotModified++
+	}
+	if cached {
+		t.stats.Cached++
+	}
+	if notModified || cached {
+		t.hits++
+	}
+	if d == nil {
+		return
+	}
+	sum := hex.EncodeToString(d.Sum(nil))
+	s, ok := t.hashes[manifest]
+	if !ok {
+		s = &pollState{versions: map[string]bool{}}
+		t.hashes[manifest] = s
+	}
+	if s.last != "" && sum != s.last {
+		t.stats.Changes++
+		if s.versions[sum] {
+			t.stats.Reverts++
+		}
+	}
+	s.last = sum
+	s.versions[sum] = true
+	if len(s.versions) > t.stats.MaxVersions {
+		t.stats.MaxVersions = len(s.versions)
+	}
+}
+
+// Stats returns the stats for the polls so far.
+func (t *PollTracker) Stats() *PollStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.stats
+	s.Hashes = len(t.hashes)
+	if s.Polls > 0 {
+		s.CacheHitRate = float64(t.hits) / float64(s.Polls)
+	}
+	return &s
+}
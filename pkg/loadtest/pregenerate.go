@@ -0,0 +1,145 @@
+package loadtest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// pregenerateProgressInterval is how often Pregenerate logs its progress.
+const pregenerateProgressInterval = 5 * time.Second
+
+// ManifestCache holds the manifests got for containers, so each is only
+// generated once. A nil ManifestCache holds nothing.
+type ManifestCache struct {
+	mu        sync.RWMutex
+	manifests map[string][]byte
+}
+
+func NewManifestCache() *ManifestCache {
+	return &ManifestCache{manifests: map[string][]byte{}}
+}
+
+func (c *ManifestCache) get(container string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.manifests[container]
+	return m, ok
+}
+
+func (c *ManifestCache) put(container string, manifest []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.manifests[container] = manifest
+}
+
+// PregenerationStats report the manifests generated before a run.
+type PregenerationStats struct {
+	Containers     int     `json:"containers"`
+	Generated      int     `json:"generated"`
+	Failed         int     `json:"failed"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// The latencies are of generating each manifest, including sizing it
+	// for size classes.
+	P50LatencyMilliseconds int64 `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64 `json:"p95_latency_milliseconds"`
+	MaxLatencyMilliseconds int64 `json:"max_latency_milliseconds"`
+	// Errors are why each container that failed did, by container.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Pregenerate generates the manifests of containers into the Reporter's
+// Manifests, concurrency at a time, so generating them isn't part of the
+// run. Containers that fail are reported and left to be generated during the
+// run. If ctx is cancelled, the containers not started yet are neither
+// generated nor failed.
+func (r *Reporter) Pregenerate(ctx context.Context, containers []string, concurrency int) *PregenerationStats {
+	if r.Manifests == nil {
+		r.Manifests = NewManifestCache()
+	}
+	seen := map[string]bool{}
+	var todo []string
+	for _, cc := range containers {
+		if !seen[cc] {
+			seen[cc] = true
+			todo = append(todo, cc)
+		}
+	}
+	st := &PregenerationStats{Containers: len(todo)}
+	start := time.Now()
+	var (
+		mu        sync.Mutex
+		latencies histogram
+		wg        sync.WaitGroup
+	)
+	progress := func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		zlog.Info(ctx).
+			Int("generated", st.Generated).
+			Int("failed", st.Failed).
+			Int("containers", st.Containers).
+			Msg(msg)
+	}
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(pregenerateProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				progress("pregenerating manifests")
+			}
+		}
+	}()
+	sem := make(chan struct{}, concurrency)
+	for _, cc := range todo {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		cc := cc
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t := time.Now()
+			_, err := r.Manifest(ctx, cc)
+			d := time.Since(t)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				st.Failed++
+				if st.Errors == nil {
+					st.Errors = map[string]string{}
+				}
+				st.Errors[cc] = err.Error()
+				zlog.Warn(ctx).Err(err).Str("container", cc).Msg("could not pregenerate manifest")
+				return
+			}
+			st.Generated++
+			latencies.observe(d.Milliseconds())
+		}()
+	}
+	wg.Wait()
+	close(done)
+	st.ElapsedSeconds = time.Since(start).Seconds()
+	st.P50LatencyMilliseconds = latencies.percentile(50)
+	st.P95LatencyMilliseconds = latencies.percentile(95)
+	st.MaxLatencyMilliseconds = latencies.max
+	progress("pregenerated manifests")
+	return st
+}
@@ -0,0 +1,274 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/quay/zlog"
+)
+
+// Probe is a dependency checked during a run: an HTTP readiness endpoint,
+// ready when it answers with a 2XX, a Postgres database, ready when a
+// connection can be made and queried, or a TCP address, ready when it
+// accepts a connection.
+type Probe struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+
+	url *url.URL
+}
+
+// ParseProbes parses probes written as name=target, such as
+// clair=http://localhost:8089/readyz, matcher-db=postgres://clair@db/matcher
+// or matcher=tcp://localhost:6060.
+func ParseProbes(specs []string) ([]*Probe, error) {
+	var probes []*Probe
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid probe %q, expected name=target such as clair=http://localhost:8089/readyz", spec)
+		}
+		u, err := url.Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("probe %q: %w", parts[0], err)
+		}
+		switch u.Scheme {
+		case "http", "https", "postgres", "postgresql":
+		case "tcp":
+			if u.Port() == "" {
+				return nil, fmt.Errorf("probe %q: tcp targets need a port", parts[0])
+			}
+		default:
+			return nil, fmt.Errorf("probe %q: unknown scheme %q, expected http, https, postgres or tcp", parts[0], u.Scheme)
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("probe %q given more than once", parts[0])
+		}
+		seen[parts[0]] = true
+		probes = append(probes, &Probe{Name: parts[0], Target: u.Redacted(), url: u})
+	}
+	return probes, nil
+}
+
+// ProbeEvent is a change in a dependency's readiness.
+type ProbeEvent struct {
+	Time           time.Time `json:"time"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Up             bool      `json:"up"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// ProbeStats are the results of probing a dependency over a run.
+type ProbeStats struct {
+	Target   string `json:"target"`
+	Checks   int    `json:"checks"`
+	Failures int    `json:"failures"`
+	// Flaps counts the times the dependency went down after being up.
+	Flaps           int     `json:"flaps"`
+	DowntimeSeconds float64 `json:"downtime_seconds"`
+	// Events are the changes in readiness, beginning with the first check.
+	Events []*ProbeEvent `json:"events"`
+
+	up        bool
+	downSince time.Time
+}
+
+// Prober checks dependencies every interval during a run, recording when
+// they go down and come back. A nil Prober does nothing.
+type Prober struct {
+	probes   []*Probe
+	interval time.Duration
+	cl       *http.Client
+
+	mu    sync.Mutex
+	start time.Time
+	stats map[string]*ProbeStats
+}
+
+// NewProber returns a Prober checking probes every interval, over tr for
+// HTTP probes. It returns nil if there are no probes.
+func NewProber(probes []*Probe, interval time.Duration, tr http.RoundTripper) *Prober {
+	if len(probes) == 0 {
+		return nil
+	}
+	p := &Prober{
+		probes:   probes,
+		interval: interval,
+		cl:       &http.Client{Timeout: interval, Transport: tr},
+		start:    time.Now(),
+		stats:    map[string]*ProbeStats{},
+	}
+	for _, pr := range probes {
+		p.stats[pr.Name] = &ProbeStats{Target: pr.Target}
+	}
+	return p
+}
+
+// Watch checks every dependency each interval until ctx is done.
+func (p *Prober) Watch(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, pr := range p.probes {
+			wg.Add(1)
+			go func(pr *Probe) {
+				defer wg.Done()
+				p.check(ctx, pr)
+			}(pr)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (p *Prober) check(ctx context.Context, pr *Probe) {
+	cctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	err := p.probe(cctx, pr)
+	if ctx.Err() != nil {
+		// The run ended mid-check, which says nothing about the dependency.
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats[pr.Name]
+	s.Checks++
+	up := err == nil
+	if !up {
+		s.Failures++
+	}
+	first := s.Checks == 1
+	if !first && up == s.up {
+		return
+	}
+	ev := &ProbeEvent{Time: now, ElapsedSeconds: now.Sub(p.start).Seconds(), Up: up}
+	switch {
+	case !up:
+		ev.Error = err.Error()
+		s.downSince = now
+		if !first {
+			s.Flaps++
+		}
+		zlog.Warn(ctx).Str("probe", pr.Name).Err(err).Msg("dependency down")
+	case !first:
+		s.DowntimeSeconds += now.Sub(s.downSince).Seconds()
+		zlog.Info(ctx).Str("probe", pr.Name).Msg("dependency back up")
+	}
+	s.up = up
+	s.Events = append(s.Events, ev)
+}
+
+func (p *Prober) probe(ctx context.Context, pr *Probe) error {
+	switch pr.url.Scheme {
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pr.url.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := p.cl.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("non 2XX response %d", resp.StatusCode)
+		}
+		return nil
+	case "tcp":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", pr.url.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		conn, err := pgx.Connect(ctx, pr.url.String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close(context.Background())
+		var one int
+		return conn.QueryRow(ctx, `SELECT 1`).Scan(&one)
+	}
+}
+
+// Results returns the stats for every dependency, counting downtime up to
+// now for any still down.
+func (p *Prober) Results() map[string]*ProbeStats {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	out := make(map[string]*ProbeStats, len(p.stats))
+	for name, s := range p.stats {
+		c := *s
+		if c.Checks > 0 && !c.up {
+			c.DowntimeSeconds += now.Sub(c.downSince).Seconds()
+		}
+		out[name] = &c
+	}
+	return out
+}
+
+// Annotate marks the buckets of stats' timeline with the dependencies that
+// were down during them.
+func (p *Prober) Annotate(stats *Stats) {
+	if p == nil {
+		return
+	}
+	results := p.Results()
+	end := time.Now()
+	stats.tlMu.Lock()
+	defer stats.tlMu.Unlock()
+	for name, s := range results {
+		for i, ev := range s.Events {
+			if ev.Up {
+				continue
+			}
+			until := end
+			if i+1 < len(s.Events) {
+				until = s.Events[i+1].Time
+			}
+			for _, b := range stats.Timeline {
+				from := stats.start.Add(time.Duration(b.StartSeconds * float64(time.Second)))
+				if from.Before(until) && from.Add(TimelineBucket).After(ev.Time) {
+					b.DependenciesDown = appendUnique(b.DependenciesDown, name)
+				}
+			}
+		}
+	}
+	for _, b := range stats.Timeline {
+		sort.Strings(b.DependenciesDown)
+	}
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
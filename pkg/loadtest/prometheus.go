@@ -0,0 +1,134 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/quay/zlog"
+)
+
+func init() {
+	RegisterSink(SinkPrometheus, func(ctx context.Context, target string) (Sink, error) {
+		if target == "" {
+			target = "localhost:9464"
+		}
+		return NewPrometheusSink(ctx, target)
+	})
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration
+// histogram.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// promSeries is what's counted for each endpoint and status.
+type promSeries struct {
+	requests      uint64
+	responseBytes int64
+	buckets       []uint64
+	sum           float64
+}
+
+type promKey struct {
+	endpoint, status string
+}
+
+// PrometheusSink serves counters and a latency histogram of the samples it's
+// given for Prometheus to scrape, until Summary is called.
+type PrometheusSink struct {
+	mu     sync.Mutex
+	series map[promKey]*promSeries
+	srv    *http.Server
+}
+
+// NewPrometheusSink listens on addr and serves the metrics at /metrics.
+func NewPrometheusSink(ctx context.Context, addr string) (*PrometheusSink, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", addr, err)
+	}
+	p := &PrometheusSink{series: make(map[promKey]*promSeries)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.serveMetrics)
+	p.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := p.srv.Serve(l); err != http.ErrServerClosed {
+			zlog.Error(ctx).Err(err).Msg("prometheus sink stopped")
+		}
+	}()
+	zlog.Info(ctx).Str("addr", l.Addr().String()).Msg("serving prometheus metrics")
+	return p, nil
+}
+
+func (p *PrometheusSink) ConsumeSample(s *Sample) error {
+	k := promKey{endpoint: s.Endpoint, status: "error"}
+	if s.StatusCode != 0 {
+		k.status = strconv.Itoa(s.StatusCode)
+	}
+	secs := float64(s.LatencyMilliseconds) / 1000
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ser, ok := p.series[k]
+	if !ok {
+		ser = &promSeries{buckets: make([]uint64, len(latencyBuckets))}
+		p.series[k] = ser
+	}
+	ser.requests++
+	ser.responseBytes += s.ResponseBytes
+	ser.sum += secs
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			ser.buckets[i]++
+		}
+	}
+	return nil
+}
+
+// Summary stops serving the metrics.
+func (p *PrometheusSink) Summary(*Stats) error {
+	return p.srv.Close()
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func (p *PrometheusSink) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]promKey, 0, len(p.series))
+	for k := range p.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].status < keys[j].status
+	})
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP clair_load_test_requests_total Requests made against Clair.")
+	fmt.Fprintln(w, "# TYPE clair_load_test_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "clair_load_test_requests_total{endpoint=%q,status=%q} %d\n", k.endpoint, k.status, p.series[k].requests)
+	}
+	fmt.Fprintln(w, "# HELP clair_load_test_response_bytes_total Bytes read from Clair's responses.")
+	fmt.Fprintln(w, "# TYPE clair_load_test_response_bytes_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "clair_load_test_response_bytes_total{endpoint=%q,status=%q} %d\n", k.endpoint, k.status, p.series[k].responseBytes)
+	}
+	fmt.Fprintln(w, "# HELP clair_load_test_request_duration_seconds Latency of requests made against Clair.")
+	fmt.Fprintln(w, "# TYPE clair_load_test_request_duration_seconds histogram")
+	for _, k := range keys {
+		ser := p.series[k]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "clair_load_test_request_duration_seconds_bucket{endpoint=%q,status=%q,le=%q} %d\n",
+				k.endpoint, k.status, strconv.FormatFloat(le, 'g', -1, 64), ser.buckets[i])
+		}
+		fmt.Fprintf(w, "clair_load_test_request_duration_seconds_bucket{endpoint=%q,status=%q,le=\"+Inf\"} %d\n", k.endpoint, k.status, ser.requests)
+		fmt.Fprintf(w, "clair_load_test_request_duration_seconds_sum{endpoint=%q,status=%q} %g\n", k.endpoint, k.status, ser.sum)
+		fmt.Fprintf(w, "clair_load_test_request_duration_seconds_count{endpoint=%q,status=%q} %d\n", k.endpoint, k.status, ser.requests)
+	}
+}
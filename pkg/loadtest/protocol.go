@@ -0,0 +1,39 @@
+package loadtest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// HTTP protocols requests can be made with.
+const (
+	// ProtocolAuto uses HTTP/2 when the server offers it over TLS, and
+	// HTTP/1.1 otherwise.
+	ProtocolAuto  = "auto"
+	ProtocolHTTP1 = "http1"
+	// ProtocolHTTP2 asks for HTTP/2 over TLS. Go doesn't speak HTTP/2
+	// without TLS, so plain http hosts still get HTTP/1.1.
+	ProtocolHTTP2 = "http2"
+)
+
+// SetProtocol configures tr to make requests with protocol.
+func SetProtocol(tr *http.Transport, protocol string) error {
+	switch protocol {
+	case "", ProtocolAuto, ProtocolHTTP2:
+		tr.ForceAttemptHTTP2 = true
+		tr.TLSNextProto = nil
+	case ProtocolHTTP1:
+		// A non-nil, empty map turns HTTP/2 off, and only offering
+		// HTTP/1.1 keeps the server from picking HTTP/2 anyway.
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	default:
+		return fmt.Errorf("unknown protocol %q, expected %s, %s or %s", protocol, ProtocolHTTP1, ProtocolHTTP2, ProtocolAuto)
+	}
+	return nil
+}
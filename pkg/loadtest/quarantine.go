@@ -0,0 +1,137 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// ErrAllQuarantined is returned by Pick once every container has been
+// quarantined, leaving none to load.
+var ErrAllQuarantined = errors.New("every container is quarantined")
+
+// QuarantinedImage is a container taken out of rotation for failing.
+type QuarantinedImage struct {
+	Container string `json:"container"`
+	// Failures is how many times in a row it failed.
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error"`
+	Time      time.Time `json:"time"`
+}
+
+// Quarantine takes containers that keep failing out of rotation, so one
+// broken reference doesn't fail a share of a long run's steps. A container
+// is quarantined once its manifest can't be got, or Clair fails to index it,
+// more than After times in a row. A nil Quarantine quarantines nothing.
+type Quarantine struct {
+	After int
+
+	mu       sync.Mutex
+	failures map[string]int
+	images   map[string]*QuarantinedImage
+	order    []*QuarantinedImage
+}
+
+// NewQuarantine returns a Quarantine for containers failing more than after
+// times in a row, or nil if after isn't positive.
+func NewQuarantine(after int) *Quarantine {
+	if after <= 0 {
+		return nil
+	}
+	return &Quarantine{
+		After:    after,
+		failures: map[string]int{},
+		images:   map[string]*QuarantinedImage{},
+	}
+}
+
+// Pick returns the container for step n, the nth of containers in turn,
+// skipping over those quarantined. It returns ErrAllQuarantined if there are
+// none left.
+func (q *Quarantine) Pick(containers []string, n int) (string, error) {
+	if q == nil {
+		return containers[n%len(containers)], nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := 0; i < len(containers); i++ {
+		cc := containers[(n+i)%len(containers)]
+		if q.images[cc] == nil {
+			return cc, nil
+		}
+	}
+	return "", ErrAllQuarantined
+}
+
+// ManifestFailed counts a failure to get container's manifest against it.
+func (q *Quarantine) ManifestFailed(ctx context.Context, container string, err error) {
+	q.fail(ctx, container, fmt.Errorf("could not generate manifest: %w", err))
+}
+
+// IndexFailed counts a failure to index container against it, if Clair
+// responded. A request that got no response says more about Clair than about
+// the image.
+func (q *Quarantine) IndexFailed(ctx context.Context, container string, err error) {
+	var (
+		re  *ResponseError
+		ire *IndexReportError
+	)
+	if !errors.As(err, &re) && !errors.As(err, &ire) {
+		return
+	}
+	q.fail(ctx, container, fmt.Errorf("could not create index report: %w", err))
+}
+
+// Indexed clears container's failures.
+func (q *Quarantine) Indexed(container string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.failures, container)
+}
+
+func (q *Quarantine) fail(ctx context.Context, container string, err error) {
+	// Steps cut short by the end of the run aren't the container's fault.
+	if q == nil || ctx.Err() != nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.images[container] != nil {
+		return
+	}
+	q.failures[container]++
+	n := q.failures[container]
+	if n <= q.After {
+		return
+	}
+	img := &QuarantinedImage{
+		Container: container,
+		Failures:  n,
+		LastError: err.Error(),
+		Time:      time.Now(),
+	}
+	q.images[container] = img
+	q.order = append(q.order, img)
+	zlog.Warn(ctx).
+		Str("container", container).
+		Int("failures", n).
+		Err(err).
+		Msg("quarantined container, it's left out of the rest of the run")
+}
+
+// Images returns the containers quarantined, in the order they were.
+func (q *Quarantine) Images() []*QuarantinedImage {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*QuarantinedImage(nil), q.order...)
+}
@@ -0,0 +1,306 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// recheckTick is how often the rechecks due are looked for.
+const recheckTick = 250 * time.Millisecond
+
+// recheckMaxIDs is the most vulnerabilities listed as added or removed for
+// a single hash.
+const recheckMaxIDs = 20
+
+// RecheckStats are the results of fetching each vulnerability report again,
+// to look for reports that differ for the same manifest.
+type RecheckStats struct {
+	Hashes   int   `json:"hashes"`
+	Rechecks int64 `json:"rechecks"`
+	// Failed counts the rechecks that got no report to compare.
+	Failed int64 `json:"failed"`
+	// Inconsistent are the hashes whose reports didn't all list the same
+	// vulnerabilities.
+	Inconsistent []*InconsistentReport `json:"inconsistent,omitempty"`
+}
+
+// InconsistentReport is a manifest whose vulnerability report changed
+// between fetches.
+type InconsistentReport struct {
+	Hash    string `json:"hash"`
+	Fetches int    `json:"fetches"`
+	// Versions is how many different sets of vulnerabilities were seen.
+	Versions int `json:"versions"`
+	// Added are vulnerabilities in a later report but not the first, and
+	// Removed the other way around, by ID.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// recheckState is what's been seen of a hash's vulnerability report.
+type recheckState struct {
+	first    map[string]bool
+	versions map[string]bool
+	added    map[string]bool
+	removed  map[string]bool
+	fetches  int
+	// done counts the rechecks started, next is when the next is due.
+	done int
+	next time.Time
+}
+
+// RecheckTracker fetches the vulnerability report of every hash seen n more
+// times, spread over what's left of the run, and compares the sets of
+// vulnerabilities listed. A nil RecheckTracker does nothing.
+type RecheckTracker struct {
+	n   int
+	end time.Time
+
+	mu       sync.Mutex
+	hashes   map[string]*recheckState
+	rechecks int64
+	failed   int64
+}
+
+// NewRecheckTracker returns a RecheckTracker making n rechecks of each hash
+// by end, when the run stops starting steps. An n of 0 returns nil.
+func NewRecheckTracker(n int, end time.Time) *RecheckTracker {
+	if n <= 0 {
+		return nil
+	}
+	return &RecheckTracker{n: n, end: end, hashes: map[string]*recheckState{}}
+}
+
+// capture returns a buffer to copy a vulnerability report into, or nil if t
+// is nil.
+func (t *RecheckTracker) capture() *bytes.Buffer {
+	if t == nil {
+		return nil
+	}
+	return &bytes.Buffer{}
+}
+
+// observe compares the vulnerability report for hash in body with the first
+// one seen.
+func (t *RecheckTracker) observe(ctx context.Context, hash string, body []byte) {
+	if t == nil {
+		return
+	}
+	var report struct {
+		Vulnerabilities map[string]json.RawMessage `json:"vulnerabilities"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		zlog.Warn(ctx).Str("hash", hash).Err(err).Msg("could not read vulnerability report to recheck")
+		return
+	}
+	ids := make([]string, 0, len(report.Vulnerabilities))
+	set := make(map[string]bool, len(report.Vulnerabilities))
+	for id := range report.Vulnerabilities {
+		ids = append(ids, id)
+		set[id] = true
+	}
+	sort.Strings(ids)
+	version := strings.Join(ids, ",")
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.hashes[hash]
+	if !ok {
+		s = &recheckState{
+			first:    set,
+			versions: map[string]bool{version: true},
+			added:    map[string]bool{},
+			removed:  map[string]bool{},
+			fetches:  1,
+		}
+		s.next = now.Add(t.spacing(now, t.n))
+		t.hashes[hash] = s
+		return
+	}
+	s.fetches++
+	if s.versions[version] {
+		return
+	}
+	s.versions[version] = true
+	for id := range set {
+		if !s.first[id] {
+			s.added[id] = true
+		}
+	}
+	for id := range s.first {
+		if !set[id] {
+			s.removed[id] = true
+		}
+	}
+	zlog.Warn(ctx).
+		Str("hash", hash).
+		Int("versions", len(s.versions)).
+		Msg("vulnerability report differs from an earlier one for the same manifest")
+}
+
+// spacing is the wait before the next of left rechecks, spreading them
+// evenly over what's left of the run.
+func (t *RecheckTracker) spacing(now time.Time, left int) time.Duration {
+	d := t.end.Sub(now) / time.Duration(left+1)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// due returns the hashes due a recheck at now, or owed one at all if all is
+// set, counting the rechecks as started.
+func (t *RecheckTracker) due(now time.Time, all bool) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []string
+	for hash, s := range t.hashes {
+		if s.done >= t.n || (!all && now.Before(s.next)) {
+			continue
+		}
+		s.done++
+		s.next = now.Add(t.spacing(now, t.n-s.done))
+		out = append(out, hash)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (t *RecheckTracker) counted(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rechecks++
+	if err != nil {
+		t.failed++
+	}
+}
+
+// Stats returns the results of the rechecks so far.
+func (t *RecheckTracker) Stats() *RecheckStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := &RecheckStats{Hashes: len(t.hashes), Rechecks: t.rechecks, Failed: t.failed}
+	for hash, s := range t.hashes {
+		if len(s.versions) < 2 {
+			continue
+		}
+		st.Inconsistent = append(st.Inconsistent, &InconsistentReport{
+			Hash:     hash,
+			Fetches:  s.fetches,
+			Versions: len(s.versions),
+			Added:    recheckIDs(s.added),
+			Removed:  recheckIDs(s.removed),
+		})
+	}
+	sort.Slice(st.Inconsistent, func(i, j int) bool { return st.Inconsistent[i].Hash < st.Inconsistent[j].Hash })
+	return st
+}
+
+// recheckIDs returns up to recheckMaxIDs of the IDs in set, in order.
+func recheckIDs(set map[string]bool) []string {
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) > recheckMaxIDs {
+		ids = ids[:recheckMaxIDs]
+	}
+	return ids
+}
+
+// WatchRechecks rechecks the vulnerability reports in Rechecks as they come
+// due, until ctx is done.
+func (r *Reporter) WatchRechecks(ctx context.Context) {
+	if r.Rechecks == nil {
+		return
+	}
+	t := time.NewTicker(recheckTick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for _, hash := range r.Rechecks.due(now, false) {
+				r.recheck(ctx, hash)
+			}
+		}
+	}
+}
+
+// FinishRechecks makes the rechecks still owed once the run is over, for the
+// hashes seen too late for them all to come due.
+func (r *Reporter) FinishRechecks(ctx context.Context) {
+	if r.Rechecks == nil {
+		return
+	}
+	for {
+		hashes := r.Rechecks.due(time.Now(), true)
+		if len(hashes) == 0 {
+			return
+		}
+		for _, hash := range hashes {
+			r.recheck(ctx, hash)
+		}
+	}
+}
+
+func (r *Reporter) recheck(ctx context.Context, hash string) {
+	err := r.recheckVulnerabilityReport(ctx, hash)
+	if err != nil {
+		zlog.Warn(ctx).Str("hash", hash).Err(err).Msg("could not recheck vulnerability report")
+	}
+	r.Rechecks.counted(err)
+}
+
+// recheckVulnerabilityReport fetches the vulnerability report for hash
+// again, unconditionally, and compares it with the earlier ones.
+func (r *Reporter) recheckVulnerabilityReport(ctx context.Context, hash string) error {
+	token, err := CreateToken(r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	req, err := r.newRequest(
+		ctx, http.MethodGet,
+		"/matcher/api/v1/vulnerability_report/"+hash,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	resp, sample, err := r.Do(EndpointRecheckVulnerabilityReport, req)
+	sample.Hash = hash
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(EndpointRecheckVulnerabilityReport).IncrNon2XXResponses(int64(1))
+		return ResponseErrorf(resp.StatusCode, "non 200 response from matcher %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		sample.Error = err.Error()
+		return err
+	}
+	r.Rechecks.observe(ctx, hash, body)
+	return nil
+}
@@ -0,0 +1,102 @@
+package loadtest
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is a request made during a run. A recording is a sequence of JSON
+// encoded records, one per line, that replay can make again.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	// BodySHA256 identifies the request body. Bodies are mostly the same
+	// few manifests, so Body is only written the first time it's seen.
+	BodySHA256          string          `json:"body_sha256,omitempty"`
+	Body                json.RawMessage `json:"body,omitempty"`
+	LatencyMilliseconds int64           `json:"latency_milliseconds"`
+	StatusCode          int             `json:"status_code,omitempty"`
+}
+
+// Recorder writes the requests made to a recording. A nil Recorder discards
+// everything written to it.
+type Recorder struct {
+	mu   sync.Mutex
+	f    *os.File
+	buf  *bufio.Writer
+	enc  *json.Encoder
+	seen map[string]bool
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	return &Recorder{
+		f:    f,
+		buf:  buf,
+		enc:  json.NewEncoder(buf),
+		seen: map[string]bool{},
+	}, nil
+}
+
+// Write records req, made at t. The request's body is read again with
+// GetBody, which is set for all of the requests made to Clair.
+func (w *Recorder) Write(req *http.Request, t time.Time, latency time.Duration, status int) error {
+	if w == nil {
+		return nil
+	}
+	rec := &Record{
+		Time:                t,
+		Method:              req.Method,
+		Path:                req.URL.Path,
+		LatencyMilliseconds: latency.Milliseconds(),
+		StatusCode:          status,
+	}
+	var body []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(body) != 0 {
+		sum := sha256.Sum256(body)
+		rec.BodySHA256 = hex.EncodeToString(sum[:])
+		if !w.seen[rec.BodySHA256] && json.Valid(body) {
+			w.seen[rec.BodySHA256] = true
+			rec.Body = body
+		}
+	}
+	return w.enc.Encode(rec)
+}
+
+func (w *Recorder) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buf.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,538 @@
+package loadtest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Media types of the registry manifests needed to pick a platform.
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// ImageRef is a parsed container reference, such as ubuntu:latest or
+// quay.io/projectquay/clair@sha256:...
+type ImageRef struct {
+	Registry   string
+	Repository string
+	// Reference is a tag or digest.
+	Reference string
+}
+
+// ParseImageRef parses a container reference the way docker does: without a
+// registry it's on Docker Hub, and without a tag it's latest.
+func ParseImageRef(s string) (*ImageRef, error) {
+	ref := &ImageRef{Registry: "docker.io"}
+	name := s
+	if i := strings.Index(name, "/"); i != -1 {
+		if host := name[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry, name = host, name[i+1:]
+		}
+	}
+	switch i, j := strings.Index(name, "@"), strings.LastIndex(name, ":"); {
+	case i != -1:
+		name, ref.Reference = name[:i], name[i+1:]
+	case j != -1 && !strings.Contains(name[j:], "/"):
+		name, ref.Reference = name[:j], name[j+1:]
+	default:
+		ref.Reference = "latest"
+	}
+	if ref.Registry == "docker.io" && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" || ref.Reference == "" {
+		return nil, fmt.Errorf("invalid container reference %q", s)
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// WithDigest returns the reference to the same repository at digest.
+func (ref *ImageRef) WithDigest(digest string) string {
+	return ref.Registry + "/" + ref.Repository + "@" + digest
+}
+
+func (ref *ImageRef) url(kind, reference string) string {
+	host := ref.Registry
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	scheme := "https"
+	if strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		scheme = "http"
+	}
+	return scheme + "://" + host + "/v2/" + ref.Repository + "/" + kind + "/" + reference
+}
+
+// Platform is an image's os, architecture and optional variant, written as
+// linux/arm64 or linux/arm/v7.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func ParsePlatform(s string) (*Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", s)
+	}
+	p := &Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p *Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matches reports whether an image for o runs on p. A variant is only
+// compared if p has one.
+func (p *Platform) matches(o *Platform) bool {
+	return p.OS == o.OS && p.Architecture == o.Architecture &&
+		(p.Variant == "" || p.Variant == o.Variant)
+}
+
+// defaultPlatform is the image indexed for a multi-arch container without a
+// platform given, as clairctl picks.
+var defaultPlatform = &Platform{OS: "linux", Architecture: "amd64"}
+
+// registryManifest is the part of a registry manifest or index needed to pick
+// a platform and list an image's layers.
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest   string   `json:"digest"`
+		Platform Platform `json:"platform"`
+	} `json:"manifests"`
+}
+
+// registryClient fetches manifests from container registries, handling the
+// basic and bearer token challenges registries answer anonymous requests
+// with.
+type registryClient struct {
+	cl *http.Client
+	// dump logs failed requests, as Reporter.DumpFailed does.
+	dump   bool
+	auth   *RegistryAuth
+	limits *RegistryLimiter
+
+	mu sync.Mutex
+	// tokens are the bearer tokens per registry and repository.
+	tokens map[string]string
+}
+
+func newRegistryClient(tr http.RoundTripper, auth *RegistryAuth, limits *RegistryLimiter) *registryClient {
+	return &registryClient{
+		cl:     &http.Client{Timeout: time.Minute, Transport: tr},
+		auth:   auth,
+		limits: limits,
+		tokens: map[string]string{},
+	}
+}
+
+// get fetches the url for ref within the registry's rate limit,
+// authenticating if the registry asks.
+func (c *registryClient) get(ctx context.Context, ref *ImageRef, u string, accept ...string) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, ref, u, acceptHeader(accept...))
+}
+
+func acceptHeader(accept ...string) http.Header {
+	h := http.Header{}
+	for _, a := range accept {
+		h.Add("Accept", a)
+	}
+	return h
+}
+
+func (c *registryClient) do(ctx context.Context, method string, ref *ImageRef, u string, header http.Header) (*http.Response, error) {
+	var resp *http.Response
+	err := c.limits.do(ctx, ref.Registry, func() (bool, time.Duration, error) {
+		var err error
+		resp, err = c.doAuthenticated(ctx, method, ref, u, header)
+		if err != nil {
+			return false, 0, err
+		}
+		limited, after := rateLimited(resp)
+		if limited {
+			drainClose(resp.Body)
+			return true, after, fmt.Errorf("rate limited by %s", ref.Registry)
+		}
+		return false, 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.dump && resp.StatusCode >= http.StatusBadRequest {
+		dumpRequest(ctx, "registry", resp.Request, resp)
+	}
+	return resp, nil
+}
+
+func (c *registryClient) doAuthenticated(ctx context.Context, method string, ref *ImageRef, u string, header http.Header) (*http.Response, error) {
+	key := ref.Registry + "/" + ref.Repository
+	user, pass, err := c.auth.credentials(ctx, ref.Registry)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		c.mu.Lock()
+		token := c.tokens[key]
+		c.mu.Unlock()
+		switch {
+		case token != "":
+			req.Header.Set("Authorization", "Bearer "+token)
+		case attempt > 0 && user != "":
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := c.cl.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		drainClose(resp.Body)
+		if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+			if user == "" {
+				return nil, fmt.Errorf("%s needs credentials", ref.Registry)
+			}
+			continue
+		}
+		token, err = c.token(ctx, challenge, user, pass)
+		if err != nil {
+			return nil, fmt.Errorf("could not authenticate with %s: %w", ref.Registry, err)
+		}
+		c.mu.Lock()
+		c.tokens[key] = token
+		c.mu.Unlock()
+	}
+}
+
+// token answers a bearer challenge, of the form
+// Bearer realm="...",service="...",scope="...", with the credentials if
+// there are any.
+func (c *registryClient) token(ctx context.Context, challenge, user, pass string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("unsupported challenge %q", challenge)
+	}
+	params := map[string]string{}
+	for _, kv := range strings.Split(challenge[len("bearer "):], ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) == 2 {
+			params[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+		}
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid realm in challenge %q", challenge)
+	}
+	q := realm.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v := params[k]; v != "" {
+			q.Set(k, v)
+		}
+	}
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := c.cl.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("non 200 response from token server %d", resp.StatusCode)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	return tok.Token, nil
+}
+
+// manifestTypes are the manifest media types asked for, in order of
+// preference.
+var manifestTypes = []string{mediaTypeOCIIndex, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeDockerManifest}
+
+// manifest fetches the manifest or index for reference, returning it along
+// with its digest.
+func (c *registryClient) manifest(ctx context.Context, ref *ImageRef, reference string) (*registryManifest, string, error) {
+	resp, err := c.get(ctx, ref, ref.url("manifests", reference), manifestTypes...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("non 200 response from registry %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var m registryManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, "", fmt.Errorf("could not decode manifest: %w", err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		sum := sha256.Sum256(body)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return &m, digest, nil
+}
+
+// digest returns the digest ref's tag currently points at. It's looked up
+// with a HEAD request, which Docker Hub doesn't count against its rate limit,
+// falling back to fetching the manifest for registries that don't support it.
+func (c *registryClient) digest(ctx context.Context, ref *ImageRef) (string, error) {
+	resp, err := c.do(ctx, http.MethodHead, ref, ref.url("manifests", ref.Reference), acceptHeader(manifestTypes...))
+	if err != nil {
+		return "", err
+	}
+	drainClose(resp.Body)
+	if d := resp.Header.Get("Docker-Content-Digest"); resp.StatusCode == http.StatusOK && d != "" {
+		return d, nil
+	}
+	_, d, err := c.manifest(ctx, ref, ref.Reference)
+	return d, err
+}
+
+// configPlatform fetches an image's config to find its platform.
+func (c *registryClient) configPlatform(ctx context.Context, ref *ImageRef, digest string) (*Platform, error) {
+	resp, err := c.get(ctx, ref, ref.url("blobs", digest))
+	if err != nil {
+		return nil, err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non 200 response from registry fetching config %d", resp.StatusCode)
+	}
+	var p Platform
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, fmt.Errorf("could not decode config: %w", err)
+	}
+	return &p, nil
+}
+
+// clairManifest builds the Clair manifest for container from its registry,
+// as clairctl manifest does: the image for defaultPlatform if container is
+// multi-arch, with the URL each layer is fetched from once redirects are
+// followed, and the credentials to fetch it with.
+func (c *registryClient) clairManifest(ctx context.Context, container string) ([]byte, error) {
+	ref, err := ParseImageRef(container)
+	if err != nil {
+		return nil, err
+	}
+	m, digest, err := c.manifest(ctx, ref, ref.Reference)
+	if err != nil {
+		return nil, err
+	}
+	switch m.MediaType {
+	case mediaTypeOCIIndex, mediaTypeDockerManifestList:
+		image := ""
+		for _, d := range m.Manifests {
+			if defaultPlatform.matches(&d.Platform) {
+				image = d.Digest
+				break
+			}
+		}
+		if image == "" {
+			return nil, fmt.Errorf("%s has no image for %s", container, defaultPlatform)
+		}
+		m, digest, err = c.manifest(ctx, ref, image)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Layers) == 0 {
+		return nil, fmt.Errorf("%s has no layers", container)
+	}
+	out := manifest{Hash: digest}
+	for _, l := range m.Layers {
+		layer, err := c.layer(ctx, ref, l.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("could not locate layer %s: %w", l.Digest, err)
+		}
+		out.Layers = append(out.Layers, layer)
+	}
+	return json.Marshal(out)
+}
+
+// layer locates the blob digest for Clair. The first byte is requested, so
+// the blob's not downloaded, to follow any redirect to where it's stored.
+// The registry's credentials are only passed on if it's stored there.
+func (c *registryClient) layer(ctx context.Context, ref *ImageRef, digest string) (manifestLayer, error) {
+	header := http.Header{}
+	header.Set("Range", "bytes=0-0")
+	resp, err := c.do(ctx, http.MethodGet, ref, ref.url("blobs", digest), header)
+	if err != nil {
+		return manifestLayer{}, err
+	}
+	drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return manifestLayer{}, fmt.Errorf("non 200 response from registry %d", resp.StatusCode)
+	}
+	l := manifestLayer{Hash: digest, URI: resp.Request.URL.String(), Headers: map[string][]string{}}
+	if auth := resp.Request.Header.Get("Authorization"); auth != "" {
+		l.Headers["Authorization"] = []string{auth}
+	}
+	return l, nil
+}
+
+// platformDigests returns the digests of the images for container matching
+// want, or for every platform if want is nil. A container that isn't
+// multi-arch is returned as is, if it matches.
+func (c *registryClient) platformDigests(ctx context.Context, container string, want *Platform) ([]string, error) {
+	ref, err := ParseImageRef(container)
+	if err != nil {
+		return nil, err
+	}
+	m, digest, err := c.manifest(ctx, ref, ref.Reference)
+	if err != nil {
+		return nil, err
+	}
+	switch m.MediaType {
+	case mediaTypeOCIIndex, mediaTypeDockerManifestList:
+	default:
+		if want != nil {
+			p, err := c.configPlatform(ctx, ref, m.Config.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if !want.matches(p) {
+				return nil, fmt.Errorf("%s is only available for %s", container, p)
+			}
+		}
+		return []string{ref.WithDigest(digest)}, nil
+	}
+	var out []string
+	for _, d := range m.Manifests {
+		p := d.Platform
+		// Attestations and the like are listed as unknown/unknown.
+		if p.OS == "unknown" || p.OS == "" {
+			continue
+		}
+		if want != nil && !want.matches(&p) {
+			continue
+		}
+		zlog.Debug(ctx).Str("container", container).Str("platform", p.String()).Str("digest", d.Digest).Msg("found platform")
+		out = append(out, ref.WithDigest(d.Digest))
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s has no image for %s", container, want)
+	}
+	return out, nil
+}
+
+// registryClient returns a client for the registries of the containers,
+// sharing the reporter's transport, credentials and rate limits.
+func (r *Reporter) registryClient() *registryClient {
+	c := newRegistryClient(r.Client.Transport, r.Auth, r.Limits)
+	c.dump = r.DumpFailed
+	return c
+}
+
+// ResolvePlatforms replaces each container with a reference to the digest
+// of its image for want, or one for every platform if want is nil.
+// Containers given as manifests, by URL or file, are left alone.
+func (r *Reporter) ResolvePlatforms(ctx context.Context, containers []string, want *Platform) ([]string, error) {
+	reg := r.registryClient()
+	var out []string
+	for _, cc := range containers {
+		if !r.fromImage(cc) {
+			out = append(out, cc)
+			continue
+		}
+		refs, err := reg.platformDigests(ctx, cc, want)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve platforms of %s: %w", cc, err)
+		}
+		zlog.Info(ctx).Str("container", cc).Strs("images", refs).Msg("resolved platforms")
+		out = append(out, refs...)
+	}
+	return out, nil
+}
+
+// PinDigests replaces every container given by tag with a reference to the
+// digest the tag points at now, so the images can't change during a run. It
+// returns the containers pinned, mapped to their digest references.
+// Containers given by digest or as manifests are left alone.
+func (r *Reporter) PinDigests(ctx context.Context, containers []string) ([]string, map[string]string, error) {
+	reg := r.registryClient()
+	pinned := map[string]string{}
+	out := make([]string, len(containers))
+	for i, cc := range containers {
+		out[i] = cc
+		if !r.fromImage(cc) {
+			continue
+		}
+		ref, err := ParseImageRef(cc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.Contains(ref.Reference, ":") {
+			continue
+		}
+		if d, ok := pinned[cc]; ok {
+			out[i] = d
+			continue
+		}
+		digest, err := reg.digest(ctx, ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not resolve %s to a digest: %w", cc, err)
+		}
+		out[i] = ref.WithDigest(digest)
+		pinned[cc] = out[i]
+		zlog.Info(ctx).Str("container", cc).Str("digest", digest).Msg("pinned digest")
+	}
+	return out, pinned, nil
+}
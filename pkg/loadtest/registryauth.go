@@ -0,0 +1,235 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/quay/zlog"
+)
+
+// dockerHubKeys are the names docker config files use for Docker Hub.
+var dockerHubKeys = []string{"https://index.docker.io/v1/", "index.docker.io", "docker.io", "registry-1.docker.io"}
+
+// dockerConfig is the part of a docker config.json holding credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// RegistryAuth finds the credentials for container registries: the user
+// and password it was made with, then the docker config file
+// and the credential helpers it names, such as ecr-login or gcloud. A nil
+// RegistryAuth has no credentials.
+type RegistryAuth struct {
+	user, password string
+	path           string
+	raw            []byte
+	config         dockerConfig
+	// dir is a docker config directory made for clairctl, holding the
+	// given credentials, if there are any.
+	dir string
+}
+
+// NewRegistryAuth returns the credentials in the docker config, overridden
+// by user and password for every registry if they're set. Those are made
+// available to clairctl for the registries of containers; Close removes the
+// config written for it.
+func NewRegistryAuth(user, password string, containers []string) (*RegistryAuth, error) {
+	a := &RegistryAuth{
+		user:     user,
+		password: password,
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	if a.user != "" {
+		var hosts []string
+		for _, cc := range containers {
+			if ref, err := ParseImageRef(cc); err == nil && !strings.Contains(cc, "://") {
+				hosts = append(hosts, ref.Registry)
+			}
+		}
+		if err := a.writeConfig(hosts); err != nil {
+			return nil, fmt.Errorf("could not write docker config for clairctl: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// load reads the docker config, from $DOCKER_CONFIG or ~/.docker. A missing
+// config has no credentials.
+func (a *RegistryAuth) load() error {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	a.path = filepath.Join(dir, "config.json")
+	raw, err := os.ReadFile(a.path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("could not read docker config: %w", err)
+	}
+	if err := json.Unmarshal(raw, &a.config); err != nil {
+		return fmt.Errorf("could not decode docker config %s: %w", a.path, err)
+	}
+	a.raw = raw
+	return nil
+}
+
+// registryKeys returns the names a docker config might use for host.
+func registryKeys(host string) []string {
+	if host == "docker.io" {
+		return dockerHubKeys
+	}
+	return []string{host, "https://" + host}
+}
+
+// credentials returns the username and password for host, or empty strings
+// if there are none.
+func (a *RegistryAuth) credentials(ctx context.Context, host string) (string, string, error) {
+	if a == nil {
+		return "", "", nil
+	}
+	if a.user != "" {
+		return a.user, a.password, nil
+	}
+	for _, k := range registryKeys(host) {
+		if helper, ok := a.config.CredHelpers[k]; ok {
+			return credentialHelper(ctx, helper, k)
+		}
+	}
+	for _, k := range registryKeys(host) {
+		auth, ok := a.config.Auths[k]
+		if !ok {
+			continue
+		}
+		if auth.Auth == "" {
+			if auth.Username != "" {
+				return auth.Username, auth.Password, nil
+			}
+			// Credentials kept in the store only leave an empty entry.
+			break
+		}
+		dec, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth for %s in %s: %w", k, a.path, err)
+		}
+		parts := strings.SplitN(string(dec), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("invalid auth for %s in %s", k, a.path)
+		}
+		return parts[0], parts[1], nil
+	}
+	if a.config.CredsStore != "" {
+		for _, k := range registryKeys(host) {
+			user, pass, err := credentialHelper(ctx, a.config.CredsStore, k)
+			if err != nil || user != "" {
+				return user, pass, err
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// credentialHelper asks docker-credential-<helper> for the credentials for
+// key, returning empty strings if it has none.
+func credentialHelper(ctx context.Context, helper, key string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(key)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Helpers print this, and exit 1, for registries they don't know.
+		if strings.Contains(string(out)+stderr.String(), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("could not get credentials for %s from docker-credential-%s: %w", key, helper, err)
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return "", "", fmt.Errorf("could not decode docker-credential-%s output: %w", helper, err)
+	}
+	zlog.Debug(ctx).Str("helper", helper).Str("registry", key).Msg("got registry credentials")
+	return creds.Username, creds.Secret, nil
+}
+
+// writeConfig writes a copy of the docker config with the given credentials
+// added for hosts, for clairctl to use.
+func (a *RegistryAuth) writeConfig(hosts []string) error {
+	config := map[string]interface{}{}
+	if a.raw != nil {
+		if err := json.Unmarshal(a.raw, &config); err != nil {
+			return err
+		}
+	}
+	auths, _ := config["auths"].(map[string]interface{})
+	if auths == nil {
+		auths = map[string]interface{}{}
+	}
+	helpers, _ := config["credHelpers"].(map[string]interface{})
+	auth := base64.StdEncoding.EncodeToString([]byte(a.user + ":" + a.password))
+	for _, h := range hosts {
+		k := registryKeys(h)[0]
+		auths[k] = map[string]string{"auth": auth}
+		// Helpers take precedence over auths.
+		for _, k := range registryKeys(h) {
+			delete(helpers, k)
+		}
+	}
+	config["auths"] = auths
+	// The store would take precedence too, and every container's registry
+	// is in auths now.
+	delete(config, "credsStore")
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "clair-load-test-docker-")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), b, 0600); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	a.dir = dir
+	return nil
+}
+
+// env is the environment clairctl needs to use the credentials.
+func (a *RegistryAuth) env() []string {
+	if a == nil || a.dir == "" {
+		return nil
+	}
+	return []string{"DOCKER_CONFIG=" + a.dir}
+}
+
+// Close removes the docker config made for clairctl.
+func (a *RegistryAuth) Close() error {
+	if a == nil || a.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(a.dir)
+}
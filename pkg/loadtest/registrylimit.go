@@ -0,0 +1,169 @@
+package loadtest
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Backoff after a registry rate limits, doubling from the first up to the
+// most, unless the registry says how long to wait.
+const (
+	registryBackoff    = time.Second
+	registryMaxBackoff = time.Minute
+)
+
+// RegistryLimiter spaces out manifest requests to each registry, and backs
+// off when one rate limits anyway, counting the time spent doing so in the
+// registry's stats. A nil RegistryLimiter makes requests as they come.
+type RegistryLimiter struct {
+	// Stats are where the registry's requests are counted. They can be
+	// swapped between runs.
+	Stats    *Stats
+	interval time.Duration
+	retries  int
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// NewRegistryLimiter returns a RegistryLimiter allowing rate requests a
+// second to each registry, or unlimited if rate is 0, and retrying up to
+// retries times when rate limited.
+func NewRegistryLimiter(rate float64, retries int, stats *Stats) *RegistryLimiter {
+	l := &RegistryLimiter{
+		retries: retries,
+		Stats:   stats,
+		next:    map[string]time.Time{},
+	}
+	if rate > 0 {
+		l.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return l
+}
+
+// wait blocks until the next request to host is allowed.
+func (l *RegistryLimiter) wait(ctx context.Context, host string) error {
+	if l.interval == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(l.interval)
+	l.mu.Unlock()
+	return l.sleep(ctx, host, at.Sub(now))
+}
+
+func (l *RegistryLimiter) sleep(ctx context.Context, host string, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	l.Stats.Registry(host).IncrThrottledMilliseconds(d.Milliseconds())
+	addStepTime(ctx, stepThrottled, d)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// do calls fn, a request to host, within the rate limit, retrying when fn
+// reports it was rate limited. fn returns how long the registry asked to
+// wait, if it did.
+func (l *RegistryLimiter) do(ctx context.Context, host string, fn func() (limited bool, retryAfter time.Duration, err error)) error {
+	if l == nil {
+		start := time.Now()
+		_, _, err := fn()
+		addStepTime(ctx, stepRegistry, time.Since(start))
+		return err
+	}
+	rs := l.Stats.Registry(host)
+	backoff := registryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := l.wait(ctx, host); err != nil {
+			return err
+		}
+		start := time.Now()
+		limited, retryAfter, err := fn()
+		rs.IncrRequests(1)
+		took := time.Since(start)
+		rs.IncrLatencyMilliseconds(took.Milliseconds())
+		addStepTime(ctx, stepRegistry, took)
+		if !limited {
+			return err
+		}
+		rs.IncrRateLimitedResponses(1)
+		if attempt >= l.retries {
+			return err
+		}
+		d := backoff
+		if retryAfter > 0 {
+			d = retryAfter
+		}
+		zlog.Warn(ctx).Str("registry", host).Dur("backoff", d).Msg("rate limited by registry, backing off")
+		if err := l.sleep(ctx, host, d); err != nil {
+			return err
+		}
+		if backoff *= 2; backoff > registryMaxBackoff {
+			backoff = registryMaxBackoff
+		}
+	}
+}
+
+// rateLimited reports whether resp is a registry's rate limit, and how long
+// it asked to wait.
+func rateLimited(resp *http.Response) (bool, time.Duration) {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return false, 0
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil {
+		return true, 0
+	}
+	return true, time.Duration(secs) * time.Second
+}
+
+// clairctlRateLimited reports whether clairctl failed because the registry
+// rate limited it, going by what it printed.
+func clairctlRateLimited(stderr []byte) bool {
+	s := strings.ToLower(string(stderr))
+	return strings.Contains(s, "toomanyrequests") || strings.Contains(s, "too many requests")
+}
+
+// RegistryStats are the stats for the manifest requests made to a single
+// registry, through clairctl or to look up platforms.
+type RegistryStats struct {
+	Requests             int64 `json:"requests"`
+	RateLimitedResponses int64 `json:"rate_limited_responses"`
+	// ThrottledMilliseconds is the time spent waiting, for the rate limit
+	// or backing off after being rate limited.
+	ThrottledMilliseconds int64 `json:"throttled_milliseconds"`
+	LatencyMilliseconds   int64 `json:"latency_milliseconds"`
+}
+
+func (s *RegistryStats) IncrRequests(by int64) {
+	atomic.AddInt64(&s.Requests, by)
+}
+
+func (s *RegistryStats) IncrRateLimitedResponses(by int64) {
+	atomic.AddInt64(&s.RateLimitedResponses, by)
+}
+
+func (s *RegistryStats) IncrThrottledMilliseconds(by int64) {
+	atomic.AddInt64(&s.ThrottledMilliseconds, by)
+}
+
+func (s *RegistryStats) IncrLatencyMilliseconds(by int64) {
+	atomic.AddInt64(&s.LatencyMilliseconds, by)
+}
@@ -0,0 +1,51 @@
+package loadtest
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// VulnerabilityReportSummary is the size of a vulnerability report, and how
+// much was in it.
+type VulnerabilityReportSummary struct {
+	Bytes int64
+	// Counted is set if the counts were read from the report. Filtered
+	// reports aren't counted, as they leave things out.
+	Counted         bool
+	Packages        int
+	Vulnerabilities int
+	Enrichments     int
+}
+
+// count reads the counts from the vulnerability report in body. Enrichments
+// are summed over every kind, an object counting as one for each of its
+// keys, as the CVSS enrichment is an object keyed by vulnerability.
+func (s *VulnerabilityReportSummary) count(body []byte) error {
+	var report struct {
+		Packages        map[string]json.RawMessage   `json:"packages"`
+		Vulnerabilities map[string]json.RawMessage   `json:"vulnerabilities"`
+		Enrichments     map[string][]json.RawMessage `json:"enrichments"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return err
+	}
+	enrichments := 0
+	for _, es := range report.Enrichments {
+		for _, e := range es {
+			if !bytes.HasPrefix(bytes.TrimSpace(e), []byte("{")) {
+				enrichments++
+				continue
+			}
+			var keys map[string]json.RawMessage
+			if err := json.Unmarshal(e, &keys); err != nil {
+				return err
+			}
+			enrichments += len(keys)
+		}
+	}
+	s.Counted = true
+	s.Packages = len(report.Packages)
+	s.Vulnerabilities = len(report.Vulnerabilities)
+	s.Enrichments = enrichments
+	return nil
+}
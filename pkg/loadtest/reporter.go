@@ -0,0 +1,970 @@
+package loadtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Index report states, as reported by Clair.
+const (
+	IndexFinished = "IndexFinished"
+	IndexError    = "IndexError"
+)
+
+// IndexReportReponse is the index report Clair returns, less its contents.
+type IndexReportReponse struct {
+	Hash    string `json:"manifest_hash"`
+	State   string `json:"state"`
+	Success bool   `json:"success"`
+	Err     string `json:"err"`
+}
+
+// Reporter makes requests to Clair, recording each one in its Stats and
+// Sink. Create one with NewReporter, then set any of the optional fields
+// before making requests; nil fields do nothing.
+type Reporter struct {
+	// Host is Clair's URL. It can be a template, such as
+	// https://{tenant}.clair.example.com or http://clair/{region}/, with
+	// variables in braces filled in for each request: {tenant} is the
+	// name of the tenant it's made as, and the rest come from the tenant's
+	// Vars, then Vars.
+	Host  string
+	Vars  map[string]string
+	PSK   string
+	Stats *Stats
+	// Sink is given every sample, if set.
+	Sink    Sink
+	Records *Recorder
+	Control *Control
+	// Deletes, if set, batches the deletes made by ReportForContainer into
+	// bulk deletes.
+	Deletes *DeleteBatch
+	ETags   *ETagCache
+	Window  *ErrorWindow
+	Rewrite *LayerRewriter
+	Classes *SizeClassifier
+	Pads    *ManifestPadder
+	Auth    *RegistryAuth
+	Limits  *RegistryLimiter
+	Phases  *PhaseTracker
+	Spikes  *SpikeSchedule
+	Updates *UpdateTracker
+	// Tenants, if set, signs each request's token as one of several
+	// tenants, otherwise Signer signs them with a private key if set.
+	Tenants *Tenants
+	Signer  *KeySigner
+	// Tokens, if set, mints tokens with a skewed clock or unusual lifetime,
+	// reusing them for a while, and counts how Clair treats them.
+	Tokens *TokenTiming
+	// Polls, if set, is given every vulnerability report response to
+	// check for changes between polls.
+	Polls *PollTracker
+	// Rechecks, if set, is given every vulnerability report to compare
+	// with the others for the same manifest, see WatchRechecks.
+	Rechecks *RecheckTracker
+	// ReportFilter, if set, is a query string FilterShare of vulnerability
+	// reports are requested with, under EndpointFilteredVulnerabilityReport,
+	// to compare with full reports. They're left out of Polls and Rechecks.
+	ReportFilter string
+	FilterShare  float64
+	// Anomalies, if set, is given every sample to look for clusters of
+	// timeouts and slow requests in.
+	Anomalies *AnomalyDetector
+	// Reservoir, if set, keeps a bounded random sample of the samples.
+	Reservoir *SampleReservoir
+	// Errors, if set, counts the errors steps fail with. With FailFast the
+	// first one ends the run.
+	Errors   *ErrorTracker
+	FailFast bool
+	Client   *http.Client
+	// Quarantine, if set, takes containers that keep failing out of
+	// rotation.
+	Quarantine *Quarantine
+
+	// MatchDelay is waited between indexing a manifest and requesting its
+	// vulnerability report, after waiting up to IndexWait for indexing to
+	// finish if that's set.
+	MatchDelay time.Duration
+	IndexWait  time.Duration
+	// SkipVuln leaves out the vulnerability report from the workflow.
+	SkipVuln bool
+	// VerifyDeletes fetches every index report deleted again, VerifyDelay
+	// later, expecting a 404. One that's still there fails the delete with
+	// ErrDeleteNotApplied.
+	VerifyDeletes bool
+	VerifyDelay   time.Duration
+	// Transfer is how index report bodies are sent, one of TransferLength,
+	// TransferChunked or TransferBoth. Unless it's empty, index requests
+	// are also counted by how they were sent in the stats' Transfers.
+	Transfer string
+	// UploadBandwidth, if set, is the most bytes a second index report
+	// bodies are sent at, as by a slow client.
+	UploadBandwidth float64
+	// Internal adds the indexer's internal endpoints Quay uses to the
+	// workflow, see IndexState and AffectedManifests.
+	Internal bool
+	// ManifestSource is where manifests come from, one of the
+	// ManifestSource constants. Empty is ManifestSourceAuto.
+	ManifestSource string
+	// Manifests, if set, caches the manifests got for containers, see
+	// Pregenerate.
+	Manifests *ManifestCache
+
+	AcceptEncoding string
+	UserAgent      string
+	// CacheBust, if set, keeps caches in front of Clair from answering
+	// GETs, see CacheBustQuery and CacheBustHeader.
+	CacheBust string
+	// Headers are added to every request.
+	Headers http.Header
+	// RunID is sent with every request, along with a per request ID.
+	RunID string
+	// Seed seeds the random choices workloads make, see StepRand.
+	Seed int64
+	// Schedule, if set, is written what each step of a workload did.
+	Schedule *ScheduleLog
+	// DumpFailed logs the requests and responses of failed requests.
+	DumpFailed bool
+	requests   int64
+	reports    int64
+	uploads    int64
+	vulns      vulnPool
+	sources    manifestSources
+	// registry generates manifests natively, sharing its tokens between
+	// them.
+	registry     *registryClient
+	registryOnce sync.Once
+}
+
+// DeleteBatch collects hashes to be deleted with a single bulk delete.
+type DeleteBatch struct {
+	mu     sync.Mutex
+	size   int
+	hashes []string
+}
+
+// NewDeleteBatch returns a DeleteBatch sent once it holds size hashes.
+func NewDeleteBatch(size int) *DeleteBatch {
+	return &DeleteBatch{size: size}
+}
+
+// NewReporter returns a Reporter for the Clair at host, authenticating with
+// psk, under a new run ID.
+func NewReporter(host, psk string) *Reporter {
+	// Compression is handled by countingBody, so that compressed sizes can
+	// be measured.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DisableCompression = true
+	runID := NewUUID()
+	return &Reporter{
+		Host:           host,
+		PSK:            psk,
+		Stats:          NewStats(),
+		Client:         &http.Client{Timeout: time.Minute * 1, Transport: tr},
+		AcceptEncoding: "gzip",
+		UserAgent:      "clair-load-test (run " + runID + ")",
+		RunID:          runID,
+	}
+}
+
+func (r *Reporter) ReportForContainer(ctx context.Context, container string, delete bool) error {
+	return r.reportForContainer(ctx, container, "", delete)
+}
+
+// reportForContainer is ReportForContainer, but indexing the manifest under
+// hash instead if that's set.
+func (r *Reporter) reportForContainer(ctx context.Context, container, hash string, delete bool) error {
+	manifest, err := r.manifest(ctx, container, hash)
+	if err != nil {
+		r.Quarantine.ManifestFailed(ctx, container, err)
+		return fmt.Errorf("could not generate manifest: %w", err)
+	}
+	// Get a token
+	zlog.Debug(ctx).Str("container", container).Msg("got manifest")
+	token, err := CreateToken(r.PSK)
+	if err != nil {
+		zlog.Debug(ctx).Str("PSK", r.PSK).Msg("creating token")
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	// Send manifest as body to index_report
+	hash, err = r.CreateIndexReport(ctx, manifest, token)
+	if err != nil {
+		r.Quarantine.IndexFailed(ctx, container, err)
+		return fmt.Errorf("could not create index report: %w", err)
+	}
+	r.Quarantine.Indexed(container)
+	// Request vuln report
+	if err := r.MatchContainer(ctx, container, hash, token); err != nil {
+		return err
+	}
+	if r.Internal {
+		if err := r.internalRequests(ctx, token); err != nil {
+			return err
+		}
+	}
+	// Delete index_report
+	if delete {
+		if r.Deletes != nil {
+			return r.QueueDelete(ctx, hash)
+		}
+		err = r.DeleteIndexReports(ctx, hash, token)
+		if err != nil {
+			return fmt.Errorf("could not delete index report: %w", err)
+		}
+	}
+	return nil
+}
+
+// MatchContainer requests the vulnerability report for container's freshly
+// indexed hash, unless the workflow skips it. A 404 only gets a warning, so
+// the index report is still deleted, as it will exist eventually.
+func (r *Reporter) MatchContainer(ctx context.Context, container, hash, token string) error {
+	if r.SkipVuln {
+		return nil
+	}
+	if err := r.beforeMatch(ctx, hash); err != nil {
+		return err
+	}
+	report, err := r.GetVulnerabilityReport(ctx, hash, token)
+	switch {
+	case errors.Is(err, ErrIndexReportNotFound):
+		zlog.Warn(ctx).Str("container", container).Str("hash", hash).Msg("vulnerability report requested before the index report was found")
+	case err != nil:
+		return fmt.Errorf("could not get vulnerability report: %w", err)
+	default:
+		r.Stats.Image(container).ObserveVulnerabilityReport(report)
+	}
+	return nil
+}
+
+// beforeMatch waits between indexing hash and requesting its vulnerability
+// report, as configured.
+func (r *Reporter) beforeMatch(ctx context.Context, hash string) error {
+	if r.IndexWait > 0 {
+		if err := r.WaitForIndex(ctx, hash, r.IndexWait); err != nil {
+			return err
+		}
+	}
+	if r.MatchDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.MatchDelay):
+		}
+	}
+	return nil
+}
+
+// GetManifest gets the manifest for container from the Manifests cache or
+// else the ManifestSource, counting the source used in the stats. In auto
+// mode, an image that can't be generated natively is generated with clairctl
+// instead, if it's installed.
+func (r *Reporter) GetManifest(ctx context.Context, container string) ([]byte, error) {
+	if m, ok := r.Manifests.get(container); ok {
+		return m, nil
+	}
+	source := r.manifestSource(container)
+	out, err := r.manifestFrom(ctx, source, container)
+	if err != nil && source == ManifestSourceNative && r.ManifestSource != ManifestSourceNative &&
+		ctx.Err() == nil && ClairctlAvailable() {
+		zlog.Warn(ctx).Err(err).Str("container", container).Msg("could not generate manifest natively, falling back to clairctl")
+		r.sources.fallBack(container)
+		source = ManifestSourceClairctl
+		out, err = r.manifestFrom(ctx, source, container)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.Stats.manifestSources.add(source, 1)
+	r.Manifests.put(container, out)
+	return out, nil
+}
+
+func fetchManifest(ctx context.Context, url string) ([]byte, error) {
+	zlog.Debug(ctx).Str("url", url).Msg("fetching manifest")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non 200 response fetching manifest %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Manifest generates the manifest for container, rewriting its layer URLs,
+// classifying it by size and padding it as configured.
+func (r *Reporter) Manifest(ctx context.Context, container string) ([]byte, error) {
+	return r.manifest(ctx, container, "")
+}
+
+// manifest is Manifest, but giving the manifest hash if that's set, before
+// it's classified and padded.
+func (r *Reporter) manifest(ctx context.Context, container, hash string) ([]byte, error) {
+	manifest, err := r.GetManifest(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err = r.Rewrite.apply(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if hash != "" {
+		manifest, err = WithManifestHash(manifest, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.Classes.classify(ctx, manifest, r.Stats)
+	return r.Pads.pad(ctx, manifest), nil
+}
+
+// Do sends req and records its latency against the named endpoint. The
+// returned sample must be passed to Record once the caller is done filling it
+// in, which records its outcome.
+func (r *Reporter) Do(endpoint string, req *http.Request) (*http.Response, *Sample, error) {
+	es := r.Stats.Endpoint(endpoint)
+	req.Header.Set("Accept-Encoding", r.AcceptEncoding)
+	requestID := r.nextRequestID()
+	req.Header.Set(HeaderRunID, r.RunID)
+	req.Header.Set(HeaderRequestID, requestID)
+	req.Header.Set("User-Agent", r.UserAgent)
+	for k, vs := range r.Headers {
+		req.Header[k] = vs
+	}
+	if req.Method == http.MethodGet {
+		cacheBust(req, r.CacheBust, requestID)
+	}
+	tenant, token, err := r.authorize(req)
+	if err != nil {
+		return nil, &Sample{Time: time.Now(), Endpoint: endpoint, RequestID: requestID, Error: err.Error()}, err
+	}
+	req, conn := traceConn(req)
+	// Start clock
+	t := time.Now()
+	resp, err := r.Client.Do(req)
+	// end clock and report
+	diff := time.Now().Sub(t)
+	addStepTime(req.Context(), stepClair, diff)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	if err := r.Records.Write(req, t, diff, status); err != nil {
+		zlog.Warn(req.Context()).Err(err).Msg("could not record request")
+	}
+	es.IncrTotalLatencyMilliseconds(diff.Milliseconds())
+	es.IncrTotalRequests(int64(1))
+	sample := &Sample{
+		Time:                t,
+		Endpoint:            endpoint,
+		RequestID:           requestID,
+		Tenant:              tenant,
+		LatencyMilliseconds: diff.Milliseconds(),
+	}
+	if req.ContentLength > 0 {
+		es.IncrRequestBytes(req.ContentLength)
+		sample.RequestBytes = req.ContentLength
+	}
+	// Whether the request failed isn't known until the caller has read the
+	// response, so the rest is left for Record.
+	sample.observe = func() {
+		if sample.StatusCode/100 == 2 && sample.Failed() {
+			es.IncrFailedResponses(1)
+		}
+		conn.observe(es, sample)
+		es.ObserveOutcome(sample)
+		r.Stats.observeTimeline(sample)
+		r.Window.observe(t, sample.Failed())
+		r.Tokens.observe(token, sample)
+	}
+	if err != nil {
+		if r.DumpFailed {
+			dumpRequest(req.Context(), endpoint, req, nil)
+		}
+		class := classifyError(err)
+		es.IncrRequestErrors(int64(1))
+		es.IncrTransportErrors(class)
+		sample.Error = err.Error()
+		sample.ErrorClass = class
+		return nil, sample, err
+	}
+	es.IncrStatusCodes(resp.StatusCode)
+	es.IncrProtocols(resp.Proto)
+	sample.StatusCode = resp.StatusCode
+	sample.Protocol = resp.Proto
+	if age := resp.Header.Get("Age"); age != "" {
+		es.IncrCachedResponses(1)
+		sample.AgeSeconds, _ = strconv.ParseInt(age, 10, 64)
+	}
+	resp.Body = &countingBody{
+		rc:   resp.Body,
+		wire: countingReader{r: resp.Body},
+		gzip: resp.Header.Get("Content-Encoding") == "gzip",
+		done: func(wire, n int64) {
+			es.IncrResponseBytes(wire)
+			es.IncrUncompressedResponseBytes(n)
+			sample.ResponseBytes = wire
+			sample.UncompressedResponseBytes = n
+		},
+	}
+	if r.DumpFailed && sample.Failed() {
+		dumpRequest(req.Context(), endpoint, req, resp)
+	}
+	return resp, sample, nil
+}
+
+// countingBody counts the bytes of a response body as sent on the wire and
+// after decoding, decompressing gzip encoded bodies itself so both sizes are
+// known. On Close it reads whatever is left, so every body is measured in
+// full, and reports the totals.
+type countingBody struct {
+	rc   io.ReadCloser
+	wire countingReader
+	gzip bool
+	r    io.Reader
+	n    int64
+	done func(wire, n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	if b.r == nil {
+		b.r = &b.wire
+		if b.gzip {
+			gz, err := gzip.NewReader(&b.wire)
+			if err != nil {
+				return 0, err
+			}
+			b.r = gz
+		}
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	io.Copy(io.Discard, b)
+	io.Copy(io.Discard, &b.wire)
+	b.done(b.wire.n, b.n)
+	return b.rc.Close()
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (r *Reporter) CreateIndexReport(ctx context.Context, body []byte, token string) (string, error) {
+	return r.createIndexReport(ctx, body, token, "")
+}
+
+// CreateIndexReportFor is CreateIndexReport for a manifest whose hash is
+// known, failing the request if Clair returns the index report for another.
+func (r *Reporter) CreateIndexReportFor(ctx context.Context, body []byte, hash string, token string) error {
+	_, err := r.createIndexReport(ctx, body, token, hash)
+	return err
+}
+
+func (r *Reporter) createIndexReport(ctx context.Context, body []byte, token string, want string) (string, error) {
+	req, err := r.newRequest(
+		ctx, http.MethodPost,
+		"/indexer/api/v1/index_report",
+		bytes.NewBuffer(body),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	transfer := r.transfer()
+	setTransfer(req, transfer)
+	r.throttleBody(req, body)
+
+	resp, sample, err := r.Do(EndpointIndexReport, req)
+	if transfer == TransferChunked {
+		// Do only counts bodies of a known length.
+		sample.RequestBytes = int64(len(body))
+		r.Stats.Endpoint(EndpointIndexReport).IncrRequestBytes(sample.RequestBytes)
+	}
+	if r.Transfer != "" {
+		sample.Transfer = transfer
+	}
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		r.Stats.Endpoint(EndpointIndexReport).IncrNon2XXResponses(int64(1))
+		return "", ResponseErrorf(resp.StatusCode, "non 201 response from indexer %d", resp.StatusCode)
+	}
+	// decode response
+	var irr = &IndexReportReponse{}
+	err = json.NewDecoder(resp.Body).Decode(&irr)
+	if err != nil {
+		sample.Error = err.Error()
+		return "", err
+	}
+	sample.Hash = irr.Hash
+	sample.State = irr.State
+	r.Stats.indexReports.observe(irr)
+	if irr.failed() {
+		err := &IndexReportError{Hash: irr.Hash, State: irr.State, Err: irr.Err}
+		sample.Error = err.Error()
+		return "", err
+	}
+	if want != "" && irr.Hash != want {
+		err := fmt.Errorf("index report for %s returned for %s", irr.Hash, want)
+		sample.Error = err.Error()
+		return "", err
+	}
+
+	return irr.Hash, nil
+}
+
+// ErrIndexReportNotFound is returned when the matcher doesn't know the
+// index report asked for, usually because the vulnerability report was
+// requested before indexing finished.
+var ErrIndexReportNotFound = errors.New("index report not found")
+
+// GetVulnerabilityReport fetches the vulnerability report for hash, returning
+// its size and counts, or nil if it wasn't sent because it hadn't changed. A
+// 404 is counted separately from other failures, and returns
+// ErrIndexReportNotFound.
+func (r *Reporter) GetVulnerabilityReport(ctx context.Context, hash string, token string) (*VulnerabilityReportSummary, error) {
+	endpoint, path := EndpointVulnerabilityReport, "/matcher/api/v1/vulnerability_report/"+hash
+	filtered := r.filterReport()
+	if filtered {
+		endpoint, path = EndpointFilteredVulnerabilityReport, path+"?"+r.ReportFilter
+	}
+	req, err := r.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Authorization", "Bearer "+token)
+	key := endpoint + "/" + hash
+	conditional := r.ETags.apply(req, key)
+
+	resp, sample, err := r.Do(endpoint, req)
+	sample.Hash = hash
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	cached := resp.Header.Get("Age") != ""
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		r.Stats.Endpoint(endpoint).IncrNotModifiedResponses(int64(1))
+		if !filtered {
+			r.Polls.observe(hash, nil, true, cached)
+		}
+		return nil, nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		r.Stats.Endpoint(endpoint).IncrNotFoundResponses(int64(1))
+		return nil, ErrIndexReportNotFound
+	}
+	r.ETags.store(key, resp)
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(endpoint).IncrNon2XXResponses(int64(1))
+		return nil, ResponseErrorf(resp.StatusCode, "non 200 response from matcher %d", resp.StatusCode)
+	}
+	if filtered {
+		report, err := r.readVulnerabilityReport(ctx, resp.Body, true)
+		if err != nil {
+			sample.Error = err.Error()
+		}
+		return report, err
+	}
+	var body io.Reader = resp.Body
+	d := r.Polls.digest()
+	if d != nil {
+		body = io.TeeReader(body, d)
+	}
+	full := r.Rechecks.capture()
+	if full != nil {
+		body = io.TeeReader(body, full)
+	}
+	report, err := r.readVulnerabilityReport(ctx, body, false)
+	if err != nil {
+		sample.Error = err.Error()
+		return report, err
+	}
+	r.Polls.observe(hash, d, false, cached)
+	if full != nil {
+		r.Rechecks.observe(ctx, hash, full.Bytes())
+	}
+	return report, nil
+}
+
+func (r *Reporter) DeleteIndexReports(ctx context.Context, hash string, token string) error {
+	req, err := r.newRequest(
+		ctx, http.MethodDelete,
+		"/indexer/api/v1/index_report/"+hash,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	zlog.Debug(ctx).Str("hash", hash).Msg("deleting index report")
+	resp, sample, err := r.Do(EndpointDeleteIndexReport, req)
+	sample.Hash = hash
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		r.Stats.Endpoint(EndpointDeleteIndexReport).IncrNon2XXResponses(int64(1))
+		return ResponseErrorf(resp.StatusCode, "non 204 response from indexer while deleting %d", resp.StatusCode)
+	}
+	r.Stats.IncrDeletedIndexReports(int64(1))
+	if r.VerifyDeletes {
+		return r.VerifyDeleted(ctx, hash, token)
+	}
+	return nil
+}
+
+// ErrDeleteNotApplied is returned when an index report can still be fetched
+// after Clair said it was deleted.
+var ErrDeleteNotApplied = errors.New("delete didn't take effect")
+
+// VerifyDeleted waits VerifyDelay, then fetches the index report for hash,
+// which was just deleted, returning ErrDeleteNotApplied if it's still there.
+func (r *Reporter) VerifyDeleted(ctx context.Context, hash string, token string) error {
+	if err := r.waitVerifyDelay(ctx); err != nil {
+		return err
+	}
+	return r.checkDeleted(ctx, hash, token)
+}
+
+// verifyDeletedAll verifies the deletes of hashes after waiting VerifyDelay
+// once, returning the first error.
+func (r *Reporter) verifyDeletedAll(ctx context.Context, hashes []string, token string) error {
+	if err := r.waitVerifyDelay(ctx); err != nil {
+		return err
+	}
+	var first error
+	for _, hash := range hashes {
+		if err := r.checkDeleted(ctx, hash, token); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (r *Reporter) waitVerifyDelay(ctx context.Context) error {
+	if r.VerifyDelay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.VerifyDelay):
+		return nil
+	}
+}
+
+func (r *Reporter) checkDeleted(ctx context.Context, hash string, token string) error {
+	req, err := r.newRequest(
+		ctx, http.MethodGet,
+		"/indexer/api/v1/index_report/"+hash,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	resp, sample, err := r.Do(EndpointVerifyDelete, req)
+	sample.Hash = hash
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		r.Stats.IncrVerifiedDeletes(int64(1))
+		return nil
+	case http.StatusOK:
+		r.Stats.IncrVerifiedDeletes(int64(1))
+		r.Stats.IncrDeletesNotApplied(int64(1))
+		sample.Error = ErrDeleteNotApplied.Error()
+		return fmt.Errorf("index report %s: %w", hash, ErrDeleteNotApplied)
+	}
+	r.Stats.Endpoint(EndpointVerifyDelete).IncrNon2XXResponses(int64(1))
+	return ResponseErrorf(resp.StatusCode, "non 404 response from indexer while verifying delete %d", resp.StatusCode)
+}
+
+// BulkDeleteIndexReports deletes the index reports for all of the hashes in a
+// single request, returning how many Clair reported as deleted.
+func (r *Reporter) BulkDeleteIndexReports(ctx context.Context, hashes []string, token string) (int, error) {
+	body, err := json.Marshal(hashes)
+	if err != nil {
+		return 0, err
+	}
+	req, err := r.newRequest(
+		ctx, http.MethodDelete,
+		"/indexer/api/v1/index_report",
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	zlog.Debug(ctx).Int("count", len(hashes)).Msg("bulk deleting index reports")
+	resp, sample, err := r.Do(EndpointBulkDeleteIndexReports, req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(EndpointBulkDeleteIndexReports).IncrNon2XXResponses(int64(1))
+		return 0, ResponseErrorf(resp.StatusCode, "non 200 response from indexer while bulk deleting %d", resp.StatusCode)
+	}
+	var deleted []string
+	err = json.NewDecoder(resp.Body).Decode(&deleted)
+	if err != nil {
+		sample.Error = err.Error()
+		return 0, err
+	}
+	r.Stats.IncrDeletedIndexReports(int64(len(deleted)))
+	if r.VerifyDeletes {
+		return len(deleted), r.verifyDeletedAll(ctx, deleted, token)
+	}
+	return len(deleted), nil
+}
+
+// QueueDelete adds hash to the pending bulk delete, sending it once it's
+// full.
+func (r *Reporter) QueueDelete(ctx context.Context, hash string) error {
+	r.Deletes.mu.Lock()
+	r.Deletes.hashes = append(r.Deletes.hashes, hash)
+	var batch []string
+	if len(r.Deletes.hashes) >= r.Deletes.size {
+		batch = r.Deletes.hashes
+		r.Deletes.hashes = nil
+	}
+	r.Deletes.mu.Unlock()
+	if batch == nil {
+		return nil
+	}
+	return r.sendDeletes(ctx, batch)
+}
+
+// FlushDeletes sends whatever is left in the pending bulk delete.
+func (r *Reporter) FlushDeletes(ctx context.Context) error {
+	if r.Deletes == nil {
+		return nil
+	}
+	r.Deletes.mu.Lock()
+	batch := r.Deletes.hashes
+	r.Deletes.hashes = nil
+	r.Deletes.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	return r.sendDeletes(ctx, batch)
+}
+
+func (r *Reporter) sendDeletes(ctx context.Context, batch []string) error {
+	token, err := CreateToken(r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	n, err := r.BulkDeleteIndexReports(ctx, batch, token)
+	if err != nil {
+		return fmt.Errorf("could not bulk delete index reports: %w", err)
+	}
+	if n != len(batch) {
+		zlog.Warn(ctx).
+			Int("requested", len(batch)).
+			Int("deleted", n).
+			Msg("bulk delete didn't delete every index report")
+	}
+	return nil
+}
+
+// StepFailed records that a step doing op failed with err, which the caller
+// has logged. It returns err if FailFast is set, so returning it from the
+// step ends the run, and nil otherwise.
+func (r *Reporter) StepFailed(op string, err error) error {
+	r.Errors.Record(op, err)
+	if r.FailFast {
+		return fmt.Errorf("%s failed: %w", op, err)
+	}
+	return nil
+}
+
+// authorize re-signs the token of requests that carry one, as a tenant, with
+// the signing key or with the PSK timed by Tokens, returning the tenant and
+// when the token is valid if Tokens is set.
+func (r *Reporter) authorize(req *http.Request) (string, *tokenInfo, error) {
+	switch {
+	case req.Header.Get("Authorization") == "":
+		return "", nil, nil
+	case r.Tenants != nil:
+		return r.Tenants.authorize(req, r.Tokens)
+	case r.Signer != nil:
+		info, err := r.Signer.authorize(req, r.Tokens)
+		return "", info, err
+	case r.Tokens != nil:
+		info, err := setToken(req, "", r.Tokens, func(t *TokenTiming) (string, tokenInfo, error) {
+			return createToken(r.PSK, DefaultIssuer, t)
+		})
+		return "", info, err
+	}
+	return "", nil, nil
+}
+
+// Record records the outcome of the request Do made, attributes the sample
+// to its manifest's size class, pad size, tenant and the current phase, marks
+// it if it was made during a spike or an update window, and passes it to the
+// Sink, if there is one, and the Reservoir.
+func (r *Reporter) Record(ctx context.Context, s *Sample) {
+	if s.observe != nil {
+		s.observe()
+		s.observe = nil
+	}
+	r.Classes.observe(s, r.Stats)
+	r.Pads.observe(s, r.Stats)
+	r.observeTransfer(s)
+	r.Tenants.observe(s, r.Stats)
+	r.Phases.observe(s)
+	r.Spikes.observe(s)
+	r.Updates.observe(s)
+	r.Anomalies.observe(s)
+	r.Reservoir.observe(s)
+	if r.Sink == nil {
+		return
+	}
+	if err := r.Sink.ConsumeSample(s); err != nil {
+		zlog.Warn(ctx).Err(err).Msg("could not record sample")
+	}
+}
+
+// WaitForIndex polls the index report for hash, backing off up to 10s
+// between requests, until Clair reports it as finished or timeout passes.
+func (r *Reporter) WaitForIndex(ctx context.Context, hash string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	wait := time.Second
+	for {
+		token, err := CreateToken(r.PSK)
+		if err != nil {
+			return fmt.Errorf("could not create token: %w", err)
+		}
+		state, err := r.IndexReportState(ctx, hash, token)
+		switch {
+		case err != nil:
+			return fmt.Errorf("could not confirm index report %s: %w", hash, err)
+		case state == IndexFinished:
+			return nil
+		case state == IndexError:
+			return fmt.Errorf("index report %s failed", hash)
+		}
+		zlog.Debug(ctx).Str("hash", hash).Str("state", state).Msg("waiting for index report")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("index report %s not finished: %w", hash, ctx.Err())
+		case <-time.After(wait):
+		}
+		if wait < time.Second*10 {
+			wait *= 2
+		}
+	}
+}
+
+// IndexReportState fetches the index report for hash, returning its state.
+func (r *Reporter) IndexReportState(ctx context.Context, hash string, token string) (string, error) {
+	req, err := r.newRequest(
+		ctx, http.MethodGet,
+		"/indexer/api/v1/index_report/"+hash,
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	resp, sample, err := r.Do(EndpointGetIndexReport, req)
+	sample.Hash = hash
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(EndpointGetIndexReport).IncrNon2XXResponses(int64(1))
+		return "", ResponseErrorf(resp.StatusCode, "non 200 response from indexer %d", resp.StatusCode)
+	}
+	var report struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		sample.Error = err.Error()
+		return "", err
+	}
+	return report.State, nil
+}
+
+func (r *Reporter) GetIndexReport(ctx context.Context, hash string, token string) error {
+	req, err := r.newRequest(
+		ctx, http.MethodGet,
+		"/indexer/api/v1/index_report/"+hash,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	key := EndpointGetIndexReport + "/" + hash
+	conditional := r.ETags.apply(req, key)
+
+	resp, sample, err := r.Do(EndpointGetIndexReport, req)
+	sample.Hash = hash
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		r.Stats.Endpoint(EndpointGetIndexReport).IncrNotModifiedResponses(int64(1))
+		return nil
+	}
+	r.ETags.store(key, resp)
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(EndpointGetIndexReport).IncrNon2XXResponses(int64(1))
+		return ResponseErrorf(resp.StatusCode, "non 200 response from indexer %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// outcomeRequests returns how many of the endpoint's requests were recorded
+// with outcome.
+func outcomeRequests(e *EndpointStats, outcome string) int64 {
+	if l := e.LatencyByOutcome[outcome]; l != nil {
+		return l.Requests
+	}
+	return 0
+}
+
+func TestDeleteNotAppliedCountsAsFailure(t *testing.T) {
+	// The index report is still served after it's deleted.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			fmt.Fprint(w, `{"manifest_hash":"sha256:abc","state":"IndexFinished","success":true}`)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	r := NewReporter(srv.URL, "")
+	r.VerifyDeletes = true
+
+	err := r.DeleteIndexReports(ctx, "sha256:abc", "token")
+	if !errors.Is(err, ErrDeleteNotApplied) {
+		t.Fatalf("got error %v, want ErrDeleteNotApplied", err)
+	}
+
+	st := r.Stats.GetStats()
+	if st.DeletesNotApplied != 1 {
+		t.Errorf("deletes not applied is %d, want 1", st.DeletesNotApplied)
+	}
+	if st.ErrorRate <= 0 {
+		t.Errorf("error rate is %v, want it above 0", st.ErrorRate)
+	}
+	e := st.Endpoints[EndpointVerifyDelete]
+	if e.FailedResponses != 1 {
+		t.Errorf("failed responses is %d, want 1", e.FailedResponses)
+	}
+	if got := outcomeRequests(e, OutcomeFailure); got != 1 {
+		t.Errorf("%d verify requests recorded as failures, want 1", got)
+	}
+	if len(st.Timeline) == 0 || st.Timeline[0].Endpoints[EndpointVerifyDelete].Errors != 1 {
+		t.Errorf("timeline %+v, want 1 verify error", st.Timeline)
+	}
+}
+
+func TestIndexErrorCountsAsFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"manifest_hash":"sha256:abc","state":"IndexError","success":false,"err":"could not fetch layer"}`)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	r := NewReporter(srv.URL, "")
+	r.Window = NewErrorWindow(time.Minute)
+
+	_, err := r.CreateIndexReport(ctx, []byte(`{"hash":"sha256:abc"}`), "token")
+	var ire *IndexReportError
+	if !errors.As(err, &ire) {
+		t.Fatalf("got error %v, want an IndexReportError", err)
+	}
+
+	st := r.Stats.GetStats()
+	if st.ErrorRate <= 0 {
+		t.Errorf("error rate is %v, want it above 0", st.ErrorRate)
+	}
+	e := st.Endpoints[EndpointIndexReport]
+	if e.FailedResponses != 1 {
+		t.Errorf("failed responses is %d, want 1", e.FailedResponses)
+	}
+	if got := outcomeRequests(e, OutcomeFailure); got != 1 {
+		t.Errorf("%d requests recorded as failures, want 1", got)
+	}
+	if got := outcomeRequests(e, OutcomeSuccess); got != 0 {
+		t.Errorf("%d requests recorded as successes, want 0", got)
+	}
+	if len(st.Timeline) == 0 || st.Timeline[0].Errors != 1 {
+		t.Errorf("timeline %+v, want 1 error", st.Timeline)
+	}
+	if rate, n := r.Window.Rate(time.Now()); rate != 1 || n != 1 {
+		t.Errorf("window error rate is %v of %d requests, want 1 of 1", rate, n)
+	}
+}
+
+func TestDoLeavesOutcomeToRecord(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"state":"IndexFinished"}`)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	r := NewReporter(srv.URL, "")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, sample, err := r.Do(EndpointGetIndexReport, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// The caller finds fault with the response after Do has returned.
+	sample.Error = "could not decode index report"
+	r.Record(ctx, sample)
+
+	e := r.Stats.GetStats().Endpoints[EndpointGetIndexReport]
+	if e.FailedResponses != 1 || e.Non2XXResponses != 0 {
+		t.Errorf("failed responses is %d and non 2XX responses %d, want 1 and 0", e.FailedResponses, e.Non2XXResponses)
+	}
+	if got := outcomeRequests(e, OutcomeFailure); got != 1 {
+		t.Errorf("%d requests recorded as failures, want 1", got)
+	}
+}
+
+func TestNon2XXResponsesAreNotFailedResponses(t *testing.T) {
+	codes := []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError, http.StatusServiceUnavailable}
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(codes[atomic.AddInt32(&n, 1)-1])
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	r := NewReporter(srv.URL, "")
+
+	for _, code := range codes {
+		_, err := r.CreateIndexReport(ctx, []byte(`{"hash":"sha256:abc"}`), "token")
+		var re *ResponseError
+		if !errors.As(err, &re) {
+			t.Fatalf("%d: got error %v, want a ResponseError", code, err)
+		}
+	}
+
+	st := r.Stats.GetStats()
+	e := st.Endpoints[EndpointIndexReport]
+	if e.Non2XXResponses != int64(len(codes)) {
+		t.Errorf("non 2XX responses is %d, want %d", e.Non2XXResponses, len(codes))
+	}
+	if e.FailedResponses != 0 {
+		t.Errorf("failed responses is %d, want 0", e.FailedResponses)
+	}
+	if got := outcomeRequests(e, OutcomeFailure); got != int64(len(codes)) {
+		t.Errorf("%d requests recorded as failures, want %d", got, len(codes))
+	}
+	if st.ErrorRate != 1 {
+		t.Errorf("error rate is %v, want 1", st.ErrorRate)
+	}
+}
+
+func TestStatsKeepTopLevelReportTotals(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	r := NewReporter(srv.URL, "")
+
+	r.CreateIndexReport(ctx, []byte(`{"hash":"sha256:abc"}`), "token")
+	r.BulkDeleteIndexReports(ctx, []string{"sha256:abc"}, "token")
+
+	st := r.Stats.GetStats()
+	if st.TotalIndexReportRequests != 1 || st.Non2XXIndexReportResponses != 1 {
+		t.Errorf("index report requests %d with %d non 2XX responses, want 1 and 1", st.TotalIndexReportRequests, st.Non2XXIndexReportResponses)
+	}
+	if st.TotalBulkDeleteIndexReportRequests != 1 || st.Non2XXBulkDeleteIndexReportResponses != 1 {
+		t.Errorf("bulk delete requests %d with %d non 2XX responses, want 1 and 1", st.TotalBulkDeleteIndexReportRequests, st.Non2XXBulkDeleteIndexReportResponses)
+	}
+	if st.TotalVulnerabilityReportRequests != 0 {
+		t.Errorf("vulnerability report requests %d, want 0", st.TotalVulnerabilityReportRequests)
+	}
+	if _, ok := st.Endpoints[EndpointVulnerabilityReport]; ok {
+		t.Error("summarizing the stats added a vulnerability report endpoint")
+	}
+}
+
+func TestCreateIndexReportForOtherHashFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"manifest_hash":"sha256:def","state":"IndexFinished","success":true}`)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	r := NewReporter(srv.URL, "")
+
+	if err := r.CreateIndexReportFor(ctx, []byte(`{"hash":"sha256:abc"}`), "sha256:abc", "token"); err == nil {
+		t.Fatal("got no error for another manifest's index report")
+	}
+	st := r.Stats.GetStats()
+	e := st.Endpoints[EndpointIndexReport]
+	if e.FailedResponses != 1 {
+		t.Errorf("failed responses is %d, want 1", e.FailedResponses)
+	}
+	if st.ErrorRate != 1 {
+		t.Errorf("error rate is %v, want 1", st.ErrorRate)
+	}
+}
@@ -0,0 +1,85 @@
+package loadtest
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// reportFilterMinSaving is the least filtered reports must save, in percent,
+// for the filter to be taken as applied.
+const reportFilterMinSaving = 1
+
+// ReportFilterStats compare the vulnerability reports requested with a
+// filter with those requested in full, by their 200 responses.
+type ReportFilterStats struct {
+	Query    string         `json:"query"`
+	Full     *ReportVariant `json:"full"`
+	Filtered *ReportVariant `json:"filtered"`
+	// BytesSavedPercent is how much smaller filtered reports were than full
+	// ones on average, uncompressed.
+	BytesSavedPercent float64 `json:"bytes_saved_percent"`
+	// Ignored is set if filtered reports were under reportFilterMinSaving
+	// smaller than full ones, as when Clair doesn't support the filter and
+	// answers in full.
+	Ignored bool `json:"ignored"`
+}
+
+// ReportVariant is the 200 responses to one kind of vulnerability report
+// request.
+type ReportVariant struct {
+	Responses                        int64   `json:"responses"`
+	AverageResponseBytes             float64 `json:"average_response_bytes"`
+	AverageUncompressedResponseBytes float64 `json:"average_uncompressed_response_bytes"`
+	P50LatencyMilliseconds           int64   `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds           int64   `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds           int64   `json:"p99_latency_milliseconds"`
+}
+
+// filterReport reports whether the next vulnerability report is requested
+// with ReportFilter, spreading FilterShare of them evenly over the run.
+func (r *Reporter) filterReport() bool {
+	if r.ReportFilter == "" {
+		return false
+	}
+	n := float64(atomic.AddInt64(&r.reports, 1))
+	return math.Floor(n*r.FilterShare) > math.Floor((n-1)*r.FilterShare)
+}
+
+// CompareReportFilter compares the filtered and full vulnerability reports in
+// stats, summarized by GetStats. It returns nil if either kind got no 200
+// responses.
+func CompareReportFilter(stats *Stats, query string) *ReportFilterStats {
+	full := reportVariant(stats.Endpoints[EndpointVulnerabilityReport])
+	filtered := reportVariant(stats.Endpoints[EndpointFilteredVulnerabilityReport])
+	if full == nil || filtered == nil {
+		return nil
+	}
+	rf := &ReportFilterStats{Query: query, Full: full, Filtered: filtered}
+	if full.AverageUncompressedResponseBytes > 0 {
+		rf.BytesSavedPercent = (1 - filtered.AverageUncompressedResponseBytes/full.AverageUncompressedResponseBytes) * 100
+	}
+	rf.Ignored = rf.BytesSavedPercent < reportFilterMinSaving
+	return rf
+}
+
+func reportVariant(e *EndpointStats) *ReportVariant {
+	if e == nil {
+		return nil
+	}
+	ok := e.StatusCodes[http.StatusOK]
+	if ok == 0 {
+		return nil
+	}
+	v := &ReportVariant{
+		Responses:                        ok,
+		AverageResponseBytes:             float64(e.ResponseBytes) / float64(ok),
+		AverageUncompressedResponseBytes: float64(e.UncompressedResponseBytes) / float64(ok),
+	}
+	if o, found := e.LatencyByOutcome["2XX"]; found {
+		v.P50LatencyMilliseconds = o.P50LatencyMilliseconds
+		v.P95LatencyMilliseconds = o.P95LatencyMilliseconds
+		v.P99LatencyMilliseconds = o.P99LatencyMilliseconds
+	}
+	return v
+}
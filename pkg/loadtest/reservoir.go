@@ -0,0 +1,56 @@
+package loadtest
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// SampleReservoir keeps a uniform random sample of a run's samples, at most
+// max of them however long the run, so some raw requests are in the stats
+// without a results file. A nil SampleReservoir does nothing.
+type SampleReservoir struct {
+	max int
+
+	mu      sync.Mutex
+	seen    int64
+	samples []*Sample
+	rand    *rand.Rand
+}
+
+// NewSampleReservoir returns a SampleReservoir keeping up to max samples,
+// picked with randomness from seed. A max of 0 returns nil.
+func NewSampleReservoir(max int, seed int64) *SampleReservoir {
+	if max <= 0 {
+		return nil
+	}
+	return &SampleReservoir{max: max, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (r *SampleReservoir) observe(s *Sample) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen++
+	if len(r.samples) < r.max {
+		r.samples = append(r.samples, s)
+		return
+	}
+	if i := r.rand.Int63n(r.seen); i < int64(r.max) {
+		r.samples[i] = s
+	}
+}
+
+// Samples returns the samples kept, ordered by when they were made.
+func (r *SampleReservoir) Samples() []*Sample {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := append([]*Sample(nil), r.samples...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
@@ -0,0 +1,52 @@
+package loadtest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/crozzy/clair-load-test/pkg/results"
+)
+
+// Results returns the stats, as they were when GetStats was last called, as
+// package results' Stats, which is what a run's output is read back as.
+func (s *Stats) Results() (*results.Stats, error) {
+	s.mu.RLock()
+	b, err := json.Marshal(s)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("could not encode stats: %w", err)
+	}
+	out := &results.Stats{}
+	if err := json.Unmarshal(b, out); err != nil {
+		return nil, fmt.Errorf("could not convert stats: %w", err)
+	}
+	return out, nil
+}
+
+// Result returns the sample as package results' Sample, a line of a results
+// file.
+func (s *Sample) Result() *results.Sample {
+	return &results.Sample{
+		Time:                      s.Time,
+		Endpoint:                  s.Endpoint,
+		RequestID:                 s.RequestID,
+		Hash:                      s.Hash,
+		SizeClass:                 s.SizeClass,
+		Tenant:                    s.Tenant,
+		Phase:                     s.Phase,
+		Spike:                     s.Spike,
+		Updating:                  s.Updating,
+		State:                     s.State,
+		Transfer:                  s.Transfer,
+		LatencyMilliseconds:       s.LatencyMilliseconds,
+		RequestBytes:              s.RequestBytes,
+		StatusCode:                s.StatusCode,
+		Protocol:                  s.Protocol,
+		NewConnection:             s.NewConnection,
+		ResponseBytes:             s.ResponseBytes,
+		UncompressedResponseBytes: s.UncompressedResponseBytes,
+		AgeSeconds:                s.AgeSeconds,
+		Error:                     s.Error,
+		ErrorClass:                s.ErrorClass,
+	}
+}
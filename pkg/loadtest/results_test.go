@@ -0,0 +1,107 @@
+package loadtest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/crozzy/clair-load-test/pkg/results"
+)
+
+// jsonFields returns the struct's fields by the name they're encoded with,
+// including those of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			for n, ef := range jsonFields(f.Type) {
+				fields[n] = ef
+			}
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// sameSchema checks a and b encode to the same JSON fields, of the same
+// kinds.
+func sameSchema(t *testing.T, path string, a, b reflect.Type) {
+	t.Helper()
+	if a.Kind() != b.Kind() {
+		t.Errorf("%s is a %s in loadtest and a %s in results", path, a.Kind(), b.Kind())
+		return
+	}
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		sameSchema(t, path, a.Elem(), b.Elem())
+		return
+	case reflect.Map:
+		sameSchema(t, path+" key", a.Key(), b.Key())
+		sameSchema(t, path, a.Elem(), b.Elem())
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+	if a.PkgPath() == "time" || b.PkgPath() == "time" {
+		if a != b {
+			t.Errorf("%s is a %s in loadtest and a %s in results", path, a, b)
+		}
+		return
+	}
+	af, bf := jsonFields(a), jsonFields(b)
+	for n, f := range af {
+		g, ok := bf[n]
+		if !ok {
+			t.Errorf("%s.%s is missing from results", path, n)
+			continue
+		}
+		if f.Tag != g.Tag {
+			t.Errorf("%s.%s is tagged %q in loadtest and %q in results", path, n, f.Tag, g.Tag)
+		}
+		sameSchema(t, path+"."+n, f.Type, g.Type)
+	}
+	for n := range bf {
+		if _, ok := af[n]; !ok {
+			t.Errorf("%s.%s is only in results", path, n)
+		}
+	}
+}
+
+func TestResultsSchema(t *testing.T) {
+	sameSchema(t, "stats", reflect.TypeOf(Stats{}), reflect.TypeOf(results.Stats{}))
+	sameSchema(t, "sample", reflect.TypeOf(Sample{}), reflect.TypeOf(results.Sample{}))
+}
+
+func TestStatsResults(t *testing.T) {
+	s := NewStats()
+	e := s.Endpoint(EndpointIndexReport)
+	e.IncrTotalRequests(2)
+	e.IncrTotalLatencyMilliseconds(30)
+	e.IncrNon2XXResponses(1)
+	s.GetStats()
+
+	out, err := s.Results()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.SchemaVersion != results.SchemaVersion {
+		t.Errorf("schema version is %d, want %d", out.SchemaVersion, results.SchemaVersion)
+	}
+	re := out.Endpoints[results.EndpointIndexReport]
+	if re == nil || re.TotalRequests != 2 || re.Non2XXResponses != 1 || re.MaxLatencyMilliseconds != 30 {
+		t.Errorf("index report stats are %+v, want 2 requests, 1 non 2XX response and a max of 30ms", re)
+	}
+	if out.TotalIndexReportRequests != 2 {
+		t.Errorf("total index report requests is %d, want 2", out.TotalIndexReportRequests)
+	}
+}
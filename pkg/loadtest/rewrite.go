@@ -0,0 +1,91 @@
+package loadtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// LayerRewriter rewrites the layer URLs of generated manifests, so Clair
+// fetches layers from a local stub or mirror instead of the registry. A nil
+// LayerRewriter leaves manifests untouched.
+type LayerRewriter struct {
+	// from is the prefix replaced by to. If from is empty, the scheme and
+	// host of every URL are replaced by those of target instead.
+	from, to string
+	target   *url.URL
+}
+
+// ParseLayerRewrite parses a rewrite of the form "from=to", replacing the
+// from prefix of layer URLs, or a bare base URL whose scheme and host
+// replace those of every layer URL.
+func ParseLayerRewrite(s string) (*LayerRewriter, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if parts := strings.SplitN(s, "=", 2); len(parts) == 2 {
+		if parts[0] == "" {
+			return nil, fmt.Errorf("empty prefix in %q", s)
+		}
+		return &LayerRewriter{from: parts[0], to: parts[1]}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("%q needs a scheme and host", s)
+	}
+	return &LayerRewriter{target: u}, nil
+}
+
+func (lr *LayerRewriter) rewriteURL(s string) (string, error) {
+	if lr.target == nil {
+		if strings.HasPrefix(s, lr.from) {
+			return lr.to + strings.TrimPrefix(s, lr.from), nil
+		}
+		return s, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = lr.target.Scheme
+	u.Host = lr.target.Host
+	return u.String(), nil
+}
+
+// apply returns the manifest with its layer URLs rewritten. Everything else
+// in the manifest is passed through as is.
+func (lr *LayerRewriter) apply(manifest []byte) ([]byte, error) {
+	if lr == nil {
+		return manifest, nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("could not decode manifest: %w", err)
+	}
+	var layers []map[string]json.RawMessage
+	if err := json.Unmarshal(m["layers"], &layers); err != nil {
+		return nil, fmt.Errorf("could not decode manifest layers: %w", err)
+	}
+	for _, l := range layers {
+		var uri string
+		if err := json.Unmarshal(l["uri"], &uri); err != nil {
+			return nil, fmt.Errorf("could not decode layer uri: %w", err)
+		}
+		uri, err := lr.rewriteURL(uri)
+		if err != nil {
+			return nil, fmt.Errorf("could not rewrite layer uri: %w", err)
+		}
+		if l["uri"], err = json.Marshal(uri); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if m["layers"], err = json.Marshal(layers); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
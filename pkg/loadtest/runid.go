@@ -0,0 +1,31 @@
+package loadtest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync/atomic"
+)
+
+// Headers identifying load test traffic, so Clair's access logs and traces
+// can be filtered down to a run or a single request.
+const (
+	HeaderRunID     = "X-Load-Test-Run-Id"
+	HeaderRequestID = "X-Request-Id"
+)
+
+// NewUUID returns a random (version 4) UUID.
+func NewUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("could not read random bytes: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// nextRequestID returns the ID for the reporter's next request, the run ID
+// followed by a sequence number.
+func (r *Reporter) nextRequestID() string {
+	return fmt.Sprintf("%s-%d", r.RunID, atomic.AddInt64(&r.requests, 1))
+}
@@ -0,0 +1,210 @@
+package loadtest
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/quay/zlog"
+	"golang.org/x/sync/errgroup"
+)
+
+// StepFunc is a single step of a load test, such as indexing and matching
+// one container. n counts the steps started before it.
+type StepFunc func(ctx context.Context, n int) error
+
+// DefaultWorkers is how many steps a Runner runs at once by default.
+const DefaultWorkers = 500
+
+// DefaultGrace is how long steps still running at the end of a run are
+// given to finish by default.
+const DefaultGrace = time.Minute
+
+// Runner drives a load test, calling a StepFunc at the rate set by its
+// Control.
+type Runner struct {
+	Control *Control
+	// Timeout is how long steps are started for.
+	Timeout time.Duration
+	// Workers is how many steps can run at once. Steps are handed to a
+	// fixed pool of this many workers; while every one is busy, steps that
+	// are due wait for one to finish, and once as many are waiting as there
+	// are workers further steps are skipped.
+	Workers int
+	// Grace is how long steps still running once the timeout has passed, or
+	// the Control is stopped, get to finish before they're cancelled. Each
+	// step's context has a deadline of Timeout plus Grace from the start of
+	// the run.
+	Grace time.Duration
+	// Budget, if set, splits the time of each step from being due to
+	// returning into time queued for a worker, waiting on Clair and the
+	// rest.
+	Budget *BudgetTracker
+	// Steps, if set, is how many steps are started. The run ends once the
+	// last of them returns, or at the timeout if that's first.
+	Steps int
+
+	inFlight int64
+}
+
+// job is a step handed to a worker, and when it was due.
+type job struct {
+	n   int
+	due time.Time
+}
+
+// NewRunner returns a Runner starting steps at the rate set by ctl for
+// timeout, with DefaultWorkers workers and DefaultGrace to finish.
+func NewRunner(ctl *Control, timeout time.Duration) *Runner {
+	return &Runner{Control: ctl, Timeout: timeout, Workers: DefaultWorkers, Grace: DefaultGrace}
+}
+
+// InFlight returns how many steps are running.
+func (r *Runner) InFlight() int {
+	return int(atomic.LoadInt64(&r.inFlight))
+}
+
+// Run calls step at the rate set by the Control until the timeout has
+// passed, ctx is done or the Control is stopped, then waits up to the grace
+// period for the calls still in flight before cancelling them. With Steps
+// set, once they've all been started it waits for them until the timeout
+// plus the grace period from the start of the run instead. While the
+// Control is paused no calls are made, but the timeout keeps running. A step
+// returning an error cancels the others and ends the run, as does ctx being
+// done.
+func (r *Runner) Run(ctx context.Context, step StepFunc) error {
+	ctl := r.Control
+	g, ctx := errgroup.WithContext(ctx)
+	workers := r.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	stepsCtx, cancelSteps := context.WithDeadline(ctx, time.Now().Add(r.Timeout+r.Grace))
+	defer cancelSteps()
+	work := make(chan job)
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			for j := range work {
+				atomic.AddInt64(&r.inFlight, 1)
+				start := time.Now()
+				ctx, t := r.Budget.start(stepsCtx)
+				err := step(ctx, j.n)
+				r.Budget.observe(j.due, start, t)
+				atomic.AddInt64(&r.inFlight, -1)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	// due counts the steps whose time has come but that no worker has
+	// taken yet. Sending to work is only attempted while there are some,
+	// and everything the loop waits on is in the one select, so it sleeps
+	// until there's something to do and notices a cancelled run or a
+	// changed Control however busy the workers are. dueAt holds when each
+	// of them came due, oldest first.
+	n, due, skipped := 0, 0, 0
+	var dueAt []time.Time
+	saturated := false
+	timer := time.NewTimer(r.Timeout)
+	defer timer.Stop()
+	rate, paused, changed := ctl.State()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+loop:
+	for {
+		tick := ticker.C
+		if paused {
+			tick = nil
+		}
+		var dispatch chan<- job
+		var next job
+		if due > 0 {
+			dispatch = work
+			next = job{n: n, due: dueAt[0]}
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-timer.C:
+			break loop
+		case <-changed:
+			if ctl.Stopped() {
+				break loop
+			}
+			rate, paused, changed = ctl.State()
+			ticker.Reset(time.Duration(float64(time.Second) / rate))
+			if paused {
+				due = 0
+				dueAt = dueAt[:0]
+			}
+		case now := <-tick:
+			switch {
+			case r.Steps > 0 && n+due >= r.Steps:
+				// Every step left is already due.
+			case due == 0:
+				due++
+				dueAt = append(dueAt, now)
+			case due < workers:
+				// Every worker was busy at the last tick too.
+				if !saturated {
+					saturated = true
+					zlog.Warn(ctx).
+						Int("workers", workers).
+						Msg("every worker is busy, steps are being started late; the rate can't be kept up without more workers")
+				}
+				due++
+				dueAt = append(dueAt, now)
+			default:
+				// A whole pool's worth of steps is already late, starting
+				// more once workers free up would only be a burst.
+				skipped++
+			}
+		case dispatch <- next:
+			n++
+			due--
+			dueAt = dueAt[1:]
+			if r.Steps > 0 && n == r.Steps {
+				break loop
+			}
+		}
+	}
+	close(work)
+	if skipped > 0 {
+		zlog.Warn(ctx).Int("skipped", skipped).Msg("steps skipped because every worker was busy")
+	}
+	done := make(chan error, 1)
+	go func() { done <- g.Wait() }()
+	switch {
+	case r.Steps == 0:
+	case n == r.Steps:
+		// The steps' deadline bounds the wait.
+		return <-done
+	default:
+		zlog.Warn(ctx).
+			Int("started", n).
+			Int("steps", r.Steps).
+			Msg("the run ended before every step was started")
+	}
+	if inFlight := r.InFlight(); inFlight > 0 && ctx.Err() == nil {
+		zlog.Info(ctx).
+			Int("in_flight", inFlight).
+			Dur("grace", r.Grace).
+			Msg("waiting for steps in flight")
+	}
+	grace := time.NewTimer(r.Grace)
+	defer grace.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-grace.C:
+	}
+	if inFlight := r.InFlight(); inFlight > 0 {
+		zlog.Warn(ctx).
+			Int("in_flight", inFlight).
+			Msg("cancelling steps still in flight after the grace period")
+	}
+	cancelSteps()
+	return <-done
+}
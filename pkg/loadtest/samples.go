@@ -0,0 +1,164 @@
+package loadtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crozzy/clair-load-test/pkg/results"
+)
+
+// Endpoint names used to label samples and stats, which are package
+// results' names.
+const (
+	EndpointIndexReport                 = results.EndpointIndexReport
+	EndpointGetIndexReport              = results.EndpointGetIndexReport
+	EndpointVulnerabilityReport         = results.EndpointVulnerabilityReport
+	EndpointFilteredVulnerabilityReport = results.EndpointFilteredVulnerabilityReport
+	EndpointRecheckVulnerabilityReport  = results.EndpointRecheckVulnerabilityReport
+	EndpointDeleteIndexReport           = results.EndpointDeleteIndexReport
+	EndpointVerifyDelete                = results.EndpointVerifyDelete
+	EndpointBulkDeleteIndexReports      = results.EndpointBulkDeleteIndexReports
+	EndpointListUpdateOperations        = results.EndpointListUpdateOperations
+	EndpointUpdateDiff                  = results.EndpointUpdateDiff
+	EndpointDeleteUpdateOperation       = results.EndpointDeleteUpdateOperation
+	EndpointIndexState                  = results.EndpointIndexState
+	EndpointAffectedManifests           = results.EndpointAffectedManifests
+	EndpointNotificationPage            = results.EndpointNotificationPage
+	EndpointDeleteNotification          = results.EndpointDeleteNotification
+)
+
+// knownEndpoint reports whether name is one of the endpoint names above.
+func knownEndpoint(name string) bool {
+	switch name {
+	case EndpointIndexReport, EndpointGetIndexReport, EndpointVulnerabilityReport, EndpointRecheckVulnerabilityReport,
+		EndpointFilteredVulnerabilityReport,
+		EndpointDeleteIndexReport, EndpointBulkDeleteIndexReports, EndpointVerifyDelete,
+		EndpointListUpdateOperations, EndpointUpdateDiff, EndpointDeleteUpdateOperation,
+		EndpointIndexState, EndpointAffectedManifests,
+		EndpointNotificationPage, EndpointDeleteNotification:
+		return true
+	}
+	return false
+}
+
+// Sample is the record of a single request made against Clair. A results
+// file is a sequence of JSON encoded samples, one per line.
+type Sample struct {
+	Time      time.Time `json:"time"`
+	Endpoint  string    `json:"endpoint"`
+	RequestID string    `json:"request_id,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	SizeClass string    `json:"size_class,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Phase     string    `json:"phase,omitempty"`
+	Spike     bool      `json:"spike,omitempty"`
+	Updating  bool      `json:"updating,omitempty"`
+	// State is the state of the index report an index request returned.
+	State string `json:"state,omitempty"`
+	// Transfer is how an index request's body was sent, if chosen.
+	Transfer            string `json:"transfer,omitempty"`
+	LatencyMilliseconds int64  `json:"latency_milliseconds"`
+	RequestBytes        int64  `json:"request_bytes,omitempty"`
+	StatusCode          int    `json:"status_code,omitempty"`
+	Protocol            string `json:"protocol,omitempty"`
+	// NewConnection is set if the request couldn't reuse a connection.
+	NewConnection             bool  `json:"new_connection,omitempty"`
+	ResponseBytes             int64 `json:"response_bytes,omitempty"`
+	UncompressedResponseBytes int64 `json:"uncompressed_response_bytes,omitempty"`
+	// AgeSeconds is the response's Age header, set by caches.
+	AgeSeconds int64  `json:"age_seconds,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+
+	// observe records the sample in the stats, once it's been classified.
+	observe func()
+}
+
+// Failed reports whether the request errored or got a non-2XX response, by
+// the rules of package results' Sample.Failed.
+func (s *Sample) Failed() bool {
+	return s.Result().Failed()
+}
+
+// SampleWriter writes samples as JSON lines, the format of a results file.
+// It's the file and stdout sinks. A nil SampleWriter discards everything
+// written to it.
+type SampleWriter struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+// NewSampleWriter creates the results file at path.
+func NewSampleWriter(path string) (*SampleWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return newSampleWriter(f), nil
+}
+
+func newSampleWriter(w io.WriteCloser) *SampleWriter {
+	buf := bufio.NewWriter(w)
+	return &SampleWriter{
+		w:   w,
+		buf: buf,
+		enc: json.NewEncoder(buf),
+	}
+}
+
+func (w *SampleWriter) Write(s *Sample) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(s)
+}
+
+func (w *SampleWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buf.Flush(); err != nil {
+		w.w.Close()
+		return err
+	}
+	return w.w.Close()
+}
+
+// ConsumeSample writes s.
+func (w *SampleWriter) ConsumeSample(s *Sample) error {
+	return w.Write(s)
+}
+
+// Summary flushes and closes the writer. The stats are already in the run's
+// output, so aren't written.
+func (w *SampleWriter) Summary(*Stats) error {
+	return w.Close()
+}
+
+// ReadSamples decodes a results file.
+func ReadSamples(r io.Reader) ([]*Sample, error) {
+	var samples []*Sample
+	dec := json.NewDecoder(r)
+	for {
+		s := &Sample{}
+		err := dec.Decode(s)
+		switch {
+		case err == io.EOF:
+			return samples, nil
+		case err != nil:
+			return nil, fmt.Errorf("could not decode sample %d: %w", len(samples)+1, err)
+		}
+		samples = append(samples, s)
+	}
+}
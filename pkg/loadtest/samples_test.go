@@ -0,0 +1,31 @@
+package loadtest
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSampleFailed(t *testing.T) {
+	tests := []struct {
+		name   string
+		sample Sample
+		want   bool
+	}{
+		{"ok", Sample{Endpoint: EndpointVulnerabilityReport, StatusCode: http.StatusOK}, false},
+		{"not modified", Sample{Endpoint: EndpointVulnerabilityReport, StatusCode: http.StatusNotModified}, false},
+		{"vulnerability report not found", Sample{Endpoint: EndpointVulnerabilityReport, StatusCode: http.StatusNotFound}, false},
+		{"filtered vulnerability report not found", Sample{Endpoint: EndpointFilteredVulnerabilityReport, StatusCode: http.StatusNotFound}, false},
+		{"verify delete not found", Sample{Endpoint: EndpointVerifyDelete, StatusCode: http.StatusNotFound}, false},
+		{"index report not found", Sample{Endpoint: EndpointGetIndexReport, StatusCode: http.StatusNotFound}, true},
+		{"filtered vulnerability report error", Sample{Endpoint: EndpointFilteredVulnerabilityReport, StatusCode: http.StatusInternalServerError}, true},
+		{"ok with an error", Sample{Endpoint: EndpointIndexReport, StatusCode: http.StatusCreated, Error: "index report failed"}, true},
+		{"no response", Sample{Endpoint: EndpointIndexReport, Error: "connection refused"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sample.Failed(); got != tt.want {
+				t.Errorf("Failed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
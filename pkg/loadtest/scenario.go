@@ -0,0 +1,201 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How often SLOs are evaluated while a run is in progress.
+const sloCheckInterval = time.Second * 5
+
+// Scenario is the contents of a scenario file.
+type Scenario struct {
+	SLOs   []*SLO   `yaml:"slos" json:"slos,omitempty"`
+	Phases []*Phase `yaml:"phases" json:"phases,omitempty"`
+	// Updates, if set, triggers runs of the updaters during the run.
+	Updates *Updates `yaml:"updates" json:"updates,omitempty"`
+	// Vars are values for the variables in the host, for every tenant.
+	Vars map[string]string `yaml:"vars" json:"vars,omitempty"`
+}
+
+// SLO is an objective for a single endpoint: either a latency percentile that
+// must stay at or below Max, or an error rate that must stay at or below
+// MaxErrorRate percent, or both. If SizeClass is set, only requests for
+// manifests of that size class count.
+type SLO struct {
+	Endpoint     string        `yaml:"endpoint" json:"endpoint"`
+	SizeClass    string        `yaml:"size_class" json:"size_class,omitempty"`
+	Percentile   float64       `yaml:"percentile" json:"percentile,omitempty"`
+	Max          time.Duration `yaml:"max" json:"max,omitempty"`
+	MaxErrorRate float64       `yaml:"max_error_rate" json:"max_error_rate,omitempty"`
+}
+
+// LoadScenario reads and validates a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read scenario: %w", err)
+	}
+	var sc Scenario
+	if err := yaml.Unmarshal(b, &sc); err != nil {
+		return nil, fmt.Errorf("could not parse scenario: %w", err)
+	}
+	for i, slo := range sc.SLOs {
+		if !knownEndpoint(slo.Endpoint) {
+			return nil, fmt.Errorf("slo %d: unknown endpoint %q", i, slo.Endpoint)
+		}
+		if slo.Max <= 0 && slo.MaxErrorRate <= 0 {
+			return nil, fmt.Errorf("slo %d: one of max or max_error_rate is needed", i)
+		}
+		if slo.Max > 0 && (slo.Percentile <= 0 || slo.Percentile > 100) {
+			return nil, fmt.Errorf("slo %d: percentile must be in (0, 100]", i)
+		}
+		switch slo.SizeClass {
+		case "", SizeSmall, SizeMedium, SizeLarge:
+		default:
+			return nil, fmt.Errorf("slo %d: unknown size class %q, expected %s, %s or %s", i, slo.SizeClass, SizeSmall, SizeMedium, SizeLarge)
+		}
+	}
+	for i, ph := range sc.Phases {
+		if ph.Name == "" {
+			return nil, fmt.Errorf("phase %d: name is needed", i)
+		}
+		if ph.Duration <= 0 {
+			return nil, fmt.Errorf("phase %q: duration must be more than 0", ph.Name)
+		}
+		if ph.Rate < 0 {
+			return nil, fmt.Errorf("phase %q: rate can't be negative", ph.Name)
+		}
+	}
+	if sc.Updates != nil {
+		if err := sc.Updates.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &sc, nil
+}
+
+// UsesSizeClasses reports whether any of the SLOs is for a size class.
+func (sc *Scenario) UsesSizeClasses() bool {
+	if sc == nil {
+		return false
+	}
+	for _, slo := range sc.SLOs {
+		if slo.SizeClass != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// SLOResult is the outcome of an SLO over a run.
+type SLOResult struct {
+	SLO *SLO `json:"slo"`
+	// Passed reports whether the SLO held at the end of the run.
+	Passed              bool  `json:"passed"`
+	LatencyMilliseconds int64 `json:"latency_milliseconds,omitempty"`
+	// CompliancePercent is the share of requests at or below Max, which
+	// needs to be at least the percentile for the SLO to pass.
+	CompliancePercent float64 `json:"compliance_percent,omitempty"`
+	ErrorRate         float64 `json:"error_rate,omitempty"`
+	// Breaches counts the evaluations during the run where the SLO didn't
+	// hold.
+	Breaches    int        `json:"breaches"`
+	FirstBreach *time.Time `json:"first_breach,omitempty"`
+}
+
+// evaluate checks the SLO against the current stats, returning a
+// description of the violation if there is one.
+func (r *SLOResult) evaluate(stats *Stats, now time.Time) string {
+	es := stats.Endpoint(r.SLO.Endpoint)
+	name := r.SLO.Endpoint
+	if r.SLO.SizeClass != "" {
+		es = stats.SizeClass(r.SLO.SizeClass).Endpoint(r.SLO.Endpoint)
+		name = r.SLO.SizeClass + " " + name
+	}
+	var v string
+	if r.SLO.Max > 0 {
+		max := r.SLO.Max.Milliseconds()
+		r.LatencyMilliseconds = es.Percentile(r.SLO.Percentile)
+		r.CompliancePercent = es.Within(max) * 100
+		if r.LatencyMilliseconds > max {
+			v = fmt.Sprintf("%s p%v %dms > %dms (%.1f%% within)", name, r.SLO.Percentile, r.LatencyMilliseconds, max, r.CompliancePercent)
+		}
+	}
+	if r.SLO.MaxErrorRate > 0 {
+		r.ErrorRate = es.CurrentErrorRate()
+		if r.ErrorRate*100 > r.SLO.MaxErrorRate {
+			if v != "" {
+				v += ", "
+			}
+			v += fmt.Sprintf("%s error rate %.2f%% > %v%%", name, r.ErrorRate*100, r.SLO.MaxErrorRate)
+		}
+	}
+	r.Passed = v == ""
+	if !r.Passed {
+		r.Breaches++
+		if r.FirstBreach == nil {
+			r.FirstBreach = &now
+		}
+	}
+	return v
+}
+
+// SLOTracker evaluates a scenario's SLOs over a run.
+type SLOTracker struct {
+	mu      sync.Mutex
+	results []*SLOResult
+}
+
+func NewSLOTracker(sc *Scenario) *SLOTracker {
+	t := &SLOTracker{}
+	if sc == nil {
+		return t
+	}
+	for _, slo := range sc.SLOs {
+		t.results = append(t.results, &SLOResult{SLO: slo, Passed: true})
+	}
+	return t
+}
+
+// Evaluate checks every SLO against stats, returning the violations.
+func (t *SLOTracker) Evaluate(stats *Stats) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var vs []string
+	for _, r := range t.results {
+		if v := r.evaluate(stats, now); v != "" {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+// Watch evaluates the SLOs periodically until ctx is done.
+func (t *SLOTracker) Watch(ctx context.Context, stats *Stats) {
+	if len(t.results) == 0 {
+		return
+	}
+	tick := time.NewTicker(sloCheckInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			t.Evaluate(stats)
+		}
+	}
+}
+
+func (t *SLOTracker) Results() []*SLOResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.results
+}
@@ -0,0 +1,91 @@
+package loadtest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// StepRand returns the random source for step n of a run seeded with seed.
+// Every step gets its own, so the choices a step makes don't depend on the
+// order concurrent steps happen to run in.
+func StepRand(seed int64, n int) *rand.Rand {
+	return rand.New(rand.NewSource(seed + int64(n)))
+}
+
+// ScheduledStep is what a step of a run did. A schedule log is a sequence of
+// JSON encoded steps, one per line.
+type ScheduledStep struct {
+	Step int `json:"step"`
+	// OffsetMilliseconds is how long after the first step this one
+	// started.
+	OffsetMilliseconds int64  `json:"offset_milliseconds"`
+	Op                 string `json:"op"`
+	Target             string `json:"target,omitempty"`
+}
+
+// ScheduleLog writes the steps of a run, so a failing run can be compared
+// with the same run repeated with its seed. A nil ScheduleLog discards
+// everything written to it.
+type ScheduleLog struct {
+	mu    sync.Mutex
+	f     *os.File
+	buf   *bufio.Writer
+	enc   *json.Encoder
+	start time.Time
+}
+
+func NewScheduleLog(path string) (*ScheduleLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	return &ScheduleLog{
+		f:   f,
+		buf: buf,
+		enc: json.NewEncoder(buf),
+	}, nil
+}
+
+// Step records that step n did op to target, such as indexing a container.
+// Failures are logged rather than stopping the run.
+func (l *ScheduleLog) Step(ctx context.Context, n int, op, target string) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.start.IsZero() {
+		l.start = now
+	}
+	err := l.enc.Encode(&ScheduledStep{
+		Step:               n,
+		OffsetMilliseconds: now.Sub(l.start).Milliseconds(),
+		Op:                 op,
+		Target:             target,
+	})
+	if err != nil {
+		zlog.Warn(ctx).Err(err).Msg("could not write schedule")
+	}
+}
+
+func (l *ScheduleLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.buf.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,130 @@
+package loadtest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// QuayIssuer is the issuer of the tokens Quay signs with its service keys.
+const QuayIssuer = "quay"
+
+// KeySigner mints tokens signed with a private key and its key ID, as Quay
+// does with the service keys published by its key server, rather than with
+// a PSK.
+type KeySigner struct {
+	Issuer    string `json:"issuer"`
+	Audience  string `json:"audience,omitempty"`
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+
+	signer jose.Signer
+}
+
+// LoadKeySigner reads an RSA or ECDSA private key from path, PEM encoded or
+// as a JWK. The key ID is taken from the JWK if kid is empty.
+func LoadKeySigner(path, kid, issuer, audience string) (*KeySigner, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key: %w", err)
+	}
+	var key crypto.PrivateKey
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		var jwk jose.JSONWebKey
+		if err := jwk.UnmarshalJSON(b); err != nil {
+			return nil, fmt.Errorf("could not parse signing key: %w", err)
+		}
+		if jwk.IsPublic() {
+			return nil, fmt.Errorf("signing key %q is a public key", path)
+		}
+		key = jwk.Key
+		if kid == "" {
+			kid = jwk.KeyID
+		}
+	} else {
+		key, err = parsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse signing key: %w", err)
+		}
+	}
+	if kid == "" {
+		return nil, fmt.Errorf("a key ID is needed for signing key %q", path)
+	}
+	var alg jose.SignatureAlgorithm
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			alg = jose.ES256
+		case elliptic.P384():
+			alg = jose.ES384
+		case elliptic.P521():
+			alg = jose.ES512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T, expected RSA or ECDSA", key)
+	}
+	s, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: key, KeyID: kid},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return nil, err
+	}
+	if issuer == "" {
+		issuer = QuayIssuer
+	}
+	return &KeySigner{
+		Issuer:    issuer,
+		Audience:  audience,
+		KeyID:     kid,
+		Algorithm: string(alg),
+		signer:    s,
+	}, nil
+}
+
+// parsePrivateKey parses a PEM encoded PKCS #1, PKCS #8 or SEC 1 private key.
+func parsePrivateKey(b []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// Token mints a token signed with the key.
+func (s *KeySigner) Token() (string, error) {
+	token, _, err := s.mint(nil)
+	return token, err
+}
+
+// mint mints a token signed with the key, timed by t.
+func (s *KeySigner) mint(t *TokenTiming) (string, tokenInfo, error) {
+	return mintToken(s.signer, s.Issuer, s.Audience, t)
+}
+
+// authorize replaces req's token with one signed with the key.
+func (s *KeySigner) authorize(req *http.Request, t *TokenTiming) (*tokenInfo, error) {
+	return setToken(req, s.KeyID, t, s.mint)
+}
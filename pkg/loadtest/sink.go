@@ -0,0 +1,123 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sink receives every sample a Reporter records, as it's recorded, and the
+// final stats once the run is over. ConsumeSample is called concurrently.
+// Summary is called once, and should flush and release whatever the Sink
+// holds.
+type Sink interface {
+	ConsumeSample(*Sample) error
+	Summary(*Stats) error
+}
+
+// SinkFactory makes a Sink writing to target, such as a path or an address.
+// Target is empty if none was given.
+type SinkFactory func(ctx context.Context, target string) (Sink, error)
+
+// Sink names.
+const (
+	SinkStdout     = "stdout"
+	SinkFile       = "file"
+	SinkPrometheus = "prometheus"
+	SinkStatsd     = "statsd"
+	SinkElastic    = "elastic"
+)
+
+var (
+	sinksMu sync.Mutex
+	sinks   = map[string]SinkFactory{}
+)
+
+func init() {
+	RegisterSink(SinkStdout, func(_ context.Context, target string) (Sink, error) {
+		if target != "" {
+			return nil, fmt.Errorf("the stdout sink doesn't take a target")
+		}
+		return newSampleWriter(nopCloser{os.Stdout}), nil
+	})
+	RegisterSink(SinkFile, func(_ context.Context, target string) (Sink, error) {
+		if target == "" {
+			return nil, fmt.Errorf("the file sink needs a path, such as file=results.jsonl")
+		}
+		return NewSampleWriter(target)
+	})
+}
+
+// RegisterSink makes a kind of Sink available to NewSink as name, replacing
+// any registered before.
+func RegisterSink(name string, f SinkFactory) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinks[name] = f
+}
+
+// SinkNames returns the names of the registered sinks, sorted.
+func SinkNames() []string {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSink makes the Sink described by spec, a registered name optionally
+// followed by a target, such as "statsd" or "file=results.jsonl".
+func NewSink(ctx context.Context, spec string) (Sink, error) {
+	name, target := spec, ""
+	if i := strings.Index(spec, "="); i != -1 {
+		name, target = spec[:i], spec[i+1:]
+	}
+	sinksMu.Lock()
+	f, ok := sinks[name]
+	sinksMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q, expected one of %s", name, strings.Join(SinkNames(), ", "))
+	}
+	s, err := f(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s sink: %w", name, err)
+	}
+	return s, nil
+}
+
+// MultiSink passes everything to each of its sinks in turn, returning the
+// first error.
+type MultiSink []Sink
+
+func (m MultiSink) ConsumeSample(s *Sample) error {
+	var err error
+	for _, sink := range m {
+		if e := sink.ConsumeSample(s); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m MultiSink) Summary(stats *Stats) error {
+	var err error
+	for _, sink := range m {
+		if e := sink.Summary(stats); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// nopCloser keeps a sink from closing stdout.
+type nopCloser struct {
+	*os.File
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,230 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/quay/zlog"
+)
+
+// Size classes manifests are put into.
+const (
+	SizeSmall  = "small"
+	SizeMedium = "medium"
+	SizeLarge  = "large"
+)
+
+// What manifests can be classified by.
+const (
+	SizeByLayers = "layers"
+	SizeByBytes  = "bytes"
+)
+
+// SizeClasses are the boundaries between the size classes. A manifest is
+// small below Medium, large at or above Large and medium otherwise.
+type SizeClasses struct {
+	By     string `json:"by"`
+	Medium int64  `json:"medium"`
+	Large  int64  `json:"large"`
+}
+
+// ParseSizeClasses parses boundaries of the form "layers=5,15" or
+// "bytes=100MB,1GB".
+func ParseSizeClasses(s string) (*SizeClasses, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid size classes %q, expected by=medium,large", s)
+	}
+	sc := &SizeClasses{By: strings.TrimSpace(parts[0])}
+	parse := strconv.ParseInt
+	switch sc.By {
+	case SizeByLayers:
+	case SizeByBytes:
+		parse = func(s string, _ int, _ int) (int64, error) { return ParseBytes(s) }
+	default:
+		return nil, fmt.Errorf("unknown size class measure %q, expected %s or %s", sc.By, SizeByLayers, SizeByBytes)
+	}
+	bounds := strings.Split(parts[1], ",")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid size classes %q, expected two boundaries", s)
+	}
+	var err error
+	if sc.Medium, err = parse(strings.TrimSpace(bounds[0]), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid size class boundary %q", bounds[0])
+	}
+	if sc.Large, err = parse(strings.TrimSpace(bounds[1]), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid size class boundary %q", bounds[1])
+	}
+	if sc.Medium <= 0 || sc.Large <= sc.Medium {
+		return nil, fmt.Errorf("size class boundaries must be positive and increasing")
+	}
+	return sc, nil
+}
+
+// ParseBytes parses a size such as "512", "100MB" or "1GB".
+func ParseBytes(s string) (int64, error) {
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(strings.ToUpper(s), u.suffix) {
+			s, mult = s[:len(s)-len(u.suffix)], u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+func (sc *SizeClasses) class(v int64) string {
+	switch {
+	case v < sc.Medium:
+		return SizeSmall
+	case v < sc.Large:
+		return SizeMedium
+	default:
+		return SizeLarge
+	}
+}
+
+// manifest is the subset of a clairctl generated manifest needed to size it,
+// and all that's generated natively.
+type manifest struct {
+	Hash   string          `json:"hash"`
+	Layers []manifestLayer `json:"layers"`
+}
+
+type manifestLayer struct {
+	Hash    string              `json:"hash"`
+	URI     string              `json:"uri"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// SizeClassifier remembers the size class of every manifest it's seen, so
+// requests can be attributed to one by hash. A nil SizeClassifier does
+// nothing.
+type SizeClassifier struct {
+	classes *SizeClasses
+	cl      *http.Client
+
+	mu        sync.Mutex
+	manifests map[string]string
+	layers    map[string]int64
+}
+
+func NewSizeClassifier(classes *SizeClasses, cl *http.Client) *SizeClassifier {
+	if classes == nil {
+		return nil
+	}
+	return &SizeClassifier{
+		classes:   classes,
+		cl:        cl,
+		manifests: map[string]string{},
+		layers:    map[string]int64{},
+	}
+}
+
+// classify works out the size class of the manifest and counts it in stats.
+// Measuring by bytes needs a HEAD request per layer, the sizes are cached by
+// layer hash.
+func (c *SizeClassifier) classify(ctx context.Context, body []byte, stats *Stats) {
+	if c == nil {
+		return
+	}
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		zlog.Warn(ctx).Err(err).Msg("could not decode manifest to classify it")
+		return
+	}
+	c.mu.Lock()
+	_, seen := c.manifests[m.Hash]
+	c.mu.Unlock()
+	if seen {
+		return
+	}
+
+	v := int64(len(m.Layers))
+	if c.classes.By == SizeByBytes {
+		v = 0
+		for _, l := range m.Layers {
+			n, err := c.layerSize(ctx, l.Hash, l.URI, l.Headers)
+			if err != nil {
+				zlog.Warn(ctx).Err(err).Str("layer", l.Hash).Msg("could not get layer size")
+				return
+			}
+			v += n
+		}
+	}
+	class := c.classes.class(v)
+	c.mu.Lock()
+	c.manifests[m.Hash] = class
+	c.mu.Unlock()
+	stats.SizeClass(class).IncrManifests(1)
+	zlog.Debug(ctx).Str("hash", m.Hash).Int64(c.classes.By, v).Str("class", class).Msg("classified manifest")
+}
+
+func (c *SizeClassifier) layerSize(ctx context.Context, hash, uri string, headers map[string][]string) (int64, error) {
+	c.mu.Lock()
+	n, ok := c.layers[hash]
+	c.mu.Unlock()
+	if ok {
+		return n, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	for k, vs := range headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	resp, err := c.cl.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("non 200 response from registry %d", resp.StatusCode)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("registry didn't report the layer size")
+	}
+	c.mu.Lock()
+	c.layers[hash] = resp.ContentLength
+	c.mu.Unlock()
+	return resp.ContentLength, nil
+}
+
+// observe attributes a sample to the size class of its manifest, if known.
+func (c *SizeClassifier) observe(s *Sample, stats *Stats) {
+	if c == nil || s.Hash == "" {
+		return
+	}
+	c.mu.Lock()
+	class, ok := c.manifests[s.Hash]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	s.SizeClass = class
+	es := stats.SizeClass(class).Endpoint(s.Endpoint)
+	es.IncrTotalLatencyMilliseconds(s.LatencyMilliseconds)
+	es.IncrTotalRequests(int64(1))
+	if s.Failed() {
+		es.IncrNon2XXResponses(int64(1))
+	}
+	es.ObserveOutcome(s)
+}
@@ -0,0 +1,125 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Spike multiplies the rate by Factor for Duration, beginning At after the
+// start of the run.
+type Spike struct {
+	Factor   float64       `json:"factor"`
+	Duration time.Duration `json:"duration"`
+	At       time.Duration `json:"at"`
+}
+
+func (s *Spike) String() string {
+	return fmt.Sprintf("%vx:%v@%v", s.Factor, s.Duration, s.At)
+}
+
+// ParseSpikes parses spikes written as "10x:30s@5m", a factor, duration and
+// offset. Spikes can't overlap.
+func ParseSpikes(specs []string) ([]*Spike, error) {
+	var spikes []*Spike
+	for _, spec := range specs {
+		s, err := parseSpike(spec)
+		if err != nil {
+			return nil, err
+		}
+		spikes = append(spikes, s)
+	}
+	sort.Slice(spikes, func(i, j int) bool { return spikes[i].At < spikes[j].At })
+	for i := 1; i < len(spikes); i++ {
+		if prev := spikes[i-1]; prev.At+prev.Duration > spikes[i].At {
+			return nil, fmt.Errorf("spikes %v and %v overlap", prev, spikes[i])
+		}
+	}
+	return spikes, nil
+}
+
+func parseSpike(spec string) (*Spike, error) {
+	invalid := fmt.Errorf("invalid spike %q, expected factor:duration@offset such as 10x:30s@5m", spec)
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+	window := strings.SplitN(parts[1], "@", 2)
+	if len(window) != 2 {
+		return nil, invalid
+	}
+	s := &Spike{}
+	var err error
+	if s.Factor, err = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(parts[0]), "x"), 64); err != nil {
+		return nil, invalid
+	}
+	if s.Duration, err = time.ParseDuration(strings.TrimSpace(window[0])); err != nil {
+		return nil, invalid
+	}
+	if s.At, err = time.ParseDuration(strings.TrimSpace(window[1])); err != nil {
+		return nil, invalid
+	}
+	if s.Factor <= 0 || s.Duration <= 0 || s.At < 0 {
+		return nil, fmt.Errorf("spike %q: factor and duration must be more than 0, and the offset can't be negative", spec)
+	}
+	return s, nil
+}
+
+// SpikeSchedule applies spikes to a run's load, and tells which requests
+// were made during one. A nil SpikeSchedule does nothing.
+type SpikeSchedule struct {
+	start  time.Time
+	spikes []*Spike
+}
+
+func NewSpikeSchedule(spikes []*Spike) *SpikeSchedule {
+	if len(spikes) == 0 {
+		return nil
+	}
+	return &SpikeSchedule{start: time.Now(), spikes: spikes}
+}
+
+// Run multiplies ctl's rate for each spike, dividing it again afterwards, so
+// rate changes made during a spike are kept, until ctx is done.
+func (s *SpikeSchedule) Run(ctx context.Context, ctl *Control) {
+	if s == nil {
+		return
+	}
+	for _, sp := range s.spikes {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(s.start.Add(sp.At))):
+		}
+		rate, _, _ := ctl.State()
+		zlog.Info(ctx).Str("spike", sp.String()).Float64("rate", rate*sp.Factor).Msg("spike beginning")
+		ctl.SetRate(rate * sp.Factor)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(s.start.Add(sp.At + sp.Duration))):
+		}
+		rate, _, _ = ctl.State()
+		zlog.Info(ctx).Str("spike", sp.String()).Float64("rate", rate/sp.Factor).Msg("spike over")
+		ctl.SetRate(rate / sp.Factor)
+	}
+}
+
+// observe marks samples for requests made during a spike.
+func (s *SpikeSchedule) observe(sample *Sample) {
+	if s == nil {
+		return
+	}
+	at := sample.Time.Sub(s.start)
+	for _, sp := range s.spikes {
+		if at >= sp.At && at < sp.At+sp.Duration {
+			sample.Spike = true
+			return
+		}
+	}
+}
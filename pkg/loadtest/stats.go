@@ -0,0 +1,758 @@
+package loadtest
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crozzy/clair-load-test/pkg/results"
+)
+
+// SchemaVersion is the version of package results' schema the stats are
+// written with. Stats and Sample encode to the same JSON as its Stats and
+// Sample.
+const SchemaVersion = results.SchemaVersion
+
+type Stats struct {
+	SchemaVersion int `json:"schema_version"`
+	// The index and vulnerability report and delete totals are kept at the
+	// top level, as well as in Endpoints, for anything reading results from
+	// before stats were kept per endpoint.
+	TotalIndexReportRequests                           int64   `json:"total_index_report_requests"`
+	TotalVulnerabilityReportRequests                   int64   `json:"total_vulnerability_report_requests"`
+	TotalIndexReportRequestLatencyMilliseconds         int64   `json:"total_index_report_latency_milliseconds"`
+	TotalVulnerabilityReportRequestLatencyMilliseconds int64   `json:"total_vulnerability_report_latency_milliseconds"`
+	LatencyPerIndexReportRequest                       float64 `json:"latency_per_index_report_request"`
+	LatencyPerVulnerabilityReportRequest               float64 `json:"latency_per_vulnerability_report_request"`
+	Non2XXIndexReportResponses                         int64   `json:"non_2XX_index_report_responses"`
+	Non2XXVulnerabilityReportResponses                 int64   `json:"non_2XX_vulnerability_report_responses"`
+	MaxIndexReportRequestLatencyMilliseconds           int64   `json:"max_index_report_request_latency_milliseconds"`
+	MaxVulnerabilityReportRequestLatencyMilliseconds   int64   `json:"max_vulnerability_report_request_latency_milliseconds"`
+	TotalDeleteIndexReportRequests                     int64   `json:"total_delete_index_report_requests,omitempty"`
+	TotalBulkDeleteIndexReportRequests                 int64   `json:"total_bulk_delete_index_report_requests,omitempty"`
+	Non2XXDeleteIndexReportResponses                   int64   `json:"non_2XX_delete_index_report_responses,omitempty"`
+	Non2XXBulkDeleteIndexReportResponses               int64   `json:"non_2XX_bulk_delete_index_report_responses,omitempty"`
+	DeletedIndexReports                                int64   `json:"deleted_index_reports,omitempty"`
+	// VerifiedDeletes counts the deletes checked by fetching the index
+	// report again, and DeletesNotApplied those where it was still there.
+	VerifiedDeletes   int64                      `json:"verified_deletes,omitempty"`
+	DeletesNotApplied int64                      `json:"deletes_not_applied,omitempty"`
+	Endpoints         map[string]*EndpointStats  `json:"endpoints"`
+	Images            map[string]*ImageStats     `json:"images,omitempty"`
+	SizeClasses       map[string]*SizeClassStats `json:"size_classes,omitempty"`
+	ManifestPads      map[string]*EndpointStats  `json:"manifest_pads,omitempty"`
+	// Transfers are the index report stats by how their bodies were
+	// sent, see the Reporter's Transfer.
+	Transfers  map[string]*EndpointStats `json:"transfers,omitempty"`
+	Tenants    map[string]*TenantStats   `json:"tenants,omitempty"`
+	Registries map[string]*RegistryStats `json:"registries,omitempty"`
+	// ClairLatencyMilliseconds is the time spent waiting on Clair, summed
+	// over every request, to compare with the time spent on registries.
+	ClairLatencyMilliseconds int64 `json:"clair_latency_milliseconds"`
+	// ConnectionReuseRatio is the share of requests to Clair sent on a
+	// connection kept alive from an earlier one.
+	ConnectionReuseRatio float64 `json:"connection_reuse_ratio"`
+	// ManifestSources counts the manifests got from each source, see the
+	// Reporter's ManifestSource.
+	ManifestSources map[string]int64 `json:"manifest_sources,omitempty"`
+	// Database is how up to date the matcher's vulnerability database was.
+	Database *DatabaseFreshness `json:"database,omitempty"`
+	// IndexReports count the index reports Clair returned by state.
+	IndexReports *IndexReportStats `json:"index_reports,omitempty"`
+	// Pregeneration reports the manifests generated before the run.
+	Pregeneration         *PregenerationStats       `json:"pregeneration,omitempty"`
+	Phases                []*PhaseStats             `json:"phases,omitempty"`
+	ErrorRate             float64                   `json:"error_rate"`
+	Aborted               string                    `json:"aborted,omitempty"`
+	TotalBytes            int64                     `json:"total_bytes"`
+	ElapsedSeconds        float64                   `json:"elapsed_seconds"`
+	ThroughputMBPerSecond float64                   `json:"throughput_mb_per_second"`
+	SLOs                  []*SLOResult              `json:"slos,omitempty"`
+	Drift                 map[string]*EndpointDrift `json:"drift,omitempty"`
+	ClairMetrics          []*MetricsSnapshot        `json:"clair_metrics,omitempty"`
+	Postgres              map[string][]*PGSnapshot  `json:"postgres,omitempty"`
+	Timeline              []*TimeBucket             `json:"timeline,omitempty"`
+	Anomalies             []*Anomaly                `json:"anomalies,omitempty"`
+	Notifications         *NotificationStats        `json:"notifications,omitempty"`
+	Updates               *UpdateInterference       `json:"updates,omitempty"`
+	Probes                map[string]*ProbeStats    `json:"probes,omitempty"`
+	Polls                 *PollStats                `json:"polls,omitempty"`
+	Tokens                *TokenStats               `json:"tokens,omitempty"`
+	Rechecks              *RecheckStats             `json:"rechecks,omitempty"`
+	// ReportFilter compares filtered vulnerability reports with full ones.
+	ReportFilter *ReportFilterStats `json:"report_filter,omitempty"`
+	// Budget is where the time of the run's steps went.
+	Budget *LatencyBudget `json:"budget,omitempty"`
+	// Errors counts the errors steps failed with, by operation and type.
+	Errors []*ErrorCount `json:"errors,omitempty"`
+	// Quarantined are the containers taken out of rotation for failing.
+	Quarantined []*QuarantinedImage `json:"quarantined,omitempty"`
+	// Samples are a bounded random sample of the run's requests, if kept.
+	Samples []*Sample `json:"samples,omitempty"`
+
+	// mu guards the maps of stats, which are read far more often than
+	// they're added to.
+	mu    sync.RWMutex
+	start time.Time
+	tlMu  sync.RWMutex
+	// manifestSources are counted as manifests are got, into
+	// ManifestSources when summarizing.
+	manifestSources counters
+	indexReports    indexReportTracker
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		Endpoints:    map[string]*EndpointStats{},
+		Images:       map[string]*ImageStats{},
+		SizeClasses:  map[string]*SizeClassStats{},
+		ManifestPads: map[string]*EndpointStats{},
+		Transfers:    map[string]*EndpointStats{},
+		Tenants:      map[string]*TenantStats{},
+		Registries:   map[string]*RegistryStats{},
+		start:        time.Now(),
+	}
+}
+
+// Restart restarts the clock the run's elapsed time and timeline are measured
+// from, for runs with a setup phase that isn't part of them. It must be called
+// before any requests to Clair are recorded.
+func (s *Stats) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = time.Now()
+}
+
+// Image returns the stats for the named image, creating them if needed.
+// Images are named by container where known and by manifest hash otherwise.
+func (s *Stats) Image(name string) *ImageStats {
+	s.mu.RLock()
+	i, ok := s.Images[name]
+	s.mu.RUnlock()
+	if ok {
+		return i
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok = s.Images[name]
+	if !ok {
+		i = &ImageStats{}
+		s.Images[name] = i
+	}
+	return i
+}
+
+// SizeClass returns the stats for the named size class, creating them if
+// needed.
+func (s *Stats) SizeClass(name string) *SizeClassStats {
+	s.mu.RLock()
+	c, ok := s.SizeClasses[name]
+	s.mu.RUnlock()
+	if ok {
+		return c
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok = s.SizeClasses[name]
+	if !ok {
+		c = &SizeClassStats{Endpoints: map[string]*EndpointStats{}}
+		s.SizeClasses[name] = c
+	}
+	return c
+}
+
+// Registry returns the stats for the named registry, creating them if needed.
+func (s *Stats) Registry(name string) *RegistryStats {
+	s.mu.RLock()
+	r, ok := s.Registries[name]
+	s.mu.RUnlock()
+	if ok {
+		return r
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok = s.Registries[name]
+	if !ok {
+		r = &RegistryStats{}
+		s.Registries[name] = r
+	}
+	return r
+}
+
+// ManifestPad returns the index report stats for manifests padded to the
+// named size, creating them if needed.
+func (s *Stats) ManifestPad(name string) *EndpointStats {
+	s.mu.RLock()
+	e, ok := s.ManifestPads[name]
+	s.mu.RUnlock()
+	if ok {
+		return e
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok = s.ManifestPads[name]
+	if !ok {
+		e = &EndpointStats{}
+		s.ManifestPads[name] = e
+	}
+	return e
+}
+
+// Transfer returns the index report stats for bodies sent the named way,
+// creating them if needed.
+func (s *Stats) Transfer(name string) *EndpointStats {
+	s.mu.RLock()
+	e, ok := s.Transfers[name]
+	s.mu.RUnlock()
+	if ok {
+		return e
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok = s.Transfers[name]
+	if !ok {
+		e = &EndpointStats{}
+		s.Transfers[name] = e
+	}
+	return e
+}
+
+// Tenant returns the stats for the named tenant, creating them if needed.
+func (s *Stats) Tenant(name string) *TenantStats {
+	s.mu.RLock()
+	t, ok := s.Tenants[name]
+	s.mu.RUnlock()
+	if ok {
+		return t
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok = s.Tenants[name]
+	if !ok {
+		t = &TenantStats{Endpoints: map[string]*EndpointStats{}}
+		s.Tenants[name] = t
+	}
+	return t
+}
+
+// Endpoint returns the stats for the named endpoint, creating them if this is
+// the first request to it.
+func (s *Stats) Endpoint(name string) *EndpointStats {
+	s.mu.RLock()
+	e, ok := s.Endpoints[name]
+	s.mu.RUnlock()
+	if ok {
+		return e
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok = s.Endpoints[name]
+	if !ok {
+		e = &EndpointStats{}
+		s.Endpoints[name] = e
+	}
+	return e
+}
+
+// LookupEndpoint returns the stats for the named endpoint, if any requests to
+// it have been recorded. Unlike Endpoint, it doesn't add the endpoint to the
+// stats, so it's for reading them while the run goes on.
+func (s *Stats) LookupEndpoint(name string) (*EndpointStats, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.Endpoints[name]
+	return e, ok
+}
+
+func (s *Stats) IncrDeletedIndexReports(by int64) {
+	atomic.AddInt64((*int64)(&s.DeletedIndexReports), by)
+}
+
+func (s *Stats) IncrVerifiedDeletes(by int64) {
+	atomic.AddInt64(&s.VerifiedDeletes, by)
+}
+
+func (s *Stats) IncrDeletesNotApplied(by int64) {
+	atomic.AddInt64(&s.DeletesNotApplied, by)
+}
+
+// CurrentErrorRate returns the fraction of all requests that either failed
+// outright, got a non-2XX response or got a response they failed on.
+func (s *Stats) CurrentErrorRate() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var total, failed int64
+	for _, e := range s.Endpoints {
+		total += atomic.LoadInt64(&e.TotalRequests)
+		failed += atomic.LoadInt64(&e.Non2XXResponses) + atomic.LoadInt64(&e.RequestErrors) +
+			atomic.LoadInt64(&e.FailedResponses)
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(failed) / float64(total)
+}
+
+// Abort records why the run was aborted.
+func (s *Stats) Abort(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Aborted = reason
+}
+
+// Unreachable reports whether requests were made but none got a response.
+func (s *Stats) Unreachable() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var total, failed int64
+	for _, e := range s.Endpoints {
+		total += atomic.LoadInt64(&e.TotalRequests)
+		failed += atomic.LoadInt64(&e.RequestErrors)
+	}
+	return total != 0 && failed == total
+}
+
+func (s *Stats) GetStats() *Stats {
+	s.mu.Lock()
+	s.SchemaVersion = SchemaVersion
+	s.TotalBytes = 0
+	s.ClairLatencyMilliseconds = 0
+	var newConns, reusedConns int64
+	for _, e := range s.Endpoints {
+		e.mu.Lock()
+		e.summarize()
+		e.mu.Unlock()
+		s.TotalBytes += e.RequestBytes + e.ResponseBytes
+		s.ClairLatencyMilliseconds += e.TotalLatencyMilliseconds
+		newConns += e.NewConnections
+		reusedConns += e.ReusedConnections
+	}
+	s.ConnectionReuseRatio = reuseRatio(newConns, reusedConns)
+	s.summarizeReports()
+	s.ManifestSources = nil
+	s.manifestSources.each(func(k interface{}, n int64) {
+		if s.ManifestSources == nil {
+			s.ManifestSources = map[string]int64{}
+		}
+		s.ManifestSources[k.(string)] = n
+	})
+	s.IndexReports = s.indexReports.stats()
+	for _, i := range s.Images {
+		i.summarize()
+	}
+	for _, c := range s.SizeClasses {
+		c.summarize()
+	}
+	for _, e := range s.ManifestPads {
+		e.mu.Lock()
+		e.summarize()
+		e.mu.Unlock()
+	}
+	for _, e := range s.Transfers {
+		e.mu.Lock()
+		e.summarize()
+		e.mu.Unlock()
+	}
+	var tenantRequests int64
+	for _, t := range s.Tenants {
+		t.mu.Lock()
+		tenantRequests += t.Requests
+		t.mu.Unlock()
+	}
+	for _, t := range s.Tenants {
+		t.summarize(tenantRequests)
+	}
+	s.ElapsedSeconds = time.Since(s.start).Seconds()
+	if s.ElapsedSeconds > 0 {
+		s.ThroughputMBPerSecond = float64(s.TotalBytes) / 1e6 / s.ElapsedSeconds
+	}
+	s.mu.Unlock()
+	s.summarizeTimeline()
+	s.ErrorRate = s.CurrentErrorRate()
+	return s
+}
+
+// summarizeReports copies the index and vulnerability report and delete
+// endpoints' stats to the top level fields. s.mu must be held.
+func (s *Stats) summarizeReports() {
+	endpoint := func(name string) *EndpointStats {
+		if e := s.Endpoints[name]; e != nil {
+			return e
+		}
+		return &EndpointStats{}
+	}
+	ir, vr := endpoint(EndpointIndexReport), endpoint(EndpointVulnerabilityReport)
+	del, bulk := endpoint(EndpointDeleteIndexReport), endpoint(EndpointBulkDeleteIndexReports)
+	s.TotalIndexReportRequests = ir.TotalRequests
+	s.TotalVulnerabilityReportRequests = vr.TotalRequests
+	s.TotalIndexReportRequestLatencyMilliseconds = ir.TotalLatencyMilliseconds
+	s.TotalVulnerabilityReportRequestLatencyMilliseconds = vr.TotalLatencyMilliseconds
+	s.LatencyPerIndexReportRequest = ir.LatencyPerRequest
+	s.LatencyPerVulnerabilityReportRequest = vr.LatencyPerRequest
+	s.Non2XXIndexReportResponses = ir.Non2XXResponses
+	s.Non2XXVulnerabilityReportResponses = vr.Non2XXResponses
+	s.MaxIndexReportRequestLatencyMilliseconds = ir.MaxLatencyMilliseconds
+	s.MaxVulnerabilityReportRequestLatencyMilliseconds = vr.MaxLatencyMilliseconds
+	s.TotalDeleteIndexReportRequests = del.TotalRequests
+	s.TotalBulkDeleteIndexReportRequests = bulk.TotalRequests
+	s.Non2XXDeleteIndexReportResponses = del.Non2XXResponses
+	s.Non2XXBulkDeleteIndexReportResponses = bulk.Non2XXResponses
+}
+
+// EndpointStats are the stats for requests to a single Clair endpoint.
+type EndpointStats struct {
+	TotalRequests             int64                      `json:"total_requests"`
+	TotalLatencyMilliseconds  int64                      `json:"total_latency_milliseconds"`
+	LatencyPerRequest         float64                    `json:"latency_per_request"`
+	MaxLatencyMilliseconds    int64                      `json:"max_latency_milliseconds"`
+	P50LatencyMilliseconds    int64                      `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds    int64                      `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds    int64                      `json:"p99_latency_milliseconds"`
+	Non2XXResponses           int64                      `json:"non_2XX_responses"`
+	RequestErrors             int64                      `json:"request_errors"`
+	FailedResponses           int64                      `json:"failed_responses,omitempty"`
+	StatusCodes               map[int]int64              `json:"status_codes,omitempty"`
+	TransportErrors           map[string]int64           `json:"transport_errors,omitempty"`
+	Protocols                 map[string]int64           `json:"protocols,omitempty"`
+	LatencyByOutcome          map[string]*OutcomeLatency `json:"latency_by_outcome,omitempty"`
+	NotModifiedResponses      int64                      `json:"not_modified_responses,omitempty"`
+	NotFoundResponses         int64                      `json:"not_found_responses,omitempty"`
+	CachedResponses           int64                      `json:"cached_responses,omitempty"`
+	RequestBytes              int64                      `json:"request_bytes"`
+	ResponseBytes             int64                      `json:"response_bytes"`
+	AverageResponseBytes      float64                    `json:"average_response_bytes"`
+	UncompressedResponseBytes int64                      `json:"uncompressed_response_bytes"`
+	CompressionRatio          float64                    `json:"compression_ratio"`
+	// NewConnections and ReusedConnections count the requests sent on a new
+	// connection and on one kept alive, and ConnectionReuseRatio is the
+	// share of the latter.
+	NewConnections       int64   `json:"new_connections"`
+	ReusedConnections    int64   `json:"reused_connections"`
+	ConnectionReuseRatio float64 `json:"connection_reuse_ratio"`
+
+	// mu is held while summarizing. Requests are recorded without it, with
+	// atomic counters and sharded latencies, so recording them doesn't
+	// serialize the workers.
+	mu              sync.Mutex
+	latencies       shardedLatencies
+	statusCodes     counters
+	protocols       counters
+	transportErrors counters
+}
+
+func (e *EndpointStats) IncrTotalRequests(by int64) {
+	atomic.AddInt64((*int64)(&e.TotalRequests), by)
+}
+
+func (e *EndpointStats) IncrTotalLatencyMilliseconds(by int64) {
+	atomic.AddInt64((*int64)(&e.TotalLatencyMilliseconds), by)
+	for {
+		max := atomic.LoadInt64(&e.MaxLatencyMilliseconds)
+		if by <= max || atomic.CompareAndSwapInt64(&e.MaxLatencyMilliseconds, max, by) {
+			break
+		}
+	}
+	e.latencies.observe(by)
+}
+
+func (e *EndpointStats) IncrNon2XXResponses(by int64) {
+	atomic.AddInt64((*int64)(&e.Non2XXResponses), by)
+}
+
+func (e *EndpointStats) IncrRequestErrors(by int64) {
+	atomic.AddInt64((*int64)(&e.RequestErrors), by)
+}
+
+// IncrFailedResponses counts 2XX responses the request failed on all the
+// same, such as a deleted index report still being there, or an index
+// report in the IndexError state.
+func (e *EndpointStats) IncrFailedResponses(by int64) {
+	atomic.AddInt64(&e.FailedResponses, by)
+}
+
+func (e *EndpointStats) IncrNotModifiedResponses(by int64) {
+	atomic.AddInt64((*int64)(&e.NotModifiedResponses), by)
+}
+
+func (e *EndpointStats) IncrNotFoundResponses(by int64) {
+	atomic.AddInt64((*int64)(&e.NotFoundResponses), by)
+}
+
+func (e *EndpointStats) IncrCachedResponses(by int64) {
+	atomic.AddInt64((*int64)(&e.CachedResponses), by)
+}
+
+func (e *EndpointStats) IncrRequestBytes(by int64) {
+	atomic.AddInt64((*int64)(&e.RequestBytes), by)
+}
+
+func (e *EndpointStats) IncrResponseBytes(by int64) {
+	atomic.AddInt64((*int64)(&e.ResponseBytes), by)
+}
+
+func (e *EndpointStats) IncrUncompressedResponseBytes(by int64) {
+	atomic.AddInt64((*int64)(&e.UncompressedResponseBytes), by)
+}
+
+// IncrStatusCodes counts a response with the given status code.
+func (e *EndpointStats) IncrStatusCodes(code int) {
+	e.statusCodes.add(code, 1)
+}
+
+// IncrProtocols counts a response received with the given protocol.
+func (e *EndpointStats) IncrProtocols(proto string) {
+	e.protocols.add(proto, 1)
+}
+
+// IncrTransportErrors counts a request that failed with the given class of
+// error.
+func (e *EndpointStats) IncrTransportErrors(class string) {
+	e.transportErrors.add(class, 1)
+}
+
+// ObserveOutcome records the sample's latency under whether it succeeded or
+// failed, and under its class of status code, or "error" if it got no
+// response. Failed requests are often much faster or slower than the rest,
+// skewing the endpoint's overall percentiles.
+func (e *EndpointStats) ObserveOutcome(s *Sample) {
+	outcome := OutcomeSuccess
+	if s.Failed() {
+		outcome = OutcomeFailure
+	}
+	class := OutcomeError
+	if s.StatusCode != 0 {
+		class = strconv.Itoa(s.StatusCode/100) + "XX"
+	}
+	e.latencies.observeOutcomes(s.LatencyMilliseconds, outcome, class)
+}
+
+// CurrentErrorRate returns the fraction of requests to the endpoint that
+// either failed outright, got a non-2XX response or got a response they
+// failed on.
+func (e *EndpointStats) CurrentErrorRate() float64 {
+	total := atomic.LoadInt64(&e.TotalRequests)
+	if total == 0 {
+		return 0
+	}
+	failed := atomic.LoadInt64(&e.Non2XXResponses) + atomic.LoadInt64(&e.RequestErrors) +
+		atomic.LoadInt64(&e.FailedResponses)
+	return float64(failed) / float64(total)
+}
+
+// snapshot returns a copy of the latencies recorded so far.
+func (e *EndpointStats) snapshot() *histogram {
+	return e.latencies.merged()
+}
+
+// Within returns the fraction of requests that took at most max
+// milliseconds, or 1 if there haven't been any.
+func (e *EndpointStats) Within(max int64) float64 {
+	return e.latencies.merged().within(max)
+}
+
+// Percentile returns the p-th percentile of request latencies seen so far,
+// in milliseconds.
+func (e *EndpointStats) Percentile(p float64) int64 {
+	return e.latencies.merged().percentile(p)
+}
+
+// summarize fills in the derived fields and the counts by key. It must be
+// called with e.mu held.
+func (e *EndpointStats) summarize() {
+	total := atomic.LoadInt64(&e.TotalRequests)
+	if total != 0 {
+		e.LatencyPerRequest = float64(atomic.LoadInt64(&e.TotalLatencyMilliseconds)) / float64(total)
+		e.AverageResponseBytes = float64(atomic.LoadInt64(&e.ResponseBytes)) / float64(total)
+	}
+	if b := atomic.LoadInt64(&e.ResponseBytes); b != 0 {
+		e.CompressionRatio = float64(atomic.LoadInt64(&e.UncompressedResponseBytes)) / float64(b)
+	}
+	e.ConnectionReuseRatio = reuseRatio(atomic.LoadInt64(&e.NewConnections), atomic.LoadInt64(&e.ReusedConnections))
+	latencies := e.latencies.merged()
+	e.P50LatencyMilliseconds = latencies.percentile(50)
+	e.P95LatencyMilliseconds = latencies.percentile(95)
+	e.P99LatencyMilliseconds = latencies.percentile(99)
+	e.StatusCodes, e.Protocols, e.TransportErrors = nil, nil, nil
+	e.statusCodes.each(func(k interface{}, n int64) {
+		if e.StatusCodes == nil {
+			e.StatusCodes = map[int]int64{}
+		}
+		e.StatusCodes[k.(int)] = n
+	})
+	e.protocols.each(func(k interface{}, n int64) {
+		if e.Protocols == nil {
+			e.Protocols = map[string]int64{}
+		}
+		e.Protocols[k.(string)] = n
+	})
+	e.transportErrors.each(func(k interface{}, n int64) {
+		if e.TransportErrors == nil {
+			e.TransportErrors = map[string]int64{}
+		}
+		e.TransportErrors[k.(string)] = n
+	})
+	e.LatencyByOutcome = nil
+	for name, h := range e.latencies.mergedOutcomes() {
+		if e.LatencyByOutcome == nil {
+			e.LatencyByOutcome = map[string]*OutcomeLatency{}
+		}
+		o := &OutcomeLatency{}
+		o.summarize(h)
+		e.LatencyByOutcome[name] = o
+	}
+}
+
+// Outcomes latencies are reported under, besides status code classes such as
+// "5XX".
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeError is requests that got no response at all.
+	OutcomeError = "error"
+)
+
+// OutcomeLatency summarizes the latencies of requests with one outcome.
+type OutcomeLatency struct {
+	Requests               int64   `json:"requests"`
+	LatencyPerRequest      float64 `json:"latency_per_request"`
+	MaxLatencyMilliseconds int64   `json:"max_latency_milliseconds"`
+	P50LatencyMilliseconds int64   `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64   `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds int64   `json:"p99_latency_milliseconds"`
+}
+
+func (o *OutcomeLatency) summarize(h *histogram) {
+	o.Requests = h.n
+	if o.Requests == 0 {
+		return
+	}
+	o.LatencyPerRequest = float64(h.sum) / float64(o.Requests)
+	o.MaxLatencyMilliseconds = h.max
+	o.P50LatencyMilliseconds = h.percentile(50)
+	o.P95LatencyMilliseconds = h.percentile(95)
+	o.P99LatencyMilliseconds = h.percentile(99)
+}
+
+// SizeClassStats are the stats for requests about manifests of a single size
+// class, per endpoint.
+type SizeClassStats struct {
+	Manifests int64                     `json:"manifests"`
+	Endpoints map[string]*EndpointStats `json:"endpoints"`
+
+	mu sync.Mutex
+}
+
+func (c *SizeClassStats) IncrManifests(by int64) {
+	atomic.AddInt64((*int64)(&c.Manifests), by)
+}
+
+// Endpoint returns the size class's stats for the named endpoint, creating
+// them if needed.
+func (c *SizeClassStats) Endpoint(name string) *EndpointStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.Endpoints[name]
+	if !ok {
+		e = &EndpointStats{}
+		c.Endpoints[name] = e
+	}
+	return e
+}
+
+func (c *SizeClassStats) summarize() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.Endpoints {
+		e.mu.Lock()
+		e.summarize()
+		e.mu.Unlock()
+	}
+}
+
+// ImageStats are the stats for a single image.
+type ImageStats struct {
+	VulnerabilityReports            int64   `json:"vulnerability_reports"`
+	VulnerabilityReportBytes        int64   `json:"vulnerability_report_bytes"`
+	AverageVulnerabilityReportBytes float64 `json:"average_vulnerability_report_bytes"`
+	// Packages, Vulnerabilities and Enrichments are counted in the latest
+	// full vulnerability report, to trend across runs: a drop after
+	// upgrading Clair can be a regression in its data even when latency
+	// looks fine.
+	Packages        int `json:"packages"`
+	Vulnerabilities int `json:"vulnerabilities"`
+	Enrichments     int `json:"enrichments"`
+	// CountsChanged is set if the counts weren't the same in every report,
+	// such as when an updater ran during the run.
+	CountsChanged bool `json:"counts_changed,omitempty"`
+
+	mu      sync.Mutex
+	counted bool
+}
+
+// IncrVulnerabilityReportBytes records a vulnerability report of the given
+// size. Reports that weren't transferred, because of a 304, are ignored.
+func (i *ImageStats) IncrVulnerabilityReportBytes(by int64) {
+	if by == 0 {
+		return
+	}
+	atomic.AddInt64((*int64)(&i.VulnerabilityReports), 1)
+	atomic.AddInt64((*int64)(&i.VulnerabilityReportBytes), by)
+}
+
+// ObserveVulnerabilityReport records a vulnerability report's size and, if it
+// was counted, its counts. A nil report, one that wasn't transferred, is
+// ignored.
+func (i *ImageStats) ObserveVulnerabilityReport(report *VulnerabilityReportSummary) {
+	if report == nil {
+		return
+	}
+	i.IncrVulnerabilityReportBytes(report.Bytes)
+	if !report.Counted {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.counted && (report.Packages != i.Packages ||
+		report.Vulnerabilities != i.Vulnerabilities ||
+		report.Enrichments != i.Enrichments) {
+		i.CountsChanged = true
+	}
+	i.counted = true
+	i.Packages = report.Packages
+	i.Vulnerabilities = report.Vulnerabilities
+	i.Enrichments = report.Enrichments
+}
+
+func (i *ImageStats) summarize() {
+	if i.VulnerabilityReports != 0 {
+		i.AverageVulnerabilityReportBytes = float64(i.VulnerabilityReportBytes) / float64(i.VulnerabilityReports)
+	}
+}
+
+// Percentile returns the p-th percentile (0-100) of sorted using the
+// nearest-rank method. It returns 0 for an empty slice.
+func Percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// percentileOf is Percentile for unsorted latencies, which are left
+// untouched.
+func percentileOf(latencies []int64, p float64) int64 {
+	sorted := make([]int64, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return Percentile(sorted, p)
+}
@@ -0,0 +1,56 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/quay/zlog"
+)
+
+func init() {
+	RegisterSink(SinkStatsd, func(ctx context.Context, target string) (Sink, error) {
+		if target == "" {
+			target = "localhost:8125"
+		}
+		return NewStatsdSink(ctx, target)
+	})
+}
+
+// StatsdSink sends a count, a timing and, for failures, a failure count to
+// statsd for every sample, prefixed with clair_load_test and the endpoint.
+type StatsdSink struct {
+	ctx    context.Context
+	conn   net.Conn
+	warned sync.Once
+}
+
+// NewStatsdSink sends to the statsd listening on UDP at addr.
+func NewStatsdSink(ctx context.Context, addr string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not dial %s: %w", addr, err)
+	}
+	return &StatsdSink{ctx: ctx, conn: conn}, nil
+}
+
+// ConsumeSample sends the sample's metrics in one packet. UDP is lossy
+// anyway, so a failed send is only logged, once, rather than failing the run.
+func (s *StatsdSink) ConsumeSample(sample *Sample) error {
+	prefix := "clair_load_test." + sample.Endpoint
+	msg := fmt.Sprintf("%s.requests:1|c\n%s.latency:%d|ms", prefix, prefix, sample.LatencyMilliseconds)
+	if sample.Failed() {
+		msg += "\n" + prefix + ".failures:1|c"
+	}
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.warned.Do(func() {
+			zlog.Warn(s.ctx).Err(err).Msg("could not send to statsd, further errors won't be logged")
+		})
+	}
+	return nil
+}
+
+func (s *StatsdSink) Summary(*Stats) error {
+	return s.conn.Close()
+}
@@ -0,0 +1,33 @@
+package loadtest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// SyntheticHash is a manifest hash that is unique to the seed, container and
+// index, and the same every time it's seeded. A zero seed is left out, so
+// hashes seeded before there was a seed stay the same.
+func SyntheticHash(seed int64, container string, i int) string {
+	name := fmt.Sprintf("clair-load-test/%s/%d", container, i)
+	if seed != 0 {
+		name = fmt.Sprintf("clair-load-test/%d/%s/%d", seed, container, i)
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// WithManifestHash returns the manifest with its hash replaced.
+func WithManifestHash(manifest []byte, hash string) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("could not decode manifest: %w", err)
+	}
+	var err error
+	if m["hash"], err = json.Marshal(hash); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
@@ -0,0 +1,115 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// templateNames returns the names of the variables in s, in order.
+func templateNames(s string) []string {
+	var names []string
+	for {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			return names
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return names
+		}
+		names = append(names, s[i+1:i+j])
+		s = s[i+j+1:]
+	}
+}
+
+// expandTemplate replaces the variables in s with their values in vars,
+// leaving those without one.
+func expandTemplate(s string, vars map[string]string) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		b.WriteString(s[:i])
+		if v, ok := vars[s[i+1:i+j]]; ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(s[i : i+j+1])
+		}
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// templateVars returns the variables for a request made as tn, which may be
+// nil.
+func (r *Reporter) templateVars(tn *Tenant) map[string]string {
+	vars := make(map[string]string, len(r.Vars)+1)
+	for k, v := range r.Vars {
+		vars[k] = v
+	}
+	if tn != nil {
+		for k, v := range tn.Vars {
+			vars[k] = v
+		}
+		vars["tenant"] = tn.Name
+	}
+	return vars
+}
+
+// CheckHost checks every variable in Host has a value for every request,
+// and that Host is a URL once they're filled in.
+func (r *Reporter) CheckHost() error {
+	tenants := []*Tenant{nil}
+	if r.Tenants != nil {
+		tenants = r.Tenants.Tenants
+	}
+	names := templateNames(r.Host)
+	for _, tn := range tenants {
+		vars := r.templateVars(tn)
+		for _, name := range names {
+			if _, ok := vars[name]; ok {
+				continue
+			}
+			if tn == nil {
+				return fmt.Errorf("host %q: no value for {%s}", r.Host, name)
+			}
+			return fmt.Errorf("host %q: no value for {%s} for tenant %q", r.Host, name, tn.Name)
+		}
+		if _, err := url.Parse(expandTemplate(r.Host, vars)); err != nil {
+			return fmt.Errorf("invalid host: %w", err)
+		}
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// newRequest returns a request to path on Host. If there are Tenants, the
+// tenant it's made as is picked now, so the variables in Host can be filled
+// in for it.
+func (r *Reporter) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	var tn *Tenant
+	if r.Tenants != nil {
+		tn = r.Tenants.pick()
+		ctx = context.WithValue(ctx, tenantKey{}, tn)
+	}
+	host := r.Host
+	if strings.Contains(host, "{") {
+		host = expandTemplate(host, r.templateVars(tn))
+	}
+	return http.NewRequestWithContext(ctx, method, host+path, body)
+}
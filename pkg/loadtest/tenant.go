@@ -0,0 +1,185 @@
+package loadtest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Tenant is a client of Clair with its own issuer and PSK, or signing key
+// and key ID, such as a Quay instance, sending Share of the requests.
+type Tenant struct {
+	Name    string  `yaml:"name" json:"name"`
+	Issuer  string  `yaml:"issuer" json:"issuer"`
+	PSK     string  `yaml:"psk" json:"-"`
+	KeyFile string  `yaml:"key_file" json:"key_file,omitempty"`
+	KeyID   string  `yaml:"key_id" json:"key_id,omitempty"`
+	Share   float64 `yaml:"share" json:"share"`
+	// Vars are the tenant's values for the variables in the host.
+	Vars map[string]string `yaml:"vars" json:"vars,omitempty"`
+
+	signer *KeySigner
+}
+
+// Tenants interleaves requests from several tenants, signing each request's
+// token as one of them picked by share. A nil Tenants does nothing.
+type Tenants struct {
+	Tenants []*Tenant `yaml:"tenants" json:"tenants"`
+
+	total float64
+	mu    sync.Mutex
+	rand  *rand.Rand
+}
+
+// LoadTenants reads and validates a tenants file, picking tenants with
+// randomness from seed.
+func LoadTenants(path string, seed int64) (*Tenants, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tenants: %w", err)
+	}
+	var t Tenants
+	if err := yaml.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("could not parse tenants: %w", err)
+	}
+	if len(t.Tenants) == 0 {
+		return nil, fmt.Errorf("no tenants in %q", path)
+	}
+	seen := map[string]bool{}
+	for i, tn := range t.Tenants {
+		switch {
+		case tn.Name == "":
+			return nil, fmt.Errorf("tenant %d: name is needed", i)
+		case seen[tn.Name]:
+			return nil, fmt.Errorf("tenant %q given more than once", tn.Name)
+		case (tn.PSK == "") == (tn.KeyFile == ""):
+			return nil, fmt.Errorf("tenant %q: one of psk or key_file is needed", tn.Name)
+		case tn.Share <= 0:
+			return nil, fmt.Errorf("tenant %q: share must be more than 0", tn.Name)
+		}
+		if tn.KeyFile != "" {
+			tn.signer, err = LoadKeySigner(tn.KeyFile, tn.KeyID, tn.Issuer, "")
+			if err != nil {
+				return nil, fmt.Errorf("tenant %q: %w", tn.Name, err)
+			}
+			tn.Issuer, tn.KeyID = tn.signer.Issuer, tn.signer.KeyID
+		} else if _, err := base64.StdEncoding.DecodeString(tn.PSK); err != nil {
+			return nil, fmt.Errorf("tenant %q: psk isn't base64: %w", tn.Name, err)
+		}
+		if tn.Issuer == "" {
+			tn.Issuer = DefaultIssuer
+		}
+		seen[tn.Name] = true
+		t.total += tn.Share
+	}
+	t.rand = rand.New(rand.NewSource(seed))
+	return &t, nil
+}
+
+// pick picks a tenant by share.
+func (t *Tenants) pick() *Tenant {
+	t.mu.Lock()
+	x := t.rand.Float64() * t.total
+	t.mu.Unlock()
+	for _, tn := range t.Tenants {
+		if x < tn.Share {
+			return tn
+		}
+		x -= tn.Share
+	}
+	return t.Tenants[len(t.Tenants)-1]
+}
+
+// authorize replaces req's token with one signed as the tenant picked when
+// it was made, or one picked by share now, timed by tt, returning the
+// tenant's name.
+func (t *Tenants) authorize(req *http.Request, tt *TokenTiming) (string, *tokenInfo, error) {
+	if t == nil {
+		return "", nil, nil
+	}
+	tn, ok := req.Context().Value(tenantKey{}).(*Tenant)
+	if !ok {
+		tn = t.pick()
+	}
+	mint := func(tt *TokenTiming) (string, tokenInfo, error) {
+		return createToken(tn.PSK, tn.Issuer, tt)
+	}
+	if tn.signer != nil {
+		mint = tn.signer.mint
+	}
+	info, err := setToken(req, "tenant/"+tn.Name, tt, mint)
+	if err != nil {
+		return "", nil, fmt.Errorf("tenant %q: %w", tn.Name, err)
+	}
+	return tn.Name, info, nil
+}
+
+// observe attributes a sample to its tenant.
+func (t *Tenants) observe(s *Sample, stats *Stats) {
+	if t == nil || s.Tenant == "" {
+		return
+	}
+	ts := stats.Tenant(s.Tenant)
+	ts.count(s.StatusCode == http.StatusUnauthorized || s.StatusCode == http.StatusForbidden)
+	es := ts.Endpoint(s.Endpoint)
+	es.IncrTotalLatencyMilliseconds(s.LatencyMilliseconds)
+	es.IncrTotalRequests(int64(1))
+	if s.Failed() {
+		es.IncrNon2XXResponses(int64(1))
+	}
+	es.ObserveOutcome(s)
+}
+
+// TenantStats are the stats for the requests made as a tenant.
+type TenantStats struct {
+	Requests int64 `json:"requests"`
+	// Share is the fraction of all requests made as the tenant.
+	Share float64 `json:"share"`
+	// Rejected counts the 401s and 403s, Clair not accepting the tenant's
+	// tokens.
+	Rejected  int64                     `json:"rejected"`
+	Endpoints map[string]*EndpointStats `json:"endpoints"`
+
+	mu sync.Mutex
+}
+
+// count counts a request made as the tenant, and whether it was rejected.
+func (t *TenantStats) count(rejected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Requests++
+	if rejected {
+		t.Rejected++
+	}
+}
+
+// Endpoint returns the tenant's stats for the named endpoint, creating them
+// if needed.
+func (t *TenantStats) Endpoint(name string) *EndpointStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.Endpoints[name]
+	if !ok {
+		e = &EndpointStats{}
+		t.Endpoints[name] = e
+	}
+	return e
+}
+
+func (t *TenantStats) summarize(total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if total > 0 {
+		t.Share = float64(t.Requests) / float64(total)
+	}
+	for _, e := range t.Endpoints {
+		e.mu.Lock()
+		e.summarize()
+		e.mu.Unlock()
+	}
+}
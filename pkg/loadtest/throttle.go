@@ -0,0 +1,104 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throttleTick is how often a throttled body is written to, in writes
+// sized to keep to the bandwidth.
+const throttleTick = 50 * time.Millisecond
+
+// ParseBandwidth parses a bandwidth in bits a second such as "256kbps" or
+// "2Mbps", returning it in bytes a second. An empty string is 0, unlimited.
+func ParseBandwidth(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	lower := strings.ToLower(s)
+	if !strings.HasSuffix(lower, "bps") {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected bits a second such as 256kbps", s)
+	}
+	num, mult := strings.TrimSuffix(lower, "bps"), 1.0
+	switch {
+	case strings.HasSuffix(num, "k"):
+		num, mult = strings.TrimSuffix(num, "k"), 1e3
+	case strings.HasSuffix(num, "m"):
+		num, mult = strings.TrimSuffix(num, "m"), 1e6
+	case strings.HasSuffix(num, "g"):
+		num, mult = strings.TrimSuffix(num, "g"), 1e9
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q: %w", s, err)
+	}
+	if v <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, must be more than 0", s)
+	}
+	return v * mult / 8, nil
+}
+
+// throttledReader reads from r no faster than rate bytes a second, as a
+// slow client would send it.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  float64
+	chunk int
+	start time.Time
+	n     int64
+}
+
+func newThrottledReader(ctx context.Context, r io.Reader, rate float64) *throttledReader {
+	chunk := int(rate * throttleTick.Seconds())
+	switch {
+	case chunk < 1:
+		chunk = 1
+	case chunk > 32<<10:
+		chunk = 32 << 10
+	}
+	return &throttledReader{ctx: ctx, r: r, rate: rate, chunk: chunk}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	// Wait until what's been read so far is due at the rate.
+	due := t.start.Add(time.Duration(float64(t.n) / t.rate * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			return 0, t.ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	return n, err
+}
+
+// throttleBody has req send body, which it was made with, no faster than
+// UploadBandwidth, keeping its length.
+func (r *Reporter) throttleBody(req *http.Request, body []byte) {
+	if r.UploadBandwidth <= 0 {
+		return
+	}
+	ctx := req.Context()
+	req.Body = io.NopCloser(newThrottledReader(ctx, bytes.NewReader(body), r.UploadBandwidth))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(newThrottledReader(ctx, bytes.NewReader(body), r.UploadBandwidth)), nil
+	}
+}
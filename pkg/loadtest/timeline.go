@@ -0,0 +1,93 @@
+package loadtest
+
+import (
+	"sync"
+	"time"
+)
+
+// TimelineBucket is how long each bucket of a run's timeline covers.
+const TimelineBucket = 10 * time.Second
+
+// TimeBucket is the stats for the requests started during one
+// TimelineBucket of a run, so latency over time can be graphed from the
+// stats alone.
+type TimeBucket struct {
+	StartSeconds float64 `json:"start_seconds"`
+	BucketStats
+	Endpoints map[string]*BucketStats `json:"endpoints,omitempty"`
+	// DependenciesDown are the probed dependencies that were down at some
+	// point during the bucket.
+	DependenciesDown []string `json:"dependencies_down,omitempty"`
+
+	mu sync.Mutex
+}
+
+// BucketStats summarize the requests in a TimeBucket.
+type BucketStats struct {
+	Requests               int64 `json:"requests"`
+	Errors                 int64 `json:"errors"`
+	P50LatencyMilliseconds int64 `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64 `json:"p95_latency_milliseconds"`
+
+	latencies histogram
+}
+
+func (b *BucketStats) observe(s *Sample) {
+	b.Requests++
+	if s.Failed() {
+		b.Errors++
+	}
+	b.latencies.observe(s.LatencyMilliseconds)
+}
+
+func (b *BucketStats) summarize() {
+	b.P50LatencyMilliseconds = b.latencies.percentile(50)
+	b.P95LatencyMilliseconds = b.latencies.percentile(95)
+}
+
+// observeTimeline adds the sample to the bucket it was started in.
+func (s *Stats) observeTimeline(sample *Sample) {
+	i := int(sample.Time.Sub(s.start) / TimelineBucket)
+	if i < 0 {
+		i = 0
+	}
+	var b *TimeBucket
+	s.tlMu.RLock()
+	if i < len(s.Timeline) {
+		b = s.Timeline[i]
+	}
+	s.tlMu.RUnlock()
+	if b == nil {
+		s.tlMu.Lock()
+		for len(s.Timeline) <= i {
+			s.Timeline = append(s.Timeline, &TimeBucket{
+				StartSeconds: (time.Duration(len(s.Timeline)) * TimelineBucket).Seconds(),
+				Endpoints:    map[string]*BucketStats{},
+			})
+		}
+		b = s.Timeline[i]
+		s.tlMu.Unlock()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.observe(sample)
+	e, ok := b.Endpoints[sample.Endpoint]
+	if !ok {
+		e = &BucketStats{}
+		b.Endpoints[sample.Endpoint] = e
+	}
+	e.observe(sample)
+}
+
+func (s *Stats) summarizeTimeline() {
+	s.tlMu.Lock()
+	defer s.tlMu.Unlock()
+	for _, b := range s.Timeline {
+		b.mu.Lock()
+		b.summarize()
+		for _, e := range b.Endpoints {
+			e.summarize()
+		}
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,206 @@
+package loadtest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// DefaultIssuer is the issuer of tokens minted with CreateToken, the one
+// clairctl uses.
+const DefaultIssuer = "clairctl"
+
+// DefaultTokenLifetime is how long tokens are valid for.
+const DefaultTokenLifetime = time.Minute * 10
+
+// CreateToken mints a JWT for Clair, signed with key, Clair's base64 encoded
+// PSK. Tokens are valid for ten minutes.
+func CreateToken(key string) (string, error) {
+	token, _, err := createToken(key, DefaultIssuer, nil)
+	return token, err
+}
+
+// createToken mints a JWT for Clair from issuer, signed with key, timed by
+// t.
+func createToken(key, issuer string, t *TokenTiming) (string, tokenInfo, error) {
+	decKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", tokenInfo{}, err
+	}
+	sk := jose.SigningKey{
+		Algorithm: jose.HS256,
+		Key:       decKey,
+	}
+	s, err := jose.NewSigner(sk, nil)
+	if err != nil {
+		return "", tokenInfo{}, err
+	}
+	return mintToken(s, issuer, "", t)
+}
+
+// tokenInfo is when a token is valid.
+type tokenInfo struct {
+	notBefore, expiry time.Time
+}
+
+// mintToken mints a JWT from issuer, for audience if it's set, signed by s,
+// valid for ten minutes unless t says otherwise.
+func mintToken(s jose.Signer, issuer, audience string, t *TokenTiming) (string, tokenInfo, error) {
+	now := time.Now()
+	lifetime := DefaultTokenLifetime
+	if t != nil {
+		now = now.Add(t.Skew)
+		lifetime = t.Lifetime
+	}
+	info := tokenInfo{notBefore: now, expiry: now.Add(lifetime)}
+	claims := &jwt.Claims{
+		Issuer:    issuer,
+		Expiry:    jwt.NewNumericDate(info.expiry),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+	}
+	if audience != "" {
+		claims.Audience = jwt.Audience{audience}
+	}
+	token, err := jwt.Signed(s).Claims(claims).CompactSerialize()
+	return token, info, err
+}
+
+// minter mints a token timed by t.
+type minter func(t *TokenTiming) (string, tokenInfo, error)
+
+// setToken sets req's token to one minted by mint, or to the last one minted
+// for key if t reuses tokens.
+func setToken(req *http.Request, key string, t *TokenTiming, mint minter) (*tokenInfo, error) {
+	token, info, err := t.token(key, mint)
+	if err != nil {
+		return nil, fmt.Errorf("could not create token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return info, nil
+}
+
+// TokenTiming mints tokens with unusual lifetimes, to test how Clair treats
+// tokens that expire mid-run or that a skewed clock minted. Skew is added to
+// the time tokens are issued at and valid from, and tokens are reused for
+// Reuse, so requests can be made with expired ones. A nil TokenTiming mints
+// a fresh token valid for ten minutes for every request.
+type TokenTiming struct {
+	Lifetime time.Duration `json:"lifetime"`
+	Skew     time.Duration `json:"skew,omitempty"`
+	Reuse    time.Duration `json:"reuse,omitempty"`
+
+	mu     sync.Mutex
+	tokens map[string]*reusedToken
+	stats  TokenStats
+}
+
+type reusedToken struct {
+	token  string
+	minted time.Time
+	info   tokenInfo
+}
+
+// NewTokenTiming returns a TokenTiming, or nil if the lifetime is the default
+// and there's no skew or reuse.
+func NewTokenTiming(lifetime, skew, reuse time.Duration) (*TokenTiming, error) {
+	switch {
+	case lifetime <= 0:
+		return nil, fmt.Errorf("token lifetime must be more than 0")
+	case reuse < 0:
+		return nil, fmt.Errorf("token reuse can't be negative")
+	case lifetime == DefaultTokenLifetime && skew == 0 && reuse == 0:
+		return nil, nil
+	}
+	return &TokenTiming{
+		Lifetime: lifetime,
+		Skew:     skew,
+		Reuse:    reuse,
+		tokens:   map[string]*reusedToken{},
+	}, nil
+}
+
+// token returns the token for key, minting one if it isn't being reused.
+func (t *TokenTiming) token(key string, mint minter) (string, *tokenInfo, error) {
+	if t == nil {
+		token, _, err := mint(nil)
+		return token, nil, err
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rt, ok := t.tokens[key]; ok && now.Sub(rt.minted) < t.Reuse {
+		return rt.token, &rt.info, nil
+	}
+	token, info, err := mint(t)
+	if err != nil {
+		return "", nil, err
+	}
+	t.stats.Minted++
+	t.tokens[key] = &reusedToken{token: token, minted: now, info: info}
+	return token, &info, nil
+}
+
+// TokenStats count requests by whether their token was valid when they were
+// sent, by this host's clock, and whether Clair accepted them. Rejections are
+// 401s; accepting expired or not yet valid tokens is Clair's leeway for
+// clock skew, and rejecting valid ones is skew the other way.
+type TokenStats struct {
+	Minted   int64 `json:"minted"`
+	Requests int64 `json:"requests"`
+	Rejected int64 `json:"rejected"`
+
+	Valid           int64 `json:"valid"`
+	ValidRejected   int64 `json:"valid_rejected"`
+	Expired         int64 `json:"expired"`
+	ExpiredAccepted int64 `json:"expired_accepted"`
+	Early           int64 `json:"not_yet_valid"`
+	EarlyAccepted   int64 `json:"not_yet_valid_accepted"`
+}
+
+// observe counts a request made with a token valid as info says.
+func (t *TokenTiming) observe(info *tokenInfo, s *Sample) {
+	if t == nil || info == nil || s.StatusCode == 0 {
+		return
+	}
+	rejected := s.StatusCode == http.StatusUnauthorized
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Requests++
+	if rejected {
+		t.stats.Rejected++
+	}
+	switch {
+	case s.Time.After(info.expiry):
+		t.stats.Expired++
+		if !rejected {
+			t.stats.ExpiredAccepted++
+		}
+	case s.Time.Before(info.notBefore):
+		t.stats.Early++
+		if !rejected {
+			t.stats.EarlyAccepted++
+		}
+	default:
+		t.stats.Valid++
+		if rejected {
+			t.stats.ValidRejected++
+		}
+	}
+}
+
+// Stats returns the stats for the tokens so far.
+func (t *TokenTiming) Stats() *TokenStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.stats
+	return &s
+}
@@ -0,0 +1,72 @@
+package loadtest
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Ways of sending index report bodies, which proxies and ingresses in front
+// of Clair can treat differently.
+const (
+	// TransferLength sends bodies buffered, with a Content-Length.
+	TransferLength = "length"
+	// TransferChunked streams bodies with chunked transfer encoding and no
+	// Content-Length, or over HTTP/2 without one.
+	TransferChunked = "chunked"
+	// TransferBoth alternates between the two, to compare them.
+	TransferBoth = "both"
+)
+
+// ParseTransfer checks s is one of the ways of sending bodies. An empty
+// string is TransferLength.
+func ParseTransfer(s string) (string, error) {
+	switch s {
+	case "":
+		return TransferLength, nil
+	case TransferLength, TransferChunked, TransferBoth:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown transfer %q, expected %s, %s or %s", s, TransferLength, TransferChunked, TransferBoth)
+}
+
+// transfer returns how the next index report body is sent.
+func (r *Reporter) transfer() string {
+	switch r.Transfer {
+	case "":
+		return TransferLength
+	case TransferBoth:
+		if atomic.AddInt64(&r.uploads, 1)%2 == 0 {
+			return TransferChunked
+		}
+		return TransferLength
+	}
+	return r.Transfer
+}
+
+// setTransfer makes req send its body as transfer says. An unknown length
+// has the transport stream it chunked.
+func setTransfer(req *http.Request, transfer string) {
+	if transfer == TransferChunked {
+		req.ContentLength = -1
+	}
+}
+
+// observeTransfer attributes index requests to the way their body was sent,
+// if the Reporter has a Transfer set.
+func (r *Reporter) observeTransfer(s *Sample) {
+	if r.Transfer == "" || s.Transfer == "" {
+		return
+	}
+	es := r.Stats.Transfer(s.Transfer)
+	es.IncrTotalLatencyMilliseconds(s.LatencyMilliseconds)
+	es.IncrTotalRequests(int64(1))
+	es.IncrRequestBytes(s.RequestBytes)
+	if s.StatusCode != 0 {
+		es.IncrStatusCodes(s.StatusCode)
+	}
+	if s.Failed() {
+		es.IncrNon2XXResponses(int64(1))
+	}
+	es.ObserveOutcome(s)
+}
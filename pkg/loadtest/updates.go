@@ -0,0 +1,190 @@
+package loadtest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Updates has a scenario trigger runs of the matcher's updaters during a run,
+// first At after its start and then Every after that if set. A run's update
+// window lasts from its trigger until every one of Updaters has stored a new
+// update operation, or until none have for Settle if Updaters is empty, or
+// until Timeout.
+type Updates struct {
+	TriggerCmd   string        `yaml:"trigger_cmd" json:"trigger_cmd"`
+	At           time.Duration `yaml:"at" json:"at"`
+	Every        time.Duration `yaml:"every" json:"every,omitempty"`
+	Updaters     []string      `yaml:"updaters" json:"updaters,omitempty"`
+	Settle       time.Duration `yaml:"settle" json:"settle"`
+	PollInterval time.Duration `yaml:"poll_interval" json:"poll_interval"`
+	Timeout      time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+// validate checks u, filling in the defaults.
+func (u *Updates) validate() error {
+	if u.TriggerCmd == "" {
+		return fmt.Errorf("updates: trigger_cmd is needed")
+	}
+	if u.At < 0 || u.Every < 0 || u.Settle < 0 || u.PollInterval < 0 || u.Timeout < 0 {
+		return fmt.Errorf("updates: durations can't be negative")
+	}
+	if u.Settle == 0 {
+		u.Settle = time.Minute * 2
+	}
+	if u.PollInterval == 0 {
+		u.PollInterval = time.Second * 10
+	}
+	if u.Timeout == 0 {
+		u.Timeout = time.Hour
+	}
+	return nil
+}
+
+// UpdateWindow is a stretch of a run during which the updaters were running.
+type UpdateWindow struct {
+	StartSeconds float64 `json:"start_seconds"`
+	EndSeconds   float64 `json:"end_seconds"`
+	// Done reports whether the updaters finished before the timeout.
+	Done     bool     `json:"done"`
+	Updaters []string `json:"updaters,omitempty"`
+}
+
+// UpdateInterference compares the latencies of requests made during update
+// windows with those made outside them. Latencies are in milliseconds.
+type UpdateInterference struct {
+	Windows   []*UpdateWindow                  `json:"windows"`
+	Endpoints map[string]*EndpointInterference `json:"endpoints,omitempty"`
+}
+
+// EndpointInterference is how an endpoint's latencies and errors changed
+// while the updaters were running. Deltas are updating minus baseline.
+type EndpointInterference struct {
+	BaselineRequests   int     `json:"baseline_requests"`
+	UpdatingRequests   int     `json:"updating_requests"`
+	BaselineP50        int64   `json:"baseline_p50_latency_milliseconds"`
+	BaselineP95        int64   `json:"baseline_p95_latency_milliseconds"`
+	UpdatingP50        int64   `json:"updating_p50_latency_milliseconds"`
+	UpdatingP95        int64   `json:"updating_p95_latency_milliseconds"`
+	P50Delta           int64   `json:"p50_delta_milliseconds"`
+	P95Delta           int64   `json:"p95_delta_milliseconds"`
+	P95IncreasePercent float64 `json:"p95_increase_percent,omitempty"`
+	BaselineErrorRate  float64 `json:"baseline_error_rate"`
+	UpdatingErrorRate  float64 `json:"updating_error_rate"`
+}
+
+// latencySet is the latencies and failures of an endpoint's requests.
+type latencySet struct {
+	latencies histogram
+	failed    int
+}
+
+// UpdateTracker records update windows and splits requests into those made
+// during one and those made outside. A nil UpdateTracker does nothing.
+type UpdateTracker struct {
+	start time.Time
+
+	mu       sync.Mutex
+	current  *UpdateWindow
+	windows  []*UpdateWindow
+	baseline map[string]*latencySet
+	updating map[string]*latencySet
+}
+
+func NewUpdateTracker() *UpdateTracker {
+	return &UpdateTracker{
+		start:    time.Now(),
+		baseline: map[string]*latencySet{},
+		updating: map[string]*latencySet{},
+	}
+}
+
+// Begin begins an update window.
+func (t *UpdateTracker) Begin() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.current = &UpdateWindow{StartSeconds: time.Since(t.start).Seconds()}
+	t.windows = append(t.windows, t.current)
+}
+
+// End ends the current update window, recording which updaters ran and
+// whether they finished.
+func (t *UpdateTracker) End(updaters []string, done bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == nil {
+		return
+	}
+	t.current.EndSeconds = time.Since(t.start).Seconds()
+	t.current.Done = done
+	t.current.Updaters = updaters
+	t.current = nil
+}
+
+// observe marks samples for requests made during an update window, and
+// records their latencies.
+func (t *UpdateTracker) observe(s *Sample) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	set := t.baseline
+	if t.current != nil {
+		s.Updating = true
+		set = t.updating
+	}
+	l, ok := set[s.Endpoint]
+	if !ok {
+		l = &latencySet{}
+		set[s.Endpoint] = l
+	}
+	l.latencies.observe(s.LatencyMilliseconds)
+	if s.Failed() {
+		l.failed++
+	}
+}
+
+// Analyze compares the latencies of every endpoint requested both during
+// and outside update windows. An update window still open is ended.
+func (t *UpdateTracker) Analyze() *UpdateInterference {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		t.current.EndSeconds = time.Since(t.start).Seconds()
+		t.current = nil
+	}
+	out := &UpdateInterference{Windows: t.windows, Endpoints: map[string]*EndpointInterference{}}
+	for name, u := range t.updating {
+		b, ok := t.baseline[name]
+		if !ok {
+			continue
+		}
+		ei := &EndpointInterference{
+			BaselineRequests:  int(b.latencies.n),
+			UpdatingRequests:  int(u.latencies.n),
+			BaselineP50:       b.latencies.percentile(50),
+			BaselineP95:       b.latencies.percentile(95),
+			UpdatingP50:       u.latencies.percentile(50),
+			UpdatingP95:       u.latencies.percentile(95),
+			BaselineErrorRate: float64(b.failed) / float64(b.latencies.n),
+			UpdatingErrorRate: float64(u.failed) / float64(u.latencies.n),
+		}
+		ei.P50Delta = ei.UpdatingP50 - ei.BaselineP50
+		ei.P95Delta = ei.UpdatingP95 - ei.BaselineP95
+		if ei.BaselineP95 > 0 {
+			ei.P95IncreasePercent = float64(ei.P95Delta) / float64(ei.BaselineP95) * 100
+		}
+		out.Endpoints[name] = ei
+	}
+	return out
+}
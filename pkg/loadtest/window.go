@@ -0,0 +1,61 @@
+package loadtest
+
+import (
+	"sync"
+	"time"
+)
+
+// ErrorWindow counts requests and failures over a sliding window, in one
+// second buckets. A nil ErrorWindow does nothing.
+type ErrorWindow struct {
+	mu      sync.Mutex
+	buckets []windowBucket
+}
+
+type windowBucket struct {
+	second        int64
+	total, failed int64
+}
+
+// NewErrorWindow returns an ErrorWindow over the last width.
+func NewErrorWindow(width time.Duration) *ErrorWindow {
+	return &ErrorWindow{
+		buckets: make([]windowBucket, int(width/time.Second)),
+	}
+}
+
+func (w *ErrorWindow) observe(t time.Time, failed bool) {
+	if w == nil {
+		return
+	}
+	sec := t.Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := &w.buckets[sec%int64(len(w.buckets))]
+	if b.second != sec {
+		*b = windowBucket{second: sec}
+	}
+	b.total++
+	if failed {
+		b.failed++
+	}
+}
+
+// Rate returns the failure rate over the window ending at now, and the
+// number of requests it's based on.
+func (w *ErrorWindow) Rate(now time.Time) (float64, int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	oldest := now.Unix() - int64(len(w.buckets))
+	var total, failed int64
+	for _, b := range w.buckets {
+		if b.second > oldest {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(failed) / float64(total), total
+}
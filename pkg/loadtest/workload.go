@@ -0,0 +1,96 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/quay/zlog"
+)
+
+// Workload is a kind of load to put on Clair. A Runner sets it up, calls
+// Step at the rate set by its Control, then tears it down, so every workload
+// shares the same scheduling, rate control and stats.
+type Workload interface {
+	// Setup is called once before the first step. The run stops if it
+	// fails.
+	Setup(ctx context.Context) error
+	// Step is called concurrently, with n counting the steps started
+	// before it.
+	Step(ctx context.Context, n int) error
+	// Teardown is called once the last step has returned, if Setup
+	// succeeded.
+	Teardown(ctx context.Context) error
+}
+
+// RunWorkload sets up w, calls its Step as Run does, then tears it down.
+// Teardown is given a context with ctx's values but not its cancellation, so
+// a run ended early by cancelling ctx is still cleaned up after.
+func (r *Runner) RunWorkload(ctx context.Context, w Workload) error {
+	if err := w.Setup(ctx); err != nil {
+		return err
+	}
+	err := r.Run(ctx, w.Step)
+	if terr := w.Teardown(detach(ctx)); terr != nil && err == nil {
+		err = terr
+	}
+	return err
+}
+
+// ReportWorkload indexes each of Containers in turn, fetches its
+// vulnerability report and, if Delete is set, deletes its index report.
+// Failures are logged and counted in the Reporter's stats, and only stop the
+// run if the Reporter fails fast or every container has been quarantined.
+type ReportWorkload struct {
+	Reporter   *Reporter
+	Containers []string
+	Delete     bool
+	// MutateDigests gives each step its own manifest hashes, unique to
+	// the run, so every step indexes a manifest Clair hasn't seen.
+	MutateDigests bool
+}
+
+func (w *ReportWorkload) Setup(ctx context.Context) error {
+	if len(w.Containers) == 0 {
+		return fmt.Errorf("no containers to load")
+	}
+	return nil
+}
+
+func (w *ReportWorkload) Step(ctx context.Context, n int) error {
+	cc, err := w.Reporter.Quarantine.Pick(w.Containers, n)
+	if err != nil {
+		return err
+	}
+	w.Reporter.Schedule.Step(ctx, n, "report", cc)
+	hash := ""
+	if w.MutateDigests {
+		hash = SyntheticHash(0, w.Reporter.RunID+"/"+cc, n)
+	}
+	if err := w.Reporter.reportForContainer(ctx, cc, hash, w.Delete); err != nil {
+		zlog.Error(ctx).Str("container", cc).Msg(err.Error())
+		return w.Reporter.StepFailed("report", err)
+	}
+	zlog.Debug(ctx).Str("container", cc).Msg("completed")
+	return nil
+}
+
+// Teardown sends any deletes still batched.
+func (w *ReportWorkload) Teardown(ctx context.Context) error {
+	if err := w.Reporter.FlushDeletes(ctx); err != nil {
+		zlog.Error(ctx).Msg(err.Error())
+	}
+	return nil
+}
+
+// detached is a context that's never done, but has the values of the one it
+// wraps.
+type detached struct {
+	context.Context
+}
+
+func detach(ctx context.Context) context.Context { return detached{ctx} }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
@@ -0,0 +1,145 @@
+// Package results is the schema of what clair-load-test writes, for tools
+// reading it: a run's output, its configuration followed by its stats,
+// written as JSON to stdout or --output-file, and its results file, a JSON
+// sample per request written to --results.
+//
+// The stats carry the SchemaVersion they were written with. It's bumped
+// when a field is removed, renamed or changes meaning, so a reader built
+// against one version can rely on every field it knows about. Adding a
+// field doesn't bump it, so readers should ignore fields they don't know,
+// as encoding/json does by default.
+//
+// The configuration reflects the flags of the command that was run, and
+// isn't part of the schema beyond being a JSON object.
+//
+// The package stands alone, so reading results doesn't pull in the load
+// generator. Package loadtest converts its own stats and samples into these
+// types, with its Stats.Results and Sample.Result.
+//
+//	out, err := results.ReadOutput(f)
+//	if err != nil {
+//		return err
+//	}
+//	p99 := out.Stats.Endpoints["index_report"].P99LatencyMilliseconds
+package results
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SchemaVersion is the version of the schema described here.
+const SchemaVersion = 1
+
+// Output is a run's output. Commands reporting more than the stats write
+// those between the config and stats, and they're skipped.
+type Output struct {
+	Config map[string]interface{}
+	Stats  *Stats
+}
+
+// ReadOutput reads a run's output. Fields it doesn't know are ignored, but
+// the stats must be of the current SchemaVersion.
+func ReadOutput(r io.Reader) (*Output, error) {
+	return readOutput(r, false)
+}
+
+// ValidateOutput checks a run's output is of the current schema, with no
+// fields the schema doesn't have.
+func ValidateOutput(r io.Reader) error {
+	_, err := readOutput(r, true)
+	return err
+}
+
+func readOutput(r io.Reader, strict bool) (*Output, error) {
+	var docs []json.RawMessage
+	dec := json.NewDecoder(r)
+	for {
+		var doc json.RawMessage
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode document %d: %w", len(docs)+1, err)
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) < 2 {
+		return nil, fmt.Errorf("expected the config and stats, found %d documents", len(docs))
+	}
+	stats := docs[len(docs)-1]
+	out := &Output{}
+	if err := json.Unmarshal(docs[0], &out.Config); err != nil || out.Config == nil {
+		return nil, fmt.Errorf("config isn't a JSON object")
+	}
+	var v struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(stats, &v); err != nil {
+		return nil, fmt.Errorf("could not decode stats: %w", err)
+	}
+	switch {
+	case v.SchemaVersion == 0:
+		return nil, errors.New("stats have no schema_version, they were written before it was versioned")
+	case v.SchemaVersion != SchemaVersion:
+		return nil, fmt.Errorf("stats are of schema version %d, expected %d", v.SchemaVersion, SchemaVersion)
+	}
+	out.Stats = &Stats{}
+	if err := decode(stats, out.Stats, strict); err != nil {
+		return nil, fmt.Errorf("could not decode stats: %w", err)
+	}
+	return out, nil
+}
+
+// ReadSamples reads a results file. Fields it doesn't know are ignored.
+func ReadSamples(r io.Reader) ([]*Sample, error) {
+	var samples []*Sample
+	dec := json.NewDecoder(r)
+	for {
+		s := &Sample{}
+		err := dec.Decode(s)
+		switch {
+		case err == io.EOF:
+			return samples, nil
+		case err != nil:
+			return nil, fmt.Errorf("could not decode sample %d: %w", len(samples)+1, err)
+		}
+		samples = append(samples, s)
+	}
+}
+
+// ValidateSamples checks a results file is of the current schema, with no
+// fields the schema doesn't have, returning how many samples it has.
+func ValidateSamples(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	n := 0
+	for {
+		var s Sample
+		err := dec.Decode(&s)
+		if err == io.EOF {
+			return n, nil
+		}
+		n++
+		switch {
+		case err != nil:
+			return n, fmt.Errorf("sample %d: %w", n, err)
+		case s.Endpoint == "":
+			return n, fmt.Errorf("sample %d: endpoint is missing", n)
+		case s.Time.IsZero():
+			return n, fmt.Errorf("sample %d: time is missing", n)
+		}
+	}
+}
+
+func decode(b []byte, v interface{}, strict bool) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
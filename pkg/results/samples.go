@@ -0,0 +1,71 @@
+package results
+
+import (
+	"net/http"
+	"time"
+)
+
+// Endpoint names used to label samples and stats.
+const (
+	EndpointIndexReport         = "index_report"
+	EndpointGetIndexReport      = "get_index_report"
+	EndpointVulnerabilityReport = "vulnerability_report"
+	// EndpointFilteredVulnerabilityReport is vulnerability reports
+	// requested with a filter on the vulnerabilities returned.
+	EndpointFilteredVulnerabilityReport = "filtered_vulnerability_report"
+	EndpointRecheckVulnerabilityReport  = "recheck_vulnerability_report"
+	EndpointDeleteIndexReport           = "delete_index_report"
+	EndpointVerifyDelete                = "verify_delete"
+	EndpointBulkDeleteIndexReports      = "bulk_delete_index_reports"
+	EndpointListUpdateOperations        = "list_update_operations"
+	EndpointUpdateDiff                  = "update_diff"
+	EndpointDeleteUpdateOperation       = "delete_update_operation"
+	EndpointIndexState                  = "index_state"
+	EndpointAffectedManifests           = "affected_manifests"
+	EndpointNotificationPage            = "notification_page"
+	EndpointDeleteNotification          = "delete_notification"
+)
+
+// Sample is the record of a single request made against Clair. A results
+// file is a sequence of JSON encoded samples, one per line.
+type Sample struct {
+	Time      time.Time `json:"time"`
+	Endpoint  string    `json:"endpoint"`
+	RequestID string    `json:"request_id,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	SizeClass string    `json:"size_class,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Phase     string    `json:"phase,omitempty"`
+	Spike     bool      `json:"spike,omitempty"`
+	Updating  bool      `json:"updating,omitempty"`
+	// State is the state of the index report an index request returned.
+	State string `json:"state,omitempty"`
+	// Transfer is how an index request's body was sent, if chosen.
+	Transfer            string `json:"transfer,omitempty"`
+	LatencyMilliseconds int64  `json:"latency_milliseconds"`
+	RequestBytes        int64  `json:"request_bytes,omitempty"`
+	StatusCode          int    `json:"status_code,omitempty"`
+	Protocol            string `json:"protocol,omitempty"`
+	// NewConnection is set if the request couldn't reuse a connection.
+	NewConnection             bool  `json:"new_connection,omitempty"`
+	ResponseBytes             int64 `json:"response_bytes,omitempty"`
+	UncompressedResponseBytes int64 `json:"uncompressed_response_bytes,omitempty"`
+	// AgeSeconds is the response's Age header, set by caches.
+	AgeSeconds int64  `json:"age_seconds,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+// Failed reports whether the request errored or got a non-2XX response. A
+// 304 is only ever the answer to a conditional request, so isn't a failure.
+// Neither is a 404 for a vulnerability report, filtered or not, which is the
+// matcher not seeing the index report yet.
+func (s *Sample) Failed() bool {
+	if s.StatusCode == http.StatusNotModified ||
+		(s.Endpoint == EndpointVulnerabilityReport && s.StatusCode == http.StatusNotFound) ||
+		(s.Endpoint == EndpointFilteredVulnerabilityReport && s.StatusCode == http.StatusNotFound) ||
+		(s.Endpoint == EndpointVerifyDelete && s.StatusCode == http.StatusNotFound) {
+		return s.Error != ""
+	}
+	return s.Error != "" || s.StatusCode < 200 || s.StatusCode > 299
+}
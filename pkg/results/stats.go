@@ -0,0 +1,567 @@
+package results
+
+import "time"
+
+// Stats are a run's stats, the last document of its output.
+type Stats struct {
+	SchemaVersion int `json:"schema_version"`
+	// The index and vulnerability report and delete totals are kept at the
+	// top level, as well as in Endpoints, for anything reading results from
+	// before stats were kept per endpoint.
+	TotalIndexReportRequests                           int64   `json:"total_index_report_requests"`
+	TotalVulnerabilityReportRequests                   int64   `json:"total_vulnerability_report_requests"`
+	TotalIndexReportRequestLatencyMilliseconds         int64   `json:"total_index_report_latency_milliseconds"`
+	TotalVulnerabilityReportRequestLatencyMilliseconds int64   `json:"total_vulnerability_report_latency_milliseconds"`
+	LatencyPerIndexReportRequest                       float64 `json:"latency_per_index_report_request"`
+	LatencyPerVulnerabilityReportRequest               float64 `json:"latency_per_vulnerability_report_request"`
+	Non2XXIndexReportResponses                         int64   `json:"non_2XX_index_report_responses"`
+	Non2XXVulnerabilityReportResponses                 int64   `json:"non_2XX_vulnerability_report_responses"`
+	MaxIndexReportRequestLatencyMilliseconds           int64   `json:"max_index_report_request_latency_milliseconds"`
+	MaxVulnerabilityReportRequestLatencyMilliseconds   int64   `json:"max_vulnerability_report_request_latency_milliseconds"`
+	TotalDeleteIndexReportRequests                     int64   `json:"total_delete_index_report_requests,omitempty"`
+	TotalBulkDeleteIndexReportRequests                 int64   `json:"total_bulk_delete_index_report_requests,omitempty"`
+	Non2XXDeleteIndexReportResponses                   int64   `json:"non_2XX_delete_index_report_responses,omitempty"`
+	Non2XXBulkDeleteIndexReportResponses               int64   `json:"non_2XX_bulk_delete_index_report_responses,omitempty"`
+	DeletedIndexReports                                int64   `json:"deleted_index_reports,omitempty"`
+	// VerifiedDeletes counts the deletes checked by fetching the index
+	// report again, and DeletesNotApplied those where it was still there.
+	VerifiedDeletes   int64                      `json:"verified_deletes,omitempty"`
+	DeletesNotApplied int64                      `json:"deletes_not_applied,omitempty"`
+	Endpoints         map[string]*EndpointStats  `json:"endpoints"`
+	Images            map[string]*ImageStats     `json:"images,omitempty"`
+	SizeClasses       map[string]*SizeClassStats `json:"size_classes,omitempty"`
+	ManifestPads      map[string]*EndpointStats  `json:"manifest_pads,omitempty"`
+	// Transfers are the index report stats by how their bodies were
+	// sent, "chunked" or with a known "length".
+	Transfers  map[string]*EndpointStats `json:"transfers,omitempty"`
+	Tenants    map[string]*TenantStats   `json:"tenants,omitempty"`
+	Registries map[string]*RegistryStats `json:"registries,omitempty"`
+	// ClairLatencyMilliseconds is the time spent waiting on Clair, summed
+	// over every request, to compare with the time spent on registries.
+	ClairLatencyMilliseconds int64 `json:"clair_latency_milliseconds"`
+	// ConnectionReuseRatio is the share of requests to Clair sent on a
+	// connection kept alive from an earlier one.
+	ConnectionReuseRatio float64 `json:"connection_reuse_ratio"`
+	// ManifestSources counts the manifests got from each source: clairctl,
+	// native, file or registry.
+	ManifestSources map[string]int64 `json:"manifest_sources,omitempty"`
+	// Database is how up to date the matcher's vulnerability database was.
+	Database *DatabaseFreshness `json:"database,omitempty"`
+	// IndexReports count the index reports Clair returned by state.
+	IndexReports *IndexReportStats `json:"index_reports,omitempty"`
+	// Pregeneration reports the manifests generated before the run.
+	Pregeneration         *PregenerationStats       `json:"pregeneration,omitempty"`
+	Phases                []*PhaseStats             `json:"phases,omitempty"`
+	ErrorRate             float64                   `json:"error_rate"`
+	Aborted               string                    `json:"aborted,omitempty"`
+	TotalBytes            int64                     `json:"total_bytes"`
+	ElapsedSeconds        float64                   `json:"elapsed_seconds"`
+	ThroughputMBPerSecond float64                   `json:"throughput_mb_per_second"`
+	SLOs                  []*SLOResult              `json:"slos,omitempty"`
+	Drift                 map[string]*EndpointDrift `json:"drift,omitempty"`
+	ClairMetrics          []*MetricsSnapshot        `json:"clair_metrics,omitempty"`
+	Postgres              map[string][]*PGSnapshot  `json:"postgres,omitempty"`
+	Timeline              []*TimeBucket             `json:"timeline,omitempty"`
+	Anomalies             []*Anomaly                `json:"anomalies,omitempty"`
+	Notifications         *NotificationStats        `json:"notifications,omitempty"`
+	Updates               *UpdateInterference       `json:"updates,omitempty"`
+	Probes                map[string]*ProbeStats    `json:"probes,omitempty"`
+	Polls                 *PollStats                `json:"polls,omitempty"`
+	Tokens                *TokenStats               `json:"tokens,omitempty"`
+	Rechecks              *RecheckStats             `json:"rechecks,omitempty"`
+	// ReportFilter compares filtered vulnerability reports with full ones.
+	ReportFilter *ReportFilterStats `json:"report_filter,omitempty"`
+	// Budget is where the time of the run's steps went.
+	Budget *LatencyBudget `json:"budget,omitempty"`
+	// Errors counts the errors steps failed with, by operation and type.
+	Errors []*ErrorCount `json:"errors,omitempty"`
+	// Quarantined are the containers taken out of rotation for failing.
+	Quarantined []*QuarantinedImage `json:"quarantined,omitempty"`
+	// Samples are a bounded random sample of the run's requests, if kept.
+	Samples []*Sample `json:"samples,omitempty"`
+}
+
+// EndpointStats are the stats for requests to a single Clair endpoint.
+type EndpointStats struct {
+	TotalRequests             int64                      `json:"total_requests"`
+	TotalLatencyMilliseconds  int64                      `json:"total_latency_milliseconds"`
+	LatencyPerRequest         float64                    `json:"latency_per_request"`
+	MaxLatencyMilliseconds    int64                      `json:"max_latency_milliseconds"`
+	P50LatencyMilliseconds    int64                      `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds    int64                      `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds    int64                      `json:"p99_latency_milliseconds"`
+	Non2XXResponses           int64                      `json:"non_2XX_responses"`
+	RequestErrors             int64                      `json:"request_errors"`
+	FailedResponses           int64                      `json:"failed_responses,omitempty"`
+	StatusCodes               map[int]int64              `json:"status_codes,omitempty"`
+	TransportErrors           map[string]int64           `json:"transport_errors,omitempty"`
+	Protocols                 map[string]int64           `json:"protocols,omitempty"`
+	LatencyByOutcome          map[string]*OutcomeLatency `json:"latency_by_outcome,omitempty"`
+	NotModifiedResponses      int64                      `json:"not_modified_responses,omitempty"`
+	NotFoundResponses         int64                      `json:"not_found_responses,omitempty"`
+	CachedResponses           int64                      `json:"cached_responses,omitempty"`
+	RequestBytes              int64                      `json:"request_bytes"`
+	ResponseBytes             int64                      `json:"response_bytes"`
+	AverageResponseBytes      float64                    `json:"average_response_bytes"`
+	UncompressedResponseBytes int64                      `json:"uncompressed_response_bytes"`
+	CompressionRatio          float64                    `json:"compression_ratio"`
+	// NewConnections and ReusedConnections count the requests sent on a new
+	// connection and on one kept alive, and ConnectionReuseRatio is the
+	// share of the latter.
+	NewConnections       int64   `json:"new_connections"`
+	ReusedConnections    int64   `json:"reused_connections"`
+	ConnectionReuseRatio float64 `json:"connection_reuse_ratio"`
+}
+
+// OutcomeLatency summarizes the latencies of requests with one outcome.
+type OutcomeLatency struct {
+	Requests               int64   `json:"requests"`
+	LatencyPerRequest      float64 `json:"latency_per_request"`
+	MaxLatencyMilliseconds int64   `json:"max_latency_milliseconds"`
+	P50LatencyMilliseconds int64   `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64   `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds int64   `json:"p99_latency_milliseconds"`
+}
+
+// ImageStats are the stats for a single image.
+type ImageStats struct {
+	VulnerabilityReports            int64   `json:"vulnerability_reports"`
+	VulnerabilityReportBytes        int64   `json:"vulnerability_report_bytes"`
+	AverageVulnerabilityReportBytes float64 `json:"average_vulnerability_report_bytes"`
+	// Packages, Vulnerabilities and Enrichments are counted in the latest
+	// full vulnerability report, to trend across runs: a drop after
+	// upgrading Clair can be a regression in its data even when latency
+	// looks fine.
+	Packages        int `json:"packages"`
+	Vulnerabilities int `json:"vulnerabilities"`
+	Enrichments     int `json:"enrichments"`
+	// CountsChanged is set if the counts weren't the same in every report,
+	// such as when an updater ran during the run.
+	CountsChanged bool `json:"counts_changed,omitempty"`
+}
+
+// SizeClassStats are the stats for requests about manifests of a single size
+// class, per endpoint.
+type SizeClassStats struct {
+	Manifests int64                     `json:"manifests"`
+	Endpoints map[string]*EndpointStats `json:"endpoints"`
+}
+
+// TenantStats are the stats for the requests made as a tenant.
+type TenantStats struct {
+	Requests int64 `json:"requests"`
+	// Share is the fraction of all requests made as the tenant.
+	Share float64 `json:"share"`
+	// Rejected counts the 401s and 403s, Clair not accepting the tenant's
+	// tokens.
+	Rejected  int64                     `json:"rejected"`
+	Endpoints map[string]*EndpointStats `json:"endpoints"`
+}
+
+// RegistryStats are the stats for the manifest requests made to a single
+// registry, through clairctl or to look up platforms.
+type RegistryStats struct {
+	Requests             int64 `json:"requests"`
+	RateLimitedResponses int64 `json:"rate_limited_responses"`
+	// ThrottledMilliseconds is the time spent waiting, for the rate limit
+	// or backing off after being rate limited.
+	ThrottledMilliseconds int64 `json:"throttled_milliseconds"`
+	LatencyMilliseconds   int64 `json:"latency_milliseconds"`
+}
+
+// DatabaseFreshness is how up to date the matcher's vulnerability database
+// was for a run, from when each updater last updated it. Runs against
+// databases of different ages match different vulnerabilities, so their
+// results aren't comparable.
+type DatabaseFreshness struct {
+	// Updaters are when each updater last updated the database, as of the
+	// start of the run.
+	Updaters map[string]time.Time `json:"updaters"`
+	// Newest and Oldest are the latest and earliest of those, with how
+	// long before the run started they were.
+	Newest           time.Time `json:"newest"`
+	Oldest           time.Time `json:"oldest"`
+	NewestAgeSeconds float64   `json:"newest_age_seconds"`
+	OldestAgeSeconds float64   `json:"oldest_age_seconds"`
+	// UpdatedDuringRun are the updaters that updated the database while
+	// the run went on, so reports from before and after can differ.
+	UpdatedDuringRun []string `json:"updated_during_run,omitempty"`
+}
+
+// IndexReportStats count the index reports Clair returned by state, so a
+// report returned in state IndexError isn't mistaken for a success.
+type IndexReportStats struct {
+	Reports int64            `json:"reports"`
+	States  map[string]int64 `json:"states"`
+	// Succeeded counts the reports returned in state IndexFinished without
+	// an error.
+	Succeeded    int64   `json:"succeeded"`
+	SuccessRatio float64 `json:"success_ratio"`
+	// Errors counts the errors reports were returned with, by message.
+	Errors map[string]int64 `json:"errors,omitempty"`
+}
+
+// PregenerationStats report the manifests generated before a run.
+type PregenerationStats struct {
+	Containers     int     `json:"containers"`
+	Generated      int     `json:"generated"`
+	Failed         int     `json:"failed"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// The latencies are of generating each manifest, including sizing it
+	// for size classes.
+	P50LatencyMilliseconds int64 `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64 `json:"p95_latency_milliseconds"`
+	MaxLatencyMilliseconds int64 `json:"max_latency_milliseconds"`
+	// Errors are why each container that failed did, by container.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// PhaseStats are the stats for the requests recorded during a phase.
+type PhaseStats struct {
+	Name         string                    `json:"name"`
+	StartSeconds float64                   `json:"start_seconds"`
+	EndSeconds   float64                   `json:"end_seconds"`
+	Endpoints    map[string]*EndpointStats `json:"endpoints"`
+}
+
+// SLOResult is the outcome of an SLO over a run.
+type SLOResult struct {
+	SLO *SLO `json:"slo"`
+	// Passed reports whether the SLO held at the end of the run.
+	Passed              bool  `json:"passed"`
+	LatencyMilliseconds int64 `json:"latency_milliseconds,omitempty"`
+	// CompliancePercent is the share of requests at or below Max, which
+	// needs to be at least the percentile for the SLO to pass.
+	CompliancePercent float64 `json:"compliance_percent,omitempty"`
+	ErrorRate         float64 `json:"error_rate,omitempty"`
+	// Breaches counts the evaluations during the run where the SLO didn't
+	// hold.
+	Breaches    int        `json:"breaches"`
+	FirstBreach *time.Time `json:"first_breach,omitempty"`
+}
+
+// SLO is an objective for a single endpoint: either a latency percentile that
+// must stay at or below Max, or an error rate that must stay at or below
+// MaxErrorRate percent, or both. If SizeClass is set, only requests for
+// manifests of that size class count.
+type SLO struct {
+	Endpoint     string        `yaml:"endpoint" json:"endpoint"`
+	SizeClass    string        `yaml:"size_class" json:"size_class,omitempty"`
+	Percentile   float64       `yaml:"percentile" json:"percentile,omitempty"`
+	Max          time.Duration `yaml:"max" json:"max,omitempty"`
+	MaxErrorRate float64       `yaml:"max_error_rate" json:"max_error_rate,omitempty"`
+}
+
+// EndpointDrift is the trend of an endpoint's p95 latency over a run, fitted
+// with a least squares line. Drifting is set when the fitted p95 grew by more
+// than the threshold over the run, the slow degradation typical of a leak.
+type EndpointDrift struct {
+	Points          []DriftPoint `json:"points"`
+	SlopeMsPerHour  float64      `json:"slope_ms_per_hour"`
+	FittedStartP95  float64      `json:"fitted_start_p95"`
+	FittedEndP95    float64      `json:"fitted_end_p95"`
+	IncreasePercent float64      `json:"increase_percent"`
+	Drifting        bool         `json:"drifting"`
+}
+
+// DriftPoint is the p95 latency of the requests made during one interval.
+type DriftPoint struct {
+	ElapsedSeconds         float64 `json:"elapsed_seconds"`
+	Requests               int     `json:"requests"`
+	P95LatencyMilliseconds int64   `json:"p95_latency_milliseconds"`
+}
+
+// MetricsSnapshot is a scrape of Clair's metrics. Series are keyed by name
+// and labels as they appear in the exposition format.
+type MetricsSnapshot struct {
+	Time           time.Time          `json:"time"`
+	ElapsedSeconds float64            `json:"elapsed_seconds"`
+	Series         map[string]float64 `json:"series"`
+}
+
+// PGSnapshot is a sample of a Clair database's activity. The pg_stat_database
+// counters are cumulative, so the difference between snapshots is what
+// happened in between.
+type PGSnapshot struct {
+	Time              time.Time `json:"time"`
+	ElapsedSeconds    float64   `json:"elapsed_seconds"`
+	Connections       int64     `json:"connections"`
+	ActiveConnections int64     `json:"active_connections"`
+	WaitingOnLocks    int64     `json:"waiting_on_locks"`
+	Locks             int64     `json:"locks"`
+	UngrantedLocks    int64     `json:"ungranted_locks"`
+	XactCommit        int64     `json:"xact_commit"`
+	XactRollback      int64     `json:"xact_rollback"`
+	BlocksRead        int64     `json:"blks_read"`
+	BlocksHit         int64     `json:"blks_hit"`
+	TuplesReturned    int64     `json:"tup_returned"`
+	TuplesFetched     int64     `json:"tup_fetched"`
+	TuplesInserted    int64     `json:"tup_inserted"`
+	TuplesUpdated     int64     `json:"tup_updated"`
+	TuplesDeleted     int64     `json:"tup_deleted"`
+	TempFiles         int64     `json:"temp_files"`
+	TempBytes         int64     `json:"temp_bytes"`
+	Deadlocks         int64     `json:"deadlocks"`
+}
+
+// TimeBucket is the stats for the requests started during one
+// TimelineBucket of a run, so latency over time can be graphed from the
+// stats alone.
+type TimeBucket struct {
+	StartSeconds float64 `json:"start_seconds"`
+	BucketStats
+	Endpoints map[string]*BucketStats `json:"endpoints,omitempty"`
+	// DependenciesDown are the probed dependencies that were down at some
+	// point during the bucket.
+	DependenciesDown []string `json:"dependencies_down,omitempty"`
+}
+
+// BucketStats summarize the requests in a TimeBucket.
+type BucketStats struct {
+	Requests               int64 `json:"requests"`
+	Errors                 int64 `json:"errors"`
+	P50LatencyMilliseconds int64 `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64 `json:"p95_latency_milliseconds"`
+}
+
+// Anomaly is a cluster of timeouts or unusually slow requests to an endpoint,
+// such as a GC pause or a lock held too long would cause. Its window can be
+// cross-referenced with Clair's logs.
+type Anomaly struct {
+	Kind     string    `json:"kind"`
+	Endpoint string    `json:"endpoint"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Requests int       `json:"requests"`
+	// MaxLatencyMilliseconds is the slowest of the requests, against the
+	// endpoint's median over the whole run.
+	MaxLatencyMilliseconds    int64 `json:"max_latency_milliseconds"`
+	MedianLatencyMilliseconds int64 `json:"median_latency_milliseconds"`
+}
+
+// NotificationStats are the stats for notifications delivered by Clair's
+// notifier. Latencies are in milliseconds.
+type NotificationStats struct {
+	// Deliveries counts every delivery, Notifications only distinct
+	// notifications, and Redeliveries the deliveries of notifications
+	// already delivered.
+	Deliveries    int64 `json:"deliveries"`
+	Notifications int64 `json:"notifications"`
+	Redeliveries  int64 `json:"redeliveries"`
+	// Rejected counts the deliveries failed on purpose, to make the
+	// notifier retry.
+	Rejected int64 `json:"rejected"`
+	// Read counts the notifications read from their pages, if they're
+	// fetched.
+	Read            int64 `json:"read,omitempty"`
+	PayloadBytes    int64 `json:"payload_bytes"`
+	MaxPayloadBytes int64 `json:"max_payload_bytes"`
+	// FirstDeliverySeconds and LastDeliverySeconds are how long after the
+	// receiver started the first and last deliveries arrived.
+	FirstDeliverySeconds float64 `json:"first_delivery_seconds"`
+	LastDeliverySeconds  float64 `json:"last_delivery_seconds"`
+	// Delivery latency is from a notification's first delivery to the one
+	// accepted, so it's only more than 0 for retried notifications.
+	P50DeliveryLatency int64 `json:"p50_delivery_latency_milliseconds"`
+	P95DeliveryLatency int64 `json:"p95_delivery_latency_milliseconds"`
+	MaxDeliveryLatency int64 `json:"max_delivery_latency_milliseconds"`
+	// Retry delays are between consecutive deliveries of a notification.
+	P50RetryDelay int64 `json:"p50_retry_delay_milliseconds,omitempty"`
+	P95RetryDelay int64 `json:"p95_retry_delay_milliseconds,omitempty"`
+	MaxRetryDelay int64 `json:"max_retry_delay_milliseconds,omitempty"`
+	// Lag is from when a message holding notifications was published to a
+	// broker to when it was consumed, where the broker stamps messages.
+	P50Lag int64 `json:"p50_lag_milliseconds,omitempty"`
+	P95Lag int64 `json:"p95_lag_milliseconds,omitempty"`
+	MaxLag int64 `json:"max_lag_milliseconds,omitempty"`
+}
+
+// UpdateInterference compares the latencies of requests made during update
+// windows with those made outside them. Latencies are in milliseconds.
+type UpdateInterference struct {
+	Windows   []*UpdateWindow                  `json:"windows"`
+	Endpoints map[string]*EndpointInterference `json:"endpoints,omitempty"`
+}
+
+// UpdateWindow is a stretch of a run during which the updaters were running.
+type UpdateWindow struct {
+	StartSeconds float64 `json:"start_seconds"`
+	EndSeconds   float64 `json:"end_seconds"`
+	// Done reports whether the updaters finished before the timeout.
+	Done     bool     `json:"done"`
+	Updaters []string `json:"updaters,omitempty"`
+}
+
+// EndpointInterference is how an endpoint's latencies and errors changed
+// while the updaters were running. Deltas are updating minus baseline.
+type EndpointInterference struct {
+	BaselineRequests   int     `json:"baseline_requests"`
+	UpdatingRequests   int     `json:"updating_requests"`
+	BaselineP50        int64   `json:"baseline_p50_latency_milliseconds"`
+	BaselineP95        int64   `json:"baseline_p95_latency_milliseconds"`
+	UpdatingP50        int64   `json:"updating_p50_latency_milliseconds"`
+	UpdatingP95        int64   `json:"updating_p95_latency_milliseconds"`
+	P50Delta           int64   `json:"p50_delta_milliseconds"`
+	P95Delta           int64   `json:"p95_delta_milliseconds"`
+	P95IncreasePercent float64 `json:"p95_increase_percent,omitempty"`
+	BaselineErrorRate  float64 `json:"baseline_error_rate"`
+	UpdatingErrorRate  float64 `json:"updating_error_rate"`
+}
+
+// ProbeStats are the results of probing a dependency over a run.
+type ProbeStats struct {
+	Target   string `json:"target"`
+	Checks   int    `json:"checks"`
+	Failures int    `json:"failures"`
+	// Flaps counts the times the dependency went down after being up.
+	Flaps           int     `json:"flaps"`
+	DowntimeSeconds float64 `json:"downtime_seconds"`
+	// Events are the changes in readiness, beginning with the first check.
+	Events []*ProbeEvent `json:"events"`
+}
+
+// ProbeEvent is a change in a dependency's readiness.
+type ProbeEvent struct {
+	Time           time.Time `json:"time"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Up             bool      `json:"up"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// PollStats are the stats for vulnerability reports polled repeatedly, as a
+// dashboard refreshing them would.
+type PollStats struct {
+	Hashes int   `json:"hashes"`
+	Polls  int64 `json:"polls"`
+	// NotModified counts the 304s to conditional polls, and Cached the
+	// responses a cache in front of Clair answered.
+	NotModified int64 `json:"not_modified"`
+	Cached      int64 `json:"cached"`
+	// CacheHitRate is the fraction of polls answered by either.
+	CacheHitRate float64 `json:"cache_hit_rate"`
+	// Changes counts the full responses that differed from the previous
+	// one for their hash, and Reverts those that went back to a version
+	// seen earlier, such as replicas disagreeing would cause.
+	Changes int64 `json:"changes"`
+	Reverts int64 `json:"reverts"`
+	// MaxVersions is the most distinct responses seen for a single hash.
+	MaxVersions int `json:"max_versions"`
+}
+
+// TokenStats count requests by whether their token was valid when they were
+// sent, by this host's clock, and whether Clair accepted them. Rejections are
+// 401s; accepting expired or not yet valid tokens is Clair's leeway for
+// clock skew, and rejecting valid ones is skew the other way.
+type TokenStats struct {
+	Minted          int64 `json:"minted"`
+	Requests        int64 `json:"requests"`
+	Rejected        int64 `json:"rejected"`
+	Valid           int64 `json:"valid"`
+	ValidRejected   int64 `json:"valid_rejected"`
+	Expired         int64 `json:"expired"`
+	ExpiredAccepted int64 `json:"expired_accepted"`
+	Early           int64 `json:"not_yet_valid"`
+	EarlyAccepted   int64 `json:"not_yet_valid_accepted"`
+}
+
+// RecheckStats are the results of fetching each vulnerability report again,
+// to look for reports that differ for the same manifest.
+type RecheckStats struct {
+	Hashes   int   `json:"hashes"`
+	Rechecks int64 `json:"rechecks"`
+	// Failed counts the rechecks that got no report to compare.
+	Failed int64 `json:"failed"`
+	// Inconsistent are the hashes whose reports didn't all list the same
+	// vulnerabilities.
+	Inconsistent []*InconsistentReport `json:"inconsistent,omitempty"`
+}
+
+// InconsistentReport is a manifest whose vulnerability report changed
+// between fetches.
+type InconsistentReport struct {
+	Hash    string `json:"hash"`
+	Fetches int    `json:"fetches"`
+	// Versions is how many different sets of vulnerabilities were seen.
+	Versions int `json:"versions"`
+	// Added are vulnerabilities in a later report but not the first, and
+	// Removed the other way around, by ID.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// ReportFilterStats compare the vulnerability reports requested with a
+// filter with those requested in full, by their 200 responses.
+type ReportFilterStats struct {
+	Query    string         `json:"query"`
+	Full     *ReportVariant `json:"full"`
+	Filtered *ReportVariant `json:"filtered"`
+	// BytesSavedPercent is how much smaller filtered reports were than full
+	// ones on average, uncompressed.
+	BytesSavedPercent float64 `json:"bytes_saved_percent"`
+	// Ignored is set if filtered reports were under reportFilterMinSaving
+	// smaller than full ones, as when Clair doesn't support the filter and
+	// answers in full.
+	Ignored bool `json:"ignored"`
+}
+
+// ReportVariant is the 200 responses to one kind of vulnerability report
+// request.
+type ReportVariant struct {
+	Responses                        int64   `json:"responses"`
+	AverageResponseBytes             float64 `json:"average_response_bytes"`
+	AverageUncompressedResponseBytes float64 `json:"average_uncompressed_response_bytes"`
+	P50LatencyMilliseconds           int64   `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds           int64   `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds           int64   `json:"p99_latency_milliseconds"`
+}
+
+// LatencyBudget is where the time of a run's steps went, from each being due
+// to it returning, so a slow run can be put down to the load generator
+// falling behind or to Clair.
+type LatencyBudget struct {
+	Steps int64 `json:"steps"`
+	// Total is from a step being due to it returning.
+	Total *BudgetPart `json:"total"`
+	// Queued is from a step being due to a worker starting it, time lost
+	// to every worker being busy.
+	Queued *BudgetPart `json:"queued"`
+	// Clair is waiting on responses from Clair, and Registry on those from
+	// registries, up to their headers as for endpoint latencies.
+	Clair    *BudgetPart `json:"clair"`
+	Registry *BudgetPart `json:"registry"`
+	// Throttled is waiting for a registry's rate limit.
+	Throttled *BudgetPart `json:"throttled"`
+	// Other is the rest, such as delays between requests, waits between
+	// polls, and building requests and reading responses.
+	Other *BudgetPart `json:"other"`
+}
+
+// BudgetPart is the time steps spent on one part of their work.
+type BudgetPart struct {
+	TotalMilliseconds int64 `json:"total_milliseconds"`
+	// Percent is the share of the steps' total time.
+	Percent                float64 `json:"percent"`
+	P50LatencyMilliseconds int64   `json:"p50_latency_milliseconds"`
+	P95LatencyMilliseconds int64   `json:"p95_latency_milliseconds"`
+	P99LatencyMilliseconds int64   `json:"p99_latency_milliseconds"`
+	MaxLatencyMilliseconds int64   `json:"max_latency_milliseconds"`
+}
+
+// ErrorCount is how many steps doing one operation failed with one type of
+// error.
+type ErrorCount struct {
+	Op    string `json:"op"`
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+	// Example is the first of the errors.
+	Example string `json:"example"`
+}
+
+// QuarantinedImage is a container taken out of rotation for failing.
+type QuarantinedImage struct {
+	Container string `json:"container"`
+	// Failures is how many times in a row it failed.
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error"`
+	Time      time.Time `json:"time"`
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+)
+
+var presetFlag = &cli.StringFlag{
+	Name:    "preset",
+	Usage:   "--preset small (bundled images added to --containers: small, rhel-heavy, node-apps or top-100-dockerhub)",
+	Value:   "",
+	EnvVars: []string{"PRESET"},
+}
+
+// Preset is a curated list of images, for running meaningful tests without
+// assembling a corpus.
+type Preset struct {
+	Containers []string
+	// Expect describes the images, and what they exercise in Clair.
+	Expect string
+}
+
+var presets = map[string]*Preset{
+	"small": {
+		Expect: "a few small images with few layers and packages, for smoke tests",
+		Containers: []string{
+			"alpine:3.18",
+			"busybox:1.36",
+			"debian:bookworm-slim",
+			"ubuntu:22.04",
+			"gcr.io/distroless/static-debian12:latest",
+		},
+	},
+	"rhel-heavy": {
+		Expect: "RPM based images with hundreds of packages, exercising the RHEL indexer, CPE mapping and matcher",
+		Containers: []string{
+			"registry.access.redhat.com/ubi8/ubi:latest",
+			"registry.access.redhat.com/ubi9/ubi:latest",
+			"registry.access.redhat.com/ubi9/ubi-minimal:latest",
+			"registry.access.redhat.com/ubi8/python-39:latest",
+			"registry.access.redhat.com/ubi9/nodejs-18:latest",
+			"registry.access.redhat.com/ubi9/openjdk-17:latest",
+			"quay.io/centos/centos:stream9",
+		},
+	},
+	"node-apps": {
+		Expect: "Node.js applications with large npm dependency trees, exercising language package indexing and matching",
+		Containers: []string{
+			"node:18",
+			"node:20-alpine",
+			"node:20-slim",
+			"ghost:5",
+			"nodered/node-red:3.1",
+			"verdaccio/verdaccio:5",
+		},
+	},
+	"top-100-dockerhub": {
+		Expect: "a hundred of the most pulled Docker Hub images, a realistic mix of distributions, sizes and languages",
+		Containers: []string{
+			"alpine:latest", "busybox:latest", "nginx:latest", "ubuntu:latest",
+			"python:latest", "redis:latest", "postgres:latest", "node:latest",
+			"httpd:latest", "memcached:latest", "mongo:latest", "mysql:latest",
+			"traefik:latest", "mariadb:latest", "docker:latest", "rabbitmq:latest",
+			"golang:latest", "registry:latest", "wordpress:latest", "debian:latest",
+			"centos:latest", "php:latest", "ruby:latest", "amazonlinux:latest",
+			"eclipse-temurin:latest", "amazoncorretto:latest", "tomcat:latest", "haproxy:latest",
+			"influxdb:latest", "telegraf:latest", "sonarqube:latest", "nextcloud:latest",
+			"ghost:latest", "adminer:latest", "caddy:latest", "zookeeper:latest",
+			"cassandra:latest", "couchdb:latest", "neo4j:latest", "solr:latest",
+			"eclipse-mosquitto:latest", "nats:latest", "drupal:latest", "joomla:latest",
+			"redmine:latest", "phpmyadmin:latest", "matomo:latest", "rust:latest",
+			"perl:latest", "gcc:latest", "bash:latest", "fedora:latest",
+			"archlinux:latest", "almalinux:latest", "clojure:latest", "maven:latest",
+			"gradle:latest", "groovy:latest", "erlang:latest", "elixir:latest",
+			"haskell:latest", "julia:latest", "pypy:latest", "swift:latest",
+			"kong:latest", "percona:latest", "mongo-express:latest", "odoo:latest",
+			"rocket.chat:latest", "chronograf:latest", "varnish:latest", "tomee:latest",
+			"jetty:latest", "flink:latest", "rethinkdb:latest", "arangodb:latest",
+			"couchbase:latest", "mediawiki:latest", "photon:latest", "buildpack-deps:latest",
+			"hello-world:latest", "postfixadmin:latest", "znc:latest", "backdrop:latest",
+			"grafana/grafana:latest", "prom/prometheus:latest", "prom/node-exporter:latest", "jenkins/jenkins:latest",
+			"portainer/portainer-ce:latest", "hashicorp/vault:latest", "hashicorp/consul:latest", "bitnami/redis:latest",
+			"bitnami/postgresql:latest", "minio/minio:latest", "confluentinc/cp-kafka:latest", "localstack/localstack:latest",
+			"gitlab/gitlab-ce:latest", "sonatype/nexus3:latest", "keycloak/keycloak:latest", "mcr.microsoft.com/dotnet/aspnet:latest",
+		},
+	},
+}
+
+// applyPreset adds the images of the preset named by --preset, if there is
+// one, to containers.
+func applyPreset(c *cli.Context, containers []string) ([]string, error) {
+	name := c.String("preset")
+	if name == "" {
+		return containers, nil
+	}
+	p, ok := presets[name]
+	if !ok {
+		names := make([]string, 0, len(presets))
+		for n := range presets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown preset %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	var out []string
+	for _, cc := range containers {
+		if cc != "" {
+			out = append(out, cc)
+		}
+	}
+	zlog.Info(c.Context).
+		Str("preset", name).
+		Int("containers", len(p.Containers)).
+		Str("expect", p.Expect).
+		Msg("using preset")
+	return append(out, p.Containers...), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+)
+
+var ProxyCmd = &cli.Command{
+	Name:        "proxy",
+	Description: "proxy requests to Clair, injecting latency, dropped connections and errors",
+	Usage:       "clair-load-test proxy --target http://localhost:6060 --error-rate 5%",
+	Action:      proxyAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "addr",
+			Usage:   "--addr :6061",
+			Value:   ":6061",
+			EnvVars: []string{"PROXY_ADDR"},
+		},
+		&cli.StringFlag{
+			Name:    "target",
+			Usage:   "--target http://localhost:6060",
+			Value:   "http://localhost:6060",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.DurationFlag{
+			Name:    "latency",
+			Usage:   "--latency 500ms (added to --latency-rate of requests)",
+			Value:   0,
+			EnvVars: []string{"PROXY_LATENCY"},
+		},
+		&cli.StringFlag{
+			Name:    "latency-rate",
+			Usage:   "--latency-rate 10%",
+			Value:   "100%",
+			EnvVars: []string{"PROXY_LATENCY_RATE"},
+		},
+		&cli.StringFlag{
+			Name:    "drop-rate",
+			Usage:   "--drop-rate 1% (connections closed without a response)",
+			Value:   "",
+			EnvVars: []string{"PROXY_DROP_RATE"},
+		},
+		&cli.StringFlag{
+			Name:    "error-rate",
+			Usage:   "--error-rate 5% (requests answered with --error-status)",
+			Value:   "",
+			EnvVars: []string{"PROXY_ERROR_RATE"},
+		},
+		&cli.IntFlag{
+			Name:    "error-status",
+			Usage:   "--error-status 503",
+			Value:   http.StatusServiceUnavailable,
+			EnvVars: []string{"PROXY_ERROR_STATUS"},
+		},
+		seedFlag,
+	},
+}
+
+// faultProxy is a reverse proxy that injects faults into the requests it
+// forwards. Rates are percentages.
+type faultProxy struct {
+	proxy       *httputil.ReverseProxy
+	latency     time.Duration
+	latencyRate float64
+	dropRate    float64
+	errorRate   float64
+	errorStatus int
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	requests, delayed, dropped, errored int64
+}
+
+func proxyAction(c *cli.Context) error {
+	// Stop cleanly on an interrupt, so the fault counts get logged.
+	ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	target, err := url.Parse(c.String("target"))
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("invalid --target %q", c.String("target"))
+	}
+	p := &faultProxy{
+		proxy:       httputil.NewSingleHostReverseProxy(target),
+		latency:     c.Duration("latency"),
+		errorStatus: c.Int("error-status"),
+		rand:        rand.New(rand.NewSource(runSeed(c))),
+	}
+	for _, r := range []struct {
+		flag string
+		dst  *float64
+	}{
+		{"latency-rate", &p.latencyRate},
+		{"drop-rate", &p.dropRate},
+		{"error-rate", &p.errorRate},
+	} {
+		*r.dst, err = parsePercent(c.String(r.flag))
+		if err != nil {
+			return fmt.Errorf("invalid --%s: %w", r.flag, err)
+		}
+	}
+	if p.errorStatus < 100 || p.errorStatus > 599 {
+		return fmt.Errorf("invalid --error-status %d", p.errorStatus)
+	}
+
+	srv := &http.Server{Addr: c.String("addr"), Handler: p}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	zlog.Info(ctx).
+		Str("addr", srv.Addr).
+		Str("target", target.String()).
+		Msg("proxying")
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	zlog.Info(ctx).
+		Int64("requests", atomic.LoadInt64(&p.requests)).
+		Int64("delayed", atomic.LoadInt64(&p.delayed)).
+		Int64("dropped", atomic.LoadInt64(&p.dropped)).
+		Int64("errored", atomic.LoadInt64(&p.errored)).
+		Msg("proxy stopped")
+	return nil
+}
+
+// hit decides whether to inject a fault with the percentage rate.
+func (p *faultProxy) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rand.Float64()*100 < rate
+}
+
+func (p *faultProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	atomic.AddInt64(&p.requests, 1)
+	if p.latency > 0 && p.hit(p.latencyRate) {
+		atomic.AddInt64(&p.delayed, 1)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.latency):
+		}
+	}
+	if p.hit(p.dropRate) {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				atomic.AddInt64(&p.dropped, 1)
+				zlog.Debug(ctx).Str("path", r.URL.Path).Msg("dropping connection")
+				conn.Close()
+				return
+			}
+		}
+	}
+	if p.hit(p.errorRate) {
+		atomic.AddInt64(&p.errored, 1)
+		zlog.Debug(ctx).Str("path", r.URL.Path).Int("status", p.errorStatus).Msg("injecting error")
+		http.Error(w, "injected by clair-load-test proxy", p.errorStatus)
+		return
+	}
+	p.proxy.ServeHTTP(w, r)
+}
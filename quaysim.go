@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var QuaySimCmd = &cli.Command{
+	Name:        "quay-sim",
+	Description: "mimic the traffic Quay's security scanner worker and its users put on Clair",
+	Usage:       "clair-load-test quay-sim --containers ubuntu:latest,mysql:latest --profile quay-sim.yaml",
+	Action:      quaySimAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "containers",
+			Usage:   "--containers ubuntu:latest,mysql:latest (the manifests pushed to Quay)",
+			Value:   "",
+			EnvVars: []string{"CONTAINERS"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		presetFlag,
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		platformFlag,
+		allPlatformsFlag,
+		noPinDigestsFlag,
+		registryUserFlag,
+		registryPasswordFlag,
+		registryRateFlag,
+		registryRetriesFlag,
+		manifestSourceFlag,
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "--profile quay-sim.yaml (batching, re-indexing, views and notifications, Quay's defaults if not given)",
+			Value:   "",
+			EnvVars: []string{"QUAY_SIM_PROFILE"},
+		},
+		&cli.DurationFlag{
+			Name:    "timeout",
+			Usage:   "--timeout 1h",
+			Value:   time.Minute * 10,
+			EnvVars: []string{"TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:    "results",
+			Usage:   "--results results.jsonl (shorthand for --sink file=results.jsonl)",
+			Value:   "",
+			EnvVars: []string{"RESULTS"},
+		},
+		sinkFlag,
+		seedFlag,
+		scheduleLogFlag,
+		outputFileFlag,
+	},
+}
+
+// quaySimProfile is how Quay is simulated. Fields a profile leaves out keep
+// the values of defaultQuaySimProfile.
+type quaySimProfile struct {
+	// Quay's security worker submits up to BatchSize manifests every
+	// BatchInterval, Concurrency at a time.
+	BatchSize     int           `yaml:"batch_size" json:"batch_size"`
+	BatchInterval time.Duration `yaml:"batch_interval" json:"batch_interval"`
+	Concurrency   int           `yaml:"concurrency" json:"concurrency"`
+	// ReindexAfter is how long after a manifest was indexed it's submitted
+	// again. Manifests are also submitted again once the indexer's state
+	// changes.
+	ReindexAfter time.Duration `yaml:"reindex_after" json:"reindex_after"`
+	// ViewRate is how many vulnerability reports a second users view.
+	ViewRate float64 `yaml:"view_rate" json:"view_rate"`
+	// NotificationRate is how many vulnerability notifications a second
+	// are handled, each asking which manifests up to
+	// NotificationVulnerabilities vulnerabilities affect.
+	NotificationRate            float64 `yaml:"notification_rate" json:"notification_rate"`
+	NotificationVulnerabilities int     `yaml:"notification_vulnerabilities" json:"notification_vulnerabilities"`
+}
+
+// defaultQuaySimProfile follows Quay's defaults where it has them.
+func defaultQuaySimProfile() *quaySimProfile {
+	return &quaySimProfile{
+		BatchSize:                   50,
+		BatchInterval:               time.Second * 30,
+		Concurrency:                 4,
+		ReindexAfter:                time.Hour * 24,
+		ViewRate:                    1,
+		NotificationRate:            0.1,
+		NotificationVulnerabilities: 10,
+	}
+}
+
+// loadQuaySimProfile reads the profile at path over the defaults. Unknown
+// fields are errors, to catch typos.
+func loadQuaySimProfile(path string) (*quaySimProfile, error) {
+	p := defaultQuaySimProfile()
+	if path == "" {
+		return p, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read profile: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("could not parse profile: %w", err)
+	}
+	switch {
+	case p.BatchSize <= 0, p.Concurrency <= 0, p.NotificationVulnerabilities <= 0:
+		return nil, fmt.Errorf("batch_size, concurrency and notification_vulnerabilities must be more than 0")
+	case p.BatchInterval <= 0, p.ReindexAfter <= 0:
+		return nil, fmt.Errorf("batch_interval and reindex_after must be more than 0")
+	case p.ViewRate < 0, p.NotificationRate < 0:
+		return nil, fmt.Errorf("view_rate and notification_rate can't be negative")
+	}
+	return p, nil
+}
+
+type quaySimConfig struct {
+	RunID         string            `json:"run_id"`
+	Seed          int64             `json:"seed"`
+	Build         *BuildInfo        `json:"build"`
+	Host          string            `json:"host"`
+	PSK           string            `json:"-"`
+	Containers    []string          `json:"containers"`
+	Preset        string            `json:"preset,omitempty"`
+	PinnedDigests map[string]string `json:"pinned_digests,omitempty"`
+	Timeout       time.Duration     `json:"timeout"`
+	Profile       *quaySimProfile   `json:"profile"`
+	Results       string            `json:"results,omitempty"`
+	ScheduleLog   string            `json:"schedule_log,omitempty"`
+}
+
+func quaySimAction(c *cli.Context) error {
+	ctx := c.Context
+	conf := &quaySimConfig{
+		Host:        c.String("host"),
+		PSK:         c.String("psk"),
+		Preset:      c.String("preset"),
+		Timeout:     c.Duration("timeout"),
+		Results:     c.String("results"),
+		ScheduleLog: c.String("schedule-log"),
+	}
+	for _, cc := range strings.Split(c.String("containers"), ",") {
+		if cc = strings.TrimSpace(cc); cc != "" {
+			conf.Containers = append(conf.Containers, cc)
+		}
+	}
+	var err error
+	conf.Containers, err = applyPreset(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	if len(conf.Containers) == 0 {
+		return fmt.Errorf("--containers is needed")
+	}
+	conf.Profile, err = loadQuaySimProfile(c.String("profile"))
+	if err != nil {
+		return err
+	}
+
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	// Notifications ask about the vulnerabilities found in the reports
+	// users view.
+	reporter.Internal = true
+	conf.RunID = reporter.RunID
+	if err := reporter.setSchedule(c); err != nil {
+		return err
+	}
+	conf.Seed = reporter.Seed
+	conf.Build = buildInfo()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Msg("starting run")
+	if err := reporter.setRegistryAuth(c, conf.Containers); err != nil {
+		return err
+	}
+	if err := reporter.setRegistryLimits(c); err != nil {
+		return err
+	}
+	if err := reporter.setManifestSource(ctx, c); err != nil {
+		return err
+	}
+	defer reporter.Auth.Close()
+	conf.Containers, err = reporter.resolvePlatforms(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	conf.Containers, conf.PinnedDigests, err = reporter.pinDigests(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	if err := reporter.setSinks(c, conf.Results); err != nil {
+		return err
+	}
+
+	sim := &quaySim{r: reporter, profile: conf.Profile, containers: conf.Containers}
+	if err := sim.run(ctx, conf.Timeout); err != nil {
+		return err
+	}
+	if err := reporter.Schedule.Close(); err != nil {
+		return fmt.Errorf("could not write schedule log: %w", err)
+	}
+	zlog.Info(ctx).
+		Int("batches", sim.batches).
+		Int("submitted", sim.submitted).
+		Int("reindexed", sim.reindexed).
+		Int("state_changes", sim.stateChanges).
+		Msg("simulation done")
+	stats := reporter.Stats.GetStats()
+	if err := reporter.Sink.Summary(stats); err != nil {
+		return fmt.Errorf("could not write results: %w", err)
+	}
+
+	return writeOutput(c, conf, stats)
+}
+
+// quayManifest is a manifest the simulated worker has submitted, and when
+// and under which index state it last did.
+type quayManifest struct {
+	container string
+	hash      string
+	submitted time.Time
+	state     string
+}
+
+// quaySim is the state shared by the simulated security worker, users and
+// notification handler.
+type quaySim struct {
+	r          *reporter
+	profile    *quaySimProfile
+	containers []string
+	// views are the hashes users can view the vulnerability reports of.
+	views hashPool
+
+	mu        sync.Mutex
+	next      int
+	state     string
+	manifests []*quayManifest
+
+	batches, submitted, reindexed, stateChanges int
+}
+
+// run runs the worker, users and notification handler side by side, each
+// at their own rate, until timeout passes or ctx is done.
+func (s *quaySim) run(ctx context.Context, timeout time.Duration) error {
+	p := s.profile
+	var g errgroup.Group
+	start := func(rate float64, step loadtest.StepFunc) {
+		if rate <= 0 {
+			return
+		}
+		g.Go(func() error {
+			return loadtest.NewRunner(loadtest.NewControl(rate), timeout).Run(ctx, step)
+		})
+	}
+	start(1/p.BatchInterval.Seconds(), s.batch)
+	start(p.ViewRate, s.view)
+	start(p.NotificationRate, s.notify)
+	return g.Wait()
+}
+
+// batch is a pass of the security worker: it checks the indexer's state,
+// then submits the manifests due to be re-indexed followed by new ones, up
+// to the batch size.
+func (s *quaySim) batch(ctx context.Context, n int) error {
+	token, err := loadtest.CreateToken(s.r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	state, err := s.r.IndexState(ctx, token)
+	if err != nil {
+		zlog.Error(ctx).Msgf("could not get index state: %v", err)
+	}
+	due, reindex := s.due(ctx, state)
+
+	sem := make(chan struct{}, s.profile.Concurrency)
+	var wg sync.WaitGroup
+	for i, m := range due {
+		op := "index"
+		if i < reindex {
+			op = "reindex"
+		}
+		s.r.Schedule.Step(ctx, n, op, m.container)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(m *quayManifest, op string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			manifest, err := s.r.Manifest(ctx, m.container)
+			if err != nil {
+				zlog.Error(ctx).Str("container", m.container).Msgf("could not generate manifest: %v", err)
+				return
+			}
+			hash, err := s.r.CreateIndexReport(ctx, manifest, token)
+			if err != nil {
+				zlog.Error(ctx).Str("container", m.container).Str("op", op).Msgf("could not create index report: %v", err)
+				return
+			}
+			s.mu.Lock()
+			first := m.hash == ""
+			m.hash = hash
+			s.mu.Unlock()
+			if first {
+				s.views.add(hash, false)
+			}
+		}(m, op)
+	}
+	wg.Wait()
+	return nil
+}
+
+// due picks the manifests to submit in a batch, noting a change of the
+// indexer's state, and marks them submitted. The first reindex of them are
+// being re-indexed.
+func (s *quaySim) due(ctx context.Context, state string) (due []*quayManifest, reindex int) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches++
+	if state != "" && state != s.state {
+		if s.state != "" {
+			zlog.Info(ctx).Str("state", state).Msg("index state changed, re-indexing")
+			s.stateChanges++
+		}
+		s.state = state
+	}
+	for _, m := range s.manifests {
+		if len(due) == s.profile.BatchSize {
+			break
+		}
+		if m.state != s.state || now.Sub(m.submitted) >= s.profile.ReindexAfter {
+			due = append(due, m)
+		}
+	}
+	reindex = len(due)
+	for len(due) < s.profile.BatchSize && s.next < len(s.containers) {
+		m := &quayManifest{container: s.containers[s.next]}
+		s.manifests = append(s.manifests, m)
+		due = append(due, m)
+		s.next++
+	}
+	for _, m := range due {
+		m.submitted = now
+		m.state = s.state
+	}
+	s.submitted += len(due)
+	s.reindexed += reindex
+	return due, reindex
+}
+
+// view is a user viewing the vulnerability report of a manifest that's been
+// indexed.
+func (s *quaySim) view(ctx context.Context, n int) error {
+	hash, ok := s.views.random(loadtest.StepRand(s.r.Seed, n))
+	if !ok {
+		return nil
+	}
+	token, err := loadtest.CreateToken(s.r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	s.r.Schedule.Step(ctx, n, OpVuln, hash)
+	report, err := s.r.GetVulnerabilityReport(ctx, hash, token)
+	if err != nil {
+		zlog.Error(ctx).Str("hash", hash).Msgf("could not get vulnerability report: %v", err)
+		return nil
+	}
+	s.r.Stats.Image(hash).ObserveVulnerabilityReport(report)
+	return nil
+}
+
+// notify is a vulnerability notification being handled, asking which
+// manifests the vulnerabilities found so far affect.
+func (s *quaySim) notify(ctx context.Context, n int) error {
+	vulns := s.r.Vulnerabilities(s.profile.NotificationVulnerabilities)
+	if len(vulns) == 0 {
+		return nil
+	}
+	token, err := loadtest.CreateToken(s.r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	s.r.Schedule.Step(ctx, n, "notify", "")
+	if _, err := s.r.AffectedManifests(ctx, vulns, token); err != nil {
+		zlog.Error(ctx).Msgf("could not get affected manifests: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var platformFlag = &cli.StringFlag{
+	Name:    "platform",
+	Usage:   "--platform linux/arm64 (index this platform of multi-arch images)",
+	Value:   "",
+	EnvVars: []string{"PLATFORM"},
+}
+
+var noPinDigestsFlag = &cli.BoolFlag{
+	Name:    "no-pin-digests",
+	Usage:   "--no-pin-digests (don't resolve tags to digests at the start of the run)",
+	Value:   false,
+	EnvVars: []string{"NO_PIN_DIGESTS"},
+}
+
+var allPlatformsFlag = &cli.BoolFlag{
+	Name:    "all-platforms",
+	Usage:   "--all-platforms (index every platform of multi-arch images)",
+	Value:   false,
+	EnvVars: []string{"ALL_PLATFORMS"},
+}
+
+// resolvePlatforms applies --platform or --all-platforms to containers,
+// replacing each with a reference to the digest of the image for the chosen
+// platform, or one for every platform. Containers given as URLs are left
+// alone.
+func (r *reporter) resolvePlatforms(c *cli.Context, containers []string) ([]string, error) {
+	spec, all := c.String("platform"), c.Bool("all-platforms")
+	if spec == "" && !all {
+		return containers, nil
+	}
+	if spec != "" && all {
+		return nil, fmt.Errorf("--platform can't be combined with --all-platforms")
+	}
+	var want *loadtest.Platform
+	if spec != "" {
+		var err error
+		want, err = loadtest.ParsePlatform(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.ResolvePlatforms(c.Context, containers, want)
+}
+
+// pinDigests pins containers given by tag to their current digests, unless
+// --no-pin-digests is set. It returns the containers pinned, mapped to their
+// digest references.
+func (r *reporter) pinDigests(c *cli.Context, containers []string) ([]string, map[string]string, error) {
+	if c.Bool("no-pin-digests") {
+		return containers, nil, nil
+	}
+	return r.PinDigests(c.Context, containers)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var registryUserFlag = &cli.StringFlag{
+	Name:    "registry-user",
+	Usage:   "--registry-user robot$loadtest (for every registry, overriding the docker config)",
+	Value:   "",
+	EnvVars: []string{"REGISTRY_USER"},
+}
+
+var registryPasswordFlag = &cli.StringFlag{
+	Name:    "registry-password",
+	Usage:   "--registry-password token",
+	Value:   "",
+	EnvVars: []string{"REGISTRY_PASSWORD"},
+}
+
+// setRegistryAuth applies --registry-user and --registry-password, and makes
+// them available to clairctl for the registries of containers.
+func (r *reporter) setRegistryAuth(c *cli.Context, containers []string) error {
+	user, password := c.String("registry-user"), c.String("registry-password")
+	if (user == "") != (password == "") {
+		return fmt.Errorf("--registry-user and --registry-password are needed together")
+	}
+	a, err := loadtest.NewRegistryAuth(user, password, containers)
+	if err != nil {
+		return err
+	}
+	r.Auth = a
+	return nil
+}
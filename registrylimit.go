@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var registryRateFlag = &cli.Float64Flag{
+	Name:    "registry-rate",
+	Usage:   "--registry-rate 2 (most manifest requests a second to each registry, unlimited by default)",
+	Value:   0,
+	EnvVars: []string{"REGISTRY_RATE"},
+}
+
+var registryRetriesFlag = &cli.IntFlag{
+	Name:    "registry-retries",
+	Usage:   "--registry-retries 5 (times to back off and retry when a registry rate limits)",
+	Value:   5,
+	EnvVars: []string{"REGISTRY_RETRIES"},
+}
+
+// setRegistryLimits applies --registry-rate and --registry-retries.
+func (r *reporter) setRegistryLimits(c *cli.Context) error {
+	rate, retries := c.Float64("registry-rate"), c.Int("registry-retries")
+	if rate < 0 || retries < 0 {
+		return fmt.Errorf("--registry-rate and --registry-retries can't be negative")
+	}
+	r.Limits = loadtest.NewRegistryLimiter(rate, retries, r.Stats)
+	return nil
+}
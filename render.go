@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var RenderCmd = &cli.Command{
+	Name:        "render",
+	Description: "render a results file as a static HTML report",
+	Usage:       "clair-load-test render --results results.jsonl",
+	Action:      renderAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "results",
+			Usage:   "--results results.jsonl",
+			EnvVars: []string{"RESULTS"},
+		},
+		&cli.StringFlag{
+			Name:    "out",
+			Usage:   "--out report.html",
+			Value:   "report.html",
+			EnvVars: []string{"RENDER_OUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "bucket",
+			Usage:   "--bucket 10s",
+			Value:   time.Second * 10,
+			EnvVars: []string{"RENDER_BUCKET"},
+		},
+	},
+}
+
+const (
+	chartWidth  = 900
+	chartHeight = 300
+	// chartColumns is how many points each endpoint's latency is drawn
+	// with, however long the run, so the report doesn't grow with it.
+	chartColumns = 200
+)
+
+// chartColors are assigned to endpoints in the order they're first seen.
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b"}
+
+type endpointSummary struct {
+	Endpoint string
+	Color    string
+	Requests int
+	Failures int
+	P50      int64
+	P90      int64
+	P95      int64
+	P99      int64
+	Max      int64
+	// P50Line and P95Line are the SVG points of the endpoint's latency
+	// percentiles in each chart column that had requests.
+	P50Line string
+	P95Line string
+}
+
+type errorBucket struct {
+	X, Y, Width, Height float64
+	Start               string
+	Count               int
+}
+
+type errorCount struct {
+	Message string
+	Count   int
+}
+
+type renderData struct {
+	Source       string
+	Start, End   string
+	Duration     time.Duration
+	Bucket       time.Duration
+	Column       time.Duration
+	MaxLatency   int64
+	Width        int
+	Height       int
+	Endpoints    []*endpointSummary
+	ErrorBuckets []errorBucket
+	MaxErrors    int
+	Errors       []errorCount
+}
+
+func renderAction(c *cli.Context) error {
+	ctx := c.Context
+	in := c.String("results")
+	if in == "" {
+		return fmt.Errorf("--results is needed")
+	}
+	f, err := os.Open(in)
+	if err != nil {
+		return fmt.Errorf("could not open results file: %w", err)
+	}
+	samples, err := loadtest.ReadSamples(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no samples in %q", in)
+	}
+	data := summarizeSamples(samples, c.Duration("bucket"))
+	data.Source = in
+
+	out, err := os.Create(c.String("out"))
+	if err != nil {
+		return fmt.Errorf("could not create report: %w", err)
+	}
+	if err := reportTemplate.Execute(out, data); err != nil {
+		out.Close()
+		return fmt.Errorf("could not render report: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	zlog.Info(ctx).
+		Str("report", c.String("out")).
+		Int("samples", len(samples)).
+		Msg("rendered report")
+	return nil
+}
+
+// summarizeSamples computes everything the report template needs from the
+// raw samples.
+func summarizeSamples(samples []*loadtest.Sample, bucket time.Duration) *renderData {
+	if bucket <= 0 {
+		bucket = time.Second * 10
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	start, end := samples[0].Time, samples[len(samples)-1].Time
+	span := end.Sub(start)
+	if span <= 0 {
+		span = time.Second
+	}
+
+	data := &renderData{
+		Start:    start.Format(time.RFC3339),
+		End:      end.Format(time.RFC3339),
+		Duration: end.Sub(start).Round(time.Second),
+		Bucket:   bucket,
+		Column:   (span / chartColumns).Round(time.Millisecond),
+		Width:    chartWidth,
+		Height:   chartHeight,
+	}
+	byEndpoint := map[string]*endpointSummary{}
+	latencies := map[string][]int64{}
+	columns := map[string]*[chartColumns][]int64{}
+	errs := map[string]int{}
+	buckets := make([]int, int(span/bucket)+1)
+	for _, s := range samples {
+		es, ok := byEndpoint[s.Endpoint]
+		if !ok {
+			es = &endpointSummary{
+				Endpoint: s.Endpoint,
+				Color:    chartColors[len(data.Endpoints)%len(chartColors)],
+			}
+			byEndpoint[s.Endpoint] = es
+			data.Endpoints = append(data.Endpoints, es)
+		}
+		es.Requests++
+		latencies[s.Endpoint] = append(latencies[s.Endpoint], s.LatencyMilliseconds)
+		if columns[s.Endpoint] == nil {
+			columns[s.Endpoint] = new([chartColumns][]int64)
+		}
+		col := int(float64(s.Time.Sub(start)) / float64(span) * chartColumns)
+		if col >= chartColumns {
+			col = chartColumns - 1
+		}
+		columns[s.Endpoint][col] = append(columns[s.Endpoint][col], s.LatencyMilliseconds)
+		if s.Failed() {
+			es.Failures++
+			buckets[int(s.Time.Sub(start)/bucket)]++
+			msg := s.Error
+			if msg == "" {
+				msg = fmt.Sprintf("%s: status %d", s.Endpoint, s.StatusCode)
+			}
+			errs[msg]++
+		}
+	}
+
+	type columnPercentiles struct {
+		col      int
+		p50, p95 int64
+	}
+	percentiles := map[string][]columnPercentiles{}
+	for name, cols := range columns {
+		for col, ls := range cols {
+			if len(ls) == 0 {
+				continue
+			}
+			sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+			cp := columnPercentiles{
+				col: col,
+				p50: loadtest.Percentile(ls, 50),
+				p95: loadtest.Percentile(ls, 95),
+			}
+			if cp.p95 > data.MaxLatency {
+				data.MaxLatency = cp.p95
+			}
+			percentiles[name] = append(percentiles[name], cp)
+		}
+	}
+	if data.MaxLatency == 0 {
+		data.MaxLatency = 1
+	}
+	point := func(col int, latency int64) string {
+		x := (float64(col) + 0.5) / chartColumns * chartWidth
+		y := chartHeight - float64(latency)/float64(data.MaxLatency)*chartHeight
+		return fmt.Sprintf("%.1f,%.1f ", x, y)
+	}
+	for name, cps := range percentiles {
+		var p50, p95 strings.Builder
+		for _, cp := range cps {
+			p50.WriteString(point(cp.col, cp.p50))
+			p95.WriteString(point(cp.col, cp.p95))
+		}
+		es := byEndpoint[name]
+		es.P50Line = strings.TrimSpace(p50.String())
+		es.P95Line = strings.TrimSpace(p95.String())
+	}
+	for name, ls := range latencies {
+		sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+		es := byEndpoint[name]
+		es.P50 = loadtest.Percentile(ls, 50)
+		es.P90 = loadtest.Percentile(ls, 90)
+		es.P95 = loadtest.Percentile(ls, 95)
+		es.P99 = loadtest.Percentile(ls, 99)
+		es.Max = ls[len(ls)-1]
+	}
+	sort.Slice(data.Endpoints, func(i, j int) bool {
+		return data.Endpoints[i].Endpoint < data.Endpoints[j].Endpoint
+	})
+
+	for _, n := range buckets {
+		if n > data.MaxErrors {
+			data.MaxErrors = n
+		}
+	}
+	if data.MaxErrors > 0 {
+		w := float64(chartWidth) / float64(len(buckets))
+		for i, n := range buckets {
+			if n == 0 {
+				continue
+			}
+			h := float64(n) / float64(data.MaxErrors) * chartHeight
+			data.ErrorBuckets = append(data.ErrorBuckets, errorBucket{
+				X:      float64(i) * w,
+				Y:      chartHeight - h,
+				Width:  w,
+				Height: h,
+				Start:  start.Add(time.Duration(i) * bucket).Format(time.RFC3339),
+				Count:  n,
+			})
+		}
+	}
+	for msg, n := range errs {
+		data.Errors = append(data.Errors, errorCount{Message: msg, Count: n})
+	}
+	sort.Slice(data.Errors, func(i, j int) bool {
+		if data.Errors[i].Count != data.Errors[j].Count {
+			return data.Errors[i].Count > data.Errors[j].Count
+		}
+		return data.Errors[i].Message < data.Errors[j].Message
+	})
+	return data
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>clair-load-test report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+svg { border: 1px solid #ccc; background: #fafafa; }
+.legend span { margin-right: 1em; }
+</style>
+</head>
+<body>
+<h1>clair-load-test report</h1>
+<p>{{.Source}}: {{.Start}} to {{.End}} ({{.Duration}})</p>
+
+<h2>Latency percentiles (ms)</h2>
+<table>
+<tr><th>endpoint</th><th>requests</th><th>failures</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>max</th></tr>
+{{- range .Endpoints}}
+<tr><td>{{.Endpoint}}</td><td>{{.Requests}}</td><td>{{.Failures}}</td><td>{{.P50}}</td><td>{{.P90}}</td><td>{{.P95}}</td><td>{{.P99}}</td><td>{{.Max}}</td></tr>
+{{- end}}
+</table>
+
+<h2>Latency over time</h2>
+<p class="legend">{{range .Endpoints}}<span style="color: {{.Color}}">&#9679; {{.Endpoint}}</span>{{end}}</p>
+<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+{{- range .Endpoints}}
+<polyline points="{{.P95Line}}" fill="none" stroke="{{.Color}}" stroke-dasharray="4 3"/>
+<polyline points="{{.P50Line}}" fill="none" stroke="{{.Color}}"/>
+{{- end}}
+</svg>
+<p>p50 solid, p95 dashed, over {{.Column}} columns, y axis: 0 to {{.MaxLatency}}ms</p>
+
+<h2>Errors over time</h2>
+{{- if .ErrorBuckets}}
+<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+{{- range .ErrorBuckets}}
+<rect x="{{printf "%.1f" .X}}" y="{{printf "%.1f" .Y}}" width="{{printf "%.1f" .Width}}" height="{{printf "%.1f" .Height}}" fill="#d62728"><title>{{.Start}}: {{.Count}}</title></rect>
+{{- end}}
+</svg>
+<p>{{.Bucket}} buckets, y axis: 0 to {{.MaxErrors}} errors</p>
+<table>
+<tr><th>error</th><th>count</th></tr>
+{{- range .Errors}}
+<tr><td>{{.Message}}</td><td>{{.Count}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No errors.</p>
+{{- end}}
+</body>
+</html>
+`))
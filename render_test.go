@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+const renderResults = `{"time":"2026-01-01T00:00:00Z","endpoint":"index_report","latency_milliseconds":100,"status_code":201}
+{"time":"2026-01-01T00:00:01Z","endpoint":"vulnerability_report","latency_milliseconds":40,"status_code":200}
+{"time":"2026-01-01T00:00:30Z","endpoint":"index_report","latency_milliseconds":300,"status_code":500}
+{"time":"2026-01-01T00:01:00Z","endpoint":"vulnerability_report","latency_milliseconds":60,"status_code":200}
+`
+
+func TestRenderReport(t *testing.T) {
+	samples, err := loadtest.ReadSamples(strings.NewReader(renderResults))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := summarizeSamples(samples, 0)
+	if len(data.Endpoints) != 2 {
+		t.Fatalf("got %d endpoints, want 2", len(data.Endpoints))
+	}
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, es := range data.Endpoints {
+		// Each endpoint had requests in two columns, so has two points on
+		// each of its lines.
+		for name, line := range map[string]string{"p50": es.P50Line, "p95": es.P95Line} {
+			if n := len(strings.Fields(line)); n != 2 {
+				t.Errorf("%s %s line has %d points, want 2: %q", es.Endpoint, name, n, line)
+			}
+			if !strings.Contains(html, `<polyline points="`+line+`"`) {
+				t.Errorf("%s %s line missing from the report", es.Endpoint, name)
+			}
+		}
+		if n := strings.Count(html, `stroke="`+es.Color+`"`); n != 2 {
+			t.Errorf("%s has %d series, want 2", es.Endpoint, n)
+		}
+	}
+	if strings.Contains(html, "<circle") {
+		t.Error("report draws a point per sample")
+	}
+	if len(data.ErrorBuckets) != 1 || data.ErrorBuckets[0].Count != 1 {
+		t.Errorf("error buckets %+v, want 1 error", data.ErrorBuckets)
+	}
+	if !strings.Contains(html, `fill="#d62728"><title>`) {
+		t.Error("error series missing from the report")
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var ReplayCmd = &cli.Command{
+	Name:        "replay",
+	Description: "replay the requests in a recording, results file or HAR capture with the same timing",
+	Usage:       "clair-load-test replay --log requests.jsonl --speed 2",
+	Action:      replayAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		&cli.StringFlag{
+			Name:    "log",
+			Usage:   "--log requests.jsonl (a --record recording, a results file or a .har capture)",
+			Value:   "",
+			EnvVars: []string{"REPLAY_LOG"},
+		},
+		&cli.StringFlag{
+			Name:    "containers",
+			Usage:   "--containers ubuntu:latest,mysql:latest (manifests for index requests the log has no body for)",
+			Value:   "",
+			EnvVars: []string{"CONTAINERS"},
+		},
+		&cli.Float64Flag{
+			Name:    "speed",
+			Usage:   "--speed 2 (replay twice as fast, 0.5 for half speed)",
+			Value:   1,
+			EnvVars: []string{"REPLAY_SPEED"},
+		},
+		&cli.StringFlag{
+			Name:    "results",
+			Usage:   "--results results.jsonl (shorthand for --sink file=results.jsonl)",
+			Value:   "",
+			EnvVars: []string{"RESULTS"},
+		},
+		sinkFlag,
+		outputFileFlag,
+	},
+}
+
+type replayConfig struct {
+	RunID      string     `json:"run_id"`
+	Build      *BuildInfo `json:"build"`
+	Host       string     `json:"host"`
+	PSK        string     `json:"-"`
+	Log        string     `json:"log"`
+	Containers []string   `json:"containers,omitempty"`
+	Speed      float64    `json:"speed"`
+	Results    string     `json:"results,omitempty"`
+	Requests   int        `json:"requests"`
+	Skipped    int        `json:"skipped"`
+}
+
+// replayRequest is a request from a log, made Offset after the first one.
+type replayRequest struct {
+	Offset   time.Duration
+	Endpoint string
+	Hash     string
+	// Body is the manifest of an index_report request, or the hashes of a
+	// bulk_delete_index_reports request, if the log has it.
+	Body []byte
+}
+
+func replayAction(c *cli.Context) error {
+	ctx := c.Context
+	conf := &replayConfig{
+		Host:    c.String("host"),
+		PSK:     c.String("psk"),
+		Log:     c.String("log"),
+		Speed:   c.Float64("speed"),
+		Results: c.String("results"),
+	}
+	if conf.Log == "" {
+		return fmt.Errorf("--log is needed")
+	}
+	if conf.Speed <= 0 {
+		return fmt.Errorf("speed must be more than 0")
+	}
+	for _, cc := range strings.Split(c.String("containers"), ",") {
+		if cc = strings.TrimSpace(cc); cc != "" {
+			conf.Containers = append(conf.Containers, cc)
+		}
+	}
+	reqs, skipped, err := loadReplayLog(conf.Log)
+	if err != nil {
+		return err
+	}
+
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	conf.RunID = reporter.RunID
+	conf.Build = buildInfo()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Msg("starting run")
+
+	// Index requests without a body are matched to the manifests of
+	// --containers by hash.
+	manifests := make(map[string][]byte, len(conf.Containers))
+	for _, cc := range conf.Containers {
+		m, err := reporter.Manifest(ctx, cc)
+		if err != nil {
+			return fmt.Errorf("could not generate manifest for %s: %w", cc, err)
+		}
+		var mf manifestHash
+		if err := json.Unmarshal(m, &mf); err != nil {
+			return fmt.Errorf("could not decode manifest for %s: %w", cc, err)
+		}
+		manifests[mf.Hash] = m
+	}
+	out := reqs[:0]
+	for _, rr := range reqs {
+		if rr.Endpoint == loadtest.EndpointIndexReport && rr.Body == nil {
+			rr.Body = manifests[rr.Hash]
+			if rr.Body == nil {
+				skipped++
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	reqs = out
+	conf.Requests, conf.Skipped = len(reqs), skipped
+	if skipped != 0 {
+		zlog.Warn(ctx).
+			Int("skipped", skipped).
+			Msg("skipping requests that can't be replayed")
+	}
+	if len(reqs) == 0 {
+		return fmt.Errorf("no requests to replay in %q", conf.Log)
+	}
+
+	if err := reporter.setSinks(c, conf.Results); err != nil {
+		return err
+	}
+	if err := reporter.replay(ctx, reqs, conf.Speed); err != nil {
+		return err
+	}
+	stats := reporter.Stats.GetStats()
+	if err := reporter.Sink.Summary(stats); err != nil {
+		return fmt.Errorf("could not write results: %w", err)
+	}
+
+	if err := writeOutput(c, conf, stats); err != nil {
+		return err
+	}
+	if reporter.Stats.Unreachable() {
+		return cli.Exit("could not reach clair", ExitUnreachable)
+	}
+	return nil
+}
+
+// replay makes each request at its offset, divided by speed, from the start
+// of the replay, without waiting for earlier requests to finish.
+func (r *reporter) replay(ctx context.Context, reqs []*replayRequest, speed float64) error {
+	g, ctx := errgroup.WithContext(ctx)
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+loop:
+	for _, rr := range reqs {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(start.Add(time.Duration(float64(rr.Offset) / speed))))
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-timer.C:
+		}
+		rr := rr
+		g.Go(func() error {
+			if err := r.replayOne(ctx, rr); err != nil {
+				zlog.Error(ctx).Str("endpoint", rr.Endpoint).Str("hash", rr.Hash).Msg(err.Error())
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+func (r *reporter) replayOne(ctx context.Context, rr *replayRequest) error {
+	token, err := loadtest.CreateToken(r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	switch rr.Endpoint {
+	case loadtest.EndpointIndexReport:
+		_, err = r.CreateIndexReport(ctx, rr.Body, token)
+	case loadtest.EndpointGetIndexReport:
+		err = r.GetIndexReport(ctx, rr.Hash, token)
+	case loadtest.EndpointVulnerabilityReport:
+		_, err = r.GetVulnerabilityReport(ctx, rr.Hash, token)
+	case loadtest.EndpointDeleteIndexReport:
+		err = r.DeleteIndexReports(ctx, rr.Hash, token)
+	case loadtest.EndpointBulkDeleteIndexReports:
+		var hashes []string
+		if err := json.Unmarshal(rr.Body, &hashes); err != nil {
+			return fmt.Errorf("could not decode bulk delete: %w", err)
+		}
+		_, err = r.BulkDeleteIndexReports(ctx, hashes, token)
+	}
+	return err
+}
+
+// loadReplayLog reads the requests from a HAR capture, if the file name ends
+// in .har, or a recording or results file. Requests that can't be replayed
+// are counted as skipped.
+func loadReplayLog(path string) ([]*replayRequest, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open log: %w", err)
+	}
+	defer f.Close()
+	type entry struct {
+		t  time.Time
+		rr *replayRequest
+	}
+	var entries []entry
+	skipped := 0
+	if strings.EqualFold(filepath.Ext(path), ".har") {
+		var har harFile
+		if err := json.NewDecoder(f).Decode(&har); err != nil {
+			return nil, 0, fmt.Errorf("could not decode HAR file: %w", err)
+		}
+		for _, e := range har.Log.Entries {
+			u, err := url.Parse(e.Request.URL)
+			if err != nil {
+				skipped++
+				continue
+			}
+			endpoint, hash := classifyRequest(e.Request.Method, u.Path)
+			if endpoint == "" {
+				skipped++
+				continue
+			}
+			rr := &replayRequest{Endpoint: endpoint, Hash: hash}
+			if e.Request.PostData != nil && e.Request.PostData.Text != "" {
+				rr.Body = []byte(e.Request.PostData.Text)
+			}
+			entries = append(entries, entry{e.StartedDateTime, rr})
+		}
+	} else {
+		// Recordings and results files are told apart line by line, by
+		// whether there's a method.
+		var line struct {
+			loadtest.Record
+			Endpoint string `json:"endpoint"`
+			Hash     string `json:"hash"`
+		}
+		bodies := map[string][]byte{}
+		dec := json.NewDecoder(f)
+		for n := 1; ; n++ {
+			line.Record, line.Endpoint, line.Hash = loadtest.Record{}, "", ""
+			err := dec.Decode(&line)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not decode line %d: %w", n, err)
+			}
+			rr := &replayRequest{Endpoint: line.Endpoint, Hash: line.Hash}
+			if line.Method != "" {
+				rr.Endpoint, rr.Hash = classifyRequest(line.Method, line.Path)
+				if line.Body != nil {
+					bodies[line.BodySHA256] = line.Body
+				}
+				rr.Body = bodies[line.BodySHA256]
+			}
+			switch rr.Endpoint {
+			case loadtest.EndpointIndexReport:
+				// The hash of a manifest from a recording is in its body.
+				if rr.Body != nil {
+					var mf manifestHash
+					if err := json.Unmarshal(rr.Body, &mf); err == nil {
+						rr.Hash = mf.Hash
+					}
+				}
+			case loadtest.EndpointGetIndexReport, loadtest.EndpointVulnerabilityReport, loadtest.EndpointDeleteIndexReport:
+			case loadtest.EndpointBulkDeleteIndexReports:
+				if rr.Body == nil {
+					skipped++
+					continue
+				}
+			default:
+				skipped++
+				continue
+			}
+			if rr.Hash == "" && rr.Body == nil {
+				skipped++
+				continue
+			}
+			entries = append(entries, entry{line.Time, rr})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].t.Before(entries[j].t) })
+	reqs := make([]*replayRequest, len(entries))
+	for i, e := range entries {
+		e.rr.Offset = e.t.Sub(entries[0].t)
+		reqs[i] = e.rr
+	}
+	return reqs, skipped, nil
+}
+
+// harFile is the subset of the HTTP Archive format needed to replay
+// requests.
+// manifestHash is the part of a manifest needed to find its hash.
+type manifestHash struct {
+	Hash string `json:"hash"`
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method   string `json:"method"`
+				URL      string `json:"url"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// classifyRequest returns the endpoint a request to Clair's API was made to,
+// and the manifest hash in its path if there is one. The endpoint is empty
+// for requests that can't be replayed.
+func classifyRequest(method, path string) (endpoint, hash string) {
+	const (
+		indexReport = "/indexer/api/v1/index_report"
+		vulnReport  = "/matcher/api/v1/vulnerability_report/"
+	)
+	// A --host with a trailing slash leaves a double slash in the path.
+	path = "/" + strings.TrimLeft(path, "/")
+	switch {
+	case method == http.MethodPost && path == indexReport:
+		return loadtest.EndpointIndexReport, ""
+	case method == http.MethodDelete && path == indexReport:
+		return loadtest.EndpointBulkDeleteIndexReports, ""
+	case method == http.MethodGet && strings.HasPrefix(path, indexReport+"/"):
+		return loadtest.EndpointGetIndexReport, strings.TrimPrefix(path, indexReport+"/")
+	case method == http.MethodDelete && strings.HasPrefix(path, indexReport+"/"):
+		return loadtest.EndpointDeleteIndexReport, strings.TrimPrefix(path, indexReport+"/")
+	case method == http.MethodGet && strings.HasPrefix(path, vulnReport):
+		return loadtest.EndpointVulnerabilityReport, strings.TrimPrefix(path, vulnReport)
+	}
+	return "", ""
+}
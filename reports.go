@@ -1,20 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
 
-	"golang.org/x/sync/errgroup"
-
 	"github.com/quay/zlog"
 	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
 )
 
 var ReportsCmd = &cli.Command{
@@ -41,12 +39,59 @@ var ReportsCmd = &cli.Command{
 			Value:   "",
 			EnvVars: []string{"PSK"},
 		},
+		presetFlag,
+		shardFlag,
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		tenantsFlag,
+		signingKeyFlag,
+		keyIDFlag,
+		issuerFlag,
+		audienceFlag,
+		tokenLifetimeFlag,
+		tokenSkewFlag,
+		tokenReuseFlag,
+		platformFlag,
+		allPlatformsFlag,
+		noPinDigestsFlag,
+		registryUserFlag,
+		registryPasswordFlag,
+		registryRateFlag,
+		registryRetriesFlag,
+		manifestSourceFlag,
 		&cli.BoolFlag{
 			Name:    "delete",
 			Usage:   "--delete",
 			Value:   false,
 			EnvVars: []string{"DELETE"},
 		},
+		&cli.StringFlag{
+			Name:    "delete-mode",
+			Usage:   "--delete-mode single|bulk",
+			Value:   DeleteModeSingle,
+			EnvVars: []string{"DELETE_MODE"},
+		},
+		&cli.IntFlag{
+			Name:    "delete-batch-size",
+			Usage:   "--delete-batch-size 100",
+			Value:   100,
+			EnvVars: []string{"DELETE_BATCH_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:    "verify-deletes",
+			Usage:   "--verify-deletes (fetch each deleted index report again, expecting a 404)",
+			Value:   false,
+			EnvVars: []string{"VERIFY_DELETES"},
+		},
+		&cli.DurationFlag{
+			Name:    "verify-delete-delay",
+			Usage:   "--verify-delete-delay 5s (wait between deleting and verifying the delete)",
+			Value:   0,
+			EnvVars: []string{"VERIFY_DELETE_DELAY"},
+		},
 		&cli.DurationFlag{
 			Name:    "timeout",
 			Usage:   "--timeout 1m",
@@ -59,222 +104,1057 @@ var ReportsCmd = &cli.Command{
 			Value:   1,
 			EnvVars: []string{"RATE"},
 		},
+		&cli.IntFlag{
+			Name:    "workers",
+			Usage:   "--workers 500 (most steps in flight at once, steps wait for a free worker beyond that)",
+			Value:   loadtest.DefaultWorkers,
+			EnvVars: []string{"WORKERS"},
+		},
+		&cli.DurationFlag{
+			Name:    "grace-period",
+			Usage:   "--grace-period 30s (how long requests in flight when --timeout passes get to finish before they're cancelled, 0 to cancel them at once)",
+			Value:   loadtest.DefaultGrace,
+			EnvVars: []string{"GRACE_PERIOD"},
+		},
+		&cli.StringFlag{
+			Name:    "hashes-file",
+			Usage:   "--hashes-file hashes.txt (skip indexing, use these manifest hashes)",
+			Value:   "",
+			EnvVars: []string{"HASHES_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "mode",
+			Usage:   "--mode full|index-get|vuln-poll",
+			Value:   ModeFull,
+			EnvVars: []string{"REPORT_MODE"},
+		},
+		&cli.DurationFlag{
+			Name:    "poll-interval",
+			Usage:   "--poll-interval 30s (how often each vulnerability report is polled in mode vuln-poll)",
+			Value:   time.Second * 30,
+			EnvVars: []string{"POLL_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:    "only",
+			Usage:   "--only index|vuln|delete (run just one step of the workflow)",
+			Value:   "",
+			EnvVars: []string{"ONLY"},
+		},
+		&cli.BoolFlag{
+			Name:    "skip-index",
+			Usage:   "--skip-index (request vulnerability reports for --hashes-file only)",
+			Value:   false,
+			EnvVars: []string{"SKIP_INDEX"},
+		},
+		&cli.IntFlag{
+			Name:    "recheck",
+			Usage:   "--recheck 3 (fetch each vulnerability report this many more times over the run, flagging any that change)",
+			Value:   0,
+			EnvVars: []string{"RECHECK"},
+		},
+		&cli.StringFlag{
+			Name:    "report-filter",
+			Usage:   "--report-filter \"severity=High\" (a query string to request some vulnerability reports with, to compare with full ones)",
+			Value:   "",
+			EnvVars: []string{"REPORT_FILTER"},
+		},
+		&cli.StringFlag{
+			Name:    "report-filter-share",
+			Usage:   "--report-filter-share 25% (of vulnerability reports requested with --report-filter)",
+			Value:   "50%",
+			EnvVars: []string{"REPORT_FILTER_SHARE"},
+		},
+		&cli.BoolFlag{
+			Name:    "skip-vuln-report",
+			Usage:   "--skip-vuln-report (index, and delete with --delete, without matching)",
+			Value:   false,
+			EnvVars: []string{"SKIP_VULN_REPORT"},
+		},
+		&cli.BoolFlag{
+			Name:    "internal",
+			Usage:   "--internal (also load the indexer's internal endpoints Quay uses: index_state and affected_manifest)",
+			Value:   false,
+			EnvVars: []string{"INTERNAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "index-to-match-delay",
+			Usage:   "--index-to-match-delay 30s (wait between indexing and requesting the vulnerability report)",
+			Value:   0,
+			EnvVars: []string{"INDEX_TO_MATCH_DELAY"},
+		},
+		&cli.BoolFlag{
+			Name:    "wait-for-index",
+			Usage:   "--wait-for-index (poll the index report until it's finished before requesting the vulnerability report)",
+			Value:   false,
+			EnvVars: []string{"WAIT_FOR_INDEX"},
+		},
+		&cli.DurationFlag{
+			Name:    "wait-for-index-timeout",
+			Usage:   "--wait-for-index-timeout 5m",
+			Value:   time.Minute * 5,
+			EnvVars: []string{"WAIT_FOR_INDEX_TIMEOUT"},
+		},
+		&cli.IntFlag{
+			Name:    "per-image-iterations",
+			Usage:   "--per-image-iterations 10 (process each container exactly 10 times and end the run, rather than for the whole --timeout)",
+			Value:   0,
+			EnvVars: []string{"PER_IMAGE_ITERATIONS"},
+		},
+		&cli.BoolFlag{
+			Name:    "mutate-digests",
+			Usage:   "--mutate-digests (give each container's manifest a new hash every time, so Clair indexes it afresh)",
+			Value:   false,
+			EnvVars: []string{"MUTATE_DIGESTS"},
+		},
+		&cli.IntFlag{
+			Name:    "duplicate-burst",
+			Usage:   "--duplicate-burst 20 (index the same manifest 20 times at once, each step)",
+			Value:   0,
+			EnvVars: []string{"DUPLICATE_BURST"},
+		},
+		&cli.StringFlag{
+			Name:    "mix",
+			Usage:   "--mix index=50,vuln=40,get=0,delete=10",
+			Value:   "",
+			EnvVars: []string{"MIX"},
+		},
+		&cli.BoolFlag{
+			Name:    "no-conditional",
+			Usage:   "--no-conditional (don't send If-None-Match on repeated GETs)",
+			Value:   false,
+			EnvVars: []string{"NO_CONDITIONAL"},
+		},
+		&cli.StringFlag{
+			Name:    "accept-encoding",
+			Usage:   "--accept-encoding gzip|identity",
+			Value:   "gzip",
+			EnvVars: []string{"ACCEPT_ENCODING"},
+		},
+		&cli.StringFlag{
+			Name:    "upload-transfer",
+			Usage:   "--upload-transfer chunked (send index report bodies with a Content-Length, length, streamed chunked, or alternate between them with both)",
+			Value:   "",
+			EnvVars: []string{"UPLOAD_TRANSFER"},
+		},
+		&cli.StringFlag{
+			Name:    "upload-bandwidth",
+			Usage:   "--upload-bandwidth 256kbps (send index report bodies no faster than this, as a slow client would, unlimited by default)",
+			Value:   "",
+			EnvVars: []string{"UPLOAD_BANDWIDTH"},
+		},
+		&cli.BoolFlag{
+			Name:    "pregenerate",
+			Usage:   "--pregenerate (generate every container's manifest before the run, so generating them isn't timed with indexing)",
+			Value:   false,
+			EnvVars: []string{"PREGENERATE"},
+		},
+		&cli.IntFlag{
+			Name:    "pregenerate-concurrency",
+			Usage:   "--pregenerate-concurrency 8 (manifests generated at once with --pregenerate)",
+			Value:   8,
+			EnvVars: []string{"PREGENERATE_CONCURRENCY"},
+		},
+		&cli.StringFlag{
+			Name:    "results",
+			Usage:   "--results results.jsonl (shorthand for --sink file=results.jsonl)",
+			Value:   "",
+			EnvVars: []string{"RESULTS"},
+		},
+		sinkFlag,
+		seedFlag,
+		scheduleLogFlag,
+		&cli.StringFlag{
+			Name:    "record",
+			Usage:   "--record requests.jsonl (record every request made, for replay)",
+			Value:   "",
+			EnvVars: []string{"RECORD"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "spike",
+			Usage:   "--spike 10x:30s@5m (multiply the rate by 10 for 30s, 5m into the run)",
+			EnvVars: []string{"SPIKE"},
+		},
+		&cli.StringFlag{
+			Name:    "control-addr",
+			Usage:   "--control-addr localhost:6070 (serve /pause, /resume, /set-rate and /stats)",
+			Value:   "",
+			EnvVars: []string{"CONTROL_ADDR"},
+		},
+		&cli.BoolFlag{
+			Name:  "interactive",
+			Usage: "--interactive (adjust the rate, pause and stop from the keyboard, ? for help)",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:    "abort-on-error-rate",
+			Usage:   "--abort-on-error-rate 25%",
+			Value:   "",
+			EnvVars: []string{"ABORT_ON_ERROR_RATE"},
+		},
+		&cli.DurationFlag{
+			Name:    "abort-window",
+			Usage:   "--abort-window 1m",
+			Value:   time.Minute,
+			EnvVars: []string{"ABORT_WINDOW"},
+		},
+		&cli.BoolFlag{
+			Name:    "fail-fast",
+			Usage:   "--fail-fast (abort the run on the first failed step, rather than counting failures in the report)",
+			Value:   false,
+			EnvVars: []string{"FAIL_FAST"},
+		},
+		&cli.IntFlag{
+			Name:    "quarantine-after",
+			Usage:   "--quarantine-after 5 (take a container out of rotation once its manifest or index report fails more than 5 times in a row, 0 never does)",
+			Value:   0,
+			EnvVars: []string{"QUARANTINE_AFTER"},
+		},
+		&cli.StringFlag{
+			Name:    "layer-url-rewrite",
+			Usage:   "--layer-url-rewrite http://localhost:8080 or --layer-url-rewrite https://quay.io/=http://mirror:5000/",
+			Value:   "",
+			EnvVars: []string{"LAYER_URL_REWRITE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "manifest-pad",
+			Usage:   "--manifest-pad 1MB,5MB (pad manifests to each size in turn)",
+			EnvVars: []string{"MANIFEST_PAD"},
+		},
+		&cli.StringFlag{
+			Name:    "size-classes",
+			Usage:   "--size-classes layers=5,15 or --size-classes bytes=100MB,1GB",
+			Value:   "",
+			EnvVars: []string{"SIZE_CLASSES"},
+		},
+		&cli.StringFlag{
+			Name:    "scenario",
+			Usage:   "--scenario scenario.yaml",
+			Value:   "",
+			EnvVars: []string{"SCENARIO"},
+		},
+		&cli.DurationFlag{
+			Name:    "drift-interval",
+			Usage:   "--drift-interval 5m (record p95 per interval and analyze its trend, for soak tests)",
+			Value:   0,
+			EnvVars: []string{"DRIFT_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:    "drift-threshold",
+			Usage:   "--drift-threshold 20% (flag endpoints whose p95 grew by more over the run)",
+			Value:   "20%",
+			EnvVars: []string{"DRIFT_THRESHOLD"},
+		},
+		&cli.Float64Flag{
+			Name:    "anomaly-factor",
+			Usage:   "--anomaly-factor 5 (report clusters of requests slower than this many times their endpoint's median, 0 to not look for anomalies)",
+			Value:   5,
+			EnvVars: []string{"ANOMALY_FACTOR"},
+		},
+		&cli.IntFlag{
+			Name:    "max-samples",
+			Usage:   "--max-samples 1000 (keep a random sample of this many requests in the stats, however long the run)",
+			Value:   0,
+			EnvVars: []string{"MAX_SAMPLES"},
+		},
+		&cli.StringFlag{
+			Name:    "clair-metrics-url",
+			Usage:   "--clair-metrics-url http://localhost:8089/metrics",
+			Value:   "",
+			EnvVars: []string{"CLAIR_METRICS_URL"},
+		},
+		&cli.DurationFlag{
+			Name:    "clair-metrics-interval",
+			Usage:   "--clair-metrics-interval 30s",
+			Value:   time.Second * 30,
+			EnvVars: []string{"CLAIR_METRICS_INTERVAL"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "clair-metrics",
+			Usage:   "--clair-metrics pgxpool_,go_goroutines (prefixes of the metrics to keep)",
+			Value:   cli.NewStringSlice(loadtest.DefaultClairMetrics...),
+			EnvVars: []string{"CLAIR_METRICS"},
+		},
+		&cli.StringFlag{
+			Name:    "indexer-dsn",
+			Usage:   "--indexer-dsn postgres://clair@localhost/indexer",
+			Value:   "",
+			EnvVars: []string{"INDEXER_DSN"},
+		},
+		&cli.StringFlag{
+			Name:    "matcher-dsn",
+			Usage:   "--matcher-dsn postgres://clair@localhost/matcher",
+			Value:   "",
+			EnvVars: []string{"MATCHER_DSN"},
+		},
+		&cli.DurationFlag{
+			Name:    "pg-stats-interval",
+			Usage:   "--pg-stats-interval 10s",
+			Value:   time.Second * 10,
+			EnvVars: []string{"PG_STATS_INTERVAL"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "probe",
+			Usage:   "--probe clair=http://localhost:8089/readyz (a dependency to check during the run, as name=target where target is an http(s) readiness endpoint, a postgres DSN or a tcp://host:port to connect to, repeatable)",
+			EnvVars: []string{"PROBES"},
+		},
+		&cli.DurationFlag{
+			Name:    "probe-interval",
+			Usage:   "--probe-interval 5s",
+			Value:   time.Second * 5,
+			EnvVars: []string{"PROBE_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:    "notify-webhook",
+			Usage:   "--notify-webhook https://hooks.slack.com/services/...",
+			Value:   "",
+			EnvVars: []string{"NOTIFY_WEBHOOK"},
+		},
+		&cli.StringFlag{
+			Name:    "run-link",
+			Usage:   "--run-link https://ci.example.com/job/123",
+			Value:   "",
+			EnvVars: []string{"RUN_LINK"},
+		},
+		&cli.DurationFlag{
+			Name:    "max-p95",
+			Usage:   "--max-p95 30s",
+			EnvVars: []string{"MAX_P95"},
+		},
+		&cli.Float64Flag{
+			Name:    "max-error-rate",
+			Usage:   "--max-error-rate 5 (percent)",
+			EnvVars: []string{"MAX_ERROR_RATE"},
+		},
+		outputFileFlag,
 	},
 }
 
-type IndexReportReponse struct {
-	Hash string `json:"manifest_hash"`
-}
+// Report modes.
+const (
+	// ModeFull indexes, matches and optionally deletes each container.
+	ModeFull = "full"
+	// ModeIndexGet indexes each container once, then repeatedly fetches
+	// the index reports.
+	ModeIndexGet = "index-get"
+	// ModeVulnPoll indexes each container once, then polls the
+	// vulnerability reports every poll interval, as a dashboard would.
+	ModeVulnPoll = "vuln-poll"
+)
+
+// Workflow steps, for --only.
+const (
+	StepIndex  = "index"
+	StepVuln   = "vuln"
+	StepDelete = "delete"
+)
+
+// Delete modes.
+const (
+	DeleteModeSingle = "single"
+	DeleteModeBulk   = "bulk"
+)
 
 type testConfig struct {
-	Containers []string      `json:"containers"`
-	PSK        string        `json:"-"`
-	Host       string        `json:"host"`
-	Delete     bool          `json:"delete"`
-	Timeout    time.Duration `json:"timeout"`
-	PerSecond  float64       `json:"rate"`
+	RunID                  string                  `json:"run_id"`
+	Seed                   int64                   `json:"seed"`
+	Build                  *BuildInfo              `json:"build"`
+	Containers             []string                `json:"containers"`
+	Shard                  string                  `json:"shard,omitempty"`
+	Preset                 string                  `json:"preset,omitempty"`
+	PinnedDigests          map[string]string       `json:"pinned_digests,omitempty"`
+	PSK                    string                  `json:"-"`
+	Host                   string                  `json:"host"`
+	Delete                 bool                    `json:"delete"`
+	DeleteMode             string                  `json:"delete_mode"`
+	DeleteBatchSize        int                     `json:"delete_batch_size,omitempty"`
+	VerifyDeletes          bool                    `json:"verify_deletes,omitempty"`
+	VerifyDelay            time.Duration           `json:"verify_delete_delay,omitempty"`
+	Timeout                time.Duration           `json:"timeout"`
+	PerSecond              float64                 `json:"rate"`
+	Workers                int                     `json:"workers"`
+	GracePeriod            time.Duration           `json:"grace_period"`
+	Mode                   string                  `json:"mode"`
+	PollInterval           time.Duration           `json:"poll_interval,omitempty"`
+	HashesFile             string                  `json:"hashes_file,omitempty"`
+	Mix                    Mix                     `json:"mix,omitempty"`
+	Only                   string                  `json:"only,omitempty"`
+	SkipIndex              bool                    `json:"skip_index,omitempty"`
+	SkipVulnReport         bool                    `json:"skip_vuln_report,omitempty"`
+	Recheck                int                     `json:"recheck,omitempty"`
+	ReportFilter           string                  `json:"report_filter,omitempty"`
+	ReportFilterShare      float64                 `json:"report_filter_share,omitempty"`
+	Internal               bool                    `json:"internal,omitempty"`
+	DuplicateBurst         int                     `json:"duplicate_burst,omitempty"`
+	PerImageIterations     int                     `json:"per_image_iterations,omitempty"`
+	MutateDigests          bool                    `json:"mutate_digests,omitempty"`
+	MatchDelay             time.Duration           `json:"index_to_match_delay,omitempty"`
+	WaitForIndex           time.Duration           `json:"wait_for_index_timeout,omitempty"`
+	Conditional            bool                    `json:"conditional"`
+	AcceptEncoding         string                  `json:"accept_encoding"`
+	UploadTransfer         string                  `json:"upload_transfer,omitempty"`
+	UploadBandwidth        string                  `json:"upload_bandwidth,omitempty"`
+	Pregenerate            bool                    `json:"pregenerate,omitempty"`
+	PregenerateConcurrency int                     `json:"pregenerate_concurrency,omitempty"`
+	Results                string                  `json:"results,omitempty"`
+	Record                 string                  `json:"record,omitempty"`
+	ScheduleLog            string                  `json:"schedule_log,omitempty"`
+	ControlAddr            string                  `json:"control_addr,omitempty"`
+	Spikes                 []*loadtest.Spike       `json:"spikes,omitempty"`
+	NotifyWebhook          string                  `json:"-"`
+	RunLink                string                  `json:"run_link,omitempty"`
+	MaxP95                 time.Duration           `json:"max_p95,omitempty"`
+	MaxErrorRate           float64                 `json:"max_error_rate,omitempty"`
+	AbortOnErrorRate       float64                 `json:"abort_on_error_rate,omitempty"`
+	AbortWindow            time.Duration           `json:"abort_window,omitempty"`
+	FailFast               bool                    `json:"fail_fast,omitempty"`
+	QuarantineAfter        int                     `json:"quarantine_after,omitempty"`
+	LayerURLRewrite        string                  `json:"layer_url_rewrite,omitempty"`
+	SizeClasses            *loadtest.SizeClasses   `json:"size_classes,omitempty"`
+	ManifestPads           []*loadtest.ManifestPad `json:"manifest_pads,omitempty"`
+	Scenario               *loadtest.Scenario      `json:"scenario,omitempty"`
+	DriftInterval          time.Duration           `json:"drift_interval,omitempty"`
+	DriftThreshold         float64                 `json:"drift_threshold,omitempty"`
+	AnomalyFactor          float64                 `json:"anomaly_factor,omitempty"`
+	MaxSamples             int                     `json:"max_samples,omitempty"`
+	ClairMetricsURL        string                  `json:"clair_metrics_url,omitempty"`
+	IndexerDSN             string                  `json:"-"`
+	MatcherDSN             string                  `json:"-"`
+	PGStatsInterval        time.Duration           `json:"pg_stats_interval,omitempty"`
+	Probes                 []*loadtest.Probe       `json:"probes,omitempty"`
+	Tenants                *loadtest.Tenants       `json:"tenants,omitempty"`
+	Signer                 *loadtest.KeySigner     `json:"signer,omitempty"`
+	Tokens                 *loadtest.TokenTiming   `json:"tokens,omitempty"`
+	ProbeInterval          time.Duration           `json:"probe_interval,omitempty"`
+}
+
+// checkSteps checks the workflow steps asked for make sense together, and
+// turns --only into the equivalent skips.
+func (conf *testConfig) checkSteps() error {
+	if conf.Only == "" && !conf.SkipIndex && !conf.SkipVulnReport {
+		return nil
+	}
+	switch conf.Only {
+	case "":
+	case StepIndex:
+		conf.SkipVulnReport = true
+	case StepVuln:
+		conf.SkipIndex = true
+	case StepDelete:
+	default:
+		return fmt.Errorf("unknown step %q, expected %s, %s or %s", conf.Only, StepIndex, StepVuln, StepDelete)
+	}
+	switch {
+	case conf.Mode != ModeFull || conf.Mix != nil:
+		return fmt.Errorf("--only and --skip-* can only be used in mode %q, without --mix", ModeFull)
+	case conf.Only != "" && (conf.SkipIndex && conf.Only != StepVuln || conf.SkipVulnReport && conf.Only != StepIndex):
+		return fmt.Errorf("--only can't be combined with --skip-index or --skip-vuln-report")
+	case conf.SkipIndex && conf.SkipVulnReport:
+		return fmt.Errorf("--skip-index and --skip-vuln-report leave nothing to do")
+	case (conf.SkipIndex || conf.Only == StepDelete) && conf.HashesFile == "":
+		return fmt.Errorf("skipping indexing needs the hashes in --hashes-file")
+	case conf.SkipVulnReport && conf.HashesFile != "":
+		return fmt.Errorf("--hashes-file skips indexing, leaving nothing to do")
+	case conf.Delete && (conf.SkipIndex || conf.Only != ""):
+		return fmt.Errorf("--delete can't be combined with --only or --skip-index, use --only delete to delete the hashes in --hashes-file")
+	}
+	return nil
+}
+
+// setReportFilter checks --report-filter and sets the share of vulnerability
+// reports requested with it.
+func (conf *testConfig) setReportFilter(c *cli.Context, mix Mix) error {
+	if conf.ReportFilter == "" {
+		if c.IsSet("report-filter-share") {
+			return fmt.Errorf("--report-filter-share needs --report-filter")
+		}
+		return nil
+	}
+	if _, err := url.ParseQuery(conf.ReportFilter); err != nil {
+		return fmt.Errorf("invalid --report-filter: %w", err)
+	}
+	if conf.SkipVulnReport || conf.Only == StepDelete || conf.Mode == ModeIndexGet || mix != nil && mix[OpVuln] == 0 {
+		return fmt.Errorf("--report-filter needs vulnerability reports to be requested")
+	}
+	share, err := parsePercent(c.String("report-filter-share"))
+	if err != nil {
+		return fmt.Errorf("invalid --report-filter-share: %w", err)
+	}
+	if share == 0 {
+		return fmt.Errorf("--report-filter-share must be more than 0%%")
+	}
+	conf.ReportFilterShare = share
+	return nil
 }
 
 func NewConfig(c *cli.Context) *testConfig {
 	containersArg := c.String("containers")
 	return &testConfig{
-		Containers: strings.Split(containersArg, ","),
-		PSK:        c.String("psk"),
-		Host:       c.String("host"),
-		Delete:     c.Bool("delete"),
-		Timeout:    c.Duration("timeout"),
-		PerSecond:  c.Float64("rate"),
+		Containers:      strings.Split(containersArg, ","),
+		Preset:          c.String("preset"),
+		Shard:           c.String("shard"),
+		PSK:             c.String("psk"),
+		Host:            c.String("host"),
+		Delete:          c.Bool("delete"),
+		DeleteMode:      c.String("delete-mode"),
+		DeleteBatchSize: c.Int("delete-batch-size"),
+		VerifyDeletes:   c.Bool("verify-deletes"),
+		VerifyDelay:     c.Duration("verify-delete-delay"),
+		Timeout:         c.Duration("timeout"),
+		PerSecond:       c.Float64("rate"),
+		Workers:         c.Int("workers"),
+		GracePeriod:     c.Duration("grace-period"),
+		Mode:            c.String("mode"),
+		HashesFile:      c.String("hashes-file"),
+		Only:            c.String("only"),
+		SkipIndex:       c.Bool("skip-index"),
+		SkipVulnReport:  c.Bool("skip-vuln-report"),
+		Recheck:         c.Int("recheck"),
+		ReportFilter:    strings.TrimPrefix(c.String("report-filter"), "?"),
+		Internal:        c.Bool("internal"),
+		DuplicateBurst:  c.Int("duplicate-burst"),
+		MatchDelay:      c.Duration("index-to-match-delay"),
+		Conditional:     !c.Bool("no-conditional"),
+		AcceptEncoding:  c.String("accept-encoding"),
+		UploadTransfer:  c.String("upload-transfer"),
+		UploadBandwidth: c.String("upload-bandwidth"),
+		Pregenerate:     c.Bool("pregenerate"),
+		Results:         c.String("results"),
+		Record:          c.String("record"),
+		ScheduleLog:     c.String("schedule-log"),
+		ControlAddr:     c.String("control-addr"),
+		NotifyWebhook:   c.String("notify-webhook"),
+		RunLink:         c.String("run-link"),
+		MaxP95:          c.Duration("max-p95"),
+		MaxErrorRate:    c.Float64("max-error-rate"),
+		FailFast:        c.Bool("fail-fast"),
+		LayerURLRewrite: c.String("layer-url-rewrite"),
+		DriftInterval:   c.Duration("drift-interval"),
+		AnomalyFactor:   c.Float64("anomaly-factor"),
+		MaxSamples:      c.Int("max-samples"),
+		ClairMetricsURL: c.String("clair-metrics-url"),
+		IndexerDSN:      c.String("indexer-dsn"),
+		MatcherDSN:      c.String("matcher-dsn"),
 	}
 }
 
+// reporter is a loadtest.Reporter, with the methods the commands need on top.
 type reporter struct {
-	host  string
-	psk   string
-	stats *Stats
-	cl    *http.Client
+	*loadtest.Reporter
 }
 
-func NewReporter(host, psk string) *reporter {
-	return &reporter{
-		host:  host,
-		psk:   psk,
-		stats: NewStats(),
-		cl:    &http.Client{Timeout: time.Minute * 1},
-	}
+// newReporter returns a reporter identifying itself as this build, dumping
+// failed requests if -vvv was given.
+func newReporter(host, psk string) *reporter {
+	r := &reporter{loadtest.NewReporter(host, psk)}
+	r.UserAgent = fmt.Sprintf("clair-load-test/%s (commit %s; run %s)", version, commit, r.RunID)
+	r.DumpFailed = dumpFailed
+	return r
 }
 
 func reportAction(c *cli.Context) error {
 	ctx := c.Context
 	conf := NewConfig(c)
-
-	reporter := NewReporter(conf.Host, conf.PSK)
-
-	g, ctx := errgroup.WithContext(ctx)
-	i := 0
-	timer := time.NewTimer(conf.Timeout)
-	ticker := time.NewTicker(time.Duration(1000/conf.PerSecond) * time.Millisecond)
-loop:
-	for {
-		select {
-		case <-timer.C:
-			break loop
-		case <-ticker.C:
-			cc := conf.Containers[i]
-			g.Go(func() error {
-				err := reporter.reportForContainer(ctx, cc, conf.Delete)
-				if err != nil {
-					zlog.Error(ctx).Str("container", cc).Msg(err.Error())
-					return nil
-				}
-				zlog.Debug(ctx).Str("container", cc).Msg("completed")
-				return nil
-			})
-			i++
-			if i+1 > len(conf.Containers) {
-				i = 0
-			}
-		}
+	var err error
+	conf.Containers, err = applyPreset(c, conf.Containers)
+	if err != nil {
+		return err
 	}
-	err := g.Wait()
+	shard, err := ParseShard(conf.Shard)
 	if err != nil {
 		return err
 	}
+	if conf.Containers[0] != "" {
+		conf.Containers, err = shard.Select(ctx, "containers", conf.Containers)
+		if err != nil {
+			return err
+		}
+	}
 
-	stats := reporter.stats.GetStats()
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
-	err = enc.Encode(conf)
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	if err := reporter.setRegistryAuth(c, conf.Containers); err != nil {
+		return err
+	}
+	if err := reporter.setRegistryLimits(c); err != nil {
+		return err
+	}
+	if err := reporter.setManifestSource(ctx, c); err != nil {
+		return err
+	}
+	defer reporter.Auth.Close()
+	if conf.Containers[0] != "" {
+		conf.Containers, err = reporter.resolvePlatforms(c, conf.Containers)
+		if err != nil {
+			return err
+		}
+		conf.Containers, conf.PinnedDigests, err = reporter.pinDigests(c, conf.Containers)
+		if err != nil {
+			return err
+		}
+	}
+	conf.RunID = reporter.RunID
+	if err := reporter.setSchedule(c); err != nil {
+		return err
+	}
+	conf.Seed = reporter.Seed
+	if err := reporter.setTenants(c); err != nil {
+		return err
+	}
+	conf.Tenants = reporter.Tenants
+	if err := reporter.setSigner(c); err != nil {
+		return err
+	}
+	conf.Signer = reporter.Signer
+	if err := reporter.setTokenTiming(c); err != nil {
+		return err
+	}
+	conf.Tokens = reporter.Tokens
+	conf.Build = buildInfo()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Msg("starting run")
+	if err := reporter.setSinks(c, conf.Results); err != nil {
+		return err
+	}
+	if conf.Record != "" {
+		w, err := loadtest.NewRecorder(conf.Record)
+		if err != nil {
+			return fmt.Errorf("could not create recording: %w", err)
+		}
+		reporter.Records = w
+	}
+	if conf.Conditional {
+		reporter.ETags = loadtest.NewETagCache()
+	}
+	switch conf.AcceptEncoding {
+	case "gzip", "identity":
+		reporter.AcceptEncoding = conf.AcceptEncoding
+	default:
+		return fmt.Errorf("unsupported accept encoding %q", conf.AcceptEncoding)
+	}
+	switch conf.DeleteMode {
+	case DeleteModeSingle:
+	case DeleteModeBulk:
+		if conf.DeleteBatchSize < 1 {
+			return fmt.Errorf("delete batch size must be at least 1")
+		}
+		reporter.Deletes = loadtest.NewDeleteBatch(conf.DeleteBatchSize)
+	default:
+		return fmt.Errorf("unknown delete mode %q", conf.DeleteMode)
+	}
+	if conf.Workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+	if conf.GracePeriod < 0 {
+		return fmt.Errorf("--grace-period can't be negative")
+	}
+	switch conf.Mode {
+	case ModeFull, ModeIndexGet:
+	case ModeVulnPoll:
+		if c.IsSet("rate") {
+			return fmt.Errorf("--rate can't be set in mode %q, it's set by --poll-interval", conf.Mode)
+		}
+		conf.PollInterval = c.Duration("poll-interval")
+		if conf.PollInterval <= 0 {
+			return fmt.Errorf("--poll-interval must be more than 0")
+		}
+		reporter.Polls = loadtest.NewPollTracker()
+	default:
+		return fmt.Errorf("unknown mode %q", conf.Mode)
+	}
+	mix, err := ParseMix(c.String("mix"))
 	if err != nil {
 		return err
 	}
-	return enc.Encode(stats)
-}
+	if mix != nil && conf.Mode != ModeFull {
+		return fmt.Errorf("--mix can't be combined with mode %q", conf.Mode)
+	}
+	conf.Mix = mix
+	switch {
+	case conf.DuplicateBurst < 0:
+		return fmt.Errorf("duplicate burst can't be negative")
+	case conf.DuplicateBurst > 0 && (conf.Mode != ModeFull || mix != nil || conf.HashesFile != ""):
+		return fmt.Errorf("--duplicate-burst can only be used in mode %q, without --mix or --hashes-file", ModeFull)
+	}
+	conf.PerImageIterations = c.Int("per-image-iterations")
+	conf.MutateDigests = c.Bool("mutate-digests")
+	switch {
+	case conf.PerImageIterations < 0:
+		return fmt.Errorf("--per-image-iterations can't be negative")
+	case (conf.PerImageIterations > 0 || conf.MutateDigests) &&
+		(conf.Mode != ModeFull || mix != nil || conf.HashesFile != "" || conf.DuplicateBurst > 0):
+		return fmt.Errorf("--per-image-iterations and --mutate-digests can only be used in mode %q, without --mix, --hashes-file or --duplicate-burst", ModeFull)
+	}
+	conf.QuarantineAfter = c.Int("quarantine-after")
+	if conf.QuarantineAfter < 0 {
+		return fmt.Errorf("--quarantine-after can't be negative")
+	}
+	if err := conf.checkSteps(); err != nil {
+		return err
+	}
+	switch {
+	case conf.VerifyDelay < 0:
+		return fmt.Errorf("verify delete delay can't be negative")
+	case conf.VerifyDelay > 0 && !conf.VerifyDeletes:
+		return fmt.Errorf("--verify-delete-delay needs --verify-deletes")
+	case conf.VerifyDeletes && !conf.Delete && conf.Only != StepDelete && mix[OpDelete] == 0:
+		return fmt.Errorf("--verify-deletes needs --delete, --only delete or deletes in --mix")
+	}
+	switch {
+	case conf.Recheck < 0:
+		return fmt.Errorf("--recheck can't be negative")
+	case conf.Recheck == 0:
+	case conf.SkipVulnReport || conf.Only == StepDelete || conf.Mode == ModeIndexGet || mix != nil && mix[OpVuln] == 0:
+		return fmt.Errorf("--recheck needs vulnerability reports to be requested")
+	case conf.Delete || mix[OpDelete] > 0:
+		return fmt.Errorf("--recheck can't be combined with deleting index reports, the rechecks would find them gone")
+	}
+	if err := conf.setReportFilter(c, mix); err != nil {
+		return err
+	}
+	reporter.ReportFilter = conf.ReportFilter
+	reporter.FilterShare = conf.ReportFilterShare / 100
+	if conf.UploadTransfer != "" {
+		if _, err := loadtest.ParseTransfer(conf.UploadTransfer); err != nil {
+			return fmt.Errorf("invalid --upload-transfer: %w", err)
+		}
+	}
+	if (conf.UploadTransfer != "" || conf.UploadBandwidth != "") &&
+		(conf.SkipIndex || conf.Only == StepDelete || conf.HashesFile != "" || mix != nil && mix[OpIndex] == 0) {
+		return fmt.Errorf("--upload-transfer and --upload-bandwidth need manifests to be indexed")
+	}
+	reporter.Transfer = conf.UploadTransfer
+	reporter.UploadBandwidth, err = loadtest.ParseBandwidth(conf.UploadBandwidth)
+	if err != nil {
+		return fmt.Errorf("invalid --upload-bandwidth: %w", err)
+	}
+	if conf.Pregenerate {
+		if conf.SkipIndex || conf.Only == StepDelete || conf.HashesFile != "" || mix != nil && mix[OpIndex] == 0 {
+			return fmt.Errorf("--pregenerate needs manifests to be indexed")
+		}
+		conf.PregenerateConcurrency = c.Int("pregenerate-concurrency")
+		if conf.PregenerateConcurrency < 1 {
+			return fmt.Errorf("--pregenerate-concurrency must be at least 1")
+		}
+	}
+	reporter.VerifyDeletes = conf.VerifyDeletes
+	reporter.VerifyDelay = conf.VerifyDelay
+	reporter.SkipVuln = conf.SkipVulnReport
+	if conf.Internal && (conf.Mode != ModeFull || mix != nil || conf.HashesFile != "") {
+		return fmt.Errorf("--internal can only be used in mode %q, without --mix or --hashes-file", ModeFull)
+	}
+	reporter.Internal = conf.Internal
+	if c.Bool("wait-for-index") {
+		conf.WaitForIndex = c.Duration("wait-for-index-timeout")
+		if conf.WaitForIndex <= 0 {
+			return fmt.Errorf("wait for index timeout must be more than 0")
+		}
+	}
+	switch {
+	case conf.MatchDelay < 0:
+		return fmt.Errorf("index to match delay can't be negative")
+	case (conf.MatchDelay > 0 || conf.WaitForIndex > 0) && (conf.Mode != ModeFull || mix != nil || conf.HashesFile != ""):
+		return fmt.Errorf("--index-to-match-delay and --wait-for-index can only be used in mode %q, without --mix or --hashes-file", ModeFull)
+	}
+	reporter.MatchDelay = conf.MatchDelay
+	reporter.IndexWait = conf.WaitForIndex
+	conf.AbortOnErrorRate, err = parsePercent(c.String("abort-on-error-rate"))
+	if err != nil {
+		return fmt.Errorf("invalid --abort-on-error-rate: %w", err)
+	}
+	if conf.AbortOnErrorRate > 0 {
+		conf.AbortWindow = c.Duration("abort-window")
+		if conf.AbortWindow < time.Second {
+			return fmt.Errorf("abort window must be at least a second")
+		}
+	}
 
-func (r *reporter) reportForContainer(ctx context.Context, container string, delete bool) error {
-	// Call clairctl for the manifest
-	manifest, err := getManifest(ctx, container)
+	reporter.Rewrite, err = loadtest.ParseLayerRewrite(conf.LayerURLRewrite)
 	if err != nil {
-		return fmt.Errorf("could not generate manifest: %w", err)
+		return fmt.Errorf("invalid --layer-url-rewrite: %w", err)
 	}
-	// Get a token
-	logout.Debug().Str("container", container).Msg("got manifest")
-	token, err := createToken(r.psk)
+	conf.SizeClasses, err = loadtest.ParseSizeClasses(c.String("size-classes"))
 	if err != nil {
-		zlog.Debug(ctx).Str("PSK", r.psk).Msg("creating token")
-		return fmt.Errorf("could not create token: %w", err)
+		return fmt.Errorf("invalid --size-classes: %w", err)
 	}
-	// Send manifest as body to index_report
-	hash, err := r.createIndexReport(ctx, manifest, token)
+	reporter.Classes = loadtest.NewSizeClassifier(conf.SizeClasses, reporter.Client)
+	conf.ManifestPads, err = loadtest.ParseManifestPads(splitList(c.StringSlice("manifest-pad")))
 	if err != nil {
-		return fmt.Errorf("could not create index report: %w", err)
+		return err
 	}
-	// Get a token
-	// Request vuln report
-	err = r.getVulnerabilityReport(ctx, hash, token)
+	reporter.Pads = loadtest.NewManifestPadder(conf.ManifestPads)
+	conf.DriftThreshold, err = parsePercent(c.String("drift-threshold"))
 	if err != nil {
-		return fmt.Errorf("could not get vulnerability report: %w", err)
+		return fmt.Errorf("invalid --drift-threshold: %w", err)
 	}
-	// Delete index_report
-	if delete {
-		err = r.deleteIndexReports(ctx, hash, token)
+	conf.Spikes, err = loadtest.ParseSpikes(splitList(c.StringSlice("spike")))
+	if err != nil {
+		return err
+	}
+	if path := c.String("scenario"); path != "" {
+		conf.Scenario, err = loadtest.LoadScenario(path)
 		if err != nil {
-			return fmt.Errorf("could not delete index report: %w", err)
+			return err
 		}
 	}
-	return nil
-}
-
-func getManifest(ctx context.Context, container string) ([]byte, error) {
-	cmd := exec.Command("clairctl", "manifest", container)
-	zlog.Debug(ctx).Str("container", cmd.String()).Msg("getting manifest")
-	return cmd.Output()
-}
+	if conf.SizeClasses == nil && conf.Scenario.UsesSizeClasses() {
+		return fmt.Errorf("the scenario's size class SLOs need --size-classes")
+	}
+	if conf.Scenario != nil {
+		reporter.Vars = conf.Scenario.Vars
+	}
+	if err := reporter.CheckHost(); err != nil {
+		return err
+	}
 
-func (r *reporter) createIndexReport(ctx context.Context, body []byte, token string) (string, error) {
-	req, err := http.NewRequestWithContext(
-		ctx, http.MethodPost,
-		r.host+"/indexer/api/v1/index_report",
-		bytes.NewBuffer(body),
-	)
+	pg, err := loadtest.NewPGSampler(ctx, map[string]string{
+		"indexer": conf.IndexerDSN,
+		"matcher": conf.MatcherDSN,
+	}, c.Duration("pg-stats-interval"))
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer pg.Close(ctx)
+	if pg != nil {
+		conf.PGStatsInterval = pg.Interval()
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
 
-	// Start clock
-	t := time.Now()
-	resp, err := r.cl.Do(req)
-	// end clock and report
-	diff := time.Now().Sub(t)
-	r.stats.IncrTotalIndexReportRequestLatencyMilliseconds(diff.Milliseconds())
-	r.stats.IncrTotalIndexReportRequests(int64(1))
+	conf.Probes, err = loadtest.ParseProbes(c.StringSlice("probe"))
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusCreated {
-		r.stats.IncrNon2XXIndexReportResponses(int64(1))
-		return "", fmt.Errorf("non 201 response from indexer %d", resp.StatusCode)
+	if len(conf.Probes) != 0 {
+		conf.ProbeInterval = c.Duration("probe-interval")
+		if conf.ProbeInterval <= 0 {
+			return fmt.Errorf("--probe-interval must be more than 0")
+		}
 	}
-	// decode response
-	var irr = &IndexReportReponse{}
-	err = json.NewDecoder(resp.Body).Decode(&irr)
-	if err != nil {
-		return "", err
+	prober := loadtest.NewProber(conf.Probes, conf.ProbeInterval, reporter.Client.Transport)
+
+	notifier := NewNotifier(conf.NotifyWebhook)
+	if notifier != nil && (conf.MaxP95 > 0 || conf.MaxErrorRate > 0) {
+		wctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go watchThresholds(wctx, conf, reporter.Stats, notifier)
 	}
 
-	return irr.Hash, nil
-}
+	var hashes []string
+	if conf.HashesFile != "" {
+		hashes, err = ReadHashes(conf.HashesFile)
+		if err != nil {
+			return err
+		}
+		if len(hashes) == 0 {
+			return fmt.Errorf("no hashes in %q", conf.HashesFile)
+		}
+		hashes, err = shard.Select(ctx, "hashes", hashes)
+		if err != nil {
+			return err
+		}
+	}
 
-func (r *reporter) getVulnerabilityReport(ctx context.Context, hash string, token string) error {
-	req, err := http.NewRequestWithContext(
-		ctx, http.MethodGet,
-		r.host+"/matcher/api/v1/vulnerability_report/"+hash,
-		nil,
-	)
-	if err != nil {
-		return err
+	var pregen *loadtest.PregenerationStats
+	if conf.Pregenerate {
+		pregen = reporter.Pregenerate(ctx, conf.Containers, conf.PregenerateConcurrency)
+		if pregen.Generated == 0 {
+			return fmt.Errorf("could not pregenerate any of the %d manifests", pregen.Containers)
+		}
+		// The run starts once the manifests are ready.
+		reporter.Stats.Restart()
 	}
 
-	req.Header.Add("Authorization", "Bearer "+token)
+	database := reporter.databaseFreshness(ctx)
 
-	// Start clock
-	t := time.Now()
-	resp, err := r.cl.Do(req)
-	// end clock and report
-	diff := time.Now().Sub(t)
-	r.stats.IncrTotalVulnerabilityReportRequestLatencyMilliseconds(diff.Milliseconds())
-	r.stats.IncrTotalVulnerabilityReportRequests(int64(1))
+	// runCtx is cancelled to abort the run early, ctx stays usable for
+	// cleaning up and reporting afterwards.
+	runCtx, abort := context.WithCancel(ctx)
+	defer abort()
+	if conf.AbortOnErrorRate > 0 {
+		reporter.Window = loadtest.NewErrorWindow(conf.AbortWindow)
+		go reporter.watchErrorRate(runCtx, conf, abort)
+	}
+	reporter.Control = loadtest.NewControl(conf.PerSecond)
+	reporter.Phases = loadtest.NewPhaseTracker()
+	if conf.Scenario != nil {
+		go reporter.Phases.Run(runCtx, conf.Scenario.Phases, reporter.Control)
+	}
+	reporter.Spikes = loadtest.NewSpikeSchedule(conf.Spikes)
+	go reporter.Spikes.Run(runCtx, reporter.Control)
+	if conf.Scenario != nil && conf.Scenario.Updates != nil {
+		reporter.Updates = loadtest.NewUpdateTracker()
+		go reporter.runUpdates(runCtx, conf.Scenario.Updates, reporter.Updates)
+	}
+	control, err := loadtest.StartControlServer(ctx, conf.ControlAddr, reporter.Control, reporter.Stats, reporter.Phases)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		r.stats.IncrNon2XXVulnerabilityReportResponses(int64(1))
-		return fmt.Errorf("non 200 response from matcher %d", resp.StatusCode)
+	defer control.Close()
+	if c.Bool("interactive") {
+		// Quitting ends the run early without aborting it, so it's
+		// reported as usual.
+		go runInteractive(runCtx, os.Stdin, os.Stderr, reporter.Control, reporter.Stats, reporter.Phases, abort)
 	}
-	return nil
-}
+	slos := loadtest.NewSLOTracker(conf.Scenario)
+	go slos.Watch(runCtx, reporter.Stats)
+	reporter.Anomalies = loadtest.NewAnomalyDetector(conf.AnomalyFactor)
+	reporter.Reservoir = loadtest.NewSampleReservoir(conf.MaxSamples, conf.Seed)
+	reporter.Errors = loadtest.NewErrorTracker()
+	reporter.FailFast = conf.FailFast
+	reporter.Quarantine = loadtest.NewQuarantine(conf.QuarantineAfter)
+	reporter.Rechecks = loadtest.NewRecheckTracker(conf.Recheck, time.Now().Add(conf.Timeout))
+	go reporter.WatchRechecks(runCtx)
+	drift := loadtest.NewDriftTracker(conf.DriftInterval)
+	go drift.Watch(runCtx, reporter.Stats)
+	metrics := loadtest.NewMetricsScraper(conf.ClairMetricsURL, splitList(c.StringSlice("clair-metrics")), c.Duration("clair-metrics-interval"), reporter.Client.Transport)
+	metrics.Scrape(ctx)
+	go metrics.Watch(runCtx)
+	pg.Sample(ctx)
+	go pg.Watch(runCtx)
+	go prober.Watch(runCtx)
 
-func (r *reporter) deleteIndexReports(ctx context.Context, hash string, token string) error {
-	req, err := http.NewRequestWithContext(
-		ctx, http.MethodDelete,
-		r.host+"/indexer/api/v1/index_report/"+hash,
-		nil,
-	)
-	if err != nil {
+	var w loadtest.Workload
+	switch {
+	case conf.Mix != nil:
+		w = &mixWorkload{r: reporter, mix: conf.Mix, containers: conf.Containers, hashes: hashes, delete: conf.Delete}
+	case conf.Only == StepDelete:
+		w = &deleteWorkload{r: reporter, hashes: hashes}
+	case conf.Mode == ModeFull && hashes != nil:
+		w = &vulnWorkload{r: reporter, hashes: hashes}
+	case conf.Mode == ModeFull:
+		rw := &loadtest.ReportWorkload{Reporter: reporter.Reporter, Containers: conf.Containers, Delete: conf.Delete, MutateDigests: conf.MutateDigests}
+		w = rw
+		if conf.DuplicateBurst > 0 {
+			w = &burstWorkload{ReportWorkload: rw, r: reporter, n: conf.DuplicateBurst}
+		}
+	case conf.Mode == ModeVulnPoll:
+		w = &vulnPollWorkload{r: reporter, conf: conf, containers: conf.Containers, hashes: hashes, delete: conf.Delete}
+	case conf.Mode == ModeIndexGet:
+		w = &indexGetWorkload{r: reporter, containers: conf.Containers, hashes: hashes, delete: conf.Delete}
+	}
+	runner := loadtest.NewRunner(reporter.Control, conf.Timeout)
+	runner.Workers = conf.Workers
+	runner.Grace = conf.GracePeriod
+	runner.Budget = loadtest.NewBudgetTracker()
+	runner.Steps = conf.PerImageIterations * len(conf.Containers)
+	err = runner.RunWorkload(runCtx, w)
+	switch {
+	case err == nil:
+	case conf.FailFast && ctx.Err() == nil:
+		// The step's error ended the run, report what there is.
+		zlog.Error(ctx).Err(err).Msg("aborting run: --fail-fast")
+		reporter.Stats.Abort("fail-fast: " + err.Error())
+		abort()
+	case errors.Is(err, loadtest.ErrAllQuarantined):
+		// Nothing's left to load, report what there is.
+		zlog.Error(ctx).Msg("aborting run: every container is quarantined")
+		reporter.Stats.Abort(err.Error())
+		abort()
+	default:
 		return err
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
+	if runCtx.Err() == nil {
+		reporter.FinishRechecks(ctx)
+	}
+	err = reporter.Records.Close()
+	if err != nil {
+		return fmt.Errorf("could not write recording: %w", err)
+	}
+	err = reporter.Schedule.Close()
+	if err != nil {
+		return fmt.Errorf("could not write schedule log: %w", err)
+	}
 
-	zlog.Debug(ctx).Str("hash", hash).Msg("deleting index report")
-	resp, err := r.cl.Do(req)
+	metrics.Scrape(ctx)
+	pg.Sample(ctx)
+	reporter.finishDatabaseFreshness(ctx, database)
+	stats := reporter.Stats.GetStats()
+	stats.Database = database
+	stats.Phases = reporter.Phases.Finish()
+	stats.Pregeneration = pregen
+	stats.ClairMetrics = metrics.Snapshots()
+	stats.Postgres = pg.Snapshots()
+	sloViolations := slos.Evaluate(stats)
+	stats.SLOs = slos.Results()
+	stats.Drift = drift.Analyze(conf.DriftThreshold)
+	stats.Updates = reporter.Updates.Analyze()
+	stats.Polls = reporter.Polls.Stats()
+	stats.Tokens = reporter.Tokens.Stats()
+	stats.Samples = reporter.Reservoir.Samples()
+	stats.Errors = reporter.Errors.Counts()
+	stats.Quarantined = reporter.Quarantine.Images()
+	stats.Rechecks = reporter.Rechecks.Stats()
+	if conf.ReportFilter != "" {
+		stats.ReportFilter = loadtest.CompareReportFilter(stats, conf.ReportFilter)
+		if rf := stats.ReportFilter; rf != nil && rf.Ignored {
+			zlog.Warn(ctx).
+				Str("query", rf.Query).
+				Msg("filtered vulnerability reports were hardly smaller than full ones, Clair may not support the filter")
+		}
+	}
+	stats.Budget = runner.Budget.Budget()
+	if b := stats.Budget; b != nil {
+		zlog.Info(ctx).
+			Float64("queued_percent", b.Queued.Percent).
+			Float64("clair_percent", b.Clair.Percent).
+			Float64("registry_percent", b.Registry.Percent).
+			Float64("throttled_percent", b.Throttled.Percent).
+			Float64("other_percent", b.Other.Percent).
+			Int64("queued_p95", b.Queued.P95LatencyMilliseconds).
+			Msg("where the steps' time went")
+	}
+	zlog.Info(ctx).
+		Float64("connection_reuse_ratio", stats.ConnectionReuseRatio).
+		Msg("connections to Clair kept alive")
+	stats.Probes = prober.Results()
+	prober.Annotate(stats)
+	stats.Anomalies = reporter.Anomalies.Detect(stats)
+	for _, a := range stats.Anomalies {
+		zlog.Warn(ctx).
+			Str("kind", a.Kind).
+			Str("endpoint", a.Endpoint).
+			Time("start", a.Start).
+			Time("end", a.End).
+			Int("requests", a.Requests).
+			Msg("found anomaly")
+	}
+	for _, q := range stats.Quarantined {
+		zlog.Warn(ctx).
+			Str("container", q.Container).
+			Int("failures", q.Failures).
+			Str("last_error", q.LastError).
+			Msg("container was quarantined")
+	}
+	err = reporter.Sink.Summary(stats)
+	if err != nil {
+		return fmt.Errorf("could not write results: %w", err)
+	}
+	err = writeOutput(c, conf, stats)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("non 204 response from indexer while deleting %d", resp.StatusCode)
+
+	status := NotifyPass
+	violations := append(CheckThresholds(conf, stats), sloViolations...)
+	violations = append(violations, loadtest.DriftViolations(stats.Drift)...)
+	if stats.Aborted != "" {
+		violations = append(violations, "aborted: "+stats.Aborted)
+	}
+	if len(violations) != 0 {
+		status = NotifyFail
+	}
+	err = notifier.Notify(ctx, NewNotification(status, conf, stats, violations))
+	if err != nil {
+		zlog.Warn(ctx).Err(err).Msg("could not send notification")
+	}
+	switch {
+	case stats.Unreachable():
+		return cli.Exit("could not reach clair", ExitUnreachable)
+	case stats.Aborted != "":
+		return cli.Exit("run aborted: "+stats.Aborted, ExitErrors)
+	case conf.MaxErrorRate > 0 && stats.CurrentErrorRate()*100 > conf.MaxErrorRate:
+		return cli.Exit(fmt.Sprintf("error rate %.2f%% > %.2f%%", stats.CurrentErrorRate()*100, conf.MaxErrorRate), ExitErrors)
+	case len(violations) != 0:
+		return cli.Exit("run failed: "+strings.Join(violations, "; "), ExitSLOViolation)
 	}
 	return nil
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var seedFlag = &cli.Int64Flag{
+	Name:    "seed",
+	Usage:   "--seed 42 (seeds every random choice, so a run can be repeated, random by default)",
+	Value:   0,
+	EnvVars: []string{"SEED"},
+}
+
+var scheduleLogFlag = &cli.StringFlag{
+	Name:    "schedule-log",
+	Usage:   "--schedule-log schedule.jsonl (where what each step did is written)",
+	Value:   "",
+	EnvVars: []string{"SCHEDULE_LOG"},
+}
+
+// runSeed returns --seed, or a new seed if it isn't set. Either way it's
+// logged, so the run can be repeated.
+func runSeed(c *cli.Context) int64 {
+	seed := c.Int64("seed")
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	zlog.Info(c.Context).Int64("seed", seed).Msg("using seed")
+	return seed
+}
+
+// setSchedule seeds the reporter's workloads, and writes their schedule to
+// --schedule-log if it's set.
+func (r *reporter) setSchedule(c *cli.Context) error {
+	r.Seed = runSeed(c)
+	path := c.String("schedule-log")
+	if path == "" {
+		return nil
+	}
+	l, err := loadtest.NewScheduleLog(path)
+	if err != nil {
+		return fmt.Errorf("could not create schedule log: %w", err)
+	}
+	r.Schedule = l
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var SeedCmd = &cli.Command{
+	Name:        "seed",
+	Description: "pre-populate Clair with indexed manifests",
+	Usage:       "clair-load-test seed --containers ubuntu:latest,alpine:latest --count 1000 --synthetic",
+	Action:      seedAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "containers",
+			Usage:   "--containers ubuntu:latest,mysql:latest",
+			Value:   "",
+			EnvVars: []string{"CONTAINERS"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		presetFlag,
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		platformFlag,
+		allPlatformsFlag,
+		noPinDigestsFlag,
+		registryUserFlag,
+		registryPasswordFlag,
+		registryRateFlag,
+		registryRetriesFlag,
+		manifestSourceFlag,
+		&cli.IntFlag{
+			Name:    "count",
+			Usage:   "--count 1000 (defaults to one per container)",
+			Value:   0,
+			EnvVars: []string{"SEED_COUNT"},
+		},
+		&cli.BoolFlag{
+			Name:  "synthetic",
+			Usage: "--synthetic (give every manifest a unique hash, so --count can exceed the number of containers)",
+			Value: false,
+		},
+		&cli.Int64Flag{
+			Name:    "seed",
+			Usage:   "--seed 42 (varies the --synthetic hashes, which are otherwise the same every time)",
+			Value:   0,
+			EnvVars: []string{"SEED"},
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Usage:   "--concurrency 10",
+			Value:   10,
+			EnvVars: []string{"CONCURRENCY"},
+		},
+		&cli.DurationFlag{
+			Name:    "confirm-timeout",
+			Usage:   "--confirm-timeout 5m (how long to wait for each index report to finish)",
+			Value:   time.Minute * 5,
+			EnvVars: []string{"CONFIRM_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:    "hashes-out",
+			Usage:   "--hashes-out hashes.txt (write the seeded hashes, for --hashes-file)",
+			Value:   "",
+			EnvVars: []string{"HASHES_OUT"},
+		},
+		&cli.StringFlag{
+			Name:    "layer-url-rewrite",
+			Usage:   "--layer-url-rewrite http://localhost:8080",
+			Value:   "",
+			EnvVars: []string{"LAYER_URL_REWRITE"},
+		},
+		outputFileFlag,
+	},
+}
+
+type seedConfig struct {
+	RunID          string            `json:"run_id"`
+	Build          *BuildInfo        `json:"build"`
+	Host           string            `json:"host"`
+	PSK            string            `json:"-"`
+	Containers     []string          `json:"containers"`
+	Preset         string            `json:"preset,omitempty"`
+	PinnedDigests  map[string]string `json:"pinned_digests,omitempty"`
+	Count          int               `json:"count"`
+	Synthetic      bool              `json:"synthetic"`
+	Seed           int64             `json:"seed,omitempty"`
+	Concurrency    int               `json:"concurrency"`
+	ConfirmTimeout time.Duration     `json:"confirm_timeout"`
+	HashesOut      string            `json:"hashes_out,omitempty"`
+}
+
+type seedResult struct {
+	Seeded int `json:"seeded"`
+	Failed int `json:"failed"`
+}
+
+func seedAction(c *cli.Context) error {
+	ctx := c.Context
+	conf := &seedConfig{
+		Host:           c.String("host"),
+		PSK:            c.String("psk"),
+		Count:          c.Int("count"),
+		Synthetic:      c.Bool("synthetic"),
+		Seed:           c.Int64("seed"),
+		Concurrency:    c.Int("concurrency"),
+		ConfirmTimeout: c.Duration("confirm-timeout"),
+		HashesOut:      c.String("hashes-out"),
+		Preset:         c.String("preset"),
+	}
+	for _, cc := range strings.Split(c.String("containers"), ",") {
+		if cc = strings.TrimSpace(cc); cc != "" {
+			conf.Containers = append(conf.Containers, cc)
+		}
+	}
+	var err error
+	conf.Containers, err = applyPreset(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	if len(conf.Containers) == 0 {
+		return fmt.Errorf("--containers is needed")
+	}
+	if conf.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	if err := reporter.setRegistryAuth(c, conf.Containers); err != nil {
+		return err
+	}
+	if err := reporter.setRegistryLimits(c); err != nil {
+		return err
+	}
+	if err := reporter.setManifestSource(ctx, c); err != nil {
+		return err
+	}
+	defer reporter.Auth.Close()
+	// Every platform of a multi-arch container counts as a container.
+	containers, err := reporter.resolvePlatforms(c, conf.Containers)
+	if err != nil {
+		return err
+	}
+	conf.Containers, conf.PinnedDigests, err = reporter.pinDigests(c, containers)
+	if err != nil {
+		return err
+	}
+	if conf.Count == 0 {
+		conf.Count = len(conf.Containers)
+	}
+	if conf.Count > len(conf.Containers) && !conf.Synthetic {
+		return fmt.Errorf("--count %d is more than the %d containers, use --synthetic", conf.Count, len(conf.Containers))
+	}
+	conf.RunID = reporter.RunID
+	conf.Build = buildInfo()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Msg("starting run")
+	reporter.Rewrite, err = loadtest.ParseLayerRewrite(c.String("layer-url-rewrite"))
+	if err != nil {
+		return fmt.Errorf("invalid --layer-url-rewrite: %w", err)
+	}
+
+	// Manifests are only generated once per container.
+	manifests := make(map[string][]byte, len(conf.Containers))
+	for _, cc := range conf.Containers {
+		m, err := reporter.Manifest(ctx, cc)
+		if err != nil {
+			return fmt.Errorf("could not generate manifest for %s: %w", cc, err)
+		}
+		manifests[cc] = m
+	}
+
+	var mu sync.Mutex
+	var hashes []string
+	res := &seedResult{}
+	sem := make(chan struct{}, conf.Concurrency)
+	g, gctx := errgroup.WithContext(ctx)
+loop:
+	for i := 0; i < conf.Count; i++ {
+		select {
+		case <-gctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+		cc := conf.Containers[i%len(conf.Containers)]
+		manifest := manifests[cc]
+		if conf.Synthetic {
+			manifest, err = loadtest.WithManifestHash(manifest, loadtest.SyntheticHash(conf.Seed, cc, i))
+			if err != nil {
+				return err
+			}
+		}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			hash, err := reporter.seedOne(gctx, manifest, conf.ConfirmTimeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.Failed++
+				zlog.Error(gctx).Str("container", cc).Msg(err.Error())
+				return nil
+			}
+			res.Seeded++
+			hashes = append(hashes, hash)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	zlog.Info(ctx).
+		Int("seeded", res.Seeded).
+		Int("failed", res.Failed).
+		Msg("seeding done")
+
+	if conf.HashesOut != "" {
+		if err := writeHashes(conf.HashesOut, hashes); err != nil {
+			return err
+		}
+	}
+	if err := writeOutput(c, conf, res); err != nil {
+		return err
+	}
+	if res.Failed != 0 {
+		return failedExit(reporter.Stats, fmt.Sprintf("could not seed %d manifests", res.Failed))
+	}
+	return nil
+}
+
+// seedOne indexes the manifest and waits for Clair to report the index
+// report as finished.
+func (r *reporter) seedOne(ctx context.Context, manifest []byte, timeout time.Duration) (string, error) {
+	token, err := loadtest.CreateToken(r.PSK)
+	if err != nil {
+		return "", fmt.Errorf("could not create token: %w", err)
+	}
+	hash, err := r.CreateIndexReport(ctx, manifest, token)
+	if err != nil {
+		return "", fmt.Errorf("could not create index report: %w", err)
+	}
+	if err := r.WaitForIndex(ctx, hash, timeout); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// writeHashes writes hashes one per line, the format ReadHashes reads.
+func writeHashes(path string, hashes []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create hashes file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, h := range hashes {
+		fmt.Fprintln(w, h)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write hashes file: %w", err)
+	}
+	return f.Close()
+}
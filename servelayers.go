@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var ServeLayersCmd = &cli.Command{
+	Name:        "serve-layers",
+	Description: "serve a directory of layer tarballs, and manifests referencing them, for hermetic indexer load tests",
+	Usage:       "clair-load-test serve-layers --dir layers/ --addr :8080",
+	Action:      serveLayersAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "dir",
+			Usage:   "--dir layers/ (one subdirectory of layer tarballs per image)",
+			EnvVars: []string{"LAYERS_DIR"},
+		},
+		&cli.StringFlag{
+			Name:    "addr",
+			Usage:   "--addr :8080",
+			Value:   ":8080",
+			EnvVars: []string{"LAYERS_ADDR"},
+		},
+		&cli.StringFlag{
+			Name:    "base-url",
+			Usage:   "--base-url http://layers:8080 (how Clair reaches this server, defaults to http://localhost and the port of --addr)",
+			Value:   "",
+			EnvVars: []string{"LAYERS_BASE_URL"},
+		},
+		&cli.DurationFlag{
+			Name:    "latency",
+			Usage:   "--latency 50ms (added before every response)",
+			Value:   0,
+			EnvVars: []string{"LAYERS_LATENCY"},
+		},
+		&cli.StringFlag{
+			Name:    "bandwidth",
+			Usage:   "--bandwidth 10MB (per second, per request, 0 for unlimited)",
+			Value:   "0",
+			EnvVars: []string{"LAYERS_BANDWIDTH"},
+		},
+	},
+}
+
+// layerImage is an image made up of the tarballs in one subdirectory.
+type layerImage struct {
+	Name   string
+	Hash   string
+	Layers []string
+}
+
+type layerServer struct {
+	baseURL   string
+	latency   time.Duration
+	bandwidth int64
+	// blobs maps layer digests to files.
+	blobs  map[string]string
+	images map[string]*layerImage
+}
+
+func serveLayersAction(c *cli.Context) error {
+	ctx := c.Context
+	if c.String("dir") == "" {
+		return fmt.Errorf("--dir is needed")
+	}
+	bandwidth, err := loadtest.ParseBytes(c.String("bandwidth"))
+	if err != nil || bandwidth < 0 {
+		return fmt.Errorf("invalid --bandwidth %q", c.String("bandwidth"))
+	}
+	addr := c.String("addr")
+	baseURL := c.String("base-url")
+	if baseURL == "" {
+		baseURL = "http://localhost:" + addr[strings.LastIndex(addr, ":")+1:]
+	}
+	s := &layerServer{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		latency:   c.Duration("latency"),
+		bandwidth: bandwidth,
+		blobs:     map[string]string{},
+		images:    map[string]*layerImage{},
+	}
+	if err := s.load(c.String("dir")); err != nil {
+		return err
+	}
+	if len(s.images) == 0 {
+		return fmt.Errorf("no images in %q", c.String("dir"))
+	}
+	for name, img := range s.images {
+		zlog.Info(ctx).
+			Str("image", name).
+			Int("layers", len(img.Layers)).
+			Str("manifest", s.baseURL+"/manifests/"+name).
+			Msg("serving image")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifests", s.listManifests)
+	mux.HandleFunc("/manifests/", s.serveManifest)
+	mux.HandleFunc("/blobs/", s.serveBlob)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	zlog.Info(ctx).Str("addr", addr).Msg("serving layers")
+	err = srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// load finds the images in dir and digests their layers. Layers are ordered
+// by file name.
+func (s *layerServer) load(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read layers directory: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("could not read image directory: %w", err)
+		}
+		img := &layerImage{Name: e.Name()}
+		h := sha256.New()
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, e.Name(), f.Name())
+			digest, err := digestFile(path)
+			if err != nil {
+				return err
+			}
+			s.blobs[digest] = path
+			img.Layers = append(img.Layers, digest)
+			io.WriteString(h, digest)
+		}
+		if len(img.Layers) == 0 {
+			continue
+		}
+		img.Hash = "sha256:" + hex.EncodeToString(h.Sum(nil))
+		s.images[img.Name] = img
+	}
+	return nil
+}
+
+func digestFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open layer: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("could not digest layer: %w", err)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *layerServer) listManifests(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.latency)
+	names := make([]string, 0, len(s.images))
+	for name := range s.images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// serveManifest serves the Clair manifest for an image, with layer URLs
+// pointing back at this server.
+func (s *layerServer) serveManifest(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.latency)
+	img, ok := s.images[strings.TrimPrefix(r.URL.Path, "/manifests/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	type layer struct {
+		Hash    string              `json:"hash"`
+		URI     string              `json:"uri"`
+		Headers map[string][]string `json:"headers"`
+	}
+	m := struct {
+		Hash   string  `json:"hash"`
+		Layers []layer `json:"layers"`
+	}{Hash: img.Hash}
+	for _, digest := range img.Layers {
+		m.Layers = append(m.Layers, layer{
+			Hash:    digest,
+			URI:     s.baseURL + "/blobs/" + digest,
+			Headers: map[string][]string{},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+func (s *layerServer) serveBlob(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.latency)
+	path, ok := s.blobs[strings.TrimPrefix(r.URL.Path, "/blobs/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	var dst io.Writer = w
+	if s.bandwidth > 0 {
+		dst = &throttledWriter{w: w, rate: s.bandwidth, start: time.Now()}
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		zlog.Debug(r.Context()).Err(err).Str("path", path).Msg("could not send layer")
+	}
+}
+
+// throttledWriter caps the rate of writes to rate bytes a second.
+type throttledWriter struct {
+	w     io.Writer
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		// Write at most a tenth of a second's worth at a time, so the
+		// rate stays smooth.
+		chunk := t.rate / 10
+		if chunk < 1 {
+			chunk = 1
+		}
+		if int64(len(p)) < chunk {
+			chunk = int64(len(p))
+		}
+		n, err := t.w.Write(p[:chunk])
+		written += n
+		t.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+		time.Sleep(time.Until(due))
+	}
+	return written, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var ServeWebhookCmd = &cli.Command{
+	Name:        "serve-webhook",
+	Description: "act as the notifier's webhook target, measuring deliveries, and serve the stats at /stats",
+	Usage:       "clair-load-test serve-webhook --addr :8090 --fetch --psk secretkey",
+	Action:      serveWebhookAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "addr",
+			Usage:   "--addr :8090",
+			Value:   ":8090",
+			EnvVars: []string{"WEBHOOK_ADDR"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey (for fetching notifications with --fetch)",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		&cli.BoolFlag{
+			Name:    "fetch",
+			Usage:   "--fetch (read every page of each notification delivered, then delete it, as Quay does)",
+			Value:   false,
+			EnvVars: []string{"WEBHOOK_FETCH"},
+		},
+		&cli.StringFlag{
+			Name:    "fail-rate",
+			Usage:   "--fail-rate 10% (deliveries answered with a 500, so the notifier retries them)",
+			Value:   "",
+			EnvVars: []string{"WEBHOOK_FAIL_RATE"},
+		},
+		&cli.DurationFlag{
+			Name:    "latency",
+			Usage:   "--latency 500ms (added before answering every delivery)",
+			Value:   0,
+			EnvVars: []string{"WEBHOOK_LATENCY"},
+		},
+		&cli.DurationFlag{
+			Name:    "timeout",
+			Usage:   "--timeout 1h (how long to receive for, until interrupted by default)",
+			Value:   0,
+			EnvVars: []string{"TIMEOUT"},
+		},
+		seedFlag,
+		outputFileFlag,
+	},
+}
+
+type webhookConfig struct {
+	RunID    string        `json:"run_id"`
+	Seed     int64         `json:"seed"`
+	Build    *BuildInfo    `json:"build"`
+	Addr     string        `json:"addr"`
+	PSK      string        `json:"-"`
+	Fetch    bool          `json:"fetch"`
+	FailRate float64       `json:"fail_rate,omitempty"`
+	Latency  time.Duration `json:"latency,omitempty"`
+	Timeout  time.Duration `json:"timeout,omitempty"`
+}
+
+// webhookDelivery is the body of a notifier webhook delivery.
+type webhookDelivery struct {
+	ID       string `json:"notification_id"`
+	Callback string `json:"callback"`
+}
+
+// webhookReceiver answers the notifier's webhook deliveries, recording them,
+// and fetches the notifications delivered if asked to.
+type webhookReceiver struct {
+	ctx     context.Context
+	r       *reporter
+	conf    *webhookConfig
+	tracker *loadtest.NotificationTracker
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	// fetches are the fetches still in progress.
+	fetches sync.WaitGroup
+}
+
+func serveWebhookAction(c *cli.Context) error {
+	// Stop cleanly on an interrupt, so the stats get written.
+	ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	conf := &webhookConfig{
+		Addr:    c.String("addr"),
+		PSK:     c.String("psk"),
+		Fetch:   c.Bool("fetch"),
+		Latency: c.Duration("latency"),
+		Timeout: c.Duration("timeout"),
+	}
+	var err error
+	conf.FailRate, err = parsePercent(c.String("fail-rate"))
+	if err != nil {
+		return fmt.Errorf("invalid --fail-rate: %w", err)
+	}
+	if conf.Fetch && conf.PSK == "" {
+		return fmt.Errorf("--fetch needs --psk")
+	}
+	if conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Timeout)
+		defer cancel()
+	}
+
+	// The host is taken from each delivery's callback.
+	reporter := newReporter("", conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	conf.RunID = reporter.RunID
+	conf.Seed = runSeed(c)
+	conf.Build = buildInfo()
+	wr := &webhookReceiver{
+		ctx:     ctx,
+		r:       reporter,
+		conf:    conf,
+		tracker: loadtest.NewNotificationTracker(),
+		rand:    rand.New(rand.NewSource(conf.Seed)),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", wr.serveStats)
+	mux.HandleFunc("/", wr.deliver)
+	srv := &http.Server{Addr: conf.Addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Str("addr", conf.Addr).Msg("receiving notifications")
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	wr.fetches.Wait()
+	stats := wr.stats()
+	zlog.Info(ctx).
+		Int64("deliveries", stats.Notifications.Deliveries).
+		Int64("notifications", stats.Notifications.Notifications).
+		Int64("redeliveries", stats.Notifications.Redeliveries).
+		Msg("receiver stopped")
+	return writeOutput(c, conf, stats)
+}
+
+func (wr *webhookReceiver) stats() *loadtest.Stats {
+	stats := wr.r.Stats.GetStats()
+	stats.Notifications = wr.tracker.Stats()
+	return stats
+}
+
+func (wr *webhookReceiver) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wr.stats())
+}
+
+// fail reports whether to fail the next delivery, at the fail rate.
+func (wr *webhookReceiver) fail() bool {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.rand.Float64()*100 < wr.conf.FailRate
+}
+
+func (wr *webhookReceiver) deliver(w http.ResponseWriter, r *http.Request) {
+	ctx := wr.ctx
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		zlog.Warn(ctx).Err(err).Msg("could not read delivery")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var d webhookDelivery
+	if err := json.Unmarshal(body, &d); err != nil || d.ID == "" {
+		zlog.Warn(ctx).Str("body", string(body)).Msg("not a notification")
+		http.Error(w, "not a notification", http.StatusBadRequest)
+		return
+	}
+	time.Sleep(wr.conf.Latency)
+	accept := !wr.fail()
+	attempt, first := wr.tracker.Deliver(d.ID, int64(len(body)), accept)
+	zlog.Debug(ctx).
+		Str("notification_id", d.ID).
+		Int("attempt", attempt).
+		Bool("accepted", accept).
+		Msg("notification delivered")
+	if !accept {
+		http.Error(w, "failed on purpose", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	// Only the first accepted delivery is fetched, any later ones are
+	// redeliveries of what's already been read.
+	if wr.conf.Fetch && first && ctx.Err() == nil {
+		wr.fetches.Add(1)
+		go func() {
+			defer wr.fetches.Done()
+			if err := wr.r.readNotification(ctx, d.Callback, wr.tracker); err != nil {
+				zlog.Error(ctx).Str("notification_id", d.ID).Msg(err.Error())
+			}
+		}()
+	}
+}
+
+// readNotification reads every page of the notification at callback,
+// recording how many notifications were read, then deletes it.
+func (r *reporter) readNotification(ctx context.Context, callback string, tracker *loadtest.NotificationTracker) error {
+	token, err := loadtest.CreateToken(r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	next := ""
+	for {
+		n, nextPage, err := r.NotificationPage(ctx, callback, next, token)
+		if err != nil {
+			return fmt.Errorf("could not get notification page: %w", err)
+		}
+		tracker.Read(n)
+		if nextPage == "" {
+			break
+		}
+		next = nextPage
+	}
+	if err := r.DeleteNotification(ctx, callback, token); err != nil {
+		return fmt.Errorf("could not delete notification: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+)
+
+var shardFlag = &cli.StringFlag{
+	Name:    "shard",
+	Usage:   "--shard 2/4 (only use the containers, or hashes in --hashes-file, in this shard of n, so n instances can split a corpus)",
+	Value:   "",
+	EnvVars: []string{"SHARD"},
+}
+
+// Shard is one of N shards of a corpus, numbered from 1. Every image name
+// belongs to exactly one shard, picked by its hash, so instances sharding
+// the same corpus split it between them without talking to each other.
+type Shard struct {
+	I, N int
+}
+
+// ParseShard parses a shard written as i/n. An empty string is nil, the
+// whole corpus.
+func ParseShard(s string) (*Shard, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid shard %q, expected i/n such as 2/4", s)
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard %q: %w", s, err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard %q: %w", s, err)
+	}
+	if n < 1 || i < 1 || i > n {
+		return nil, fmt.Errorf("invalid shard %q, expected 1 <= i <= n", s)
+	}
+	return &Shard{I: i, N: n}, nil
+}
+
+func (s *Shard) String() string {
+	return fmt.Sprintf("%d/%d", s.I, s.N)
+}
+
+// Has reports whether name belongs to the shard. Everything belongs to a
+// nil Shard.
+func (s *Shard) Has(name string) bool {
+	if s == nil {
+		return true
+	}
+	sum := sha256.Sum256([]byte(name))
+	return int(binary.BigEndian.Uint64(sum[:8])%uint64(s.N)) == s.I-1
+}
+
+// Select returns the names in the shard, in their original order, failing
+// if there are none.
+func (s *Shard) Select(ctx context.Context, what string, names []string) ([]string, error) {
+	if s == nil {
+		return names, nil
+	}
+	var out []string
+	for _, name := range names {
+		if name != "" && s.Has(name) {
+			out = append(out, name)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("shard %s has none of the %d %s", s, len(names), what)
+	}
+	zlog.Info(ctx).
+		Str("shard", s.String()).
+		Int("total", len(names)).
+		Int("selected", len(out)).
+		Msg("sharding " + what)
+	return out, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var signingKeyFlag = &cli.StringFlag{
+	Name:    "signing-key",
+	Usage:   "--signing-key quay-service-key.pem (an RSA or ECDSA private key, PEM encoded or a JWK, to sign tokens with as Quay does, instead of --psk)",
+	Value:   "",
+	EnvVars: []string{"SIGNING_KEY"},
+}
+
+var keyIDFlag = &cli.StringFlag{
+	Name:    "key-id",
+	Usage:   "--key-id kid (the signing key's ID, as published by the key server, taken from the JWK if not given)",
+	Value:   "",
+	EnvVars: []string{"KEY_ID"},
+}
+
+var issuerFlag = &cli.StringFlag{
+	Name:    "issuer",
+	Usage:   "--issuer quay (of tokens signed with --signing-key)",
+	Value:   loadtest.QuayIssuer,
+	EnvVars: []string{"ISSUER"},
+}
+
+var audienceFlag = &cli.StringFlag{
+	Name:    "audience",
+	Usage:   "--audience clair (of tokens signed with --signing-key, none by default)",
+	Value:   "",
+	EnvVars: []string{"AUDIENCE"},
+}
+
+var tokenLifetimeFlag = &cli.DurationFlag{
+	Name:    "token-lifetime",
+	Usage:   "--token-lifetime 30s (how long tokens are valid for, short ones expiring mid-run with --token-reuse)",
+	Value:   loadtest.DefaultTokenLifetime,
+	EnvVars: []string{"TOKEN_LIFETIME"},
+}
+
+var tokenSkewFlag = &cli.DurationFlag{
+	Name:    "token-skew",
+	Usage:   "--token-skew -2m (added to tokens' iat and nbf, as if minted by a host with a skewed clock)",
+	Value:   0,
+	EnvVars: []string{"TOKEN_SKEW"},
+}
+
+var tokenReuseFlag = &cli.DurationFlag{
+	Name:    "token-reuse",
+	Usage:   "--token-reuse 5m (reuse each token this long before minting another, rather than minting one per request)",
+	Value:   0,
+	EnvVars: []string{"TOKEN_REUSE"},
+}
+
+// setTokenTiming applies --token-lifetime, --token-skew and --token-reuse.
+func (r *reporter) setTokenTiming(c *cli.Context) error {
+	t, err := loadtest.NewTokenTiming(c.Duration("token-lifetime"), c.Duration("token-skew"), c.Duration("token-reuse"))
+	if err != nil {
+		return err
+	}
+	r.Tokens = t
+	return nil
+}
+
+// setSigner applies --signing-key, --key-id, --issuer and --audience.
+func (r *reporter) setSigner(c *cli.Context) error {
+	path := c.String("signing-key")
+	if path == "" {
+		return nil
+	}
+	if r.Tenants != nil {
+		return fmt.Errorf("--signing-key can't be combined with --tenants, give tenants a key_file instead")
+	}
+	s, err := loadtest.LoadKeySigner(path, c.String("key-id"), c.String("issuer"), c.String("audience"))
+	if err != nil {
+		return err
+	}
+	r.Signer = s
+	return nil
+}
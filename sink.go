@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var sinkFlag = &cli.StringSliceFlag{
+	Name:    "sink",
+	Usage:   "--sink statsd=localhost:8125 (where samples are sent as they're made, any of " + strings.Join(loadtest.SinkNames(), ", ") + ", with an optional =target, repeatable)",
+	EnvVars: []string{"SINK"},
+}
+
+// setSinks creates the sinks given by --sink, and a file sink for results,
+// if set.
+func (r *reporter) setSinks(c *cli.Context, results string) error {
+	specs := c.StringSlice("sink")
+	if results != "" {
+		specs = append(specs, loadtest.SinkFile+"="+results)
+	}
+	var sinks loadtest.MultiSink
+	for _, spec := range specs {
+		s, err := loadtest.NewSink(c.Context, spec)
+		if err != nil {
+			sinks.Summary(nil)
+			return fmt.Errorf("could not set up --sink: %w", err)
+		}
+		sinks = append(sinks, s)
+	}
+	r.Sink = sinks
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var tenantsFlag = &cli.StringFlag{
+	Name:    "tenants",
+	Usage:   "--tenants tenants.yaml (tenants, each with its own issuer, psk and share of the requests, overriding --psk)",
+	Value:   "",
+	EnvVars: []string{"TENANTS"},
+}
+
+// setTenants applies --tenants, picking tenants with the reporter's seed, so
+// it must be called after setSchedule.
+func (r *reporter) setTenants(c *cli.Context) error {
+	path := c.String("tenants")
+	if path == "" {
+		return nil
+	}
+	t, err := loadtest.LoadTenants(path, r.Seed)
+	if err != nil {
+		return err
+	}
+	r.Tenants = t
+	return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var UpdateOpsCmd = &cli.Command{
+	Name:        "update-ops",
+	Description: "load the matcher's update operation endpoints",
+	Usage:       "clair-load-test update-ops --ops list=80,diff=20",
+	Action:      updateOpsAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		&cli.DurationFlag{
+			Name:    "timeout",
+			Usage:   "--timeout 1m",
+			Value:   time.Minute * 1,
+			EnvVars: []string{"TIMEOUT"},
+		},
+		&cli.Float64Flag{
+			Name:    "rate",
+			Usage:   "--rate 1",
+			Value:   1,
+			EnvVars: []string{"RATE"},
+		},
+		&cli.StringFlag{
+			Name:    "ops",
+			Usage:   "--ops list=80,diff=20,delete=0 (delete removes update operations!)",
+			Value:   "list=80,diff=20",
+			EnvVars: []string{"UPDATE_OPS"},
+		},
+		&cli.StringFlag{
+			Name:    "results",
+			Usage:   "--results results.jsonl (shorthand for --sink file=results.jsonl)",
+			Value:   "",
+			EnvVars: []string{"RESULTS"},
+		},
+		sinkFlag,
+		seedFlag,
+		scheduleLogFlag,
+		outputFileFlag,
+	},
+}
+
+// Update operation workload operations.
+const (
+	OpList = "list"
+	OpDiff = "diff"
+)
+
+type updateOpsConfig struct {
+	RunID       string        `json:"run_id"`
+	Seed        int64         `json:"seed"`
+	Build       *BuildInfo    `json:"build"`
+	Host        string        `json:"host"`
+	PSK         string        `json:"-"`
+	Timeout     time.Duration `json:"timeout"`
+	PerSecond   float64       `json:"rate"`
+	Ops         Mix           `json:"ops"`
+	Results     string        `json:"results,omitempty"`
+	ScheduleLog string        `json:"schedule_log,omitempty"`
+}
+
+// UpdateOperation is the subset of Clair's update operation the tool needs.
+type UpdateOperation struct {
+	Ref     string    `json:"ref"`
+	Updater string    `json:"updater"`
+	Date    time.Time `json:"date"`
+}
+
+// updateOpsCache holds the update operations from the most recent list, so
+// diffs and deletes have refs to work with.
+type updateOpsCache struct {
+	mu  sync.Mutex
+	ops map[string][]UpdateOperation
+}
+
+func (c *updateOpsCache) set(ops map[string][]UpdateOperation) {
+	for _, uops := range ops {
+		sort.Slice(uops, func(i, j int) bool { return uops[i].Date.After(uops[j].Date) })
+	}
+	c.mu.Lock()
+	c.ops = ops
+	c.mu.Unlock()
+}
+
+// pair returns the two most recent operations of a random updater that has
+// at least two.
+func (c *updateOpsCache) pair(rng *rand.Rand) (cur, prev UpdateOperation, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var candidates []string
+	for u, uops := range c.ops {
+		if len(uops) >= 2 {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return cur, prev, false
+	}
+	sort.Strings(candidates)
+	uops := c.ops[candidates[rng.Intn(len(candidates))]]
+	return uops[0], uops[1], true
+}
+
+// takeOldest removes and returns the oldest operation of a random updater
+// that has more than one, so the latest operation of every updater is kept.
+func (c *updateOpsCache) takeOldest(rng *rand.Rand) (UpdateOperation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var candidates []string
+	for u, uops := range c.ops {
+		if len(uops) > 1 {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return UpdateOperation{}, false
+	}
+	sort.Strings(candidates)
+	u := candidates[rng.Intn(len(candidates))]
+	uops := c.ops[u]
+	op := uops[len(uops)-1]
+	c.ops[u] = uops[:len(uops)-1]
+	return op, true
+}
+
+func updateOpsAction(c *cli.Context) error {
+	ctx := c.Context
+	ops, err := parseWeights(c.String("ops"), OpList, OpDiff, OpDelete)
+	if err != nil {
+		return err
+	}
+	conf := &updateOpsConfig{
+		Host:        c.String("host"),
+		PSK:         c.String("psk"),
+		Timeout:     c.Duration("timeout"),
+		PerSecond:   c.Float64("rate"),
+		Ops:         ops,
+		Results:     c.String("results"),
+		ScheduleLog: c.String("schedule-log"),
+	}
+
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	conf.RunID = reporter.RunID
+	if err := reporter.setSchedule(c); err != nil {
+		return err
+	}
+	conf.Seed = reporter.Seed
+	conf.Build = buildInfo()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Msg("starting run")
+	if err := reporter.setSinks(c, conf.Results); err != nil {
+		return err
+	}
+
+	reporter.Errors = loadtest.NewErrorTracker()
+	w := &updateOpsWorkload{r: reporter, ops: conf.Ops}
+	err = loadtest.NewRunner(loadtest.NewControl(conf.PerSecond), conf.Timeout).RunWorkload(ctx, w)
+	if err != nil {
+		return err
+	}
+	if err := reporter.Schedule.Close(); err != nil {
+		return fmt.Errorf("could not write schedule log: %w", err)
+	}
+	stats := reporter.Stats.GetStats()
+	stats.Errors = reporter.Errors.Counts()
+	if err := reporter.Sink.Summary(stats); err != nil {
+		return fmt.Errorf("could not write results: %w", err)
+	}
+
+	return writeOutput(c, conf, stats)
+}
+
+// updateOpsWorkload calls the update operation endpoints chosen by ops,
+// diffing and deleting the operations found by the most recent list.
+type updateOpsWorkload struct {
+	r     *reporter
+	ops   Mix
+	cache updateOpsCache
+}
+
+func (w *updateOpsWorkload) Setup(context.Context) error { return nil }
+
+func (w *updateOpsWorkload) Step(ctx context.Context, n int) error {
+	token, err := loadtest.CreateToken(w.r.PSK)
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	rng := loadtest.StepRand(w.r.Seed, n)
+	op := w.ops.pick(rng.Float64)
+	var cur, prev UpdateOperation
+	ok := true
+	switch op {
+	case OpDiff:
+		cur, prev, ok = w.cache.pair(rng)
+	case OpDelete:
+		prev, ok = w.cache.takeOldest(rng)
+	}
+	if !ok {
+		zlog.Debug(ctx).Str("op", op).Msg("no suitable update operations, listing instead")
+		op = OpList
+	}
+
+	switch op {
+	case OpList:
+		w.r.Schedule.Step(ctx, n, op, "")
+		var ops map[string][]UpdateOperation
+		ops, err = w.r.listUpdateOperations(ctx, token)
+		if err == nil {
+			w.cache.set(ops)
+		}
+	case OpDiff:
+		w.r.Schedule.Step(ctx, n, op, cur.Ref)
+		err = w.r.getUpdateDiff(ctx, cur.Ref, prev.Ref, token)
+	case OpDelete:
+		w.r.Schedule.Step(ctx, n, op, prev.Ref)
+		err = w.r.deleteUpdateOperation(ctx, prev.Ref, token)
+	}
+	if err != nil {
+		zlog.Error(ctx).Str("op", op).Msg(err.Error())
+		return w.r.StepFailed(op, err)
+	}
+	return nil
+}
+
+func (w *updateOpsWorkload) Teardown(context.Context) error { return nil }
+
+func (r *reporter) listUpdateOperations(ctx context.Context, token string) (map[string][]UpdateOperation, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet,
+		r.Host+"/matcher/api/v1/internal/update_operation",
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	resp, sample, err := r.Do(loadtest.EndpointListUpdateOperations, req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(loadtest.EndpointListUpdateOperations).IncrNon2XXResponses(int64(1))
+		return nil, loadtest.ResponseErrorf(resp.StatusCode, "non 200 response from matcher %d", resp.StatusCode)
+	}
+	ops := map[string][]UpdateOperation{}
+	err = json.NewDecoder(resp.Body).Decode(&ops)
+	if err != nil {
+		sample.Error = err.Error()
+		return nil, err
+	}
+	return ops, nil
+}
+
+func (r *reporter) getUpdateDiff(ctx context.Context, cur, prev string, token string) error {
+	v := url.Values{}
+	v.Set("cur", cur)
+	v.Set("prev", prev)
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet,
+		r.Host+"/matcher/api/v1/internal/update_diff?"+v.Encode(),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	resp, sample, err := r.Do(loadtest.EndpointUpdateDiff, req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.Stats.Endpoint(loadtest.EndpointUpdateDiff).IncrNon2XXResponses(int64(1))
+		return loadtest.ResponseErrorf(resp.StatusCode, "non 200 response from matcher %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *reporter) deleteUpdateOperation(ctx context.Context, ref string, token string) error {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodDelete,
+		r.Host+"/matcher/api/v1/internal/update_operation/"+ref,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	zlog.Debug(ctx).Str("ref", ref).Msg("deleting update operation")
+	resp, sample, err := r.Do(loadtest.EndpointDeleteUpdateOperation, req)
+	defer r.Record(ctx, sample)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		r.Stats.Endpoint(loadtest.EndpointDeleteUpdateOperation).IncrNon2XXResponses(int64(1))
+		return loadtest.ResponseErrorf(resp.StatusCode, "non 200 response from matcher while deleting %d", resp.StatusCode)
+	}
+	return nil
+}
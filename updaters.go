@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/loadtest"
+)
+
+var UpdatersCmd = &cli.Command{
+	Name:        "updaters",
+	Description: "trigger a run of the matcher's vulnerability updaters, and time it until it's done",
+	Usage:       "clair-load-test updaters --trigger-cmd 'kubectl rollout restart deploy/clair-matcher' --matcher-dsn postgres://clair@localhost/matcher",
+	Action:      updatersAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "--host localhost:6060/",
+			Value:   "http://localhost:6060/",
+			EnvVars: []string{"CLAIR_API"},
+		},
+		&cli.StringFlag{
+			Name:    "psk",
+			Usage:   "--psk secretkey",
+			Value:   "",
+			EnvVars: []string{"PSK"},
+		},
+		headerFlag,
+		userAgentFlag,
+		proxyFlag,
+		cacheBustFlag,
+		protocolFlag,
+		&cli.StringFlag{
+			Name:    "trigger-cmd",
+			Usage:   "--trigger-cmd 'kubectl rollout restart deploy/clair-matcher' (run with sh to start the updaters, which run when the matcher starts; waits for the next scheduled run if not given)",
+			Value:   "",
+			EnvVars: []string{"UPDATERS_TRIGGER_CMD"},
+		},
+		&cli.StringFlag{
+			Name:    "matcher-dsn",
+			Usage:   "--matcher-dsn postgres://clair@localhost/matcher (to measure database growth)",
+			Value:   "",
+			EnvVars: []string{"MATCHER_DSN"},
+		},
+		&cli.BoolFlag{
+			Name:    "force",
+			Usage:   "--force (clear the updaters' fingerprints through --matcher-dsn, so they all fetch and store their vulnerabilities again)",
+			Value:   false,
+			EnvVars: []string{"UPDATERS_FORCE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "updaters",
+			Usage:   "--updaters alpine,debian (the run is done once each has a new update operation, otherwise once no new ones appear for --settle)",
+			EnvVars: []string{"UPDATERS"},
+		},
+		&cli.DurationFlag{
+			Name:    "settle",
+			Usage:   "--settle 2m",
+			Value:   time.Minute * 2,
+			EnvVars: []string{"UPDATERS_SETTLE"},
+		},
+		&cli.DurationFlag{
+			Name:    "poll-interval",
+			Usage:   "--poll-interval 10s (between listings of update operations)",
+			Value:   time.Second * 10,
+			EnvVars: []string{"UPDATERS_POLL_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "timeout",
+			Usage:   "--timeout 1h",
+			Value:   time.Hour,
+			EnvVars: []string{"TIMEOUT"},
+		},
+		outputFileFlag,
+	},
+}
+
+type updatersConfig struct {
+	RunID        string        `json:"run_id"`
+	Build        *BuildInfo    `json:"build"`
+	Host         string        `json:"host"`
+	PSK          string        `json:"-"`
+	TriggerCmd   string        `json:"trigger_cmd,omitempty"`
+	MatcherDSN   string        `json:"-"`
+	Force        bool          `json:"force,omitempty"`
+	Updaters     []string      `json:"updaters,omitempty"`
+	Settle       time.Duration `json:"settle"`
+	PollInterval time.Duration `json:"poll_interval"`
+	Timeout      time.Duration `json:"timeout"`
+}
+
+// UpdaterRun is the outcome of a run of the updaters. Times are from the
+// trigger, and taken from the update operations' dates, so they're subject
+// to clock skew between this host and the matcher.
+type UpdaterRun struct {
+	TriggeredAt time.Time `json:"triggered_at"`
+	// Done reports whether the run finished before the timeout.
+	Done                  bool    `json:"done"`
+	FirstOperationSeconds float64 `json:"first_operation_seconds,omitempty"`
+	DurationSeconds       float64 `json:"duration_seconds,omitempty"`
+	// Updaters are those that stored a new update operation.
+	Updaters map[string]*UpdaterResult `json:"updaters"`
+	// Missing are the expected updaters that didn't.
+	Missing  []string        `json:"missing,omitempty"`
+	Database *DatabaseGrowth `json:"database,omitempty"`
+}
+
+type UpdaterResult struct {
+	Operations  int     `json:"operations"`
+	LastSeconds float64 `json:"last_seconds"`
+}
+
+// DatabaseGrowth is how much the matcher's database grew over the run.
+type DatabaseGrowth struct {
+	BytesBefore int64                   `json:"bytes_before"`
+	BytesAfter  int64                   `json:"bytes_after"`
+	GrowthBytes int64                   `json:"growth_bytes"`
+	Tables      map[string]*TableGrowth `json:"tables"`
+}
+
+// TableGrowth is how much a table grew, rows are Postgres' estimate of the
+// live rows.
+type TableGrowth struct {
+	BytesBefore int64 `json:"bytes_before"`
+	BytesAfter  int64 `json:"bytes_after"`
+	RowsBefore  int64 `json:"rows_before"`
+	RowsAfter   int64 `json:"rows_after"`
+}
+
+func updatersAction(c *cli.Context) error {
+	ctx := c.Context
+	conf := &updatersConfig{
+		Host:         c.String("host"),
+		PSK:          c.String("psk"),
+		TriggerCmd:   c.String("trigger-cmd"),
+		MatcherDSN:   c.String("matcher-dsn"),
+		Force:        c.Bool("force"),
+		Updaters:     splitList(c.StringSlice("updaters")),
+		Settle:       c.Duration("settle"),
+		PollInterval: c.Duration("poll-interval"),
+		Timeout:      c.Duration("timeout"),
+	}
+	switch {
+	case conf.Force && conf.MatcherDSN == "":
+		return fmt.Errorf("--force needs --matcher-dsn")
+	case conf.Settle <= 0 || conf.PollInterval <= 0 || conf.Timeout <= 0:
+		return fmt.Errorf("settle, poll interval and timeout must be more than 0")
+	}
+
+	reporter := newReporter(conf.Host, conf.PSK)
+	if err := reporter.setRequestFlags(c); err != nil {
+		return err
+	}
+	conf.RunID = reporter.RunID
+	conf.Build = buildInfo()
+	zlog.Info(ctx).Str("run_id", conf.RunID).Msg("starting run")
+
+	var conn *pgx.Conn
+	if conf.MatcherDSN != "" {
+		var err error
+		conn, err = loadtest.ConnectDB(ctx, conf.MatcherDSN)
+		if err != nil {
+			return err
+		}
+		defer conn.Close(ctx)
+	}
+	before, err := matcherSize(ctx, conn)
+	if err != nil {
+		return err
+	}
+	known, err := reporter.knownUpdateOperations(ctx)
+	if err != nil {
+		return err
+	}
+
+	if conf.Force {
+		tag, err := conn.Exec(ctx, `UPDATE update_operation SET fingerprint = ''`)
+		if err != nil {
+			return fmt.Errorf("could not clear fingerprints: %w", err)
+		}
+		zlog.Info(ctx).Int64("operations", tag.RowsAffected()).Msg("cleared updater fingerprints")
+	}
+	run := &UpdaterRun{TriggeredAt: time.Now(), Updaters: map[string]*UpdaterResult{}}
+	if conf.TriggerCmd != "" {
+		if err := triggerUpdaters(ctx, conf.TriggerCmd); err != nil {
+			return err
+		}
+	} else {
+		zlog.Info(ctx).Msg("waiting for the next scheduled updater run")
+	}
+
+	if err := reporter.waitForUpdaters(ctx, conf, run, known); err != nil {
+		return err
+	}
+	after, err := matcherSize(ctx, conn)
+	if err != nil {
+		return err
+	}
+	run.Database = databaseGrowth(before, after)
+	zlog.Info(ctx).
+		Bool("done", run.Done).
+		Int("updaters", len(run.Updaters)).
+		Float64("duration_seconds", run.DurationSeconds).
+		Msg("updater run over")
+	if err := writeOutput(c, conf, run, reporter.Stats.GetStats()); err != nil {
+		return err
+	}
+	if !run.Done {
+		return cli.Exit("updaters didn't finish before the timeout", ExitErrors)
+	}
+	return nil
+}
+
+// knownUpdateOperations returns the refs of the update operations there are
+// now, so those stored later can be told apart.
+func (r *reporter) knownUpdateOperations(ctx context.Context) (map[string]bool, error) {
+	token, err := loadtest.CreateToken(r.PSK)
+	if err != nil {
+		return nil, fmt.Errorf("could not create token: %w", err)
+	}
+	ops, err := r.listUpdateOperations(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("could not list update operations: %w", err)
+	}
+	known := map[string]bool{}
+	for _, uops := range ops {
+		for _, op := range uops {
+			known[op.Ref] = true
+		}
+	}
+	return known, nil
+}
+
+// triggerUpdaters runs cmd with sh, its output going to stderr.
+func triggerUpdaters(ctx context.Context, cmd string) error {
+	zlog.Info(ctx).Str("cmd", cmd).Msg("triggering updaters")
+	c := exec.CommandContext(ctx, "sh", "-c", cmd)
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("could not trigger updaters: %w", err)
+	}
+	return nil
+}
+
+// runUpdates triggers the scenario's updater runs until ctx is done, marking
+// the update windows on t.
+func (r *reporter) runUpdates(ctx context.Context, u *loadtest.Updates, t *loadtest.UpdateTracker) {
+	if u == nil {
+		return
+	}
+	conf := &updatersConfig{
+		PSK:          r.PSK,
+		Updaters:     u.Updaters,
+		Settle:       u.Settle,
+		PollInterval: u.PollInterval,
+		Timeout:      u.Timeout,
+	}
+	next := time.Now().Add(u.At)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		next = next.Add(u.Every)
+		known, err := r.knownUpdateOperations(ctx)
+		if err != nil {
+			zlog.Error(ctx).Err(err).Msg("could not start updater run")
+			if u.Every == 0 {
+				return
+			}
+			continue
+		}
+		t.Begin()
+		run := &UpdaterRun{TriggeredAt: time.Now(), Updaters: map[string]*UpdaterResult{}}
+		err = triggerUpdaters(ctx, u.TriggerCmd)
+		if err == nil {
+			err = r.waitForUpdaters(ctx, conf, run, known)
+		}
+		if err != nil {
+			zlog.Error(ctx).Err(err).Msg("updater run failed")
+		}
+		var ran []string
+		for name := range run.Updaters {
+			ran = append(ran, name)
+		}
+		sort.Strings(ran)
+		t.End(ran, run.Done)
+		zlog.Info(ctx).
+			Bool("done", run.Done).
+			Strs("updaters", ran).
+			Float64("duration_seconds", run.DurationSeconds).
+			Msg("update window over")
+		if u.Every == 0 {
+			return
+		}
+	}
+}
+
+// waitForUpdaters lists the update operations every poll interval, adding
+// those not known before the trigger to run, until the run is done or the
+// timeout passes.
+func (r *reporter) waitForUpdaters(ctx context.Context, conf *updatersConfig, run *UpdaterRun, known map[string]bool) error {
+	ctx, cancel := context.WithTimeout(ctx, conf.Timeout)
+	defer cancel()
+	var lastNew time.Time
+	t := time.NewTicker(conf.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			run.Missing = missingUpdaters(conf.Updaters, run.Updaters)
+			return nil
+		case <-t.C:
+		}
+		token, err := loadtest.CreateToken(conf.PSK)
+		if err != nil {
+			return fmt.Errorf("could not create token: %w", err)
+		}
+		ops, err := r.listUpdateOperations(ctx, token)
+		switch {
+		case ctx.Err() != nil:
+			// Timed out mid-listing, reported on the next pass.
+			continue
+		case err != nil:
+			zlog.Warn(ctx).Err(err).Msg("could not list update operations")
+			continue
+		}
+		for updater, uops := range ops {
+			for _, op := range uops {
+				if known[op.Ref] {
+					continue
+				}
+				known[op.Ref] = true
+				lastNew = time.Now()
+				res, ok := run.Updaters[updater]
+				if !ok {
+					res = &UpdaterResult{}
+					run.Updaters[updater] = res
+					zlog.Info(ctx).Str("updater", updater).Msg("updater ran")
+				}
+				res.Operations++
+				secs := op.Date.Sub(run.TriggeredAt).Seconds()
+				if secs > res.LastSeconds {
+					res.LastSeconds = secs
+				}
+				if run.FirstOperationSeconds == 0 || secs < run.FirstOperationSeconds {
+					run.FirstOperationSeconds = secs
+				}
+				if secs > run.DurationSeconds {
+					run.DurationSeconds = secs
+				}
+			}
+		}
+		switch {
+		case len(conf.Updaters) != 0:
+			run.Done = len(missingUpdaters(conf.Updaters, run.Updaters)) == 0
+		case !lastNew.IsZero():
+			run.Done = time.Since(lastNew) >= conf.Settle
+		}
+		if run.Done {
+			return nil
+		}
+	}
+}
+
+func missingUpdaters(want []string, ran map[string]*UpdaterResult) []string {
+	var missing []string
+	for _, u := range want {
+		if _, ok := ran[u]; !ok {
+			missing = append(missing, u)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// matcherSnapshot is the size of the matcher's database and its tables.
+type matcherSnapshot struct {
+	bytes  int64
+	tables map[string]*TableGrowth
+}
+
+// matcherSize measures the matcher's database, if there's a connection to
+// it. Sizes are put in the tables' Before fields.
+func matcherSize(ctx context.Context, conn *pgx.Conn) (*matcherSnapshot, error) {
+	if conn == nil {
+		return nil, nil
+	}
+	s := &matcherSnapshot{tables: map[string]*TableGrowth{}}
+	err := conn.QueryRow(ctx, `SELECT pg_database_size(current_database())`).Scan(&s.bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not get database size: %w", err)
+	}
+	tables, err := existingTables(ctx, conn, scopeTables[ScopeMatcher])
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tables {
+		g := &TableGrowth{}
+		err := conn.QueryRow(ctx, `
+SELECT pg_total_relation_size(relid), n_live_tup
+FROM pg_stat_user_tables
+WHERE relname = $1`, t).Scan(&g.BytesBefore, &g.RowsBefore)
+		if err != nil {
+			return nil, fmt.Errorf("could not get size of table %s: %w", t, err)
+		}
+		s.tables[t] = g
+	}
+	return s, nil
+}
+
+func databaseGrowth(before, after *matcherSnapshot) *DatabaseGrowth {
+	if before == nil || after == nil {
+		return nil
+	}
+	g := &DatabaseGrowth{
+		BytesBefore: before.bytes,
+		BytesAfter:  after.bytes,
+		GrowthBytes: after.bytes - before.bytes,
+		Tables:      map[string]*TableGrowth{},
+	}
+	for name, b := range before.tables {
+		a, ok := after.tables[name]
+		if !ok {
+			continue
+		}
+		g.Tables[name] = &TableGrowth{
+			BytesBefore: b.BytesBefore,
+			BytesAfter:  a.BytesBefore,
+			RowsBefore:  b.RowsBefore,
+			RowsAfter:   a.RowsBefore,
+		}
+	}
+	return g
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/quay/zlog"
+	"github.com/urfave/cli/v2"
+
+	"github.com/crozzy/clair-load-test/pkg/results"
+)
+
+var ValidateResultsCmd = &cli.Command{
+	Name:        "validate-results",
+	Description: "check a run's output and results file are of this build's schema, see package results",
+	Usage:       "clair-load-test validate-results --stats stats.json --results results.jsonl",
+	Action:      validateResultsAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "stats",
+			Usage:   "--stats stats.json (a run's output, its config and stats)",
+			Value:   "",
+			EnvVars: []string{"STATS"},
+		},
+		&cli.StringFlag{
+			Name:    "results",
+			Usage:   "--results results.jsonl",
+			Value:   "",
+			EnvVars: []string{"RESULTS"},
+		},
+	},
+}
+
+func validateResultsAction(c *cli.Context) error {
+	ctx := c.Context
+	statsPath, resultsPath := c.String("stats"), c.String("results")
+	if statsPath == "" && resultsPath == "" {
+		return fmt.Errorf("one of --stats or --results is needed")
+	}
+	var failed bool
+	if statsPath != "" {
+		f, err := os.Open(statsPath)
+		if err != nil {
+			return fmt.Errorf("could not open stats: %w", err)
+		}
+		err = results.ValidateOutput(f)
+		f.Close()
+		if err != nil {
+			zlog.Error(ctx).Str("file", statsPath).Msg(err.Error())
+			failed = true
+		} else {
+			zlog.Info(ctx).Str("file", statsPath).Int("schema_version", results.SchemaVersion).Msg("stats are valid")
+		}
+	}
+	if resultsPath != "" {
+		f, err := os.Open(resultsPath)
+		if err != nil {
+			return fmt.Errorf("could not open results: %w", err)
+		}
+		n, err := results.ValidateSamples(f)
+		f.Close()
+		if err != nil {
+			zlog.Error(ctx).Str("file", resultsPath).Msg(err.Error())
+			failed = true
+		} else {
+			zlog.Info(ctx).Str("file", resultsPath).Int("samples", n).Msg("results are valid")
+		}
+	}
+	if failed {
+		return cli.Exit("results don't match the schema", ExitErrors)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Build information, set at build time with -ldflags, such as
+// "-X main.commit=$(git rev-parse HEAD)". See the Makefile.
+var (
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+var VersionCmd = &cli.Command{
+	Name:        "version",
+	Description: "print the version, commit and build date of this build",
+	Usage:       "clair-load-test version",
+	Action:      versionAction,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "--json",
+			Value: false,
+		},
+	},
+}
+
+// BuildInfo identifies the build of the tool, so results can be attributed
+// to it.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildInfo() *BuildInfo {
+	return &BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func (b *BuildInfo) String() string {
+	return fmt.Sprintf("clair-load-test %s (commit %s, built %s with %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion)
+}
+
+func versionAction(c *cli.Context) error {
+	b := buildInfo()
+	if c.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(b)
+	}
+	fmt.Println(b)
+	return nil
+}